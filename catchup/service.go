@@ -58,6 +58,7 @@ type Ledger interface {
 	LastRound() basics.Round
 	Block(basics.Round) (bookkeeping.Block, error)
 	IsWritingCatchpointFile() bool
+	SetCatchingUp(catchingUp bool)
 	Validate(ctx context.Context, blk bookkeeping.Block, executionPool execpool.BacklogPool) (*ledger.ValidatedBlock, error)
 	AddValidatedBlock(vb ledger.ValidatedBlock, cert agreement.Certificate) error
 }
@@ -552,6 +553,10 @@ func (s *Service) sync() {
 		s.log.Infof("resuming previous sync from %d (now=%d)", atomic.LoadInt64(&s.syncStartNS), timeInNS)
 	}
 
+	// let the ledger know that we're catching up, so that it could adjust the way it's writing to disk.
+	s.ledger.SetCatchingUp(true)
+	defer s.ledger.SetCatchingUp(false)
+
 	pr := s.ledger.LastRound()
 
 	s.log.EventWithDetails(telemetryspec.ApplicationState, telemetryspec.CatchupStartEvent, telemetryspec.CatchupStartEventDetails{
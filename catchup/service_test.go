@@ -681,6 +681,9 @@ func (m *mockedLedger) IsWritingCatchpointFile() bool {
 	return false
 }
 
+func (m *mockedLedger) SetCatchingUp(catchingUp bool) {
+}
+
 func testingenvWithUpgrade(
 	t testing.TB,
 	numBlocks,
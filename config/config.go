@@ -418,6 +418,58 @@ type Local struct {
 	// features like catchpoint catchup would be rendered completly non-operational, and many of the node inner
 	// working would be completly dis-functional.
 	DisableNetworking bool `version[16]:"false"`
+
+	// CatchupLedgerSynchronousMode defines the synchronous mode used by the ledger database while the node is catching up. Blocks written
+	// during catchup can always be recovered from peers, so operators may choose a less durable mode here to speed up the catchup process.
+	// The values specified here and their meanings are identical to the ones in LedgerSynchronousMode.
+	CatchupLedgerSynchronousMode int `version[16]:"2"`
+
+	// EnableAccountsCommitLatencyHistogram enables the collection of the accounts database commit latencies into histograms exposed
+	// via the metrics registry. The latency is broken down into the time spent on writing the accounts, updating the round, and
+	// committing the database transaction.
+	EnableAccountsCommitLatencyHistogram bool `version[16]:"false"`
+
+	// EnableAccountsWriteAheadJournal enables writing the account changes of the rounds being committed into a journal ahead
+	// of committing them to the accounts database. A commit interrupted by a crash is then completed from the journal when the
+	// node restarts.
+	EnableAccountsWriteAheadJournal bool `version[16]:"false"`
+
+	// EnableStrictAccountsValidation enables validating every account written to the accounts database against the limits of
+	// the consensus protocol of the round modifying it, such as the maximum number of assets and applications and the declared
+	// application state schemas, as well as verifying the creatables of every new round to be consistent with the params of
+	// their creators. As the rounds were already agreed upon, they're committed regardless: an account failing the validation
+	// is only logged and counted in the ledger_strict_validation_failures_count metric, and an inconsistent creatable in the
+	// ledger_inconsistent_creatables_count metric.
+	EnableStrictAccountsValidation bool `version[16]:"false"`
+
+	// EnableAssetHolderCounts enables maintaining the number of accounts holding each asset in the accounts database. The counts
+	// are computed from all the accounts once enabled, and are kept up to date as rounds are committed; they're dropped once disabled.
+	EnableAssetHolderCounts bool `version[16]:"false"`
+
+	// EnableAccountsStateChecksum enables maintaining a checksum over the state of all the accounts in the accounts database.
+	// The checksum is computed from all the accounts once enabled, and is updated incrementally as rounds are committed; it's
+	// dropped once disabled. It's meant for detecting accidental inconsistencies, and isn't a cryptographic commitment.
+	EnableAccountsStateChecksum bool `version[16]:"false"`
+
+	// EnableNormalizedBalanceVerification enables recomputing the normalized online balance of every account read by its normalized
+	// online balance from the accounts database, and comparing it against the stored one. A mismatch, indicating that a normalized
+	// balance update was missed, is logged and counted in the ledger_normalized_balance_mismatches_count metric; the read itself
+	// proceeds with the stored balances, so that the agreement isn't stalled.
+	EnableNormalizedBalanceVerification bool `version[16]:"false"`
+
+	// EvalAccountsCacheSize is the maximal number of accounts retained by the accounts cache of every block evaluator started by
+	// the ledger, whether validating a block or assembling one. A zero size leaves the cache unbounded.
+	EvalAccountsCacheSize int `version[16]:"50000"`
+
+	// TxPoolMaxAllocationsPerTransaction is the maximal number of application storage allocations, i.e. app creations and opt-ins,
+	// that a single transaction may perform to be admitted to the transaction pool and included in the blocks assembled by this
+	// node. It doesn't affect the validation of blocks proposed by other nodes. A zero maximum leaves allocations unbounded.
+	TxPoolMaxAllocationsPerTransaction int `version[16]:"0"`
+
+	// EnableAccountsExistenceFilter enables keeping an in-memory bloom filter of the addresses of all the accounts, which lets
+	// the ledger answer lookups of accounts that don't exist without querying the accounts database. The filter is built on
+	// startup by scanning all the accounts, and takes about 1.2 bytes of memory per account.
+	EnableAccountsExistenceFilter bool `version[16]:"false"`
 }
 
 // Filenames of config files within the configdir (e.g. ~/.algorand)
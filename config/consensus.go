@@ -381,6 +381,11 @@ type ConsensusParams struct {
 	// 5. checking that in the case of going online the VoteFirst is less or equal to the LastValid+1.
 	// 6. checking that in the case of going online the VoteFirst is less or equal to the next network round.
 	EnableKeyregCoherencyCheck bool
+
+	// ReservedLargeAppKeys reserves the application storage keys starting with the large values prefix for the entries
+	// making up the large values, so that applications can no longer set or delete such keys directly. Large values can
+	// only be stored once the keys are reserved.
+	ReservedLargeAppKeys bool
 }
 
 // PaysetCommitType enumerates possible ways for the block header to commit to
@@ -984,6 +989,9 @@ func initConsensusProtocols() {
 	vFuture.CompactCertWeightThreshold = (1 << 32) * 30 / 100
 	vFuture.CompactCertSecKQ = 128
 
+	// Reserve the storage keys of the large application values.
+	vFuture.ReservedLargeAppKeys = true
+
 	Consensus[protocol.ConsensusFuture] = vFuture
 }
 
@@ -38,6 +38,7 @@ var defaultLocal = Local{
 	CatchupGossipBlockFetchTimeoutSec:       4,
 	CatchupHTTPBlockFetchTimeoutSec:         4,
 	CatchupLedgerDownloadRetryAttempts:      50,
+	CatchupLedgerSynchronousMode:            2,
 	CatchupParallelBlocks:                   16,
 	ConnectionsRateLimitingCount:            60,
 	ConnectionsRateLimitingWindowSeconds:    1,
@@ -48,9 +49,14 @@ var defaultLocal = Local{
 	DisableNetworking:                       false,
 	DisableOutgoingConnectionThrottling:     false,
 	EnableAccountUpdatesStats:               false,
+	EnableAccountsCommitLatencyHistogram:    false,
+	EnableAccountsExistenceFilter:           false,
+	EnableAccountsStateChecksum:             false,
+	EnableAccountsWriteAheadJournal:         false,
 	EnableAgreementReporting:                false,
 	EnableAgreementTimeMetrics:              false,
 	EnableAssembleStats:                     false,
+	EnableAssetHolderCounts:                 false,
 	EnableBlockService:                      false,
 	EnableBlockServiceFallbackToArchiver:    true,
 	EnableCatchupFromArchiveServers:         false,
@@ -59,13 +65,16 @@ var defaultLocal = Local{
 	EnableIncomingMessageFilter:             false,
 	EnableLedgerService:                     false,
 	EnableMetricReporting:                   false,
+	EnableNormalizedBalanceVerification:     false,
 	EnableOutgoingNetworkMessageFiltering:   true,
 	EnablePingHandler:                       true,
 	EnableProcessBlockStats:                 false,
 	EnableProfiler:                          false,
 	EnableRequestLogger:                     false,
+	EnableStrictAccountsValidation:          false,
 	EnableTopAccountsReporting:              false,
 	EndpointAddress:                         "127.0.0.1:0",
+	EvalAccountsCacheSize:                   50000,
 	FallbackDNSResolverAddress:              "",
 	ForceRelayMessages:                      false,
 	GossipFanout:                            4,
@@ -104,6 +113,7 @@ var defaultLocal = Local{
 	TLSKeyFile:                              "",
 	TelemetryToLog:                          true,
 	TxPoolExponentialIncreaseFactor:         2,
+	TxPoolMaxAllocationsPerTransaction:      0,
 	TxPoolSize:                              15000,
 	TxSyncIntervalSeconds:                   60,
 	TxSyncServeResponseSize:                 1000000,
@@ -57,6 +57,7 @@ type TransactionPool struct {
 	logAssembleStats     bool
 	expFeeFactor         uint64
 	txPoolMaxSize        int
+	maxAllocations       int
 	ledger               *ledger.Ledger
 
 	mu                     deadlock.Mutex
@@ -105,6 +106,7 @@ func MakeTransactionPool(ledger *ledger.Ledger, cfg config.Local, log logging.Lo
 		logAssembleStats:     cfg.EnableAssembleStats,
 		expFeeFactor:         cfg.TxPoolExponentialIncreaseFactor,
 		txPoolMaxSize:        cfg.TxPoolSize,
+		maxAllocations:       cfg.TxPoolMaxAllocationsPerTransaction,
 		log:                  log,
 	}
 	pool.cond.L = &pool.mu
@@ -671,6 +673,7 @@ func (pool *TransactionPool) recomputeBlockEvaluator(committedTxIds map[transact
 		pool.log.Warnf("TransactionPool.recomputeBlockEvaluator: cannot start evaluator: %v", err)
 		return
 	}
+	pool.pendingBlockEvaluator.SetMaxAllocationsPerTransaction(pool.maxAllocations)
 
 	var asmStats telemetryspec.AssembleBlockMetrics
 	asmStats.StartCount = len(txgroups)
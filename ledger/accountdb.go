@@ -17,15 +17,23 @@
 package ledger
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"database/sql"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"sort"
 	"time"
 
+	"github.com/algorand/go-deadlock"
+	"github.com/algorand/msgp/msgp"
 	"github.com/mattn/go-sqlite3"
 
 	"github.com/algorand/go-algorand/config"
+	"github.com/algorand/go-algorand/crypto"
+	"github.com/algorand/go-algorand/crypto/merkletrie"
 	"github.com/algorand/go-algorand/data/basics"
 	"github.com/algorand/go-algorand/ledger/ledgercore"
 	"github.com/algorand/go-algorand/protocol"
@@ -37,6 +45,8 @@ import (
 type accountsDbQueries struct {
 	listCreatablesStmt          *sql.Stmt
 	lookupStmt                  *sql.Stmt
+	lookupByRowIDStmt           *sql.Stmt
+	lookupStatusStmt            *sql.Stmt
 	lookupCreatorStmt           *sql.Stmt
 	deleteStoredCatchpoint      *sql.Stmt
 	insertStoredCatchpoint      *sql.Stmt
@@ -46,6 +56,11 @@ type accountsDbQueries struct {
 	insertCatchpointStateUint64 *sql.Stmt
 	selectCatchpointStateString *sql.Stmt
 	insertCatchpointStateString *sql.Stmt
+	lookupAssetHoldersStmt      *sql.Stmt
+	lookupAppCountStmt          *sql.Stmt
+
+	// cached is set when the statements are owned by a StmtCache, and therefore aren't closed by close.
+	cached bool
 }
 
 var accountsSchema = []string{
@@ -60,10 +75,13 @@ var accountsSchema = []string{
 		offlinerewardunits integer,
 		notparticipating integer,
 		notparticipatingrewardunits integer,
-		rewardslevel integer)`,
+		rewardslevel integer,
+		accountcount integer NOT NULL DEFAULT 0)`,
 	`CREATE TABLE IF NOT EXISTS accountbase (
 		address blob primary key,
-		data blob)`,
+		data blob,
+		status integer,
+		microalgos integer)`,
 	`CREATE TABLE IF NOT EXISTS assetcreators (
 		asset integer primary key,
 		creator blob)`,
@@ -80,8 +98,17 @@ var accountsSchema = []string{
 		id string primary key,
 		intval integer,
 		strval text)`,
+	`CREATE TABLE IF NOT EXISTS appcreatorcounts (
+		creator blob primary key,
+		count integer NOT NULL)`,
+	createPendingJournalTable,
 }
 
+// createPendingJournalTable creates the table holding the journal entries of the rounds being committed; see writePendingJournal.
+const createPendingJournalTable = `CREATE TABLE IF NOT EXISTS pendingjournal (
+		rnd integer primary key,
+		entry blob)`
+
 // TODO: Post applications, rename assetcreators -> creatables and rename
 // 'asset' column -> 'creatable'
 var creatablesMigration = []string{
@@ -101,6 +128,30 @@ var createOnlineAccountIndex = []string{
 	createNormalizedOnlineBalanceIndex("onlineaccountbals", "accountbase"),
 }
 
+// createAccountStatusColumn adds the status column to an accountbase table created before it was introduced
+var createAccountStatusColumn = []string{
+	`ALTER TABLE accountbase
+		ADD COLUMN status INTEGER`,
+}
+
+// createAccountCountColumn adds the accountcount column to an accounttotals table created before it was introduced
+var createAccountCountColumn = []string{
+	`ALTER TABLE accounttotals
+		ADD COLUMN accountcount INTEGER NOT NULL DEFAULT 0`,
+}
+
+// createAccountBalanceIndex handles accountbase/catchpointbalances tables
+func createAccountBalanceIndex(idxname string, tablename string) string {
+	return fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s
+		ON %s ( microalgos DESC, address )`, idxname, tablename)
+}
+
+// createAccountBalanceColumn adds the microalgos column to an accountbase table created before it was introduced
+var createAccountBalanceColumn = []string{
+	`ALTER TABLE accountbase
+		ADD COLUMN microalgos INTEGER`,
+}
+
 var accountsResetExprs = []string{
 	`DROP TABLE IF EXISTS acctrounds`,
 	`DROP TABLE IF EXISTS accounttotals`,
@@ -109,12 +160,16 @@ var accountsResetExprs = []string{
 	`DROP TABLE IF EXISTS storedcatchpoints`,
 	`DROP TABLE IF EXISTS catchpointstate`,
 	`DROP TABLE IF EXISTS accounthashes`,
+	`DROP TABLE IF EXISTS pendingjournal`,
+	`DROP TABLE IF EXISTS assetholders`,
+	`DROP TABLE IF EXISTS statechecksum`,
+	`DROP TABLE IF EXISTS appcreatorcounts`,
 }
 
 // accountDBVersion is the database version that this binary would know how to support and how to upgrade to.
 // details about the content of each of the versions can be found in the upgrade functions upgradeDatabaseSchemaXXXX
 // and their descriptions.
-var accountDBVersion = int32(5)
+var accountDBVersion = int32(10)
 
 // persistedAccountData is used for representing a single account stored on the disk. In addition to the
 // basics.AccountData, it also stores complete referencing information used to maintain the base accounts
@@ -187,18 +242,80 @@ type normalizedAccountBalance struct {
 	normalizedBalance  uint64
 }
 
+// accountLimitError is returned when an encoded account declares more assets or applications than the protocol allows.
+type accountLimitError struct {
+	address basics.Address
+	field   string
+	count   int
+	limit   int
+}
+
+// Error satisfies builtin interface `error`
+func (e *accountLimitError) Error() string {
+	return fmt.Sprintf("account %v declares %d %s entries, exceeding the maximum of %d", e.address, e.count, e.field, e.limit)
+}
+
+// checkEncodedAccountLimits scans the top level of a msgp-encoded account data and verifies that the declared sizes of its
+// assets and applications maps are within the protocol limits. The maps headers are inspected without decoding the maps
+// themselves, so that an oversized record is rejected before any allocation takes place. A zero protocol limit isn't enforced,
+// leaving these to the decoder bounds.
+func checkEncodedAccountLimits(addr basics.Address, encodedAccountData []byte, proto config.ConsensusParams) error {
+	limits := map[string]int{
+		"asset": proto.MaxAssetsPerAccount,
+		"apar":  proto.MaxAssetsPerAccount,
+		"appl":  proto.MaxAppsOptedIn,
+		"appp":  proto.MaxAppsCreated,
+	}
+	fields, _, buf, err := msgp.ReadMapHeaderBytes(encodedAccountData)
+	if err != nil {
+		return fmt.Errorf("unable to decode account %v : %w", addr, err)
+	}
+	for ; fields > 0; fields-- {
+		var field []byte
+		field, buf, err = msgp.ReadMapKeyZC(buf)
+		if err != nil {
+			return fmt.Errorf("unable to decode account %v : %w", addr, err)
+		}
+		limit, has := limits[string(field)]
+		if has && limit > 0 {
+			var count int
+			count, _, _, err = msgp.ReadMapHeaderBytes(buf)
+			if err != nil {
+				return fmt.Errorf("unable to decode account %v : %w", addr, err)
+			}
+			if count > limit {
+				return &accountLimitError{address: addr, field: string(field), count: count, limit: limit}
+			}
+		}
+		buf, err = msgp.Skip(buf)
+		if err != nil {
+			return fmt.Errorf("unable to decode account %v : %w", addr, err)
+		}
+	}
+	return nil
+}
+
 // prepareNormalizedBalances converts an array of encodedBalanceRecord into an equal size array of normalizedAccountBalances.
-func prepareNormalizedBalances(bals []encodedBalanceRecord, proto config.ConsensusParams) (normalizedAccountBalances []normalizedAccountBalance, err error) {
+// Accounts declaring more assets or applications than the protocol allows are rejected with an accountLimitError.
+// The account hashes are calculated using the hash function created by hashFactory; a nil hashFactory uses crypto.Hash.
+func prepareNormalizedBalances(bals []encodedBalanceRecord, proto config.ConsensusParams, hashFactory HashFactory) (normalizedAccountBalances []normalizedAccountBalance, err error) {
 	normalizedAccountBalances = make([]normalizedAccountBalance, len(bals), len(bals))
 	for i, balance := range bals {
 		normalizedAccountBalances[i].address = balance.Address
+		err = checkEncodedAccountLimits(balance.Address, balance.AccountData, proto)
+		if err != nil {
+			return nil, err
+		}
 		err = protocol.Decode(balance.AccountData, &(normalizedAccountBalances[i].accountData))
 		if err != nil {
 			return nil, err
 		}
 		normalizedAccountBalances[i].normalizedBalance = normalizedAccountBalances[i].accountData.NormalizedOnlineBalance(proto)
 		normalizedAccountBalances[i].encodedAccountData = balance.AccountData
-		normalizedAccountBalances[i].accountHash = accountHashBuilder(balance.Address, normalizedAccountBalances[i].accountData, balance.AccountData)
+		normalizedAccountBalances[i].accountHash, err = accountHashBuilderWithFactory(hashFactory, balance.Address, normalizedAccountBalances[i].accountData, balance.AccountData)
+		if err != nil {
+			return nil, err
+		}
 	}
 	return
 }
@@ -355,13 +472,13 @@ func (a *compactAccountDeltas) updateOld(idx int, old persistedAccountData) {
 
 // writeCatchpointStagingBalances inserts all the account balances in the provided array into the catchpoint balance staging table catchpointbalances.
 func writeCatchpointStagingBalances(ctx context.Context, tx *sql.Tx, bals []normalizedAccountBalance) error {
-	insertAcctStmt, err := tx.PrepareContext(ctx, "INSERT INTO catchpointbalances(address, normalizedonlinebalance, data) VALUES(?, ?, ?)")
+	insertAcctStmt, err := tx.PrepareContext(ctx, "INSERT INTO catchpointbalances(address, normalizedonlinebalance, status, microalgos, data) VALUES(?, ?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
 
 	for _, balance := range bals {
-		result, err := insertAcctStmt.ExecContext(ctx, balance.address[:], balance.normalizedBalance, balance.encodedAccountData)
+		result, err := insertAcctStmt.ExecContext(ctx, balance.address[:], balance.normalizedBalance, balance.accountData.Status, balance.accountData.MicroAlgos.Raw, balance.encodedAccountData)
 		if err != nil {
 			return err
 		}
@@ -456,13 +573,15 @@ func resetCatchpointStagingBalances(ctx context.Context, tx *sql.Tx, newCatchup
 		// use the current time.
 		// Apply the same logic to
 		idxnameBalances := fmt.Sprintf("onlineaccountbals_idx_%d", time.Now().UnixNano())
+		idxnameMicroAlgos := fmt.Sprintf("accountmicroalgos_idx_%d", time.Now().UnixNano())
 
 		s = append(s,
 			"CREATE TABLE IF NOT EXISTS catchpointassetcreators (asset integer primary key, creator blob, ctype integer)",
-			"CREATE TABLE IF NOT EXISTS catchpointbalances (address blob primary key, data blob, normalizedonlinebalance integer)",
+			"CREATE TABLE IF NOT EXISTS catchpointbalances (address blob primary key, data blob, normalizedonlinebalance integer, status integer, microalgos integer)",
 			"CREATE TABLE IF NOT EXISTS catchpointpendinghashes (data blob)",
 			"CREATE TABLE IF NOT EXISTS catchpointaccounthashes (id integer primary key, data blob)",
 			createNormalizedOnlineBalanceIndex(idxnameBalances, "catchpointbalances"),
+			createAccountBalanceIndex(idxnameMicroAlgos, "catchpointbalances"),
 		)
 	}
 
@@ -476,8 +595,46 @@ func resetCatchpointStagingBalances(ctx context.Context, tx *sql.Tx, newCatchup
 	return nil
 }
 
+// verifyStagingAgainstManifest verifies that the staged catchpoint balances match the catchpoint manifest, by
+// counting the staged accounts and recomputing the root hash of the staged merkle trie. It is meant to be
+// called once the merkle trie was built, and before the staged tables are applied by applyCatchpointStagingBalances.
+func verifyStagingAgainstManifest(tx *sql.Tx, expectedAccounts uint64, expectedHash crypto.Digest) error {
+	var stagedAccounts uint64
+	err := tx.QueryRow("SELECT count(*) FROM catchpointbalances").Scan(&stagedAccounts)
+	if err != nil {
+		return fmt.Errorf("verifyStagingAgainstManifest: unable to count staged accounts: %v", err)
+	}
+
+	mc, err := MakeMerkleCommitter(tx, true)
+	if err != nil {
+		return fmt.Errorf("verifyStagingAgainstManifest: unable to make MerkleCommitter: %v", err)
+	}
+	trie, err := merkletrie.MakeTrie(mc, TrieMemoryConfig)
+	if err != nil {
+		return fmt.Errorf("verifyStagingAgainstManifest: unable to make trie: %v", err)
+	}
+	stagedHash, err := trie.RootHash()
+	if err != nil {
+		return fmt.Errorf("verifyStagingAgainstManifest: unable to get trie root hash: %v", err)
+	}
+
+	if stagedAccounts != expectedAccounts && stagedHash != expectedHash {
+		return fmt.Errorf("verifyStagingAgainstManifest: staged accounts count %d and balances hash %v mismatch the manifest accounts count %d and balances hash %v", stagedAccounts, stagedHash, expectedAccounts, expectedHash)
+	}
+	if stagedAccounts != expectedAccounts {
+		return fmt.Errorf("verifyStagingAgainstManifest: staged accounts count %d mismatch the manifest accounts count %d", stagedAccounts, expectedAccounts)
+	}
+	if stagedHash != expectedHash {
+		return fmt.Errorf("verifyStagingAgainstManifest: staged balances hash %v mismatch the manifest balances hash %v", stagedHash, expectedHash)
+	}
+	return nil
+}
+
 // applyCatchpointStagingBalances switches the staged catchpoint catchup tables onto the actual
 // tables and update the correct balance round. This is the final step in switching onto the new catchpoint round.
+// The switch is performed within a savepoint, and the context is checked before every step of it; if the context
+// gets canceled or any of the steps fails, the savepoint is rolled back, leaving both the actual and the staged
+// tables untouched so that the switch could be retried.
 func applyCatchpointStagingBalances(ctx context.Context, tx *sql.Tx, balancesRound basics.Round) (err error) {
 	stmts := []string{
 		"ALTER TABLE accountbase RENAME TO accountbase_old",
@@ -491,15 +648,50 @@ func applyCatchpointStagingBalances(ctx context.Context, tx *sql.Tx, balancesRou
 		"DROP TABLE IF EXISTS accountbase_old",
 		"DROP TABLE IF EXISTS assetcreators_old",
 		"DROP TABLE IF EXISTS accounthashes_old",
+
+		// the asset holders and the state checksum would get recreated from the new accountbase table, if enabled
+		"DROP TABLE IF EXISTS assetholders",
+		"DROP TABLE IF EXISTS statechecksum",
+
+		"UPDATE accounttotals SET accountcount = (SELECT count(1) FROM accountbase) WHERE id=''",
+		"DELETE FROM appcreatorcounts",
+		fmt.Sprintf("INSERT INTO appcreatorcounts (creator, count) SELECT creator, count(1) FROM assetcreators WHERE ctype = %d GROUP BY creator", basics.AppCreatable),
+	}
+
+	_, err = tx.Exec("SAVEPOINT catchpointpromotion")
+	if err != nil {
+		return err
 	}
+	defer func() {
+		if err != nil {
+			// rolling back to a savepoint doesn't release it, so it's released below either way.
+			_, rollbackErr := tx.Exec("ROLLBACK TO catchpointpromotion")
+			if rollbackErr != nil {
+				err = fmt.Errorf("%w; unable to roll back the catchpoint promotion : %v", err, rollbackErr)
+				return
+			}
+		}
+		_, releaseErr := tx.Exec("RELEASE catchpointpromotion")
+		if err == nil {
+			err = releaseErr
+		}
+	}()
 
 	for _, stmt := range stmts {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
 		_, err = tx.Exec(stmt)
 		if err != nil {
 			return err
 		}
 	}
 
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
 	_, err = tx.Exec("INSERT OR REPLACE INTO acctrounds(id, rnd) VALUES('acctbase', ?)", balancesRound)
 	if err != nil {
 		return err
@@ -550,8 +742,8 @@ func accountsInit(tx *sql.Tx, initAccounts map[basics.Address]basics.AccountData
 		var totals ledgercore.AccountTotals
 
 		for addr, data := range initAccounts {
-			_, err = tx.Exec("INSERT INTO accountbase (address, data) VALUES (?, ?)",
-				addr[:], protocol.Encode(&data))
+			_, err = tx.Exec("INSERT INTO accountbase (address, status, microalgos, data) VALUES (?, ?, ?, ?)",
+				addr[:], data.Status, data.MicroAlgos.Raw, protocol.Encode(&data))
 			if err != nil {
 				return true, err
 			}
@@ -567,6 +759,10 @@ func accountsInit(tx *sql.Tx, initAccounts map[basics.Address]basics.AccountData
 		if err != nil {
 			return true, err
 		}
+		_, err = tx.Exec("UPDATE accounttotals SET accountcount = (SELECT count(1) FROM accountbase) WHERE id=''")
+		if err != nil {
+			return true, err
+		}
 		newDatabase = true
 	} else {
 		serr, ok := err.(sqlite3.Error)
@@ -633,6 +829,159 @@ func accountsAddNormalizedBalance(tx *sql.Tx, proto config.ConsensusParams) erro
 	return rows.Err()
 }
 
+// accountsAddStatus adds the status column to the accountbase table, and populates it
+// from the stored account data.
+func accountsAddStatus(tx *sql.Tx) error {
+	var exists bool
+	err := tx.QueryRow("SELECT 1 FROM pragma_table_info('accountbase') WHERE name='status'").Scan(&exists)
+	if err == nil {
+		// Already exists.
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	for _, stmt := range createAccountStatusColumn {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query("SELECT rowid, data FROM accountbase")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	updateStmt, err := tx.Prepare("UPDATE accountbase SET status=? WHERE rowid=?")
+	if err != nil {
+		return err
+	}
+	defer updateStmt.Close()
+
+	for rows.Next() {
+		var rowid int64
+		var buf []byte
+		err = rows.Scan(&rowid, &buf)
+		if err != nil {
+			return err
+		}
+
+		var data basics.AccountData
+		err = protocol.Decode(buf, &data)
+		if err != nil {
+			return err
+		}
+
+		_, err = updateStmt.Exec(data.Status, rowid)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// accountsAddBalance adds the microalgos column to the accountbase table, and populates it
+// from the stored account data. The column index is created regardless of whether the column
+// already existed.
+func accountsAddBalance(tx *sql.Tx) error {
+	var exists bool
+	err := tx.QueryRow("SELECT 1 FROM pragma_table_info('accountbase') WHERE name='microalgos'").Scan(&exists)
+	if err == sql.ErrNoRows {
+		err = accountsPopulateBalance(tx)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(createAccountBalanceIndex("accountbase_microalgos_idx", "accountbase"))
+	return err
+}
+
+// accountsPopulateBalance adds the microalgos column to the accountbase table and populates it
+func accountsPopulateBalance(tx *sql.Tx) error {
+	for _, stmt := range createAccountBalanceColumn {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query("SELECT rowid, data FROM accountbase")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	updateStmt, err := tx.Prepare("UPDATE accountbase SET microalgos=? WHERE rowid=?")
+	if err != nil {
+		return err
+	}
+	defer updateStmt.Close()
+
+	for rows.Next() {
+		var rowid int64
+		var buf []byte
+		err = rows.Scan(&rowid, &buf)
+		if err != nil {
+			return err
+		}
+
+		var data basics.AccountData
+		err = protocol.Decode(buf, &data)
+		if err != nil {
+			return err
+		}
+
+		_, err = updateStmt.Exec(data.MicroAlgos.Raw, rowid)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// accountsAddAccountCount adds the accountcount column to the accounttotals table, if it's missing, and
+// sets it to the number of accounts in the accountbase table.
+func accountsAddAccountCount(tx *sql.Tx) error {
+	var exists bool
+	err := tx.QueryRow("SELECT 1 FROM pragma_table_info('accounttotals') WHERE name='accountcount'").Scan(&exists)
+	if err == sql.ErrNoRows {
+		for _, stmt := range createAccountCountColumn {
+			_, err = tx.Exec(stmt)
+			if err != nil {
+				return err
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE accounttotals SET accountcount = (SELECT count(1) FROM accountbase) WHERE id=''")
+	return err
+}
+
+// accountsAddAppCounts creates the appcreatorcounts table, if it's missing, and populates it from the applications
+// in the assetcreators table.
+func accountsAddAppCounts(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS appcreatorcounts (
+		creator blob primary key,
+		count integer NOT NULL)`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM appcreatorcounts")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO appcreatorcounts (creator, count) SELECT creator, count(1) FROM assetcreators WHERE ctype = ? GROUP BY creator", basics.AppCreatable)
+	return err
+}
+
 // removeEmptyAccountData removes empty AccountData msgp-encoded entries from accountbase table
 // and optionally returns list of addresses that were eliminated
 func removeEmptyAccountData(tx *sql.Tx, queryAddresses bool) (num int64, addresses []basics.Address, err error) {
@@ -728,66 +1077,154 @@ func accountsRound(tx *sql.Tx) (rnd basics.Round, hashrnd basics.Round, err erro
 }
 
 func accountsDbInit(r db.Queryable, w db.Queryable) (*accountsDbQueries, error) {
+	return accountsDbInitCached(r, w, nil)
+}
+
+// accountsDbInitCached prepares the accounts database statements the same way accountsDbInit does, reusing the
+// statements the given cache holds for the provided handles. The statements of the returned queries set are owned
+// by the cache; closing the queries set leaves them intact. A nil cache prepares all the statements anew.
+func accountsDbInitCached(r db.Queryable, w db.Queryable, cache *StmtCache) (*accountsDbQueries, error) {
 	var err error
-	qs := &accountsDbQueries{}
+	qs := &accountsDbQueries{cached: cache != nil}
+
+	qs.listCreatablesStmt, err = cache.prepare(r, "SELECT rnd, asset, creator FROM acctrounds LEFT JOIN assetcreators ON assetcreators.asset <= ? AND assetcreators.ctype = ? WHERE acctrounds.id='acctbase' ORDER BY assetcreators.asset desc LIMIT ?")
+	if err != nil {
+		return nil, err
+	}
+
+	qs.lookupStmt, err = cache.prepare(r, "SELECT accountbase.rowid, rnd, data FROM acctrounds LEFT JOIN accountbase ON address=? WHERE id='acctbase'")
+	if err != nil {
+		return nil, err
+	}
+
+	qs.lookupByRowIDStmt, err = cache.prepare(r, "SELECT rnd, data FROM acctrounds LEFT JOIN accountbase ON accountbase.rowid=? WHERE id='acctbase'")
+	if err != nil {
+		return nil, err
+	}
+
+	qs.lookupStatusStmt, err = cache.prepare(r, "SELECT status FROM accountbase WHERE address=?")
+	if err != nil {
+		return nil, err
+	}
 
-	qs.listCreatablesStmt, err = r.Prepare("SELECT rnd, asset, creator FROM acctrounds LEFT JOIN assetcreators ON assetcreators.asset <= ? AND assetcreators.ctype = ? WHERE acctrounds.id='acctbase' ORDER BY assetcreators.asset desc LIMIT ?")
+	qs.lookupCreatorStmt, err = cache.prepare(r, "SELECT rnd, creator FROM acctrounds LEFT JOIN assetcreators ON asset = ? AND ctype = ? WHERE id='acctbase'")
 	if err != nil {
 		return nil, err
 	}
 
-	qs.lookupStmt, err = r.Prepare("SELECT accountbase.rowid, rnd, data FROM acctrounds LEFT JOIN accountbase ON address=? WHERE id='acctbase'")
+	qs.deleteStoredCatchpoint, err = cache.prepare(w, "DELETE FROM storedcatchpoints WHERE round=?")
 	if err != nil {
 		return nil, err
 	}
 
-	qs.lookupCreatorStmt, err = r.Prepare("SELECT rnd, creator FROM acctrounds LEFT JOIN assetcreators ON asset = ? AND ctype = ? WHERE id='acctbase'")
+	qs.insertStoredCatchpoint, err = cache.prepare(w, "INSERT INTO storedcatchpoints(round, filename, catchpoint, filesize, pinned) VALUES(?, ?, ?, ?, 0)")
 	if err != nil {
 		return nil, err
 	}
 
-	qs.deleteStoredCatchpoint, err = w.Prepare("DELETE FROM storedcatchpoints WHERE round=?")
+	qs.selectOldestCatchpointFiles, err = cache.prepare(r, "SELECT round, filename FROM storedcatchpoints WHERE pinned = 0 and round <= COALESCE((SELECT round FROM storedcatchpoints WHERE pinned = 0 ORDER BY round DESC LIMIT ?, 1),0) ORDER BY round ASC LIMIT ?")
 	if err != nil {
 		return nil, err
 	}
 
-	qs.insertStoredCatchpoint, err = w.Prepare("INSERT INTO storedcatchpoints(round, filename, catchpoint, filesize, pinned) VALUES(?, ?, ?, ?, 0)")
+	qs.selectCatchpointStateUint64, err = cache.prepare(r, "SELECT intval FROM catchpointstate WHERE id=?")
 	if err != nil {
 		return nil, err
 	}
 
-	qs.selectOldestCatchpointFiles, err = r.Prepare("SELECT round, filename FROM storedcatchpoints WHERE pinned = 0 and round <= COALESCE((SELECT round FROM storedcatchpoints WHERE pinned = 0 ORDER BY round DESC LIMIT ?, 1),0) ORDER BY round ASC LIMIT ?")
+	qs.deleteCatchpointState, err = cache.prepare(r, "DELETE FROM catchpointstate WHERE id=?")
 	if err != nil {
 		return nil, err
 	}
 
-	qs.selectCatchpointStateUint64, err = r.Prepare("SELECT intval FROM catchpointstate WHERE id=?")
+	qs.insertCatchpointStateUint64, err = cache.prepare(r, "INSERT OR REPLACE INTO catchpointstate(id, intval) VALUES(?, ?)")
 	if err != nil {
 		return nil, err
 	}
 
-	qs.deleteCatchpointState, err = r.Prepare("DELETE FROM catchpointstate WHERE id=?")
+	qs.insertCatchpointStateString, err = cache.prepare(r, "INSERT OR REPLACE INTO catchpointstate(id, strval) VALUES(?, ?)")
 	if err != nil {
 		return nil, err
 	}
 
-	qs.insertCatchpointStateUint64, err = r.Prepare("INSERT OR REPLACE INTO catchpointstate(id, intval) VALUES(?, ?)")
+	qs.selectCatchpointStateString, err = cache.prepare(r, "SELECT strval FROM catchpointstate WHERE id=?")
 	if err != nil {
 		return nil, err
 	}
 
-	qs.insertCatchpointStateString, err = r.Prepare("INSERT OR REPLACE INTO catchpointstate(id, strval) VALUES(?, ?)")
+	qs.lookupAppCountStmt, err = cache.prepare(r, "SELECT count FROM appcreatorcounts WHERE creator=?")
 	if err != nil {
 		return nil, err
 	}
 
-	qs.selectCatchpointStateString, err = r.Prepare("SELECT strval FROM catchpointstate WHERE id=?")
+	// the assetholders table is optional; see accountsCreateAssetHolders
+	assetHoldersExists, err := tableExists(r, "assetholders")
 	if err != nil {
 		return nil, err
 	}
+	if assetHoldersExists {
+		qs.lookupAssetHoldersStmt, err = cache.prepare(r, "SELECT count FROM assetholders WHERE asset=?")
+		if err != nil {
+			return nil, err
+		}
+	}
 	return qs, nil
 }
 
+// StmtCache holds prepared statements keyed by their query, allowing the accounts database statements to be reused
+// across repeated initializations. A statement is reused as long as it's requested for the same database handle it
+// was prepared on; once requested for another handle, such as when the database is reopened, it's closed and prepared
+// again on the new handle, so that queries sets initialized over the previous handle must no longer be used. Close
+// should be called before closing the handles.
+type StmtCache struct {
+	mu    deadlock.Mutex
+	stmts map[string]stmtCacheEntry
+}
+
+// stmtCacheEntry is a statement held by the StmtCache, along with the database handle it was prepared on.
+type stmtCacheEntry struct {
+	handle db.Queryable
+	stmt   *sql.Stmt
+}
+
+// MakeStmtCache creates an empty statements cache.
+func MakeStmtCache() *StmtCache {
+	return &StmtCache{stmts: make(map[string]stmtCacheEntry)}
+}
+
+// prepare returns the cached statement for the given query if it was prepared on the given handle, and prepares and
+// caches it otherwise. A nil cache simply prepares the statement.
+func (c *StmtCache) prepare(handle db.Queryable, query string) (*sql.Stmt, error) {
+	if c == nil {
+		return handle.Prepare(query)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.stmts[query]
+	if ok && entry.handle == handle {
+		return entry.stmt, nil
+	}
+	stmt, err := handle.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		entry.stmt.Close()
+	}
+	c.stmts[query] = stmtCacheEntry{handle: handle, stmt: stmt}
+	return stmt, nil
+}
+
+// Close closes all the cached statements and empties the cache.
+func (c *StmtCache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for query, entry := range c.stmts {
+		entry.stmt.Close()
+		delete(c.stmts, query)
+	}
+}
+
 // listCreatables returns an array of CreatableLocator which have CreatableIndex smaller or equal to maxIdx and are of the provided CreatableType.
 func (qs *accountsDbQueries) listCreatables(maxIdx basics.CreatableIndex, maxResults uint64, ctype basics.CreatableType) (results []basics.CreatableLocator, dbRound basics.Round, err error) {
 	err = db.Retry(func() error {
@@ -875,23 +1312,1194 @@ func (qs *accountsDbQueries) lookup(addr basics.Address) (data persistedAccountD
 	return
 }
 
-func (qs *accountsDbQueries) storeCatchpoint(ctx context.Context, round basics.Round, fileName string, catchpoint string, fileSize int64) (err error) {
-	err = db.Retry(func() (err error) {
-		_, err = qs.deleteStoredCatchpoint.ExecContext(ctx, round)
-
-		if err != nil || (fileName == "" && catchpoint == "" && fileSize == 0) {
-			return
-		}
+// lookupWithRewards looks up the account data of the given address, and applies the pending rewards up to the given
+// rewards level. The result is identical to calling WithUpdatedRewards on the account data returned by lookup.
+func (qs *accountsDbQueries) lookupWithRewards(addr basics.Address, proto config.ConsensusParams, rewardsLevel uint64) (basics.AccountData, error) {
+	pad, err := qs.lookup(addr)
+	if err != nil {
+		return basics.AccountData{}, err
+	}
+	return pad.accountData.WithUpdatedRewards(proto, rewardsLevel), nil
+}
 
-		_, err = qs.insertStoredCatchpoint.ExecContext(ctx, round, fileName, catchpoint, fileSize)
-		return
+// lookupStatus looks up the participation status of the given account, using the status column rather than decoding
+// the account data. Accounts whose status wasn't recorded fall back to a full lookup. The returned boolean
+// indicates whether the account exists.
+func (qs *accountsDbQueries) lookupStatus(addr basics.Address) (status basics.Status, exists bool, err error) {
+	var dbStatus sql.NullInt64
+	err = db.Retry(func() error {
+		return qs.lookupStatusStmt.QueryRow(addr[:]).Scan(&dbStatus)
 	})
-	return
+	if err == sql.ErrNoRows {
+		return basics.Offline, false, nil
+	}
+	if err != nil {
+		return basics.Offline, false, err
+	}
+	if dbStatus.Valid {
+		return basics.Status(dbStatus.Int64), true, nil
+	}
+
+	pad, err := qs.lookup(addr)
+	if err != nil {
+		return basics.Offline, false, err
+	}
+	return pad.accountData.Status, pad.rowid != 0, nil
 }
 
-func (qs *accountsDbQueries) getOldestCatchpointFiles(ctx context.Context, fileCount int, filesToKeep int) (fileNames map[basics.Round]string, err error) {
-	err = db.Retry(func() (err error) {
-		var rows *sql.Rows
+// lookupEncodedByRowID looks up the encoded account data stored at the given accountbase rowid, along with the current
+// database round. Since rowids could be reused once an account is deleted, callers holding a rowid obtained at an earlier
+// round should compare it against the returned round. An empty buffer is returned if no account is stored at that rowid.
+func (qs *accountsDbQueries) lookupEncodedByRowID(rowid int64) (buf []byte, dbRound basics.Round, err error) {
+	err = db.Retry(func() error {
+		err := qs.lookupByRowIDStmt.QueryRow(rowid).Scan(&dbRound, &buf)
+		// this should never happen; it indicates that we don't have a current round in the acctrounds table.
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("unable to query account data for rowid %d : %w", rowid, err)
+		}
+		return err
+	})
+	return
+}
+
+// lookupRawBlob returns the rowid and the account data of the given address exactly as stored in the accountbase
+// table, without decoding it. It's meant for diagnosing accounts whose stored encoding is suspected to be corrupted
+// or non-canonical. A missing account yields a zero rowid and a nil blob.
+func lookupRawBlob(qs *accountsDbQueries, addr basics.Address) (rowid int64, blob []byte, err error) {
+	err = db.Retry(func() error {
+		var nullRowid sql.NullInt64
+		var dbRound basics.Round
+		blob = nil
+		err := qs.lookupStmt.QueryRow(addr[:]).Scan(&nullRowid, &dbRound, &blob)
+		// this should never happen; it indicates that we don't have a current round in the acctrounds table.
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("unable to query account data for address %v : %w", addr, err)
+		}
+		rowid = nullRowid.Int64
+		return err
+	})
+	return
+}
+
+// decodeHoldingAmounts extracts the amount of every asset held by an account from its encoded account data. Only the
+// assets holdings map is traversed, and the amount is the only field decoded out of each holding.
+func decodeHoldingAmounts(encodedAccountData []byte) (amounts map[basics.AssetIndex]uint64, err error) {
+	fields, _, buf, err := msgp.ReadMapHeaderBytes(encodedAccountData)
+	if err != nil {
+		return nil, err
+	}
+	for ; fields > 0; fields-- {
+		var field []byte
+		field, buf, err = msgp.ReadMapKeyZC(buf)
+		if err != nil {
+			return nil, err
+		}
+		if string(field) != "asset" {
+			buf, err = msgp.Skip(buf)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var holdings int
+		holdings, _, buf, err = msgp.ReadMapHeaderBytes(buf)
+		if err != nil {
+			return nil, err
+		}
+		amounts = make(map[basics.AssetIndex]uint64, holdings)
+		for ; holdings > 0; holdings-- {
+			var aidx uint64
+			aidx, buf, err = msgp.ReadUint64Bytes(buf)
+			if err != nil {
+				return nil, err
+			}
+			var holdingFields int
+			holdingFields, _, buf, err = msgp.ReadMapHeaderBytes(buf)
+			if err != nil {
+				return nil, err
+			}
+			amount := uint64(0)
+			for ; holdingFields > 0; holdingFields-- {
+				field, buf, err = msgp.ReadMapKeyZC(buf)
+				if err != nil {
+					return nil, err
+				}
+				if string(field) == "a" {
+					amount, buf, err = msgp.ReadUint64Bytes(buf)
+				} else {
+					buf, err = msgp.Skip(buf)
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			amounts[basics.AssetIndex(aidx)] = amount
+		}
+		return amounts, nil
+	}
+	return amounts, nil
+}
+
+// lookupVoteValidity returns the rounds range during which the participation keys registered by the given account are
+// valid. The account data is only partially decoded; see decodeVoteValidity. The returned boolean indicates whether the
+// account exists.
+func lookupVoteValidity(qs *accountsDbQueries, addr basics.Address) (first, last basics.Round, exists bool, err error) {
+	var buf []byte
+	err = db.Retry(func() error {
+		var rowid sql.NullInt64
+		var dbRound basics.Round
+		err := qs.lookupStmt.QueryRow(addr[:]).Scan(&rowid, &dbRound, &buf)
+		// this should never happen; it indicates that we don't have a current round in the acctrounds table.
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("unable to query account data for address %v : %w", addr, err)
+		}
+		exists = rowid.Valid && len(buf) > 0
+		return err
+	})
+	if err != nil || !exists {
+		return 0, 0, false, err
+	}
+	first, last, err = decodeVoteValidity(buf)
+	return first, last, err == nil, err
+}
+
+// decodeVoteValidity extracts the first and last valid rounds of the participation keys from the encoded account data,
+// skipping over all the other fields.
+func decodeVoteValidity(encodedAccountData []byte) (first, last basics.Round, err error) {
+	fields, _, buf, err := msgp.ReadMapHeaderBytes(encodedAccountData)
+	if err != nil {
+		return 0, 0, err
+	}
+	for ; fields > 0; fields-- {
+		var field []byte
+		field, buf, err = msgp.ReadMapKeyZC(buf)
+		if err != nil {
+			return 0, 0, err
+		}
+		var rnd uint64
+		switch string(field) {
+		case "voteFst":
+			rnd, buf, err = msgp.ReadUint64Bytes(buf)
+			first = basics.Round(rnd)
+		case "voteLst":
+			rnd, buf, err = msgp.ReadUint64Bytes(buf)
+			last = basics.Round(rnd)
+		default:
+			buf, err = msgp.Skip(buf)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return first, last, nil
+}
+
+// RewardsView holds the fields of an account that are relevant to the rewards computation.
+type RewardsView struct {
+	Status             basics.Status
+	MicroAlgos         basics.MicroAlgos
+	RewardsBase        uint64
+	RewardedMicroAlgos basics.MicroAlgos
+}
+
+// lookupRewardsFields returns the rewards relevant fields of the given account. The account data is only partially
+// decoded; see decodeRewardsFields. A missing account yields an empty view.
+func lookupRewardsFields(qs *accountsDbQueries, addr basics.Address) (view RewardsView, err error) {
+	var buf []byte
+	err = db.Retry(func() error {
+		var rowid sql.NullInt64
+		var dbRound basics.Round
+		err := qs.lookupStmt.QueryRow(addr[:]).Scan(&rowid, &dbRound, &buf)
+		// this should never happen; it indicates that we don't have a current round in the acctrounds table.
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("unable to query account data for address %v : %w", addr, err)
+		}
+		return err
+	})
+	if err != nil || len(buf) == 0 {
+		return RewardsView{}, err
+	}
+	return decodeRewardsFields(buf)
+}
+
+// decodeRewardsFields extracts the rewards relevant fields from the encoded account data, skipping over all the
+// other fields.
+func decodeRewardsFields(encodedAccountData []byte) (view RewardsView, err error) {
+	fields, _, buf, err := msgp.ReadMapHeaderBytes(encodedAccountData)
+	if err != nil {
+		return RewardsView{}, err
+	}
+	for ; fields > 0; fields-- {
+		var field []byte
+		field, buf, err = msgp.ReadMapKeyZC(buf)
+		if err != nil {
+			return RewardsView{}, err
+		}
+		switch string(field) {
+		case "onl":
+			buf, err = view.Status.UnmarshalMsg(buf)
+		case "algo":
+			buf, err = view.MicroAlgos.UnmarshalMsg(buf)
+		case "ebase":
+			view.RewardsBase, buf, err = msgp.ReadUint64Bytes(buf)
+		case "ern":
+			buf, err = view.RewardedMicroAlgos.UnmarshalMsg(buf)
+		default:
+			buf, err = msgp.Skip(buf)
+		}
+		if err != nil {
+			return RewardsView{}, err
+		}
+	}
+	return view, nil
+}
+
+// accountsTotalHoldingAmount returns the amount of every asset held by the account stored at the given rowid, as
+// observed at round rnd. The account data is only partially decoded; see decodeHoldingAmounts.
+func accountsTotalHoldingAmount(qs *accountsDbQueries, rowid int64, rnd basics.Round) (map[basics.AssetIndex]uint64, error) {
+	buf, dbRound, err := qs.lookupEncodedByRowID(rowid)
+	if err != nil {
+		return nil, err
+	}
+	if dbRound != rnd {
+		return nil, &MismatchingDatabaseRoundError{databaseRound: dbRound, memoryRound: rnd}
+	}
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	return decodeHoldingAmounts(buf)
+}
+
+// lookupHoldingsPage returns up to limit asset holdings of the account stored at the given rowid, as observed at round
+// rnd, for the assets whose index is greater than startAfter. The asset indices are returned in ascending order, so that
+// the last one could be used as the startAfter of the next page. Only the holdings that are part of the page are decoded
+// out of the account data.
+func lookupHoldingsPage(qs *accountsDbQueries, rowid int64, rnd basics.Round, startAfter basics.AssetIndex, limit int) ([]basics.AssetIndex, map[basics.AssetIndex]basics.AssetHolding, error) {
+	buf, dbRound, err := qs.lookupEncodedByRowID(rowid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dbRound != rnd {
+		return nil, nil, &MismatchingDatabaseRoundError{databaseRound: dbRound, memoryRound: rnd}
+	}
+	if len(buf) == 0 || limit <= 0 {
+		return nil, nil, nil
+	}
+	return decodeHoldingsPage(buf, startAfter, limit)
+}
+
+// decodeHoldingsPage extracts a page of asset holdings from the encoded account data; see lookupHoldingsPage.
+func decodeHoldingsPage(encodedAccountData []byte, startAfter basics.AssetIndex, limit int) (page []basics.AssetIndex, holdings map[basics.AssetIndex]basics.AssetHolding, err error) {
+	fields, _, buf, err := msgp.ReadMapHeaderBytes(encodedAccountData)
+	if err != nil {
+		return nil, nil, err
+	}
+	for ; fields > 0; fields-- {
+		var field []byte
+		field, buf, err = msgp.ReadMapKeyZC(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		if string(field) != "asset" {
+			buf, err = msgp.Skip(buf)
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		var count int
+		count, _, buf, err = msgp.ReadMapHeaderBytes(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		// locate the encoded holdings past startAfter, without decoding them
+		encoded := make(map[basics.AssetIndex][]byte)
+		for ; count > 0; count-- {
+			var aidx uint64
+			aidx, buf, err = msgp.ReadUint64Bytes(buf)
+			if err != nil {
+				return nil, nil, err
+			}
+			holding := buf
+			buf, err = msgp.Skip(buf)
+			if err != nil {
+				return nil, nil, err
+			}
+			if basics.AssetIndex(aidx) > startAfter {
+				encoded[basics.AssetIndex(aidx)] = holding[:len(holding)-len(buf)]
+				page = append(page, basics.AssetIndex(aidx))
+			}
+		}
+		sort.Slice(page, func(i, j int) bool { return page[i] < page[j] })
+		if len(page) > limit {
+			page = page[:limit]
+		}
+		if len(page) == 0 {
+			return nil, nil, nil
+		}
+		holdings = make(map[basics.AssetIndex]basics.AssetHolding, len(page))
+		for _, aidx := range page {
+			var holding basics.AssetHolding
+			_, err = holding.UnmarshalMsg(encoded[aidx])
+			if err != nil {
+				return nil, nil, err
+			}
+			holdings[aidx] = holding
+		}
+		return page, holdings, nil
+	}
+	return nil, nil, nil
+}
+
+// lookupHoldingsSubset returns the asset holdings of the account at the given rowid for the requested asset indexes,
+// such as the foreign assets of a transaction group. Holdings the account doesn't have are omitted. The rnd must
+// match the round of the account database, as in lookupHoldingsPage. Only the requested holdings are decoded out of
+// the account data; see decodeHoldingsSubset.
+func lookupHoldingsSubset(qs *accountsDbQueries, rowid int64, rnd basics.Round, aidxs []basics.AssetIndex) (map[basics.AssetIndex]basics.AssetHolding, error) {
+	buf, dbRound, err := qs.lookupEncodedByRowID(rowid)
+	if err != nil {
+		return nil, err
+	}
+	if dbRound != rnd {
+		return nil, &MismatchingDatabaseRoundError{databaseRound: dbRound, memoryRound: rnd}
+	}
+	if len(buf) == 0 || len(aidxs) == 0 {
+		return nil, nil
+	}
+	return decodeHoldingsSubset(buf, aidxs)
+}
+
+// decodeHoldingsSubset extracts the requested asset holdings from the encoded account data; see lookupHoldingsSubset.
+func decodeHoldingsSubset(encodedAccountData []byte, aidxs []basics.AssetIndex) (holdings map[basics.AssetIndex]basics.AssetHolding, err error) {
+	requested := make(map[basics.AssetIndex]bool, len(aidxs))
+	for _, aidx := range aidxs {
+		requested[aidx] = true
+	}
+	fields, _, buf, err := msgp.ReadMapHeaderBytes(encodedAccountData)
+	if err != nil {
+		return nil, err
+	}
+	for ; fields > 0; fields-- {
+		var field []byte
+		field, buf, err = msgp.ReadMapKeyZC(buf)
+		if err != nil {
+			return nil, err
+		}
+		if string(field) != "asset" {
+			buf, err = msgp.Skip(buf)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var count int
+		count, _, buf, err = msgp.ReadMapHeaderBytes(buf)
+		if err != nil {
+			return nil, err
+		}
+		for ; count > 0; count-- {
+			var aidx uint64
+			aidx, buf, err = msgp.ReadUint64Bytes(buf)
+			if err != nil {
+				return nil, err
+			}
+			if !requested[basics.AssetIndex(aidx)] {
+				buf, err = msgp.Skip(buf)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			var holding basics.AssetHolding
+			buf, err = holding.UnmarshalMsg(buf)
+			if err != nil {
+				return nil, err
+			}
+			if holdings == nil {
+				holdings = make(map[basics.AssetIndex]basics.AssetHolding, len(requested))
+			}
+			holdings[basics.AssetIndex(aidx)] = holding
+		}
+		return holdings, nil
+	}
+	return nil, nil
+}
+
+// lookupAppGlobalKeys returns the keys of the global state of the given application, as stored in the account data of
+// its creator at the given rowid. Only the key names are decoded out of the account data; see decodeAppGlobalKeys.
+// The keys are returned sorted. A creator account that doesn't hold the application params yields no keys.
+func lookupAppGlobalKeys(qs *accountsDbQueries, creatorRowid int64, aidx basics.AppIndex) ([]string, error) {
+	buf, _, err := qs.lookupEncodedByRowID(creatorRowid)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	return decodeAppGlobalKeys(buf, aidx)
+}
+
+// decodeAppGlobalKeys extracts the global state keys of an application out of the encoded account data of its creator,
+// skipping over the values and the rest of the account data.
+func decodeAppGlobalKeys(encodedAccountData []byte, aidx basics.AppIndex) (keys []string, err error) {
+	fields, _, buf, err := msgp.ReadMapHeaderBytes(encodedAccountData)
+	if err != nil {
+		return nil, err
+	}
+	for ; fields > 0; fields-- {
+		var field []byte
+		field, buf, err = msgp.ReadMapKeyZC(buf)
+		if err != nil {
+			return nil, err
+		}
+		if string(field) != "appp" {
+			buf, err = msgp.Skip(buf)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var apps int
+		apps, _, buf, err = msgp.ReadMapHeaderBytes(buf)
+		if err != nil {
+			return nil, err
+		}
+		for ; apps > 0; apps-- {
+			var appIdx uint64
+			appIdx, buf, err = msgp.ReadUint64Bytes(buf)
+			if err != nil {
+				return nil, err
+			}
+			if basics.AppIndex(appIdx) != aidx {
+				buf, err = msgp.Skip(buf)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return decodeGlobalStateKeys(buf)
+		}
+		return nil, nil
+	}
+	return nil, nil
+}
+
+// decodeGlobalStateKeys extracts the global state keys out of encoded application params.
+func decodeGlobalStateKeys(encodedAppParams []byte) (keys []string, err error) {
+	fields, _, buf, err := msgp.ReadMapHeaderBytes(encodedAppParams)
+	if err != nil {
+		return nil, err
+	}
+	for ; fields > 0; fields-- {
+		var field []byte
+		field, buf, err = msgp.ReadMapKeyZC(buf)
+		if err != nil {
+			return nil, err
+		}
+		if string(field) != "gs" {
+			buf, err = msgp.Skip(buf)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var count int
+		count, _, buf, err = msgp.ReadMapHeaderBytes(buf)
+		if err != nil {
+			return nil, err
+		}
+		keys = make([]string, 0, count)
+		for ; count > 0; count-- {
+			var key string
+			key, buf, err = msgp.ReadStringBytes(buf)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+			buf, err = msgp.Skip(buf)
+			if err != nil {
+				return nil, err
+			}
+		}
+		sort.Strings(keys)
+		return keys, nil
+	}
+	return nil, nil
+}
+
+// accountsTotalHoldings returns the number of asset holdings across all the accounts in the accountbase table.
+// The account data is only partially decoded; see decodeHoldingAmounts.
+func accountsTotalHoldings(tx *sql.Tx) (total int, err error) {
+	rows, err := tx.Query("SELECT data FROM accountbase")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var buf []byte
+		err = rows.Scan(&buf)
+		if err != nil {
+			return 0, err
+		}
+		amounts, err := decodeHoldingAmounts(buf)
+		if err != nil {
+			return 0, err
+		}
+		total += len(amounts)
+	}
+	return total, rows.Err()
+}
+
+// assertHoldingConservation verifies that the number of asset holdings across all accounts changed from before to after
+// by exactly the number of holdings created minus the number of holdings deleted by the given deltas, and that after
+// matches the number of holdings currently stored in the database. It's meant to be used as a debugging aid around
+// accountsNewRound.
+func assertHoldingConservation(tx *sql.Tx, deltas compactAccountDeltas, before, after int) error {
+	net := 0
+	for i := 0; i < deltas.len(); i++ {
+		_, delta := deltas.getByIdx(i)
+		created, deleted, _ := ledgercore.DiffHoldings(delta.old.accountData, delta.new)
+		net += len(created) - len(deleted)
+	}
+	if after-before != net {
+		return fmt.Errorf("holdings count changed by %d (from %d to %d), while the deltas changed it by %d", after-before, before, after, net)
+	}
+
+	total, err := accountsTotalHoldings(tx)
+	if err != nil {
+		return err
+	}
+	if total != after {
+		return fmt.Errorf("database holds %d holdings, but %d were expected", total, after)
+	}
+	return nil
+}
+
+// tableExists returns true if a table with the given name exists in the database.
+func tableExists(q db.Queryable, name string) (bool, error) {
+	var exists int
+	err := q.QueryRow("SELECT 1 FROM sqlite_master WHERE type='table' AND name=?", name).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// accountsDropAssetHolders drops the optional assetholders table, so that accountsNewRound stops maintaining it.
+func accountsDropAssetHolders(tx *sql.Tx) error {
+	_, err := tx.Exec("DROP TABLE IF EXISTS assetholders")
+	return err
+}
+
+// accountsCreateAssetHolders creates the optional assetholders table, which maintains the number of accounts holding
+// each asset, and populates it from the accountbase table. Once created, the table is kept up to date by accountsNewRound,
+// until it's dropped by accountsDropAssetHolders.
+func accountsCreateAssetHolders(tx *sql.Tx) error {
+	exists, err := tableExists(tx, "assetholders")
+	if err != nil || exists {
+		return err
+	}
+	_, err = tx.Exec("CREATE TABLE assetholders (asset integer primary key, count integer NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	holders := make(map[basics.AssetIndex]int64)
+	rows, err := tx.Query("SELECT data FROM accountbase")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var buf []byte
+		err = rows.Scan(&buf)
+		if err != nil {
+			return err
+		}
+		amounts, err := decodeHoldingAmounts(buf)
+		if err != nil {
+			return err
+		}
+		for aidx := range amounts {
+			holders[aidx]++
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	return accountsUpdateAssetHolders(tx, holders)
+}
+
+// accountsUpdateAssetHolders applies the given changes in the number of holders of each asset to the assetholders table.
+// Assets left without any holders are removed from the table.
+func accountsUpdateAssetHolders(tx *sql.Tx, changes map[basics.AssetIndex]int64) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	upsertStmt, err := tx.Prepare("INSERT INTO assetholders (asset, count) VALUES (?, ?) ON CONFLICT(asset) DO UPDATE SET count = count + excluded.count")
+	if err != nil {
+		return err
+	}
+	defer upsertStmt.Close()
+	for aidx, change := range changes {
+		if change == 0 {
+			continue
+		}
+		_, err = upsertStmt.Exec(aidx, change)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("DELETE FROM assetholders WHERE count <= 0")
+	return err
+}
+
+// assetHolderCount returns the number of accounts holding the given asset. It requires the optional assetholders table
+// to have existed when the queries were initialized.
+func assetHolderCount(qs *accountsDbQueries, aidx basics.AssetIndex) (count uint64, err error) {
+	if qs.lookupAssetHoldersStmt == nil {
+		return 0, fmt.Errorf("assetHolderCount: asset holder counts aren't maintained by this database")
+	}
+	err = db.Retry(func() error {
+		err := qs.lookupAssetHoldersStmt.QueryRow(aidx).Scan(&count)
+		if err == sql.ErrNoRows {
+			count = 0
+			return nil
+		}
+		return err
+	})
+	return
+}
+
+// accountsUpdateAppCounts applies the given changes in the number of applications created by each creator to the
+// appcreatorcounts table. Creators left without any applications are removed from the table.
+func accountsUpdateAppCounts(tx *sql.Tx, changes map[basics.Address]int64) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	upsertStmt, err := tx.Prepare("INSERT INTO appcreatorcounts (creator, count) VALUES (?, ?) ON CONFLICT(creator) DO UPDATE SET count = count + excluded.count")
+	if err != nil {
+		return err
+	}
+	defer upsertStmt.Close()
+	for creator, change := range changes {
+		if change == 0 {
+			continue
+		}
+		_, err = upsertStmt.Exec(creator[:], change)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("DELETE FROM appcreatorcounts WHERE count <= 0")
+	return err
+}
+
+// appCount returns the number of applications in the assetcreators table, as maintained in the appcreatorcounts table.
+func appCount(tx *sql.Tx) (count uint64, err error) {
+	err = tx.QueryRow("SELECT COALESCE(SUM(count), 0) FROM appcreatorcounts").Scan(&count)
+	return
+}
+
+// appCountByCreator returns the number of applications created by the given creator, as maintained in the
+// appcreatorcounts table.
+func appCountByCreator(qs *accountsDbQueries, creator basics.Address) (count uint64, err error) {
+	err = db.Retry(func() error {
+		err := qs.lookupAppCountStmt.QueryRow(creator[:]).Scan(&count)
+		if err == sql.ErrNoRows {
+			count = 0
+			return nil
+		}
+		return err
+	})
+	return
+}
+
+// accountFingerprint returns the fingerprint of an account within the state checksum. It depends only on the address
+// and the logical content of the account, and not on the way it's laid out in the database.
+func accountFingerprint(addr basics.Address, ad basics.AccountData) crypto.Digest {
+	encoded := protocol.Encode(&ad)
+	buf := make([]byte, 0, len(addr)+len(encoded))
+	buf = append(buf, addr[:]...)
+	buf = append(buf, encoded...)
+	return crypto.Hash(buf)
+}
+
+// addDigests adds, or subtracts when negate is set, the given digest to the accumulator, treating both as big-endian
+// 256 bit integers and wrapping around on overflow.
+func addDigests(acc *crypto.Digest, d crypto.Digest, negate bool) {
+	var carry uint16
+	if negate {
+		// two's complement : add the bitwise not of d, plus one
+		carry = 1
+	}
+	for i := len(acc) - 1; i >= 0; i-- {
+		v := d[i]
+		if negate {
+			v = ^v
+		}
+		sum := uint16(acc[i]) + uint16(v) + carry
+		acc[i] = byte(sum)
+		carry = sum >> 8
+	}
+}
+
+// accountsCreateStateChecksum creates the optional statechecksum table and computes the checksum over all the
+// accounts in the accountbase table. The checksum is the sum, modulo 2^256, of the fingerprints of all the accounts;
+// since the sum is commutative, it's kept up to date by accountsNewRound by subtracting the fingerprints of the modified
+// accounts and adding their new ones, at a cost proportional to the size of the round rather than the number of accounts.
+//
+// The checksum is meant for detecting accidental inconsistencies, such as a corrupted or diverging accounts database.
+// It is not a cryptographic commitment : a sum of digests isn't collision resistant, as colliding sets of accounts could
+// be found using a generalized birthday attack, and so it must not be relied upon to authenticate the accounts state.
+func accountsCreateStateChecksum(tx *sql.Tx) error {
+	exists, err := tableExists(tx, "statechecksum")
+	if err != nil || exists {
+		return err
+	}
+	_, err = tx.Exec("CREATE TABLE statechecksum (id string primary key, checksum blob NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	var checksum crypto.Digest
+	rows, err := tx.Query("SELECT address, data FROM accountbase")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var addrbuf, buf []byte
+		err = rows.Scan(&addrbuf, &buf)
+		if err != nil {
+			return err
+		}
+		if len(addrbuf) != len(basics.Address{}) {
+			return fmt.Errorf("account DB address length mismatch: %d != %d", len(addrbuf), len(basics.Address{}))
+		}
+		var addr basics.Address
+		copy(addr[:], addrbuf)
+		var ad basics.AccountData
+		err = protocol.Decode(buf, &ad)
+		if err != nil {
+			return err
+		}
+		addDigests(&checksum, accountFingerprint(addr, ad), false)
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO statechecksum (id, checksum) VALUES ('', ?)", checksum[:])
+	return err
+}
+
+// accountsDropStateChecksum drops the optional statechecksum table, so that accountsNewRound stops maintaining it.
+func accountsDropStateChecksum(tx *sql.Tx) error {
+	_, err := tx.Exec("DROP TABLE IF EXISTS statechecksum")
+	return err
+}
+
+// accountsUpdateStateChecksum updates the state checksum with the given account deltas.
+func accountsUpdateStateChecksum(tx *sql.Tx, updates compactAccountDeltas) error {
+	var buf []byte
+	err := tx.QueryRow("SELECT checksum FROM statechecksum WHERE id=''").Scan(&buf)
+	if err != nil {
+		return err
+	}
+	var checksum crypto.Digest
+	copy(checksum[:], buf)
+	for i := 0; i < updates.len(); i++ {
+		addr, data := updates.getByIdx(i)
+		if data.old.rowid != 0 {
+			addDigests(&checksum, accountFingerprint(addr, data.old.accountData), true)
+		}
+		if !data.new.IsZero() {
+			addDigests(&checksum, accountFingerprint(addr, data.new), false)
+		}
+	}
+	_, err = tx.Exec("UPDATE statechecksum SET checksum=? WHERE id=''", checksum[:])
+	return err
+}
+
+// accountsStateChecksum returns the state checksum over all the accounts as of the given round, which must be the
+// current round of the accounts database. It requires the optional statechecksum table; see accountsCreateStateChecksum.
+func accountsStateChecksum(tx *sql.Tx, rnd basics.Round) (checksum crypto.Digest, err error) {
+	dbRound, _, err := accountsRound(tx)
+	if err != nil {
+		return
+	}
+	if dbRound != rnd {
+		err = fmt.Errorf("accountsStateChecksum: requested round %d, but the accounts database is at round %d", rnd, dbRound)
+		return
+	}
+	exists, err := tableExists(tx, "statechecksum")
+	if err != nil {
+		return
+	}
+	if !exists {
+		err = fmt.Errorf("accountsStateChecksum: the state checksum isn't maintained by this database")
+		return
+	}
+	var buf []byte
+	err = tx.QueryRow("SELECT checksum FROM statechecksum WHERE id=''").Scan(&buf)
+	if err != nil {
+		return
+	}
+	copy(checksum[:], buf)
+	return
+}
+
+// quickDigestOnlineAccounts is the number of top online accounts whose fingerprints are included in the quick digest.
+const quickDigestOnlineAccounts = 64
+
+// accountsQuickDigest returns a digest summarizing the accounts database as of the given round, which must be the
+// current round of the accounts database. The digest covers the account totals, the number of accounts and the
+// fingerprints of the top online accounts, which makes it cheap to compute and suitable for quick sanity comparisons
+// across peers. It's a heuristic rather than a proof : databases producing the same quick digest could still differ
+// in accounts that aren't part of the summary. Use a catchpoint label to compare full databases.
+func accountsQuickDigest(tx *sql.Tx, rnd basics.Round) (crypto.Digest, error) {
+	dbRound, _, err := accountsRound(tx)
+	if err != nil {
+		return crypto.Digest{}, err
+	}
+	if dbRound != rnd {
+		return crypto.Digest{}, fmt.Errorf("accountsQuickDigest: requested round %d, but the accounts database is at round %d", rnd, dbRound)
+	}
+
+	totals, err := accountsTotals(tx, false)
+	if err != nil {
+		return crypto.Digest{}, err
+	}
+	count, err := accountsCount(tx)
+	if err != nil {
+		return crypto.Digest{}, err
+	}
+
+	var header [16]byte
+	binary.BigEndian.PutUint64(header[:8], uint64(rnd))
+	binary.BigEndian.PutUint64(header[8:], count)
+	buf := append(header[:], protocol.Encode(&totals)...)
+
+	rows, err := tx.Query("SELECT address, data FROM accountbase WHERE normalizedonlinebalance>0 ORDER BY normalizedonlinebalance DESC, address DESC LIMIT ?", quickDigestOnlineAccounts)
+	if err != nil {
+		return crypto.Digest{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var addrbuf, databuf []byte
+		err = rows.Scan(&addrbuf, &databuf)
+		if err != nil {
+			return crypto.Digest{}, err
+		}
+		var addr basics.Address
+		if len(addrbuf) != len(addr) {
+			return crypto.Digest{}, fmt.Errorf("account DB address length mismatch: %d != %d", len(addrbuf), len(addr))
+		}
+		copy(addr[:], addrbuf)
+		var ad basics.AccountData
+		err = protocol.Decode(databuf, &ad)
+		if err != nil {
+			return crypto.Digest{}, err
+		}
+		fingerprint := accountFingerprint(addr, ad)
+		buf = append(buf, fingerprint[:]...)
+	}
+	err = rows.Err()
+	if err != nil {
+		return crypto.Digest{}, err
+	}
+	return crypto.Hash(buf), nil
+}
+
+// decodeAppPrograms extracts the approval and clear state programs of the given application from the encoded account
+// data of its creator. Only the application params map is traversed, and the global state of the application is skipped
+// without being decoded.
+func decodeAppPrograms(encodedAccountData []byte, aidx basics.AppIndex) (approval, clear []byte, exists bool, err error) {
+	fields, _, buf, err := msgp.ReadMapHeaderBytes(encodedAccountData)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	for ; fields > 0; fields-- {
+		var field []byte
+		field, buf, err = msgp.ReadMapKeyZC(buf)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if string(field) != "appp" {
+			buf, err = msgp.Skip(buf)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			continue
+		}
+
+		var apps int
+		apps, _, buf, err = msgp.ReadMapHeaderBytes(buf)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		for ; apps > 0; apps-- {
+			var appIdx uint64
+			appIdx, buf, err = msgp.ReadUint64Bytes(buf)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			if basics.AppIndex(appIdx) != aidx {
+				buf, err = msgp.Skip(buf)
+				if err != nil {
+					return nil, nil, false, err
+				}
+				continue
+			}
+
+			var paramsFields int
+			paramsFields, _, buf, err = msgp.ReadMapHeaderBytes(buf)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			for ; paramsFields > 0; paramsFields-- {
+				field, buf, err = msgp.ReadMapKeyZC(buf)
+				if err != nil {
+					return nil, nil, false, err
+				}
+				switch string(field) {
+				case "approv":
+					approval, buf, err = msgp.ReadBytesBytes(buf, nil)
+				case "clearp":
+					clear, buf, err = msgp.ReadBytesBytes(buf, nil)
+				default:
+					buf, err = msgp.Skip(buf)
+				}
+				if err != nil {
+					return nil, nil, false, err
+				}
+			}
+			return approval, clear, true, nil
+		}
+		return nil, nil, false, nil
+	}
+	return nil, nil, false, nil
+}
+
+// lookupAppPrograms returns the approval and clear state programs of the given application, created by the account
+// stored at the given rowid. The returned boolean indicates whether the application exists. See decodeAppPrograms.
+func lookupAppPrograms(qs *accountsDbQueries, creatorRowid int64, aidx basics.AppIndex) (approval, clear []byte, exists bool, err error) {
+	buf, _, err := qs.lookupEncodedByRowID(creatorRowid)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if len(buf) == 0 {
+		return nil, nil, false, nil
+	}
+	return decodeAppPrograms(buf, aidx)
+}
+
+// appsWithGlobalKey returns, in ascending order, up to limit applications whose global state contains the given key.
+// There is no index over the global state keys, so this is a scan : the applications are streamed out of the
+// assetcreators table along with the account data of their creators, which is decoded as a whole in order to inspect
+// the global state. The cost is therefore proportional to the number of applications and the size of their creators'
+// account data, up to the point where the limit is reached; it isn't meant to be used on the evaluation path.
+func appsWithGlobalKey(tx *sql.Tx, key string, limit int) ([]basics.AppIndex, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	rows, err := tx.Query("SELECT assetcreators.asset, accountbase.data FROM assetcreators JOIN accountbase ON accountbase.address = assetcreators.creator WHERE assetcreators.ctype = ? ORDER BY assetcreators.asset", basics.AppCreatable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var apps []basics.AppIndex
+	// consecutive applications are often created by the same account; avoid decoding its data again
+	var lastBuf []byte
+	var lastData basics.AccountData
+	for rows.Next() {
+		var aidx basics.AppIndex
+		var buf []byte
+		err = rows.Scan(&aidx, &buf)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(buf, lastBuf) {
+			lastData = basics.AccountData{}
+			err = protocol.Decode(buf, &lastData)
+			if err != nil {
+				return nil, err
+			}
+			lastBuf = buf
+		}
+		if _, ok := lastData.AppParams[aidx].GlobalState[key]; ok {
+			apps = append(apps, aidx)
+			if len(apps) >= limit {
+				break
+			}
+		}
+	}
+	return apps, rows.Err()
+}
+
+// CreatableMismatch describes a creatable on which the assetcreators table and the account data of the creators
+// disagree.
+type CreatableMismatch struct {
+	Index   basics.CreatableIndex
+	Type    basics.CreatableType
+	Creator basics.Address
+
+	// MissingParams is set when the assetcreators table lists the creatable, but its creator has no params for it.
+	// Otherwise, the creator has params for the creatable which aren't listed in the assetcreators table.
+	MissingParams bool
+}
+
+// reconcileCreatables verifies that every creatable listed in the assetcreators table is backed by asset or application
+// params in the account data of its creator, and that every such params is listed in the table. The mismatches are
+// returned sorted by type and index. The whole assetcreators table is loaded into memory and every account is decoded,
+// so this is meant for offline integrity checks.
+func reconcileCreatables(tx *sql.Tx) ([]CreatableMismatch, error) {
+	type creatableKey struct {
+		cidx  basics.CreatableIndex
+		ctype basics.CreatableType
+	}
+	listed := make(map[creatableKey]basics.Address)
+	err := creatablesIterate(tx, func(cidx basics.CreatableIndex, mc ledgercore.ModifiedCreatable) error {
+		listed[creatableKey{cidx, mc.Ctype}] = mc.Creator
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []CreatableMismatch
+	check := func(addr basics.Address, cidx basics.CreatableIndex, ctype basics.CreatableType) {
+		key := creatableKey{cidx, ctype}
+		if creator, ok := listed[key]; ok && creator == addr {
+			delete(listed, key)
+			return
+		}
+		mismatches = append(mismatches, CreatableMismatch{Index: cidx, Type: ctype, Creator: addr})
+	}
+
+	rows, err := tx.Query("SELECT address, data FROM accountbase")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var addrbuf, buf []byte
+		err = rows.Scan(&addrbuf, &buf)
+		if err != nil {
+			return nil, err
+		}
+		var addr basics.Address
+		if len(addrbuf) != len(addr) {
+			return nil, fmt.Errorf("account DB address length mismatch: %d != %d", len(addrbuf), len(addr))
+		}
+		copy(addr[:], addrbuf)
+		var ad basics.AccountData
+		err = protocol.Decode(buf, &ad)
+		if err != nil {
+			return nil, err
+		}
+		for aidx := range ad.AssetParams {
+			check(addr, basics.CreatableIndex(aidx), basics.AssetCreatable)
+		}
+		for aidx := range ad.AppParams {
+			check(addr, basics.CreatableIndex(aidx), basics.AppCreatable)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for key, creator := range listed {
+		mismatches = append(mismatches, CreatableMismatch{Index: key.cidx, Type: key.ctype, Creator: creator, MissingParams: true})
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		if mismatches[i].Type != mismatches[j].Type {
+			return mismatches[i].Type < mismatches[j].Type
+		}
+		if mismatches[i].Index != mismatches[j].Index {
+			return mismatches[i].Index < mismatches[j].Index
+		}
+		return mismatches[i].MissingParams && !mismatches[j].MissingParams
+	})
+	return mismatches, nil
+}
+
+// validateAccountLocalSchemas verifies that every application local state of the account stored at the given rowid
+// holds no more integer and byte slice entries than its local schema permits. Accounts that don't exist are considered valid.
+func validateAccountLocalSchemas(qs *accountsDbQueries, rowid int64) error {
+	buf, _, err := qs.lookupEncodedByRowID(rowid)
+	if err != nil {
+		return err
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+
+	var data basics.AccountData
+	err = protocol.Decode(buf, &data)
+	if err != nil {
+		return err
+	}
+	for aidx, localState := range data.AppLocalStates {
+		var counts basics.StateSchema
+		for _, value := range localState.KeyValue {
+			switch value.Type {
+			case basics.TealUintType:
+				counts.NumUint++
+			case basics.TealBytesType:
+				counts.NumByteSlice++
+			default:
+				return fmt.Errorf("app %d local state holds a value of unknown type %v", aidx, value.Type)
+			}
+		}
+		if counts.NumUint > localState.Schema.NumUint {
+			return fmt.Errorf("app %d local state holds %d integers, exceeding its schema of %d", aidx, counts.NumUint, localState.Schema.NumUint)
+		}
+		if counts.NumByteSlice > localState.Schema.NumByteSlice {
+			return fmt.Errorf("app %d local state holds %d byte slices, exceeding its schema of %d", aidx, counts.NumByteSlice, localState.Schema.NumByteSlice)
+		}
+	}
+	return nil
+}
+
+// sumHoldingAmounts totals the given assets amounts, reporting whether the sum overflowed.
+func sumHoldingAmounts(amounts map[basics.AssetIndex]uint64) (total uint64, overflowed bool) {
+	for _, amount := range amounts {
+		total, overflowed = basics.OAdd(total, amount)
+		if overflowed {
+			return 0, true
+		}
+	}
+	return total, false
+}
+
+func (qs *accountsDbQueries) storeCatchpoint(ctx context.Context, round basics.Round, fileName string, catchpoint string, fileSize int64) (err error) {
+	err = db.Retry(func() (err error) {
+		_, err = qs.deleteStoredCatchpoint.ExecContext(ctx, round)
+
+		if err != nil || (fileName == "" && catchpoint == "" && fileSize == 0) {
+			return
+		}
+
+		_, err = qs.insertStoredCatchpoint.ExecContext(ctx, round, fileName, catchpoint, fileSize)
+		return
+	})
+	return
+}
+
+func (qs *accountsDbQueries) getOldestCatchpointFiles(ctx context.Context, fileCount int, filesToKeep int) (fileNames map[basics.Round]string, err error) {
+	err = db.Retry(func() (err error) {
+		var rows *sql.Rows
 		rows, err = qs.selectOldestCatchpointFiles.QueryContext(ctx, filesToKeep, fileCount)
 		if err != nil {
 			return
@@ -982,6 +2590,8 @@ func (qs *accountsDbQueries) close() {
 	preparedQueries := []**sql.Stmt{
 		&qs.listCreatablesStmt,
 		&qs.lookupStmt,
+		&qs.lookupByRowIDStmt,
+		&qs.lookupStatusStmt,
 		&qs.lookupCreatorStmt,
 		&qs.deleteStoredCatchpoint,
 		&qs.insertStoredCatchpoint,
@@ -991,15 +2601,166 @@ func (qs *accountsDbQueries) close() {
 		&qs.insertCatchpointStateUint64,
 		&qs.selectCatchpointStateString,
 		&qs.insertCatchpointStateString,
+		&qs.lookupAssetHoldersStmt,
+		&qs.lookupAppCountStmt,
 	}
 	for _, preparedQuery := range preparedQueries {
 		if (*preparedQuery) != nil {
-			(*preparedQuery).Close()
+			if !qs.cached {
+				(*preparedQuery).Close()
+			}
 			*preparedQuery = nil
 		}
 	}
 }
 
+// connQueryable adapts a dedicated database connection to the db.Queryable interface.
+type connQueryable struct {
+	conn *sql.Conn
+}
+
+func (c connQueryable) Prepare(query string) (*sql.Stmt, error) {
+	return c.conn.PrepareContext(context.Background(), query)
+}
+
+func (c connQueryable) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.conn.QueryContext(context.Background(), query, args...)
+}
+
+func (c connQueryable) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.conn.QueryRowContext(context.Background(), query, args...)
+}
+
+// accountsDbQueriesPool is a pool of prepared statements sets, each bound to its own read connection, allowing
+// multiple goroutines to issue lookups concurrently. A set is obtained using acquire and must be returned using release.
+type accountsDbQueriesPool struct {
+	available chan *accountsDbQueries
+	conns     []*sql.Conn
+	queries   []*accountsDbQueries
+}
+
+// accountsDbInitPool creates a pool of size prepared statements sets over the given read database handle.
+func accountsDbInitPool(rdb *sql.DB, size int) (*accountsDbQueriesPool, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("accountsDbInitPool: invalid pool size %d", size)
+	}
+	pool := &accountsDbQueriesPool{
+		available: make(chan *accountsDbQueries, size),
+		conns:     make([]*sql.Conn, 0, size),
+		queries:   make([]*accountsDbQueries, 0, size),
+	}
+	for i := 0; i < size; i++ {
+		conn, err := rdb.Conn(context.Background())
+		if err != nil {
+			pool.close()
+			return nil, err
+		}
+		pool.conns = append(pool.conns, conn)
+		qs, err := accountsDbInit(connQueryable{conn}, connQueryable{conn})
+		if err != nil {
+			pool.close()
+			return nil, err
+		}
+		pool.queries = append(pool.queries, qs)
+		pool.available <- qs
+	}
+	return pool, nil
+}
+
+// acquire returns a prepared statements set for the exclusive use of the caller, waiting for one to be released if none is available.
+func (p *accountsDbQueriesPool) acquire() *accountsDbQueries {
+	return <-p.available
+}
+
+// release returns a prepared statements set obtained using acquire back to the pool.
+func (p *accountsDbQueriesPool) release(qs *accountsDbQueries) {
+	p.available <- qs
+}
+
+// close releases the prepared statements and the connections held by the pool. It must not be called while any of
+// the statements sets is acquired.
+func (p *accountsDbQueriesPool) close() {
+	for _, qs := range p.queries {
+		qs.close()
+	}
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.queries = nil
+	p.conns = nil
+}
+
+// accountsSnapshot is a read-only view of the accounts database. All the queries issued through it are
+// executed within a single deferred read transaction, and therefore observe the same database round,
+// regardless of any writes performed concurrently.
+type accountsSnapshot struct {
+	*accountsDbQueries
+
+	// tx is the read transaction holding the snapshot.
+	tx *sql.Tx
+
+	// round is the accounts round the snapshot was taken at.
+	round basics.Round
+}
+
+// accountsDbSnapshot begins a deferred read transaction on the given accessor and prepares the lookup statements
+// against it. The snapshot is pinned by reading the accounts round, and remains pinned until close is called.
+func accountsDbSnapshot(rdb db.Accessor) (*accountsSnapshot, error) {
+	tx, err := rdb.Handle.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &accountsSnapshot{tx: tx}
+	// with a deferred transaction, SQLite would establish the snapshot only on the first read, so we need to
+	// perform one here rather than on the first lookup.
+	err = tx.QueryRow("SELECT rnd FROM acctrounds WHERE id='acctbase'").Scan(&snapshot.round)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	snapshot.accountsDbQueries, err = accountsDbInit(tx, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// close releases the prepared statements and the underlying read transaction.
+// calling close more than once is allowed.
+func (s *accountsSnapshot) close() {
+	if s.accountsDbQueries != nil {
+		s.accountsDbQueries.close()
+	}
+	if s.tx != nil {
+		s.tx.Rollback()
+		s.tx = nil
+	}
+}
+
+// normalizedBalanceMismatchError is reported when the normalized online balance stored for an account doesn't match the
+// one computed from its account data.
+type normalizedBalanceMismatchError struct {
+	addr     basics.Address
+	stored   uint64
+	computed uint64
+}
+
+// Error satisfies builtin interface `error`
+func (e *normalizedBalanceMismatchError) Error() string {
+	return fmt.Sprintf("account %v stored normalized online balance %d mismatches the computed one %d", e.addr, e.stored, e.computed)
+}
+
+// normalizedBalanceVerifier verifies the normalized online balances read by accountsOnlineTop.
+type normalizedBalanceVerifier struct {
+	// proto is the consensus protocol the stored normalized balances were computed with, i.e. the genesis one.
+	proto config.ConsensusParams
+	// mismatch is called with every account whose stored normalized balance mismatches the computed one.
+	mismatch func(*normalizedBalanceMismatchError)
+}
+
 // accountsOnlineTop returns the top n online accounts starting at position offset
 // (that is, the top offset'th account through the top offset+n-1'th account).
 //
@@ -1009,8 +2770,12 @@ func (qs *accountsDbQueries) close() {
 //
 // Note that this does not check if the accounts have a vote key valid for any
 // particular round (past, present, or future).
-func accountsOnlineTop(tx *sql.Tx, offset, n uint64, proto config.ConsensusParams) (map[basics.Address]*onlineAccount, error) {
-	rows, err := tx.Query("SELECT address, data FROM accountbase WHERE normalizedonlinebalance>0 ORDER BY normalizedonlinebalance DESC, address DESC LIMIT ? OFFSET ?", n, offset)
+//
+// When verifier is provided, the normalized balance of every account is recomputed from
+// its account data and compared against the stored one; a mismatch is reported to the
+// verifier, and doesn't fail the read.
+func accountsOnlineTop(tx *sql.Tx, offset, n uint64, proto config.ConsensusParams, verifier *normalizedBalanceVerifier) (map[basics.Address]*onlineAccount, error) {
+	rows, err := tx.Query("SELECT address, data, normalizedonlinebalance FROM accountbase WHERE normalizedonlinebalance>0 ORDER BY normalizedonlinebalance DESC, address DESC LIMIT ? OFFSET ?", n, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -1020,7 +2785,8 @@ func accountsOnlineTop(tx *sql.Tx, offset, n uint64, proto config.ConsensusParam
 	for rows.Next() {
 		var addrbuf []byte
 		var buf []byte
-		err = rows.Scan(&addrbuf, &buf)
+		var normBal uint64
+		err = rows.Scan(&addrbuf, &buf, &normBal)
 		if err != nil {
 			return nil, err
 		}
@@ -1030,18 +2796,146 @@ func accountsOnlineTop(tx *sql.Tx, offset, n uint64, proto config.ConsensusParam
 		if err != nil {
 			return nil, err
 		}
-
-		var addr basics.Address
-		if len(addrbuf) != len(addr) {
-			err = fmt.Errorf("Account DB address length mismatch: %d != %d", len(addrbuf), len(addr))
-			return nil, err
+
+		var addr basics.Address
+		if len(addrbuf) != len(addr) {
+			err = fmt.Errorf("Account DB address length mismatch: %d != %d", len(addrbuf), len(addr))
+			return nil, err
+		}
+
+		copy(addr[:], addrbuf)
+		if verifier != nil {
+			computed := data.NormalizedOnlineBalance(verifier.proto)
+			if computed != normBal {
+				verifier.mismatch(&normalizedBalanceMismatchError{addr: addr, stored: normBal, computed: computed})
+			}
+		}
+		res[addr] = accountDataToOnline(addr, &data, proto)
+	}
+
+	return res, rows.Err()
+}
+
+// accountBalance is a single entry returned by accountsTopByBalance
+type accountBalance struct {
+	Addr    basics.Address
+	Balance basics.MicroAlgos
+}
+
+// accountsTopByBalance returns the top n accounts by their raw microalgos balance starting at position offset.
+// Unlike accountsOnlineTop, all the accounts are considered regardless of their participation status, and the
+// rewards pending on the accounts aren't taken into account. Accounts holding the same balance are ordered by address.
+func accountsTopByBalance(tx *sql.Tx, n int, offset int) ([]accountBalance, error) {
+	rows, err := tx.Query("SELECT address, microalgos FROM accountbase ORDER BY microalgos DESC, address ASC LIMIT ? OFFSET ?", n, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]accountBalance, 0, n)
+	for rows.Next() {
+		var addrbuf []byte
+		var entry accountBalance
+		err = rows.Scan(&addrbuf, &entry.Balance.Raw)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(addrbuf) != len(entry.Addr) {
+			err = fmt.Errorf("Account DB address length mismatch: %d != %d", len(addrbuf), len(entry.Addr))
+			return nil, err
+		}
+		copy(entry.Addr[:], addrbuf)
+		res = append(res, entry)
+	}
+
+	return res, rows.Err()
+}
+
+// AccountSummary holds the balance, the status and the number of asset holdings and application local states of an
+// account, as listed by accountsListProjection.
+type AccountSummary struct {
+	Address    basics.Address
+	MicroAlgos basics.MicroAlgos
+	Status     basics.Status
+	AssetCount int
+	AppCount   int
+}
+
+// accountsListProjection returns the summaries of up to limit accounts whose address is greater than startAfter, in
+// ascending address order, so that the address of the last one could be used as the startAfter of the next page. A nil
+// startAfter lists the first page, starting with the lowest address. The account data is only partially decoded; see
+// decodeAccountSummary.
+func accountsListProjection(tx *sql.Tx, startAfter *basics.Address, limit int) ([]AccountSummary, error) {
+	var rows *sql.Rows
+	var err error
+	if startAfter == nil {
+		rows, err = tx.Query("SELECT address, data FROM accountbase ORDER BY address LIMIT ?", limit)
+	} else {
+		rows, err = tx.Query("SELECT address, data FROM accountbase WHERE address > ? ORDER BY address LIMIT ?", startAfter[:], limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []AccountSummary
+	for rows.Next() {
+		var addrbuf []byte
+		var buf []byte
+		err = rows.Scan(&addrbuf, &buf)
+		if err != nil {
+			return nil, err
+		}
+		summary, err := decodeAccountSummary(buf)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrbuf) != len(summary.Address) {
+			return nil, fmt.Errorf("Account DB address length mismatch: %d != %d", len(addrbuf), len(summary.Address))
+		}
+		copy(summary.Address[:], addrbuf)
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+// decodeAccountSummary extracts the summary of an account out of its encoded account data. The asset holdings and the
+// application local states are counted from their map headers, without decoding them.
+func decodeAccountSummary(encodedAccountData []byte) (summary AccountSummary, err error) {
+	fields, _, buf, err := msgp.ReadMapHeaderBytes(encodedAccountData)
+	if err != nil {
+		return AccountSummary{}, err
+	}
+	for ; fields > 0; fields-- {
+		var field []byte
+		field, buf, err = msgp.ReadMapKeyZC(buf)
+		if err != nil {
+			return AccountSummary{}, err
+		}
+		switch string(field) {
+		case "onl":
+			buf, err = summary.Status.UnmarshalMsg(buf)
+		case "algo":
+			buf, err = summary.MicroAlgos.UnmarshalMsg(buf)
+		case "asset":
+			summary.AssetCount, _, _, err = msgp.ReadMapHeaderBytes(buf)
+			if err == nil {
+				buf, err = msgp.Skip(buf)
+			}
+		case "appl":
+			summary.AppCount, _, _, err = msgp.ReadMapHeaderBytes(buf)
+			if err == nil {
+				buf, err = msgp.Skip(buf)
+			}
+		default:
+			buf, err = msgp.Skip(buf)
+		}
+		if err != nil {
+			return AccountSummary{}, err
 		}
-
-		copy(addr[:], addrbuf)
-		res[addr] = accountDataToOnline(addr, &data, proto)
 	}
-
-	return res, rows.Err()
+	return summary, nil
 }
 
 func accountsTotals(tx *sql.Tx, catchpointStaging bool) (totals ledgercore.AccountTotals, err error) {
@@ -1063,7 +2957,10 @@ func accountsPutTotals(tx *sql.Tx, totals ledgercore.AccountTotals, catchpointSt
 	if catchpointStaging {
 		id = "catchpointStaging"
 	}
-	_, err := tx.Exec("REPLACE INTO accounttotals (id, online, onlinerewardunits, offline, offlinerewardunits, notparticipating, notparticipatingrewardunits, rewardslevel) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+	// the account count is maintained separately by accountsNewRound, and therefore is left untouched here.
+	_, err := tx.Exec("INSERT INTO accounttotals (id, online, onlinerewardunits, offline, offlinerewardunits, notparticipating, notparticipatingrewardunits, rewardslevel) VALUES (?, ?, ?, ?, ?, ?, ?, ?) "+
+		"ON CONFLICT(id) DO UPDATE SET online=excluded.online, onlinerewardunits=excluded.onlinerewardunits, offline=excluded.offline, offlinerewardunits=excluded.offlinerewardunits, "+
+		"notparticipating=excluded.notparticipating, notparticipatingrewardunits=excluded.notparticipatingrewardunits, rewardslevel=excluded.rewardslevel",
 		id,
 		totals.Online.Money.Raw, totals.Online.RewardUnits,
 		totals.Offline.Money.Raw, totals.Offline.RewardUnits,
@@ -1072,6 +2969,13 @@ func accountsPutTotals(tx *sql.Tx, totals ledgercore.AccountTotals, catchpointSt
 	return err
 }
 
+// accountsCount returns the number of accounts in the accountbase table, as maintained in the accounttotals table.
+// Unlike totalAccounts, it doesn't need to scan the accountbase table.
+func accountsCount(tx *sql.Tx) (count uint64, err error) {
+	err = tx.QueryRow("SELECT accountcount FROM accounttotals WHERE id=''").Scan(&count)
+	return
+}
+
 // accountsNewRound updates the accountbase and assetcreators tables by applying the provided deltas to the accounts / creatables.
 // The function returns a persistedAccountData for the modified accounts which can be stored in the base cache.
 func accountsNewRound(tx *sql.Tx, updates compactAccountDeltas, creatables map[basics.CreatableIndex]ledgercore.ModifiedCreatable, proto config.ConsensusParams, lastUpdateRound basics.Round) (updatedAccounts []persistedAccountData, err error) {
@@ -1084,19 +2988,20 @@ func accountsNewRound(tx *sql.Tx, updates compactAccountDeltas, creatables map[b
 	}
 	defer deleteByRowIDStmt.Close()
 
-	insertStmt, err = tx.Prepare("INSERT INTO accountbase (address, normalizedonlinebalance, data) VALUES (?, ?, ?)")
+	insertStmt, err = tx.Prepare("INSERT INTO accountbase (address, normalizedonlinebalance, status, microalgos, data) VALUES (?, ?, ?, ?, ?)")
 	if err != nil {
 		return
 	}
 	defer insertStmt.Close()
 
-	updateStmt, err = tx.Prepare("UPDATE accountbase SET normalizedonlinebalance = ?, data = ? WHERE rowid = ?")
+	updateStmt, err = tx.Prepare("UPDATE accountbase SET normalizedonlinebalance = ?, status = ?, microalgos = ?, data = ? WHERE rowid = ?")
 	if err != nil {
 		return
 	}
 	defer updateStmt.Close()
 	var result sql.Result
 	var rowsAffected int64
+	var accountCountDelta int64
 	updatedAccounts = make([]persistedAccountData, updates.len())
 	updatedAccountIdx := 0
 	for i := 0; i < updates.len(); i++ {
@@ -1108,10 +3013,11 @@ func accountsNewRound(tx *sql.Tx, updates compactAccountDeltas, creatables map[b
 			} else {
 				// create a new entry.
 				normBalance := data.new.NormalizedOnlineBalance(proto)
-				result, err = insertStmt.Exec(addr[:], normBalance, protocol.Encode(&data.new))
+				result, err = insertStmt.Exec(addr[:], normBalance, data.new.Status, data.new.MicroAlgos.Raw, protocol.Encode(&data.new))
 				if err == nil {
 					updatedAccounts[updatedAccountIdx].rowid, err = result.LastInsertId()
 					updatedAccounts[updatedAccountIdx].accountData = data.new
+					accountCountDelta++
 				}
 			}
 		} else {
@@ -1127,10 +3033,11 @@ func accountsNewRound(tx *sql.Tx, updates compactAccountDeltas, creatables map[b
 					if rowsAffected != 1 {
 						err = fmt.Errorf("failed to delete accountbase row for account %v, rowid %d", addr, data.old.rowid)
 					}
+					accountCountDelta--
 				}
 			} else {
 				normBalance := data.new.NormalizedOnlineBalance(proto)
-				result, err = updateStmt.Exec(normBalance, protocol.Encode(&data.new), data.old.rowid)
+				result, err = updateStmt.Exec(normBalance, data.new.Status, data.new.MicroAlgos.Raw, protocol.Encode(&data.new), data.old.rowid)
 				if err == nil {
 					// rowid doesn't change on update.
 					updatedAccounts[updatedAccountIdx].rowid = data.old.rowid
@@ -1153,6 +3060,46 @@ func accountsNewRound(tx *sql.Tx, updates compactAccountDeltas, creatables map[b
 		updatedAccountIdx++
 	}
 
+	if accountCountDelta != 0 {
+		_, err = tx.Exec("UPDATE accounttotals SET accountcount = accountcount + ? WHERE id=''", accountCountDelta)
+		if err != nil {
+			return
+		}
+	}
+
+	assetHoldersExists, err := tableExists(tx, "assetholders")
+	if err != nil {
+		return
+	}
+	if assetHoldersExists {
+		holders := make(map[basics.AssetIndex]int64)
+		for i := 0; i < updates.len(); i++ {
+			_, data := updates.getByIdx(i)
+			created, deleted, _ := ledgercore.DiffHoldings(data.old.accountData, data.new)
+			for _, aidx := range created {
+				holders[aidx]++
+			}
+			for _, aidx := range deleted {
+				holders[aidx]--
+			}
+		}
+		err = accountsUpdateAssetHolders(tx, holders)
+		if err != nil {
+			return
+		}
+	}
+
+	stateChecksumExists, err := tableExists(tx, "statechecksum")
+	if err != nil {
+		return
+	}
+	if stateChecksumExists {
+		err = accountsUpdateStateChecksum(tx, updates)
+		if err != nil {
+			return
+		}
+	}
+
 	if len(creatables) > 0 {
 		insertCreatableIdxStmt, err = tx.Prepare("INSERT INTO assetcreators (asset, creator, ctype) VALUES (?, ?, ?)")
 		if err != nil {
@@ -1166,6 +3113,7 @@ func accountsNewRound(tx *sql.Tx, updates compactAccountDeltas, creatables map[b
 		}
 		defer deleteCreatableIdxStmt.Close()
 
+		appCounts := make(map[basics.Address]int64)
 		for cidx, cdelta := range creatables {
 			if cdelta.Created {
 				_, err = insertCreatableIdxStmt.Exec(cidx, cdelta.Creator[:], cdelta.Ctype)
@@ -1175,12 +3123,142 @@ func accountsNewRound(tx *sql.Tx, updates compactAccountDeltas, creatables map[b
 			if err != nil {
 				return
 			}
+			if cdelta.Ctype == basics.AppCreatable {
+				if cdelta.Created {
+					appCounts[cdelta.Creator]++
+				} else {
+					appCounts[cdelta.Creator]--
+				}
+			}
+		}
+		err = accountsUpdateAppCounts(tx, appCounts)
+		if err != nil {
+			return
 		}
 	}
 
 	return
 }
 
+// firstFreeCreatableIndex returns the lowest creatable index which is greater or equal to startFrom, and isn't
+// present in the assetcreators table.
+func firstFreeCreatableIndex(tx *sql.Tx, startFrom basics.CreatableIndex) (basics.CreatableIndex, error) {
+	rows, err := tx.Query("SELECT asset FROM assetcreators WHERE asset >= ? ORDER BY asset", startFrom)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	candidate := startFrom
+	for rows.Next() {
+		var cidx basics.CreatableIndex
+		err = rows.Scan(&cidx)
+		if err != nil {
+			return 0, err
+		}
+		if cidx != candidate {
+			// found a gap
+			break
+		}
+		candidate++
+	}
+	return candidate, rows.Err()
+}
+
+// creatablesIterate walks over all the creatables in the assetcreators table in ascending index order, invoking
+// fn for each one of them. The iteration stops on the first error returned by fn, and that error is returned.
+func creatablesIterate(tx *sql.Tx, fn func(basics.CreatableIndex, ledgercore.ModifiedCreatable) error) error {
+	rows, err := tx.Query("SELECT asset, creator, ctype FROM assetcreators ORDER BY asset")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cidx basics.CreatableIndex
+		var buf []byte
+		mc := ledgercore.ModifiedCreatable{Created: true}
+		err = rows.Scan(&cidx, &buf, &mc.Ctype)
+		if err != nil {
+			return err
+		}
+		copy(mc.Creator[:], buf)
+		err = fn(cidx, mc)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ExportCreatables writes all the creatables in the assetcreators table to the given writer, in ascending index order.
+// Every creatable is written as its uvarint-encoded index and type, followed by the creator's address. The number of
+// creatables written is returned.
+func ExportCreatables(tx *sql.Tx, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	var buf [2*binary.MaxVarintLen64 + len(basics.Address{})]byte
+	count := 0
+	err := creatablesIterate(tx, func(cidx basics.CreatableIndex, mc ledgercore.ModifiedCreatable) error {
+		n := binary.PutUvarint(buf[:], uint64(cidx))
+		n += binary.PutUvarint(buf[n:], uint64(mc.Ctype))
+		n += copy(buf[n:], mc.Creator[:])
+		_, err := bw.Write(buf[:n])
+		if err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, bw.Flush()
+}
+
+// ImportCreatables loads the creatables written by ExportCreatables into the assetcreators table, which is expected
+// not to contain any of them already. The number of creatables loaded is returned.
+func ImportCreatables(tx *sql.Tx, r io.Reader) (int, error) {
+	insertStmt, err := tx.Prepare("INSERT INTO assetcreators (asset, creator, ctype) VALUES (?, ?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer insertStmt.Close()
+
+	br := bufio.NewReader(r)
+	count := 0
+	for {
+		cidx, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		ctype, err := binary.ReadUvarint(br)
+		if err != nil {
+			return count, fmt.Errorf("ImportCreatables: unable to read type of creatable %d: %w", cidx, noEOF(err))
+		}
+		var creator basics.Address
+		_, err = io.ReadFull(br, creator[:])
+		if err != nil {
+			return count, fmt.Errorf("ImportCreatables: unable to read creator of creatable %d: %w", cidx, noEOF(err))
+		}
+		_, err = insertStmt.Exec(basics.CreatableIndex(cidx), creator[:], basics.CreatableType(ctype))
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// noEOF converts an io.EOF encountered in the middle of a record into an io.ErrUnexpectedEOF
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 // totalsNewRounds updates the accountsTotals by applying series of round changes
 func totalsNewRounds(tx *sql.Tx, updates []ledgercore.AccountDeltas, compactUpdates compactAccountDeltas, accountTotals []ledgercore.AccountTotals, proto config.ConsensusParams) (err error) {
 	var ot basics.OverflowTracker
@@ -1283,55 +3361,175 @@ func totalAccounts(ctx context.Context, tx *sql.Tx) (total uint64, err error) {
 	return
 }
 
+// maxReportedAccountDiffs is the maximal number of differences reported by DiffAccountDBs
+const maxReportedAccountDiffs = 1000
+
+// AccountDiff describes an account whose state differs between two accounts databases. The fingerprints are
+// the hashes of the account encoded data in each of the databases; a zero fingerprint means that the account
+// is missing from that database.
+type AccountDiff struct {
+	Address      basics.Address
+	FingerprintA crypto.Digest
+	FingerprintB crypto.Digest
+}
+
+// accountFingerprintIter iterates over the accounts in the accountbase table in address order,
+// fingerprinting each account's encoded data.
+type accountFingerprintIter struct {
+	rows        *sql.Rows
+	valid       bool
+	addr        basics.Address
+	fingerprint crypto.Digest
+}
+
+func makeAccountFingerprintIter(tx *sql.Tx) (*accountFingerprintIter, error) {
+	rows, err := tx.Query("SELECT address, data FROM accountbase ORDER BY address")
+	if err != nil {
+		return nil, err
+	}
+	it := &accountFingerprintIter{rows: rows}
+	return it, it.next()
+}
+
+// next advances the iterator; once the accounts are exhausted, valid is set to false.
+func (it *accountFingerprintIter) next() error {
+	it.valid = it.rows.Next()
+	if !it.valid {
+		return it.rows.Err()
+	}
+	var addrbuf []byte
+	var buf []byte
+	err := it.rows.Scan(&addrbuf, &buf)
+	if err != nil {
+		return err
+	}
+	if len(addrbuf) != len(it.addr) {
+		return fmt.Errorf("Account DB address length mismatch: %d != %d", len(addrbuf), len(it.addr))
+	}
+	copy(it.addr[:], addrbuf)
+	it.fingerprint = crypto.Hash(buf)
+	return nil
+}
+
+// DiffAccountDBs compares the accounts of two accounts databases, which are expected to be at the same round. Both
+// databases are streamed in address order, and accounts that exist only in one of them, or that have a different
+// encoded data, are reported. At most maxReportedAccountDiffs differences are returned.
+func DiffAccountDBs(a, b *sql.Tx) (diffs []AccountDiff, err error) {
+	itA, err := makeAccountFingerprintIter(a)
+	if err != nil {
+		return nil, err
+	}
+	defer itA.rows.Close()
+	itB, err := makeAccountFingerprintIter(b)
+	if err != nil {
+		return nil, err
+	}
+	defer itB.rows.Close()
+
+	for (itA.valid || itB.valid) && len(diffs) < maxReportedAccountDiffs {
+		cmp := 0
+		switch {
+		case !itB.valid:
+			cmp = -1
+		case !itA.valid:
+			cmp = 1
+		default:
+			cmp = bytes.Compare(itA.addr[:], itB.addr[:])
+		}
+
+		switch {
+		case cmp < 0:
+			diffs = append(diffs, AccountDiff{Address: itA.addr, FingerprintA: itA.fingerprint})
+			err = itA.next()
+		case cmp > 0:
+			diffs = append(diffs, AccountDiff{Address: itB.addr, FingerprintB: itB.fingerprint})
+			err = itB.next()
+		default:
+			if itA.fingerprint != itB.fingerprint {
+				diffs = append(diffs, AccountDiff{Address: itA.addr, FingerprintA: itA.fingerprint, FingerprintB: itB.fingerprint})
+			}
+			err = itA.next()
+			if err == nil {
+				err = itB.next()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return diffs, nil
+}
+
+// reencodeAccountsChunkSize is the number of accounts reencodeAccounts processes between transaction warning deadline updates.
+const reencodeAccountsChunkSize = 1000
+
 // reencodeAccounts reads all the accounts in the accountbase table, decode and reencode the account data.
 // if the account data is found to have a different encoding, it would update the encoded account on disk.
 // on return, it returns the number of modified accounts as well as an error ( if we had any )
 func reencodeAccounts(ctx context.Context, tx *sql.Tx) (modifiedAccounts uint, err error) {
-	modifiedAccounts = 0
-	scannedAccounts := 0
+	var cursor int64
+	for {
+		chunkModifiedAccounts, lastRowid, done, err := reencodeAccountsChunk(ctx, tx, cursor, reencodeAccountsChunkSize)
+		if err != nil {
+			return 0, err
+		}
+		modifiedAccounts += chunkModifiedAccounts
+		if done {
+			return modifiedAccounts, nil
+		}
+		cursor = lastRowid
+	}
+}
+
+// reencodeAccountsChunk reencodes up to chunkSize accounts whose rowid is greater than startAfter, and returns the
+// rowid of the last account it processed. The chunks are all processed within the caller's transaction, so a
+// re-encoding that was interrupted restarts from the first account. done is set once all the accounts were processed.
+func reencodeAccountsChunk(ctx context.Context, tx *sql.Tx, startAfter int64, chunkSize int) (modifiedAccounts uint, lastRowid int64, done bool, err error) {
+	lastRowid = startAfter
 
-	updateStmt, err := tx.PrepareContext(ctx, "UPDATE accountbase SET data = ? WHERE address = ?")
+	// as long as each chunk takes less than one second, we should be good to go.
+	// note that we should be quite liberal on timing here, since it might perform much slower
+	// on low-power devices.
+	// The return value from ResetTransactionWarnDeadline can be safely ignored here since it would only default to writing the warning
+	// message, which would let us know that it failed anyway.
+	db.ResetTransactionWarnDeadline(ctx, tx, time.Now().Add(time.Second))
+
+	updateStmt, err := tx.PrepareContext(ctx, "UPDATE accountbase SET data = ? WHERE rowid = ?")
 	if err != nil {
-		return 0, err
+		return 0, 0, false, err
 	}
+	defer updateStmt.Close()
 
-	rows, err := tx.QueryContext(ctx, "SELECT address, data FROM accountbase")
+	rows, err := tx.QueryContext(ctx, "SELECT rowid, address, data FROM accountbase WHERE rowid > ? ORDER BY rowid LIMIT ?", startAfter, chunkSize)
 	if err != nil {
-		return
+		return 0, 0, false, err
 	}
 	defer rows.Close()
 
+	scannedAccounts := 0
 	var addr basics.Address
 	for rows.Next() {
-		// once every 1000 accounts we scan through, update the warning deadline.
-		// as long as the last "chunk" takes less than one second, we should be good to go.
-		// note that we should be quite liberal on timing here, since it might perform much slower
-		// on low-power devices.
-		if scannedAccounts%1000 == 0 {
-			// The return value from ResetTransactionWarnDeadline can be safely ignored here since it would only default to writing the warning
-			// message, which would let us know that it failed anyway.
-			db.ResetTransactionWarnDeadline(ctx, tx, time.Now().Add(time.Second))
-		}
-
+		var rowid int64
 		var addrbuf []byte
 		var preencodedAccountData []byte
-		err = rows.Scan(&addrbuf, &preencodedAccountData)
+		err = rows.Scan(&rowid, &addrbuf, &preencodedAccountData)
 		if err != nil {
-			return
+			return 0, 0, false, err
 		}
 
 		if len(addrbuf) != len(addr) {
 			err = fmt.Errorf("Account DB address length mismatch: %d != %d", len(addrbuf), len(addr))
-			return
+			return 0, 0, false, err
 		}
 		copy(addr[:], addrbuf[:])
 		scannedAccounts++
+		lastRowid = rowid
 
 		// decode and re-encode:
 		var decodedAccountData basics.AccountData
 		err = protocol.Decode(preencodedAccountData, &decodedAccountData)
 		if err != nil {
-			return
+			return 0, 0, false, err
 		}
 		reencodedAccountData := protocol.Encode(&decodedAccountData)
 		if bytes.Compare(preencodedAccountData, reencodedAccountData) == 0 {
@@ -1340,23 +3538,127 @@ func reencodeAccounts(ctx context.Context, tx *sql.Tx) (modifiedAccounts uint, e
 		}
 
 		// we need to update the encoded data.
-		result, err := updateStmt.ExecContext(ctx, reencodedAccountData, addrbuf)
+		result, err := updateStmt.ExecContext(ctx, reencodedAccountData, rowid)
 		if err != nil {
-			return 0, err
+			return 0, 0, false, err
 		}
 		rowsUpdated, err := result.RowsAffected()
 		if err != nil {
-			return 0, err
+			return 0, 0, false, err
 		}
 		if rowsUpdated != 1 {
-			return 0, fmt.Errorf("failed to update account %v, number of rows updated was %d instead of 1", addr, rowsUpdated)
+			return 0, 0, false, fmt.Errorf("failed to update account %v, number of rows updated was %d instead of 1", addr, rowsUpdated)
 		}
 		modifiedAccounts++
 	}
-
 	err = rows.Err()
-	updateStmt.Close()
-	return
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	return modifiedAccounts, lastRowid, scannedAccounts < chunkSize, nil
+}
+
+// appLocalStatesForApp scans the accountbase table and calls fn with the local state of every account opted into the given
+// application. The scan is aborted when the context is canceled or when fn returns an error, which is then returned.
+func appLocalStatesForApp(ctx context.Context, tx *sql.Tx, aidx basics.AppIndex, fn func(basics.Address, basics.AppLocalState) error) error {
+	rows, err := tx.QueryContext(ctx, "SELECT address, data FROM accountbase")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var addr basics.Address
+	for rows.Next() {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		var addrbuf []byte
+		var buf []byte
+		err = rows.Scan(&addrbuf, &buf)
+		if err != nil {
+			return err
+		}
+		if len(addrbuf) != len(addr) {
+			return fmt.Errorf("Account DB address length mismatch: %d != %d", len(addrbuf), len(addr))
+		}
+		copy(addr[:], addrbuf)
+
+		var data basics.AccountData
+		err = protocol.Decode(buf, &data)
+		if err != nil {
+			return err
+		}
+		localState, ok := data.AppLocalStates[aidx]
+		if !ok {
+			continue
+		}
+		err = fn(addr, localState)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// appTotalLocalStorage returns the number of values stored in the local states of the given application, summed over
+// all the accounts opted into it, along with the number of these accounts. The accounts are streamed from the
+// accountbase table; see appLocalStatesForApp.
+func appTotalLocalStorage(ctx context.Context, tx *sql.Tx, aidx basics.AppIndex) (total basics.StateSchema, holders uint64, err error) {
+	err = appLocalStatesForApp(ctx, tx, aidx, func(addr basics.Address, localState basics.AppLocalState) error {
+		usage, err := localState.KeyValue.ToStateSchema()
+		if err != nil {
+			return fmt.Errorf("app %d local state of %v : %w", aidx, addr, err)
+		}
+		total = total.AddSchema(usage)
+		holders++
+		return nil
+	})
+	if err != nil {
+		return basics.StateSchema{}, 0, err
+	}
+	return total, holders, nil
+}
+
+// reencodeAccount reads the given account from the accountbase table, decode and reencode its account data. If the stored
+// account data is found to have a different encoding, the re-encoded account data is written back.
+// It returns whether the account was modified; a missing account is not considered an error. Note that the account
+// hash is derived from the encoded account data, so the caller is responsible for keeping the merkle trie in sync.
+func reencodeAccount(tx *sql.Tx, addr basics.Address) (modified bool, err error) {
+	var preencodedAccountData []byte
+	err = tx.QueryRow("SELECT data FROM accountbase WHERE address = ?", addr[:]).Scan(&preencodedAccountData)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// decode and re-encode:
+	var decodedAccountData basics.AccountData
+	err = protocol.Decode(preencodedAccountData, &decodedAccountData)
+	if err != nil {
+		return false, err
+	}
+	reencodedAccountData := protocol.Encode(&decodedAccountData)
+	if bytes.Compare(preencodedAccountData, reencodedAccountData) == 0 {
+		// these are identical, no need to store re-encoded account data
+		return false, nil
+	}
+
+	result, err := tx.Exec("UPDATE accountbase SET data = ? WHERE address = ?", reencodedAccountData, addr[:])
+	if err != nil {
+		return false, err
+	}
+	rowsUpdated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rowsUpdated != 1 {
+		return false, fmt.Errorf("failed to update account %v, number of rows updated was %d instead of 1", addr, rowsUpdated)
+	}
+	return true, nil
 }
 
 // MerkleCommitter todo
@@ -1507,15 +3809,18 @@ type orderedAccountsIter struct {
 	tx           *sql.Tx
 	accountCount int
 	insertStmt   *sql.Stmt
+	hashFactory  HashFactory
 }
 
 // makeOrderedAccountsIter creates an ordered account iterator. Note that due to implementation reasons,
-// only a single iterator can be active at a time.
-func makeOrderedAccountsIter(tx *sql.Tx, accountCount int) *orderedAccountsIter {
+// only a single iterator can be active at a time. The account hashes are calculated using the hash function
+// created by hashFactory; a nil hashFactory uses crypto.Hash.
+func makeOrderedAccountsIter(tx *sql.Tx, accountCount int, hashFactory HashFactory) *orderedAccountsIter {
 	return &orderedAccountsIter{
 		tx:           tx,
 		accountCount: accountCount,
 		step:         oaiStepStartup,
+		hashFactory:  hashFactory,
 	}
 }
 
@@ -1593,7 +3898,12 @@ func (iterator *orderedAccountsIter) Next(ctx context.Context) (acct []accountAd
 				iterator.Close(ctx)
 				return
 			}
-			hash := accountHashBuilder(addr, accountData, buf)
+			var hash []byte
+			hash, err = accountHashBuilderWithFactory(iterator.hashFactory, addr, accountData, buf)
+			if err != nil {
+				iterator.Close(ctx)
+				return
+			}
 			_, err = iterator.insertStmt.ExecContext(ctx, addrbuf, hash)
 			if err != nil {
 				iterator.Close(ctx)
@@ -1758,3 +4068,47 @@ func (iterator *catchpointPendingHashesIterator) Close() {
 func (pac *persistedAccountData) before(other *persistedAccountData) bool {
 	return pac.round < other.round
 }
+
+// validate verifies that the account data is within the limits of the given protocol : the number of asset holdings,
+// asset params, app params and app local states must not exceed the protocol maximums, and the local and global key/value
+// stores of every application must fit their declared schemas.
+func (pac *persistedAccountData) validate(proto config.ConsensusParams) error {
+	ad := &pac.accountData
+	if len(ad.Assets) > proto.MaxAssetsPerAccount {
+		return fmt.Errorf("account %v holds %d assets, exceeding the maximum of %d", pac.addr, len(ad.Assets), proto.MaxAssetsPerAccount)
+	}
+	if len(ad.AssetParams) > proto.MaxAssetsPerAccount {
+		return fmt.Errorf("account %v created %d assets, exceeding the maximum of %d", pac.addr, len(ad.AssetParams), proto.MaxAssetsPerAccount)
+	}
+	if len(ad.AppParams) > proto.MaxAppsCreated {
+		return fmt.Errorf("account %v created %d apps, exceeding the maximum of %d", pac.addr, len(ad.AppParams), proto.MaxAppsCreated)
+	}
+	if len(ad.AppLocalStates) > proto.MaxAppsOptedIn {
+		return fmt.Errorf("account %v opted in to %d apps, exceeding the maximum of %d", pac.addr, len(ad.AppLocalStates), proto.MaxAppsOptedIn)
+	}
+	for aidx, localState := range ad.AppLocalStates {
+		err := validateKeyValueSchema(localState.KeyValue, localState.Schema)
+		if err != nil {
+			return fmt.Errorf("account %v local state of app %d : %w", pac.addr, aidx, err)
+		}
+	}
+	for aidx, params := range ad.AppParams {
+		err := validateKeyValueSchema(params.GlobalState, params.GlobalStateSchema)
+		if err != nil {
+			return fmt.Errorf("account %v global state of app %d : %w", pac.addr, aidx, err)
+		}
+	}
+	return nil
+}
+
+// validateKeyValueSchema verifies that the given key/value store fits the given schema.
+func validateKeyValueSchema(kv basics.TealKeyValue, schema basics.StateSchema) error {
+	used, err := kv.ToStateSchema()
+	if err != nil {
+		return err
+	}
+	if used.NumUint > schema.NumUint || used.NumByteSlice > schema.NumByteSlice {
+		return fmt.Errorf("store of %d uints and %d byte slices exceeds the schema of %d uints and %d byte slices", used.NumUint, used.NumByteSlice, schema.NumUint, schema.NumByteSlice)
+	}
+	return nil
+}
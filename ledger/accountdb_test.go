@@ -21,14 +21,21 @@ import (
 	"context"
 	"database/sql"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
+	"reflect"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/algorand/go-deadlock"
+	"github.com/algorand/msgp/msgp"
 	"github.com/stretchr/testify/require"
 
 	"github.com/algorand/go-algorand/config"
@@ -115,7 +122,8 @@ func randomFullAccountData(rewardsLevel, lastCreatableID uint64) (basics.Account
 
 	if 1 == (crypto.RandUint64() % 3) {
 		data.AppLocalStates = make(map[basics.AppIndex]basics.AppLocalState)
-		appStatesCount := crypto.RandUint64()%20 + 1
+		// keep the number of opted-in apps within the protocol limit
+		appStatesCount := crypto.RandUint64()%uint64(config.Consensus[protocol.ConsensusCurrentVersion].MaxAppsOptedIn) + 1
 		for i := uint64(0); i < appStatesCount; i++ {
 			ap := basics.AppLocalState{
 				Schema: basics.StateSchema{
@@ -357,6 +365,11 @@ func checkAccounts(t *testing.T, tx *sql.Tx, rnd basics.Round, accts map[basics.
 		require.NoError(t, err)
 		require.Equal(t, d, data)
 
+		status, exists, err := aq.lookupStatus(addr)
+		require.NoError(t, err)
+		require.True(t, exists)
+		require.Equal(t, d.Status, status)
+
 		switch d.Status {
 		case basics.Online:
 			totalOnline += d.MicroAlgos.Raw
@@ -394,7 +407,7 @@ func checkAccounts(t *testing.T, tx *sql.Tx, rnd basics.Round, accts map[basics.
 	}
 
 	for i := 0; i < len(onlineAccounts); i++ {
-		dbtop, err := accountsOnlineTop(tx, 0, uint64(i), proto)
+		dbtop, err := accountsOnlineTop(tx, 0, uint64(i), proto, makeTestNormalizedBalanceVerifier(t, proto))
 		require.NoError(t, err)
 		require.Equal(t, i, len(dbtop))
 
@@ -422,11 +435,76 @@ func checkAccounts(t *testing.T, tx *sql.Tx, rnd basics.Round, accts map[basics.
 		}
 	}
 
-	top, err := accountsOnlineTop(tx, 0, uint64(len(onlineAccounts)+1), proto)
+	top, err := accountsOnlineTop(tx, 0, uint64(len(onlineAccounts)+1), proto, makeTestNormalizedBalanceVerifier(t, proto))
 	require.NoError(t, err)
 	require.Equal(t, len(top), len(onlineAccounts))
 }
 
+func TestAccountsOnlineTopVerify(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	accts := make(map[basics.Address]basics.AccountData)
+	var corrupted basics.Address
+	for i := 0; i < 10; i++ {
+		addr := randomAddress()
+		ad := randomAccountData(0)
+		ad.Status = basics.Online
+		accts[addr] = ad
+		corrupted = addr
+	}
+	_, err = accountsInit(tx, accts, proto)
+	a.NoError(err)
+	a.NoError(accountsAddNormalizedBalance(tx, proto))
+
+	var mismatches []*normalizedBalanceMismatchError
+	verifier := &normalizedBalanceVerifier{
+		proto: proto,
+		mismatch: func(err *normalizedBalanceMismatchError) {
+			mismatches = append(mismatches, err)
+		},
+	}
+	top, err := accountsOnlineTop(tx, 0, uint64(len(accts)), proto, verifier)
+	a.NoError(err)
+	a.Len(top, len(accts))
+	a.Empty(mismatches)
+
+	// a stale normalized balance goes unnoticed, unless verifying
+	stale := accts[corrupted].NormalizedOnlineBalance(proto) + 1
+	_, err = tx.Exec("UPDATE accountbase SET normalizedonlinebalance = ? WHERE address = ?", stale, corrupted[:])
+	a.NoError(err)
+	top, err = accountsOnlineTop(tx, 0, uint64(len(accts)), proto, nil)
+	a.NoError(err)
+	a.Len(top, len(accts))
+
+	// the mismatch is reported, without failing the read
+	top, err = accountsOnlineTop(tx, 0, uint64(len(accts)), proto, verifier)
+	a.NoError(err)
+	a.Len(top, len(accts))
+	a.Len(mismatches, 1)
+	a.Equal(corrupted, mismatches[0].addr)
+	a.Equal(stale, mismatches[0].stored)
+	a.Equal(stale-1, mismatches[0].computed)
+}
+
+// makeTestNormalizedBalanceVerifier creates a normalizedBalanceVerifier failing the test on any mismatch.
+func makeTestNormalizedBalanceVerifier(t *testing.T, proto config.ConsensusParams) *normalizedBalanceVerifier {
+	return &normalizedBalanceVerifier{
+		proto: proto,
+		mismatch: func(err *normalizedBalanceMismatchError) {
+			t.Error(err)
+		},
+	}
+}
+
 func TestAccountDBInit(t *testing.T) {
 	proto := config.Consensus[protocol.ConsensusCurrentVersion]
 
@@ -450,6 +528,115 @@ func TestAccountDBInit(t *testing.T) {
 	checkAccounts(t, tx, 0, accts)
 }
 
+func TestAccountDBSnapshot(t *testing.T) {
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	// snapshot isolation requires separate connections, so use an on-disk database.
+	dbs, fn := dbOpenTest(t, false)
+	setDbLogging(t, dbs)
+	defer cleanupTestDb(dbs, fn, false)
+
+	accts := randomAccounts(20, true)
+	err := dbs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+		_, err := accountsInit(tx, accts, proto)
+		return err
+	})
+	require.NoError(t, err)
+
+	var addr basics.Address
+	for addr = range accts {
+		break
+	}
+
+	snapshot, err := accountsDbSnapshot(dbs.Rdb)
+	require.NoError(t, err)
+	defer snapshot.close()
+	require.Equal(t, basics.Round(0), snapshot.round)
+
+	pad, err := snapshot.lookup(addr)
+	require.NoError(t, err)
+	require.Equal(t, accts[addr], pad.accountData)
+
+	updated := accts[addr]
+	updated.MicroAlgos.Raw++
+	err = dbs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE accountbase SET data=? WHERE address=?", protocol.Encode(&updated), addr[:])
+		if err != nil {
+			return err
+		}
+		return updateAccountsRound(tx, 1, 0)
+	})
+	require.NoError(t, err)
+
+	// the snapshot keeps observing the state it was created with.
+	pad, err = snapshot.lookup(addr)
+	require.NoError(t, err)
+	require.Equal(t, accts[addr], pad.accountData)
+	require.Equal(t, basics.Round(0), pad.round)
+
+	snapshot.close()
+	snapshot.close()
+
+	qs, err := accountsDbInit(dbs.Rdb.Handle, dbs.Wdb.Handle)
+	require.NoError(t, err)
+	defer qs.close()
+	pad, err = qs.lookup(addr)
+	require.NoError(t, err)
+	require.Equal(t, updated, pad.accountData)
+	require.Equal(t, basics.Round(1), pad.round)
+}
+
+func TestLookupWithRewards(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	addr := randomAddress()
+	ad := randomAccountData(0)
+	ad.Status = basics.Online
+	ad.MicroAlgos = basics.MicroAlgos{Raw: 1234567890}
+	ad.RewardsBase = 100
+	ad.RewardedMicroAlgos = basics.MicroAlgos{Raw: 17}
+
+	err := dbs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+		// the genesis totals are computed at rewards level zero, so store the rewards base afterward
+		_, err := accountsInit(tx, map[basics.Address]basics.AccountData{addr: {}}, proto)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE accountbase SET data=? WHERE address=?", protocol.Encode(&ad), addr[:])
+		return err
+	})
+	a.NoError(err)
+
+	qs, err := accountsDbInit(dbs.Rdb.Handle, dbs.Wdb.Handle)
+	a.NoError(err)
+	defer qs.close()
+
+	for _, rewardsLevel := range []uint64{100, 101, 5000} {
+		pad, err := qs.lookup(addr)
+		a.NoError(err)
+		expected := pad.accountData.WithUpdatedRewards(proto, rewardsLevel)
+
+		withRewards, err := qs.lookupWithRewards(addr, proto, rewardsLevel)
+		a.NoError(err)
+		a.Equal(expected, withRewards)
+		a.Equal(rewardsLevel, withRewards.RewardsBase)
+	}
+	// the rewards were actually applied
+	withRewards, err := qs.lookupWithRewards(addr, proto, 5000)
+	a.NoError(err)
+	a.Greater(withRewards.MicroAlgos.Raw, ad.MicroAlgos.Raw)
+
+	// missing accounts have no balance to be rewarded
+	withRewards, err = qs.lookupWithRewards(randomAddress(), proto, 5000)
+	a.NoError(err)
+	a.Zero(withRewards.MicroAlgos.Raw)
+}
+
 // creatablesFromUpdates calculates creatables from updates
 func creatablesFromUpdates(base map[basics.Address]basics.AccountData, updates ledgercore.AccountDeltas, seen map[basics.CreatableIndex]bool) map[basics.CreatableIndex]ledgercore.ModifiedCreatable {
 	creatables := make(map[basics.CreatableIndex]ledgercore.ModifiedCreatable)
@@ -565,6 +752,126 @@ func TestAccountDBRound(t *testing.T) {
 	}
 }
 
+func TestCreatablesIterate(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	_, err = accountsInit(tx, randomAccounts(20, true), proto)
+	a.NoError(err)
+
+	// insert the creatables in a shuffled order
+	expected := make(map[basics.CreatableIndex]ledgercore.ModifiedCreatable)
+	for _, i := range rand.Perm(50) {
+		cidx := basics.CreatableIndex(i*3 + 1)
+		mc := ledgercore.ModifiedCreatable{
+			Ctype:   basics.AssetCreatable,
+			Created: true,
+			Creator: randomAddress(),
+		}
+		if i%2 == 0 {
+			mc.Ctype = basics.AppCreatable
+		}
+		_, err = tx.Exec("INSERT INTO assetcreators (asset, creator, ctype) VALUES (?, ?, ?)", cidx, mc.Creator[:], mc.Ctype)
+		a.NoError(err)
+		expected[cidx] = mc
+	}
+
+	visited := make(map[basics.CreatableIndex]bool)
+	var last basics.CreatableIndex
+	err = creatablesIterate(tx, func(cidx basics.CreatableIndex, mc ledgercore.ModifiedCreatable) error {
+		a.False(visited[cidx])
+		a.Greater(uint64(cidx), uint64(last))
+		a.Equal(expected[cidx], mc)
+		visited[cidx] = true
+		last = cidx
+		return nil
+	})
+	a.NoError(err)
+	a.Equal(len(expected), len(visited))
+
+	// errors returned by the callback abort the iteration
+	stopErr := errors.New("stop")
+	count := 0
+	err = creatablesIterate(tx, func(cidx basics.CreatableIndex, mc ledgercore.ModifiedCreatable) error {
+		count++
+		return stopErr
+	})
+	a.Equal(stopErr, err)
+	a.Equal(1, count)
+}
+
+func TestExportImportCreatables(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	_, err = accountsInit(tx, randomAccounts(20, true), proto)
+	a.NoError(err)
+
+	expected := make(map[basics.CreatableIndex]ledgercore.ModifiedCreatable)
+	for i := 0; i < 100; i++ {
+		cidx := basics.CreatableIndex(crypto.RandUint64() % (1 << 40))
+		mc := ledgercore.ModifiedCreatable{Ctype: basics.CreatableType(i % 2), Created: true, Creator: randomAddress()}
+		if _, ok := expected[cidx]; ok {
+			continue
+		}
+		_, err = tx.Exec("INSERT INTO assetcreators (asset, creator, ctype) VALUES (?, ?, ?)", cidx, mc.Creator[:], mc.Ctype)
+		a.NoError(err)
+		expected[cidx] = mc
+	}
+
+	var buf bytes.Buffer
+	count, err := ExportCreatables(tx, &buf)
+	a.NoError(err)
+	a.Equal(len(expected), count)
+
+	// import into a fresh database
+	dbs2, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs2)
+	defer dbs2.Close()
+
+	tx2, err := dbs2.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx2.Rollback()
+
+	_, err = accountsInit(tx2, randomAccounts(20, true), proto)
+	a.NoError(err)
+
+	exported := buf.Bytes()
+	count, err = ImportCreatables(tx2, bytes.NewReader(exported))
+	a.NoError(err)
+	a.Equal(len(expected), count)
+
+	imported := make(map[basics.CreatableIndex]ledgercore.ModifiedCreatable)
+	err = creatablesIterate(tx2, func(cidx basics.CreatableIndex, mc ledgercore.ModifiedCreatable) error {
+		imported[cidx] = mc
+		return nil
+	})
+	a.NoError(err)
+	a.Equal(expected, imported)
+
+	// a truncated snapshot is reported as such
+	_, err = tx2.Exec("DELETE FROM assetcreators")
+	a.NoError(err)
+	_, err = ImportCreatables(tx2, bytes.NewReader(exported[:len(exported)-1]))
+	a.True(errors.Is(err, io.ErrUnexpectedEOF))
+}
+
 // checkCreatables compares the expected database image to the actual databse content
 func checkCreatables(t *testing.T,
 	tx *sql.Tx, iteration int,
@@ -820,6 +1127,229 @@ func BenchmarkReadingRandomBalancesRAM(b *testing.B) {
 func BenchmarkReadingRandomBalancesDisk(b *testing.B) {
 	benchmarkReadingRandomBalances(b, false)
 }
+
+func TestAccountsDbQueriesPool(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, fn := dbOpenTest(t, false)
+	setDbLogging(t, dbs)
+	defer cleanupTestDb(dbs, fn, false)
+
+	accounts := benchmarkInitBalances(t, 100, dbs, proto)
+
+	_, err := accountsDbInitPool(dbs.Rdb.Handle, 0)
+	a.Error(err)
+
+	pool, err := accountsDbInitPool(dbs.Rdb.Handle, 4)
+	a.NoError(err)
+	defer pool.close()
+
+	// the lookups are verified by the test goroutine, as the require assertions can't be used by other goroutines
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for addr, ad := range accounts {
+				qs := pool.acquire()
+				pad, err := qs.lookup(addr)
+				pool.release(qs)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !reflect.DeepEqual(pad.accountData, ad) {
+					errs <- fmt.Errorf("account %v mismatch: %v != %v", addr, pad.accountData, ad)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		a.NoError(err)
+	}
+}
+
+func TestPersistedAccountDataValidate(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	pad := persistedAccountData{addr: randomAddress(), accountData: randomAccountData(0)}
+	a.NoError(pad.validate(proto))
+
+	// an app whose stores fit the declared schemas
+	schema := basics.StateSchema{NumUint: 1, NumByteSlice: 1}
+	kv := basics.TealKeyValue{
+		"u": basics.TealValue{Type: basics.TealUintType, Uint: 1},
+		"b": basics.TealValue{Type: basics.TealBytesType, Bytes: "b"},
+	}
+	pad.accountData.AppLocalStates = map[basics.AppIndex]basics.AppLocalState{1: {Schema: schema, KeyValue: kv}}
+	pad.accountData.AppParams = map[basics.AppIndex]basics.AppParams{1: {StateSchemas: basics.StateSchemas{GlobalStateSchema: schema}, GlobalState: kv}}
+	a.NoError(pad.validate(proto))
+
+	// local state exceeding its schema
+	overSchema := kv.Clone()
+	overSchema["u2"] = basics.TealValue{Type: basics.TealUintType, Uint: 2}
+	pad.accountData.AppLocalStates[1] = basics.AppLocalState{Schema: schema, KeyValue: overSchema}
+	err := pad.validate(proto)
+	a.Error(err)
+	a.Contains(err.Error(), "local state of app 1")
+	pad.accountData.AppLocalStates[1] = basics.AppLocalState{Schema: schema, KeyValue: kv}
+
+	// global state exceeding its schema
+	pad.accountData.AppParams[1] = basics.AppParams{StateSchemas: basics.StateSchemas{GlobalStateSchema: schema}, GlobalState: overSchema}
+	err = pad.validate(proto)
+	a.Error(err)
+	a.Contains(err.Error(), "global state of app 1")
+	pad.accountData.AppParams[1] = basics.AppParams{StateSchemas: basics.StateSchemas{GlobalStateSchema: schema}, GlobalState: kv}
+	a.NoError(pad.validate(proto))
+
+	// too many asset holdings
+	pad.accountData.Assets = make(map[basics.AssetIndex]basics.AssetHolding, proto.MaxAssetsPerAccount+1)
+	for i := 0; i <= proto.MaxAssetsPerAccount; i++ {
+		pad.accountData.Assets[basics.AssetIndex(i+1)] = basics.AssetHolding{}
+	}
+	a.Error(pad.validate(proto))
+}
+
+// countingQueryable counts the statements prepared through it.
+type countingQueryable struct {
+	db.Queryable
+	prepares *int
+}
+
+func (c countingQueryable) Prepare(query string) (*sql.Stmt, error) {
+	*c.prepares++
+	return c.Queryable.Prepare(query)
+}
+
+func TestAccountsDbInitCached(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, fn := dbOpenTest(t, false)
+	setDbLogging(t, dbs)
+	defer cleanupTestDb(dbs, fn, false)
+
+	accounts := benchmarkInitBalances(t, 100, dbs, proto)
+
+	var prepares int
+	r := countingQueryable{Queryable: dbs.Rdb.Handle, prepares: &prepares}
+	w := countingQueryable{Queryable: dbs.Wdb.Handle, prepares: &prepares}
+
+	const inits = 20
+	initAll := func(cache *StmtCache) {
+		for i := 0; i < inits; i++ {
+			qs, err := accountsDbInitCached(r, w, cache)
+			a.NoError(err)
+			qs.close()
+		}
+	}
+
+	initAll(nil)
+	uncachedPrepares := prepares
+	a.NotZero(uncachedPrepares)
+	a.Zero(uncachedPrepares % inits)
+
+	// with a shared cache, the statements are prepared only by the first initialization
+	cache := MakeStmtCache()
+	defer cache.Close()
+	prepares = 0
+	initAll(cache)
+	a.Equal(uncachedPrepares/inits, prepares)
+
+	// the cached statements survive the queries sets being closed, and behave just like freshly prepared ones
+	cachedQs, err := accountsDbInitCached(r, w, cache)
+	a.NoError(err)
+	defer cachedQs.close()
+	qs, err := accountsDbInit(dbs.Rdb.Handle, dbs.Wdb.Handle)
+	a.NoError(err)
+	defer qs.close()
+	for addr, ad := range accounts {
+		cachedPad, err := cachedQs.lookup(addr)
+		a.NoError(err)
+		pad, err := qs.lookup(addr)
+		a.NoError(err)
+		a.Equal(pad, cachedPad)
+		a.Equal(ad, cachedPad.accountData)
+	}
+
+	// a different handle, such as a reopened one, gets the statements prepared again, replacing the previous ones
+	otherPrepares := 0
+	otherQs, err := accountsDbInitCached(countingQueryable{Queryable: dbs.Rdb.Handle, prepares: &otherPrepares}, w, cache)
+	a.NoError(err)
+	defer otherQs.close()
+	a.NotZero(otherPrepares)
+	a.True(cachedQs.lookupStmt != otherQs.lookupStmt)
+	a.True(cachedQs.deleteStoredCatchpoint == otherQs.deleteStoredCatchpoint)
+	a.Equal(uncachedPrepares/inits, len(cache.stmts))
+	for addr, ad := range accounts {
+		pad, err := otherQs.lookup(addr)
+		a.NoError(err)
+		a.Equal(ad, pad.accountData)
+	}
+
+	// switching back to the original handle prepares its statements again, without accumulating statements
+	prepares = 0
+	initAll(cache)
+	a.Equal(otherPrepares, prepares)
+	a.Equal(uncachedPrepares/inits, len(cache.stmts))
+}
+
+func benchmarkReadingRandomBalancesConcurrently(b *testing.B, lookup func(basics.Address) error, addrs []basics.Address) {
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			err := lookup(addrs[rand.Intn(len(addrs))])
+			if err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkReadingRandomBalancesConcurrentDisk(b *testing.B) {
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+	dbs, fn := dbOpenTest(b, false)
+	setDbLogging(b, dbs)
+	defer cleanupTestDb(dbs, fn, false)
+
+	accounts := benchmarkInitBalances(b, 10000, dbs, proto)
+	addrs := make([]basics.Address, 0, len(accounts))
+	for addr := range accounts {
+		addrs = append(addrs, addr)
+	}
+
+	b.Run("Single", func(b *testing.B) {
+		qs, err := accountsDbInit(dbs.Rdb.Handle, dbs.Wdb.Handle)
+		require.NoError(b, err)
+		defer qs.close()
+		var mu deadlock.Mutex
+		benchmarkReadingRandomBalancesConcurrently(b, func(addr basics.Address) error {
+			mu.Lock()
+			defer mu.Unlock()
+			_, err := qs.lookup(addr)
+			return err
+		}, addrs)
+	})
+
+	b.Run("Pool", func(b *testing.B) {
+		pool, err := accountsDbInitPool(dbs.Rdb.Handle, runtime.GOMAXPROCS(0))
+		require.NoError(b, err)
+		defer pool.close()
+		benchmarkReadingRandomBalancesConcurrently(b, func(addr basics.Address) error {
+			qs := pool.acquire()
+			defer pool.release(qs)
+			_, err := qs.lookup(addr)
+			return err
+		}, addrs)
+	})
+}
+
 func BenchmarkWritingRandomBalancesDisk(b *testing.B) {
 	totalStartupAccountsNumber := 5000000
 	batchCount := 1000
@@ -943,6 +1473,63 @@ func BenchmarkWritingRandomBalancesDisk(b *testing.B) {
 	err = tx.Commit()
 	require.NoError(b, err)
 }
+func TestDiffAccountDBs(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbsA, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbsA)
+	defer dbsA.Close()
+	dbsB, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbsB)
+	defer dbsB.Close()
+
+	txA, err := dbsA.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer txA.Rollback()
+	txB, err := dbsB.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer txB.Rollback()
+
+	accts := randomAccounts(50, false)
+	_, err = accountsInit(txA, accts, proto)
+	a.NoError(err)
+	_, err = accountsInit(txB, accts, proto)
+	a.NoError(err)
+
+	diffs, err := DiffAccountDBs(txA, txB)
+	a.NoError(err)
+	a.Empty(diffs)
+
+	var addr basics.Address
+	for addr = range accts {
+		break
+	}
+	original := accts[addr]
+	modified := original
+	modified.MicroAlgos.Raw++
+	_, err = txB.Exec("UPDATE accountbase SET data=? WHERE address=?", protocol.Encode(&modified), addr[:])
+	a.NoError(err)
+
+	diffs, err = DiffAccountDBs(txA, txB)
+	a.NoError(err)
+	a.Equal([]AccountDiff{{
+		Address:      addr,
+		FingerprintA: crypto.Hash(protocol.Encode(&original)),
+		FingerprintB: crypto.Hash(protocol.Encode(&modified)),
+	}}, diffs)
+
+	// an account missing from one of the databases is reported with a zero fingerprint
+	_, err = txA.Exec("DELETE FROM accountbase WHERE address=?", addr[:])
+	a.NoError(err)
+	diffs, err = DiffAccountDBs(txA, txB)
+	a.NoError(err)
+	a.Len(diffs, 1)
+	a.Equal(addr, diffs[0].Address)
+	a.True(diffs[0].FingerprintA.IsZero())
+	a.False(diffs[0].FingerprintB.IsZero())
+}
+
 func TestAccountsReencoding(t *testing.T) {
 	oldEncodedAccountsData := [][]byte{
 		{132, 164, 97, 108, 103, 111, 206, 5, 234, 236, 80, 164, 97, 112, 97, 114, 129, 206, 0, 3, 60, 164, 137, 162, 97, 109, 196, 32, 49, 54, 101, 102, 97, 97, 51, 57, 50, 52, 97, 54, 102, 100, 57, 100, 51, 97, 52, 56, 50, 52, 55, 57, 57, 97, 52, 97, 99, 54, 53, 100, 162, 97, 110, 167, 65, 80, 84, 75, 73, 78, 71, 162, 97, 117, 174, 104, 116, 116, 112, 58, 47, 47, 115, 111, 109, 101, 117, 114, 108, 161, 99, 196, 32, 183, 97, 139, 76, 1, 45, 180, 52, 183, 186, 220, 252, 85, 135, 185, 87, 156, 87, 158, 83, 49, 200, 133, 169, 43, 205, 26, 148, 50, 121, 28, 105, 161, 102, 196, 32, 183, 97, 139, 76, 1, 45, 180, 52, 183, 186, 220, 252, 85, 135, 185, 87, 156, 87, 158, 83, 49, 200, 133, 169, 43, 205, 26, 148, 50, 121, 28, 105, 161, 109, 196, 32, 60, 69, 244, 159, 234, 26, 168, 145, 153, 184, 85, 182, 46, 124, 227, 144, 84, 113, 176, 206, 109, 204, 245, 165, 100, 23, 71, 49, 32, 242, 146, 68, 161, 114, 196, 32, 183, 97, 139, 76, 1, 45, 180, 52, 183, 186, 220, 252, 85, 135, 185, 87, 156, 87, 158, 83, 49, 200, 133, 169, 43, 205, 26, 148, 50, 121, 28, 105, 161, 116, 205, 3, 32, 162, 117, 110, 163, 65, 80, 75, 165, 97, 115, 115, 101, 116, 129, 206, 0, 3, 60, 164, 130, 161, 97, 0, 161, 102, 194, 165, 101, 98, 97, 115, 101, 205, 98, 54},
@@ -1028,88 +1615,1684 @@ func TestAccountsReencoding(t *testing.T) {
 	require.NoError(t, err)
 }
 
-// TestAccountsDbQueriesCreateClose tests to see that we can create the accountsDbQueries and close it.
-// it also verify that double-closing it doesn't create an issue.
-func TestAccountsDbQueriesCreateClose(t *testing.T) {
+func TestAccountsReencodingChunks(t *testing.T) {
+	a := require.New(t)
+	// a legacy encoded account data, holding a single asset
+	oldEncodedAccountData := []byte{131, 164, 97, 108, 103, 111, 206, 0, 3, 48, 104, 165, 97, 115, 115, 101, 116, 129, 206, 0, 1, 242, 159, 130, 161, 97, 0, 161, 102, 194, 165, 101, 98, 97, 115, 101, 205, 98, 54}
+
 	dbs, _ := dbOpenTest(t, true)
 	setDbLogging(t, dbs)
 	defer dbs.Close()
 
+	// interleave legacy encoded accounts with canonically encoded ones
+	const legacyAccounts = 25
+	accts := randomAccounts(legacyAccounts, false)
 	err := dbs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) (err error) {
 		_, err = accountsInit(tx, make(map[basics.Address]basics.AccountData), config.Consensus[protocol.ConsensusCurrentVersion])
 		if err != nil {
 			return err
 		}
+		for addr, data := range accts {
+			legacyAddr := randomAddress()
+			_, err = tx.ExecContext(ctx, "INSERT INTO accountbase (address, data) VALUES (?, ?)", legacyAddr[:], oldEncodedAccountData)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "INSERT INTO accountbase (address, data) VALUES (?, ?)", addr[:], protocol.Encode(&data))
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	})
-	require.NoError(t, err)
-	qs, err := accountsDbInit(dbs.Rdb.Handle, dbs.Wdb.Handle)
-	require.NoError(t, err)
-	require.NotNil(t, qs.listCreatablesStmt)
-	qs.close()
-	require.Nil(t, qs.listCreatablesStmt)
-	qs.close()
-	require.Nil(t, qs.listCreatablesStmt)
-}
+	a.NoError(err)
 
-func benchmarkWriteCatchpointStagingBalancesSub(b *testing.B, ascendingOrder bool) {
-	proto := config.Consensus[protocol.ConsensusCurrentVersion]
-	genesisInitState, _ := testGenerateInitState(b, protocol.ConsensusCurrentVersion, 100)
-	const inMem = false
-	log := logging.TestingLog(b)
-	cfg := config.GetDefaultLocal()
-	cfg.Archival = false
-	log.SetLevel(logging.Warn)
-	dbBaseFileName := strings.Replace(b.Name(), "/", "_", -1)
-	l, err := OpenLedger(log, dbBaseFileName, inMem, genesisInitState, cfg)
-	require.NoError(b, err, "could not open ledger")
-	defer func() {
-		l.Close()
-		os.Remove(dbBaseFileName + ".block.sqlite")
-		os.Remove(dbBaseFileName + ".tracker.sqlite")
-	}()
-	catchpointAccessor := MakeCatchpointCatchupAccessor(l, log)
-	catchpointAccessor.ResetStagingBalances(context.Background(), true)
-	targetAccountsCount := uint64(b.N)
-	accountsLoaded := uint64(0)
-	var last64KStart time.Time
-	last64KSize := uint64(0)
-	last64KAccountCreationTime := time.Duration(0)
-	accountsWritingStarted := time.Now()
-	accountsGenerationDuration := time.Duration(0)
-	b.ResetTimer()
-	for accountsLoaded < targetAccountsCount {
-		b.StopTimer()
-		balancesLoopStart := time.Now()
-		// generate a chunk;
-		chunkSize := targetAccountsCount - accountsLoaded
-		if chunkSize > BalancesPerCatchpointFileChunk {
-			chunkSize = BalancesPerCatchpointFileChunk
-		}
-		last64KSize += chunkSize
-		if accountsLoaded >= targetAccountsCount-64*1024 && last64KStart.IsZero() {
-			last64KStart = time.Now()
-			last64KSize = chunkSize
-			last64KAccountCreationTime = time.Duration(0)
-		}
-		var balances catchpointFileBalancesChunk
-		balances.Balances = make([]encodedBalanceRecord, chunkSize)
-		for i := uint64(0); i < chunkSize; i++ {
-			var randomAccount encodedBalanceRecord
-			accountData := basics.AccountData{RewardsBase: accountsLoaded + i}
-			accountData.MicroAlgos.Raw = crypto.RandUint63()
-			randomAccount.AccountData = protocol.Encode(&accountData)
-			crypto.RandBytes(randomAccount.Address[:])
-			if ascendingOrder {
-				binary.LittleEndian.PutUint64(randomAccount.Address[:], accountsLoaded+i)
+	const chunkSize = 20
+	var modifiedAccounts uint
+	err = dbs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) (err error) {
+		var cursor int64
+		chunks := 0
+		for done := false; !done; chunks++ {
+			var modified uint
+			var lastRowid int64
+			modified, lastRowid, done, err = reencodeAccountsChunk(ctx, tx, cursor, chunkSize)
+			a.NoError(err)
+			if !done {
+				// every full chunk holds as many legacy accounts as canonical ones
+				a.Equal(uint(chunkSize/2), modified)
+				a.Equal(cursor+chunkSize, lastRowid)
 			}
-			balances.Balances[i] = randomAccount
+			modifiedAccounts += modified
+			cursor = lastRowid
 		}
-		balanceLoopDuration := time.Now().Sub(balancesLoopStart)
-		last64KAccountCreationTime += balanceLoopDuration
-		accountsGenerationDuration += balanceLoopDuration
+		a.Equal(2*legacyAccounts/chunkSize+1, chunks)
+		return nil
+	})
+	a.NoError(err)
+	a.Equal(uint(legacyAccounts), modifiedAccounts)
+
+	// all the accounts are now canonically encoded
+	err = dbs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) (err error) {
+		modified, err := reencodeAccounts(ctx, tx)
+		a.NoError(err)
+		a.Zero(modified)
+		return nil
+	})
+	a.NoError(err)
+}
+
+func TestAccountReencoding(t *testing.T) {
+	a := require.New(t)
+	// a legacy encoded account data, holding a single asset
+	oldEncodedAccountData := []byte{131, 164, 97, 108, 103, 111, 206, 0, 3, 48, 104, 165, 97, 115, 115, 101, 116, 129, 206, 0, 1, 242, 159, 130, 161, 97, 0, 161, 102, 194, 165, 101, 98, 97, 115, 101, 205, 98, 54}
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	accts := randomAccounts(10, false)
+	_, err = accountsInit(tx, accts, config.Consensus[protocol.ConsensusCurrentVersion])
+	a.NoError(err)
+
+	legacyAddr := randomAddress()
+	_, err = tx.Exec("INSERT INTO accountbase (address, data) VALUES (?, ?)", legacyAddr[:], oldEncodedAccountData)
+	a.NoError(err)
+
+	readEncoded := func(addr basics.Address) (buf []byte) {
+		a.NoError(tx.QueryRow("SELECT data FROM accountbase WHERE address = ?", addr[:]).Scan(&buf))
+		return
+	}
+	encodedBefore := make(map[basics.Address][]byte, len(accts))
+	for addr := range accts {
+		encodedBefore[addr] = readEncoded(addr)
+	}
+
+	modified, err := reencodeAccount(tx, legacyAddr)
+	a.NoError(err)
+	a.True(modified)
+	a.NotEqual(oldEncodedAccountData, readEncoded(legacyAddr))
+
+	var oldAccountData, newAccountData basics.AccountData
+	a.NoError(protocol.Decode(oldEncodedAccountData, &oldAccountData))
+	a.NoError(protocol.Decode(readEncoded(legacyAddr), &newAccountData))
+	a.Equal(oldAccountData, newAccountData)
+
+	// once re-encoded, the account isn't modified again
+	modified, err = reencodeAccount(tx, legacyAddr)
+	a.NoError(err)
+	a.False(modified)
+
+	// the other accounts are already canonically encoded and left untouched
+	for addr := range accts {
+		modified, err = reencodeAccount(tx, addr)
+		a.NoError(err)
+		a.False(modified)
+		a.Equal(encodedBefore[addr], readEncoded(addr))
+	}
+
+	modified, err = reencodeAccount(tx, randomAddress())
+	a.NoError(err)
+	a.False(modified)
+}
+
+func TestAppLocalStatesForApp(t *testing.T) {
+	a := require.New(t)
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	aidx := basics.AppIndex(7)
+	accts := randomAccounts(20, true)
+	expected := make(map[basics.Address]basics.AppLocalState)
+	i := uint64(0)
+	for addr, ad := range accts {
+		i++
+		ad.AppLocalStates = map[basics.AppIndex]basics.AppLocalState{aidx + 1: {}}
+		if i%2 == 0 {
+			localState := basics.AppLocalState{
+				Schema:   basics.StateSchema{NumUint: 1},
+				KeyValue: basics.TealKeyValue{"counter": {Type: basics.TealUintType, Uint: i}},
+			}
+			ad.AppLocalStates[aidx] = localState
+			expected[addr] = localState
+		}
+		accts[addr] = ad
+	}
+	_, err = accountsInit(tx, accts, config.Consensus[protocol.ConsensusCurrentVersion])
+	a.NoError(err)
+
+	yielded := make(map[basics.Address]basics.AppLocalState)
+	err = appLocalStatesForApp(context.Background(), tx, aidx, func(addr basics.Address, localState basics.AppLocalState) error {
+		yielded[addr] = localState
+		return nil
+	})
+	a.NoError(err)
+	a.Equal(expected, yielded)
+
+	// a callback error aborts the scan
+	calls := 0
+	errStop := fmt.Errorf("stop")
+	err = appLocalStatesForApp(context.Background(), tx, aidx, func(basics.Address, basics.AppLocalState) error {
+		calls++
+		return errStop
+	})
+	a.Equal(errStop, err)
+	a.Equal(1, calls)
+
+	// as does a canceled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = appLocalStatesForApp(ctx, tx, aidx, func(basics.Address, basics.AppLocalState) error {
+		return nil
+	})
+	a.Error(err)
+}
+
+func TestAppTotalLocalStorage(t *testing.T) {
+	a := require.New(t)
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	aidx := basics.AppIndex(7)
+	accts := randomAccounts(20, true)
+	var expected basics.StateSchema
+	var holders uint64
+	i := uint64(0)
+	for addr, ad := range accts {
+		i++
+		// local states of another app aren't counted
+		ad.AppLocalStates = map[basics.AppIndex]basics.AppLocalState{
+			aidx + 1: {KeyValue: basics.TealKeyValue{"other": {Type: basics.TealUintType, Uint: 1}}},
+		}
+		switch i % 3 {
+		case 0:
+			ad.AppLocalStates[aidx] = basics.AppLocalState{
+				Schema: basics.StateSchema{NumUint: 2, NumByteSlice: 2},
+				KeyValue: basics.TealKeyValue{
+					"counter": {Type: basics.TealUintType, Uint: i},
+					"name":    {Type: basics.TealBytesType, Bytes: "holder"},
+				},
+			}
+			expected.NumUint++
+			expected.NumByteSlice++
+			holders++
+		case 1:
+			// opted in, without storing anything yet
+			ad.AppLocalStates[aidx] = basics.AppLocalState{Schema: basics.StateSchema{NumUint: 2, NumByteSlice: 2}}
+			holders++
+		}
+		accts[addr] = ad
+	}
+	_, err = accountsInit(tx, accts, config.Consensus[protocol.ConsensusCurrentVersion])
+	a.NoError(err)
+
+	total, count, err := appTotalLocalStorage(context.Background(), tx, aidx)
+	a.NoError(err)
+	a.Equal(expected, total)
+	a.Equal(holders, count)
+
+	total, count, err = appTotalLocalStorage(context.Background(), tx, aidx+2)
+	a.NoError(err)
+	a.Zero(total)
+	a.Zero(count)
+}
+
+func TestAccountsTotalHoldingAmount(t *testing.T) {
+	a := require.New(t)
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	accts := randomAccounts(50, false)
+	err := dbs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+		_, err := accountsInit(tx, accts, config.Consensus[protocol.ConsensusCurrentVersion])
+		return err
+	})
+	a.NoError(err)
+
+	qs, err := accountsDbInit(dbs.Rdb.Handle, dbs.Wdb.Handle)
+	a.NoError(err)
+	defer qs.close()
+
+	holders := 0
+	for addr, ad := range accts {
+		pad, err := qs.lookup(addr)
+		a.NoError(err)
+
+		var expected map[basics.AssetIndex]uint64
+		expectedTotal := uint64(0)
+		expectedOverflow := false
+		for aidx, holding := range ad.Assets {
+			if expected == nil {
+				expected = make(map[basics.AssetIndex]uint64)
+			}
+			expected[aidx] = holding.Amount
+			if !expectedOverflow {
+				expectedTotal, expectedOverflow = basics.OAdd(expectedTotal, holding.Amount)
+			}
+		}
+		if expectedOverflow {
+			expectedTotal = 0
+		}
+		if len(expected) > 0 {
+			holders++
+		}
+
+		amounts, err := accountsTotalHoldingAmount(qs, pad.rowid, pad.round)
+		a.NoError(err)
+		a.Equal(expected, amounts)
+
+		total, overflowed := sumHoldingAmounts(amounts)
+		a.Equal(expectedOverflow, overflowed)
+		a.Equal(expectedTotal, total)
+
+		_, err = accountsTotalHoldingAmount(qs, pad.rowid, pad.round+1)
+		a.IsType(&MismatchingDatabaseRoundError{}, err)
+	}
+	a.NotZero(holders)
+
+	amounts, err := accountsTotalHoldingAmount(qs, int64(len(accts)+1000), 0)
+	a.NoError(err)
+	a.Nil(amounts)
+
+	total, overflowed := sumHoldingAmounts(map[basics.AssetIndex]uint64{1: 2, 2: 3})
+	a.False(overflowed)
+	a.Equal(uint64(5), total)
+}
+
+func TestLookupHoldingsPage(t *testing.T) {
+	a := require.New(t)
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	addr := randomAddress()
+	ad := randomAccountData(0)
+	ad.Assets = make(map[basics.AssetIndex]basics.AssetHolding)
+	for i := 0; i < 95; i++ {
+		aidx := basics.AssetIndex(crypto.RandUint64()%100000 + 1)
+		ad.Assets[aidx] = basics.AssetHolding{Amount: crypto.RandUint64(), Frozen: i%3 == 0}
+	}
+	err := dbs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+		_, err := accountsInit(tx, map[basics.Address]basics.AccountData{addr: ad}, config.Consensus[protocol.ConsensusCurrentVersion])
+		return err
+	})
+	a.NoError(err)
+
+	qs, err := accountsDbInit(dbs.Rdb.Handle, dbs.Wdb.Handle)
+	a.NoError(err)
+	defer qs.close()
+
+	pad, err := qs.lookup(addr)
+	a.NoError(err)
+
+	// page through the holdings, and check that every holding is returned exactly once, in ascending order
+	const pageSize = 10
+	seen := make(map[basics.AssetIndex]basics.AssetHolding)
+	var last basics.AssetIndex
+	pages := 0
+	for {
+		page, holdings, err := lookupHoldingsPage(qs, pad.rowid, pad.round, last, pageSize)
+		a.NoError(err)
+		if len(page) == 0 {
+			break
+		}
+		pages++
+		a.LessOrEqual(len(page), pageSize)
+		a.Equal(len(page), len(holdings))
+		for _, aidx := range page {
+			a.Greater(uint64(aidx), uint64(last))
+			_, ok := seen[aidx]
+			a.False(ok)
+			seen[aidx] = holdings[aidx]
+			last = aidx
+		}
+	}
+	a.Equal(ad.Assets, seen)
+	a.Equal((len(ad.Assets)+pageSize-1)/pageSize, pages)
+
+	// a stale round is rejected
+	_, _, err = lookupHoldingsPage(qs, pad.rowid, pad.round+1, 0, pageSize)
+	a.Error(err)
+}
+
+func TestLookupHoldingsSubset(t *testing.T) {
+	a := require.New(t)
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	addr := randomAddress()
+	ad := randomAccountData(0)
+	ad.Assets = make(map[basics.AssetIndex]basics.AssetHolding)
+	for i := 1; i <= 300; i++ {
+		ad.Assets[basics.AssetIndex(i*10)] = basics.AssetHolding{Amount: crypto.RandUint64(), Frozen: i%3 == 0}
+	}
+	err := dbs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+		_, err := accountsInit(tx, map[basics.Address]basics.AccountData{addr: ad}, config.Consensus[protocol.ConsensusCurrentVersion])
+		return err
+	})
+	a.NoError(err)
+
+	qs, err := accountsDbInit(dbs.Rdb.Handle, dbs.Wdb.Handle)
+	a.NoError(err)
+	defer qs.close()
+
+	pad, err := qs.lookup(addr)
+	a.NoError(err)
+
+	// request holdings spread across the whole range, along with a few the account doesn't have
+	requested := []basics.AssetIndex{10, 1500, 3000, 7, 2995, 1500}
+	holdings, err := lookupHoldingsSubset(qs, pad.rowid, pad.round, requested)
+	a.NoError(err)
+	a.Equal(map[basics.AssetIndex]basics.AssetHolding{
+		10:   ad.Assets[10],
+		1500: ad.Assets[1500],
+		3000: ad.Assets[3000],
+	}, holdings)
+
+	// nothing requested, or nothing held
+	holdings, err = lookupHoldingsSubset(qs, pad.rowid, pad.round, nil)
+	a.NoError(err)
+	a.Empty(holdings)
+	holdings, err = lookupHoldingsSubset(qs, pad.rowid, pad.round, []basics.AssetIndex{5, 3001})
+	a.NoError(err)
+	a.Empty(holdings)
+
+	// a stale round is rejected
+	_, err = lookupHoldingsSubset(qs, pad.rowid, pad.round+1, requested)
+	a.Error(err)
+}
+
+func TestLookupRawBlob(t *testing.T) {
+	a := require.New(t)
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	addr := randomAddress()
+	ad := randomAccountData(0)
+	// a blob that isn't even a valid account encoding is returned as stored
+	corrupted := []byte{0x81, 0xa4, 'a', 'l', 'g', 'o', 0xc1, 0x00, 0xff}
+	corruptedAddr := randomAddress()
+	err := dbs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+		_, err := accountsInit(tx, map[basics.Address]basics.AccountData{addr: ad}, config.Consensus[protocol.ConsensusCurrentVersion])
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO accountbase (address, data) VALUES (?, ?)", corruptedAddr[:], corrupted)
+		return err
+	})
+	a.NoError(err)
+
+	qs, err := accountsDbInit(dbs.Rdb.Handle, dbs.Wdb.Handle)
+	a.NoError(err)
+	defer qs.close()
+
+	pad, err := qs.lookup(addr)
+	a.NoError(err)
+	rowid, blob, err := lookupRawBlob(qs, addr)
+	a.NoError(err)
+	a.Equal(pad.rowid, rowid)
+	a.Equal(protocol.Encode(&ad), blob)
+
+	rowid, blob, err = lookupRawBlob(qs, corruptedAddr)
+	a.NoError(err)
+	a.NotZero(rowid)
+	a.NotEqual(pad.rowid, rowid)
+	a.Equal(corrupted, blob)
+	_, err = qs.lookup(corruptedAddr)
+	a.Error(err)
+
+	rowid, blob, err = lookupRawBlob(qs, randomAddress())
+	a.NoError(err)
+	a.Zero(rowid)
+	a.Nil(blob)
+}
+
+func TestLookupAppGlobalKeys(t *testing.T) {
+	a := require.New(t)
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	aidx := basics.AppIndex(5)
+	creator := randomAddress()
+	ad := randomAccountData(0)
+	ad.AppParams = map[basics.AppIndex]basics.AppParams{
+		aidx: {
+			ApprovalProgram: []byte{0x02, 0x20, 0x01, 0x01, 0x22},
+			GlobalState: basics.TealKeyValue{
+				"counter": {Type: basics.TealUintType, Uint: 3},
+				"owner":   {Type: basics.TealBytesType, Bytes: string(creator[:])},
+				"":        {Type: basics.TealUintType, Uint: 1},
+				"name":    {Type: basics.TealBytesType, Bytes: "app"},
+			},
+			StateSchemas: basics.StateSchemas{GlobalStateSchema: basics.StateSchema{NumUint: 2, NumByteSlice: 2}},
+		},
+		aidx + 1: {GlobalState: basics.TealKeyValue{"other": {Type: basics.TealUintType, Uint: 1}}},
+		aidx + 2: {},
+	}
+	ad.Assets = map[basics.AssetIndex]basics.AssetHolding{1: {Amount: 10}}
+	err := dbs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+		_, err := accountsInit(tx, map[basics.Address]basics.AccountData{creator: ad}, config.Consensus[protocol.ConsensusCurrentVersion])
+		return err
+	})
+	a.NoError(err)
+
+	qs, err := accountsDbInit(dbs.Rdb.Handle, dbs.Wdb.Handle)
+	a.NoError(err)
+	defer qs.close()
+
+	pad, err := qs.lookup(creator)
+	a.NoError(err)
+
+	keys, err := lookupAppGlobalKeys(qs, pad.rowid, aidx)
+	a.NoError(err)
+	a.Equal([]string{"", "counter", "name", "owner"}, keys)
+
+	keys, err = lookupAppGlobalKeys(qs, pad.rowid, aidx+1)
+	a.NoError(err)
+	a.Equal([]string{"other"}, keys)
+
+	// an app without any global state, and an app the account didn't create, have no keys
+	keys, err = lookupAppGlobalKeys(qs, pad.rowid, aidx+2)
+	a.NoError(err)
+	a.Empty(keys)
+	keys, err = lookupAppGlobalKeys(qs, pad.rowid, aidx+3)
+	a.NoError(err)
+	a.Empty(keys)
+}
+
+func TestAccountsListProjection(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	accts := randomAccounts(25, true)
+	i := 0
+	for addr, ad := range accts {
+		i++
+		ad.Assets = make(map[basics.AssetIndex]basics.AssetHolding)
+		for j := 0; j < i%4; j++ {
+			ad.Assets[basics.AssetIndex(j+1)] = basics.AssetHolding{Amount: uint64(j)}
+		}
+		ad.AppLocalStates = make(map[basics.AppIndex]basics.AppLocalState)
+		for j := 0; j < i%3; j++ {
+			ad.AppLocalStates[basics.AppIndex(j+1)] = basics.AppLocalState{KeyValue: basics.TealKeyValue{"k": {Type: basics.TealUintType, Uint: 1}}}
+		}
+		// created apps aren't counted as local states
+		ad.AppParams = map[basics.AppIndex]basics.AppParams{basics.AppIndex(100 + i): {}}
+		accts[addr] = ad
+	}
+	// the zero address is listed as well
+	accts[basics.Address{}] = randomAccountData(0)
+	_, err = accountsInit(tx, accts, proto)
+	a.NoError(err)
+
+	// page through the accounts, and compare the summaries against the decoded accounts
+	const pageSize = 10
+	var startAfter *basics.Address
+	var listed []basics.Address
+	for {
+		page, err := accountsListProjection(tx, startAfter, pageSize)
+		a.NoError(err)
+		if len(page) == 0 {
+			break
+		}
+		a.LessOrEqual(len(page), pageSize)
+		if startAfter == nil {
+			a.Equal(basics.Address{}, page[0].Address)
+		}
+		for _, summary := range page {
+			if startAfter != nil {
+				a.True(bytes.Compare(startAfter[:], summary.Address[:]) < 0)
+			}
+			ad, ok := accts[summary.Address]
+			a.True(ok)
+			a.Equal(AccountSummary{
+				Address:    summary.Address,
+				MicroAlgos: ad.MicroAlgos,
+				Status:     ad.Status,
+				AssetCount: len(ad.Assets),
+				AppCount:   len(ad.AppLocalStates),
+			}, summary)
+			listed = append(listed, summary.Address)
+			addr := summary.Address
+			startAfter = &addr
+		}
+	}
+	a.Len(listed, len(accts))
+}
+
+func TestAccountsLookupStatus(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	statuses := []basics.Status{basics.Offline, basics.Online, basics.NotParticipating}
+	accts := make(map[basics.Address]basics.AccountData)
+	addrs := make([]basics.Address, 0, len(statuses))
+	for _, status := range statuses {
+		addr := randomAddress()
+		ad := randomAccountData(0)
+		ad.Status = status
+		accts[addr] = ad
+		addrs = append(addrs, addr)
+	}
+	_, err = accountsInit(tx, accts, proto)
+	a.NoError(err)
+	a.NoError(accountsAddNormalizedBalance(tx, proto))
+
+	qs, err := accountsDbInit(tx, tx)
+	a.NoError(err)
+	defer qs.close()
+
+	for i, addr := range addrs {
+		status, exists, err := qs.lookupStatus(addr)
+		a.NoError(err)
+		a.True(exists)
+		a.Equal(statuses[i], status)
+	}
+	_, exists, err := qs.lookupStatus(randomAddress())
+	a.NoError(err)
+	a.False(exists)
+
+	// rotate the statuses, and make sure the column follows the account data.
+	var updates ledgercore.AccountDeltas
+	for i, addr := range addrs {
+		ad := accts[addr]
+		ad.Status = statuses[(i+1)%len(statuses)]
+		updates.Upsert(addr, ad)
+		accts[addr] = ad
+	}
+	var baseAccounts lruAccounts
+	baseAccounts.init(nil, 100, 80)
+	updatesCnt := makeCompactAccountDeltas([]ledgercore.AccountDeltas{updates}, baseAccounts)
+	a.NoError(updatesCnt.accountsLoadOld(tx))
+	_, err = accountsNewRound(tx, updatesCnt, nil, proto, basics.Round(1))
+	a.NoError(err)
+
+	for i, addr := range addrs {
+		status, exists, err := qs.lookupStatus(addr)
+		a.NoError(err)
+		a.True(exists)
+		a.Equal(statuses[(i+1)%len(statuses)], status)
+	}
+
+	// rows written without a status fall back to decoding the account data.
+	legacyAddr := randomAddress()
+	legacyData := randomAccountData(0)
+	legacyData.Status = basics.Online
+	_, err = tx.Exec("INSERT INTO accountbase (address, data) VALUES (?, ?)", legacyAddr[:], protocol.Encode(&legacyData))
+	a.NoError(err)
+	status, exists, err := qs.lookupStatus(legacyAddr)
+	a.NoError(err)
+	a.True(exists)
+	a.Equal(basics.Online, status)
+}
+
+func TestLookupVoteValidity(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	accts := make(map[basics.Address]basics.AccountData)
+	for i := 0; i < 10; i++ {
+		ad := randomAccountData(0)
+		ad.Status = basics.Online
+		ad.VoteFirstValid = basics.Round(1000 * i)
+		ad.VoteLastValid = basics.Round(1000*i + 3000000)
+		accts[randomAddress()] = ad
+	}
+	offlineAddr := randomAddress()
+	offline := randomAccountData(0)
+	offline.Status = basics.Offline
+	offline.VoteFirstValid = 0
+	offline.VoteLastValid = 0
+	accts[offlineAddr] = offline
+
+	_, err = accountsInit(tx, accts, proto)
+	a.NoError(err)
+
+	qs, err := accountsDbInit(tx, tx)
+	a.NoError(err)
+	defer qs.close()
+
+	for addr, ad := range accts {
+		first, last, exists, err := lookupVoteValidity(qs, addr)
+		a.NoError(err)
+		a.True(exists)
+		a.Equal(ad.VoteFirstValid, first)
+		a.Equal(ad.VoteLastValid, last)
+	}
+
+	// an offline account without participation keys has an empty window
+	first, last, exists, err := lookupVoteValidity(qs, offlineAddr)
+	a.NoError(err)
+	a.True(exists)
+	a.Zero(first)
+	a.Zero(last)
+
+	_, _, exists, err = lookupVoteValidity(qs, randomAddress())
+	a.NoError(err)
+	a.False(exists)
+}
+
+func TestLookupRewardsFields(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	accts := randomAccounts(10, false)
+	online := randomAddress()
+	onlineData := randomAccountData(0)
+	onlineData.Status = basics.Online
+	onlineData.RewardedMicroAlgos = basics.MicroAlgos{Raw: 12345}
+	accts[online] = onlineData
+	_, err = accountsInit(tx, accts, proto)
+	a.NoError(err)
+
+	// reward the online account, as a round would
+	rewarded := onlineData.WithUpdatedRewards(proto, 1000)
+	a.NotZero(rewarded.RewardsBase)
+	_, err = tx.Exec("UPDATE accountbase SET data=? WHERE address=?", protocol.Encode(&rewarded), online[:])
+	a.NoError(err)
+	accts[online] = rewarded
+
+	qs, err := accountsDbInit(tx, tx)
+	a.NoError(err)
+	defer qs.close()
+
+	for addr := range accts {
+		pad, err := qs.lookup(addr)
+		a.NoError(err)
+		view, err := lookupRewardsFields(qs, addr)
+		a.NoError(err)
+		a.Equal(RewardsView{
+			Status:             pad.accountData.Status,
+			MicroAlgos:         pad.accountData.MicroAlgos,
+			RewardsBase:        pad.accountData.RewardsBase,
+			RewardedMicroAlgos: pad.accountData.RewardedMicroAlgos,
+		}, view)
+	}
+
+	view, err := lookupRewardsFields(qs, online)
+	a.NoError(err)
+	a.Equal(basics.Online, view.Status)
+	a.Equal(rewarded.RewardsBase, view.RewardsBase)
+	a.Equal(rewarded.RewardedMicroAlgos, view.RewardedMicroAlgos)
+
+	view, err = lookupRewardsFields(qs, randomAddress())
+	a.NoError(err)
+	a.Equal(RewardsView{}, view)
+}
+
+func TestAccountsAddStatus(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	// create an accountbase table the way it was before the status column was added.
+	_, err = tx.Exec("CREATE TABLE accountbase (address blob primary key, data blob)")
+	a.NoError(err)
+	_, err = accountsInit(tx, nil, proto)
+	a.NoError(err)
+
+	accts := randomAccounts(20, true)
+	for addr, ad := range accts {
+		_, err = tx.Exec("INSERT INTO accountbase (address, data) VALUES (?, ?)", addr[:], protocol.Encode(&ad))
+		a.NoError(err)
+	}
+
+	a.NoError(accountsAddStatus(tx))
+	// running the migration again is a no-op
+	a.NoError(accountsAddStatus(tx))
+
+	for addr, ad := range accts {
+		var status sql.NullInt64
+		a.NoError(tx.QueryRow("SELECT status FROM accountbase WHERE address=?", addr[:]).Scan(&status))
+		a.True(status.Valid)
+		a.Equal(ad.Status, basics.Status(status.Int64))
+	}
+}
+
+func TestAccountsTopByBalance(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	// accounts with distinct balances, as well as a few sharing the same balance
+	accts := make(map[basics.Address]basics.AccountData)
+	var expected []accountBalance
+	for i := 0; i < 20; i++ {
+		ad := randomAccountData(0)
+		ad.MicroAlgos.Raw = uint64(1000 * (i/2 + 1))
+		addr := randomAddress()
+		accts[addr] = ad
+		expected = append(expected, accountBalance{Addr: addr, Balance: ad.MicroAlgos})
+	}
+	sortExpected := func() {
+		sort.Slice(expected, func(i, j int) bool {
+			if expected[i].Balance.Raw != expected[j].Balance.Raw {
+				return expected[i].Balance.Raw > expected[j].Balance.Raw
+			}
+			return bytes.Compare(expected[i].Addr[:], expected[j].Addr[:]) < 0
+		})
+	}
+	sortExpected()
+
+	_, err = accountsInit(tx, accts, proto)
+	a.NoError(err)
+	a.NoError(accountsAddNormalizedBalance(tx, proto))
+	a.NoError(accountsAddBalance(tx))
+
+	top, err := accountsTopByBalance(tx, 5, 0)
+	a.NoError(err)
+	a.Equal(expected[:5], top)
+
+	// paginate through all the accounts
+	var all []accountBalance
+	for offset := 0; ; offset += 3 {
+		page, err := accountsTopByBalance(tx, 3, offset)
+		a.NoError(err)
+		if len(page) == 0 {
+			break
+		}
+		all = append(all, page...)
+	}
+	a.Equal(expected, all)
+
+	// the balance column follows the account updates
+	richest := expected[len(expected)-1]
+	richData := accts[richest.Addr]
+	richData.MicroAlgos.Raw = 1000 * 1000
+	var updates ledgercore.AccountDeltas
+	updates.Upsert(richest.Addr, richData)
+	compactUpdates := makeCompactAccountDeltas([]ledgercore.AccountDeltas{updates}, lruAccounts{})
+	a.NoError(compactUpdates.accountsLoadOld(tx))
+	_, err = accountsNewRound(tx, compactUpdates, nil, proto, basics.Round(1))
+	a.NoError(err)
+
+	top, err = accountsTopByBalance(tx, 1, 0)
+	a.NoError(err)
+	a.Equal([]accountBalance{{Addr: richest.Addr, Balance: richData.MicroAlgos}}, top)
+
+	top, err = accountsTopByBalance(tx, 5, len(expected))
+	a.NoError(err)
+	a.Empty(top)
+}
+
+func TestAccountsAddBalance(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	// create an accountbase table the way it was before the microalgos column was added.
+	_, err = tx.Exec("CREATE TABLE accountbase (address blob primary key, data blob, status integer)")
+	a.NoError(err)
+	_, err = accountsInit(tx, nil, proto)
+	a.NoError(err)
+
+	accts := randomAccounts(20, true)
+	for addr, ad := range accts {
+		_, err = tx.Exec("INSERT INTO accountbase (address, data) VALUES (?, ?)", addr[:], protocol.Encode(&ad))
+		a.NoError(err)
+	}
+
+	a.NoError(accountsAddBalance(tx))
+	// running the migration again is a no-op
+	a.NoError(accountsAddBalance(tx))
+
+	for addr, ad := range accts {
+		var microalgos sql.NullInt64
+		a.NoError(tx.QueryRow("SELECT microalgos FROM accountbase WHERE address=?", addr[:]).Scan(&microalgos))
+		a.True(microalgos.Valid)
+		a.Equal(ad.MicroAlgos.Raw, uint64(microalgos.Int64))
+	}
+
+	var idxExists bool
+	a.NoError(tx.QueryRow("SELECT 1 FROM sqlite_master WHERE type='index' AND name='accountbase_microalgos_idx'").Scan(&idxExists))
+	a.True(idxExists)
+}
+
+func TestAccountsStateChecksum(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	accts := randomAccounts(20, true)
+	_, err = accountsInit(tx, accts, proto)
+	a.NoError(err)
+	a.NoError(accountsAddNormalizedBalance(tx, proto))
+
+	_, err = accountsStateChecksum(tx, 0)
+	a.Error(err)
+	a.NoError(accountsCreateStateChecksum(tx))
+
+	// recompute the checksum from scratch, and compare it with the incrementally maintained one
+	checkChecksum := func(rnd basics.Round) crypto.Digest {
+		checksum, err := accountsStateChecksum(tx, rnd)
+		a.NoError(err)
+		_, err = tx.Exec("SAVEPOINT recompute")
+		a.NoError(err)
+		_, err = tx.Exec("DROP TABLE statechecksum")
+		a.NoError(err)
+		a.NoError(accountsCreateStateChecksum(tx))
+		recomputed, err := accountsStateChecksum(tx, rnd)
+		a.NoError(err)
+		_, err = tx.Exec("ROLLBACK TO recompute")
+		a.NoError(err)
+		_, err = tx.Exec("RELEASE recompute")
+		a.NoError(err)
+		a.Equal(recomputed, checksum)
+		return checksum
+	}
+	initial := checkChecksum(0)
+	a.NotEqual(crypto.Digest{}, initial)
+
+	newRound := func(rnd basics.Round, updates ledgercore.AccountDeltas) {
+		compactUpdates := makeCompactAccountDeltas([]ledgercore.AccountDeltas{updates}, lruAccounts{})
+		a.NoError(compactUpdates.accountsLoadOld(tx))
+		_, err := accountsNewRound(tx, compactUpdates, nil, proto, rnd)
+		a.NoError(err)
+		a.NoError(updateAccountsRound(tx, rnd, 0))
+	}
+
+	// a round creating, modifying and deleting accounts
+	var updates ledgercore.AccountDeltas
+	var deleted, modified basics.Address
+	for addr := range accts {
+		if deleted.IsZero() {
+			deleted = addr
+		} else if modified.IsZero() {
+			modified = addr
+		}
+	}
+	updates.Upsert(randomAddress(), randomAccountData(0))
+	updates.Upsert(deleted, basics.AccountData{})
+	updates.Upsert(modified, randomAccountData(0))
+	newRound(1, updates)
+	afterChanges := checkChecksum(1)
+	a.NotEqual(initial, afterChanges)
+
+	// the checksum is only available for the current round
+	_, err = accountsStateChecksum(tx, 0)
+	a.Error(err)
+
+	// a round that rewrites an account without changing its content, followed by reencoding all the accounts, changes
+	// the stored representation but not the checksum
+	updates = ledgercore.AccountDeltas{}
+	qs, err := accountsDbInit(tx, tx)
+	a.NoError(err)
+	pad, err := qs.lookup(modified)
+	a.NoError(err)
+	qs.close()
+	updates.Upsert(modified, pad.accountData)
+	newRound(2, updates)
+	_, err = reencodeAccounts(context.Background(), tx)
+	a.NoError(err)
+	a.Equal(afterChanges, checkChecksum(2))
+}
+
+func TestAccountsQuickDigest(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
 
-		normalizedAccountBalances, err := prepareNormalizedBalances(balances.Balances, proto)
+	accts := randomAccounts(30, true)
+	var online basics.Address
+	for addr, ad := range accts {
+		if ad.Status == basics.Online {
+			online = addr
+			break
+		}
+	}
+	a.False(online.IsZero())
+
+	openDB := func() (db.Pair, *sql.Tx) {
+		dbs, _ := dbOpenTest(t, true)
+		setDbLogging(t, dbs)
+		tx, err := dbs.Wdb.Handle.Begin()
+		a.NoError(err)
+		_, err = accountsInit(tx, accts, proto)
+		a.NoError(err)
+		a.NoError(accountsAddNormalizedBalance(tx, proto))
+		return dbs, tx
+	}
+	dbs1, tx1 := openDB()
+	defer dbs1.Close()
+	defer tx1.Rollback()
+	dbs2, tx2 := openDB()
+	defer dbs2.Close()
+	defer tx2.Rollback()
+
+	digest1, err := accountsQuickDigest(tx1, 0)
+	a.NoError(err)
+	a.NotEqual(crypto.Digest{}, digest1)
+	digest2, err := accountsQuickDigest(tx2, 0)
+	a.NoError(err)
+	a.Equal(digest1, digest2)
+
+	_, err = accountsQuickDigest(tx1, 1)
+	a.Error(err)
+
+	// modify one of the online accounts in the second database
+	var updates ledgercore.AccountDeltas
+	updated := accts[online]
+	updated.VoteLastValid++
+	updates.Upsert(online, updated)
+	compactUpdates := makeCompactAccountDeltas([]ledgercore.AccountDeltas{updates}, lruAccounts{})
+	a.NoError(compactUpdates.accountsLoadOld(tx2))
+	_, err = accountsNewRound(tx2, compactUpdates, nil, proto, 0)
+	a.NoError(err)
+
+	digest2, err = accountsQuickDigest(tx2, 0)
+	a.NoError(err)
+	a.NotEqual(digest1, digest2)
+}
+
+func TestAccountsCount(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	accts := randomAccounts(20, true)
+	_, err = accountsInit(tx, accts, proto)
+	a.NoError(err)
+	a.NoError(accountsAddNormalizedBalance(tx, proto))
+
+	checkCount := func(expected int) {
+		count, err := accountsCount(tx)
+		a.NoError(err)
+		a.Equal(uint64(expected), count)
+		scanned, err := totalAccounts(context.Background(), tx)
+		a.NoError(err)
+		a.Equal(scanned, count)
+	}
+	checkCount(len(accts))
+
+	// create five accounts and delete three over a couple of rounds
+	addrs := make([]basics.Address, 0, len(accts))
+	for addr := range accts {
+		addrs = append(addrs, addr)
+	}
+	for rnd := basics.Round(1); rnd <= 2; rnd++ {
+		var updates ledgercore.AccountDeltas
+		for i := 0; i < 5; i++ {
+			updates.Upsert(randomAddress(), randomAccountData(0))
+		}
+		for i := 0; i < 3; i++ {
+			updates.Upsert(addrs[0], basics.AccountData{})
+			addrs = addrs[1:]
+		}
+		// modifying an existing account doesn't change the count
+		updates.Upsert(addrs[0], randomAccountData(0))
+
+		compactUpdates := makeCompactAccountDeltas([]ledgercore.AccountDeltas{updates}, lruAccounts{})
+		a.NoError(compactUpdates.accountsLoadOld(tx))
+		_, err = accountsNewRound(tx, compactUpdates, nil, proto, rnd)
+		a.NoError(err)
+		checkCount(len(accts) + int(rnd)*2)
+	}
+
+	// the totals being rewritten and the accounts being reencoded leave the count intact
+	totals, err := accountsTotals(tx, false)
+	a.NoError(err)
+	a.NoError(accountsPutTotals(tx, totals, false))
+	_, err = reencodeAccounts(context.Background(), tx)
+	a.NoError(err)
+	checkCount(len(accts) + 4)
+
+	// the schema upgrade recomputes the count
+	_, err = tx.Exec("UPDATE accounttotals SET accountcount = 0")
+	a.NoError(err)
+	a.NoError(accountsAddAccountCount(tx))
+	checkCount(len(accts) + 4)
+}
+
+func TestAppCounts(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	_, err = accountsInit(tx, randomAccounts(5, true), proto)
+	a.NoError(err)
+	a.NoError(accountsAddNormalizedBalance(tx, proto))
+	qs, err := accountsDbInit(tx, tx)
+	a.NoError(err)
+	defer func() { qs.close() }()
+
+	creator1 := randomAddress()
+	creator2 := randomAddress()
+	checkCounts := func(total, count1, count2 uint64) {
+		count, err := appCount(tx)
+		a.NoError(err)
+		a.Equal(total, count)
+		count, err = appCountByCreator(qs, creator1)
+		a.NoError(err)
+		a.Equal(count1, count)
+		count, err = appCountByCreator(qs, creator2)
+		a.NoError(err)
+		a.Equal(count2, count)
+	}
+	checkCounts(0, 0, 0)
+
+	newRound := func(rnd basics.Round, creatables map[basics.CreatableIndex]ledgercore.ModifiedCreatable) {
+		_, err := accountsNewRound(tx, compactAccountDeltas{}, creatables, proto, rnd)
+		a.NoError(err)
+	}
+
+	// three apps for the first creator, one for the second, and an asset which isn't counted
+	newRound(1, map[basics.CreatableIndex]ledgercore.ModifiedCreatable{
+		1: {Ctype: basics.AppCreatable, Creator: creator1, Created: true},
+		2: {Ctype: basics.AppCreatable, Creator: creator1, Created: true},
+		3: {Ctype: basics.AppCreatable, Creator: creator2, Created: true},
+		4: {Ctype: basics.AssetCreatable, Creator: creator2, Created: true},
+	})
+	checkCounts(3, 2, 1)
+	newRound(2, map[basics.CreatableIndex]ledgercore.ModifiedCreatable{
+		5: {Ctype: basics.AppCreatable, Creator: creator1, Created: true},
+	})
+	checkCounts(4, 3, 1)
+
+	// deleting the second creator's only app drops it from the counts
+	newRound(3, map[basics.CreatableIndex]ledgercore.ModifiedCreatable{
+		3: {Ctype: basics.AppCreatable, Creator: creator2, Created: false},
+		4: {Ctype: basics.AssetCreatable, Creator: creator2, Created: false},
+	})
+	checkCounts(3, 3, 0)
+	var rows int
+	a.NoError(tx.QueryRow("SELECT count(1) FROM appcreatorcounts").Scan(&rows))
+	a.Equal(1, rows)
+
+	// the schema upgrade recomputes the counts
+	_, err = tx.Exec("DROP TABLE appcreatorcounts")
+	a.NoError(err)
+	a.NoError(accountsAddAppCounts(tx))
+	qs.close()
+	qs, err = accountsDbInit(tx, tx)
+	a.NoError(err)
+	checkCounts(3, 3, 0)
+}
+
+func TestAssetHolderCount(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	const aidx = basics.AssetIndex(1000)
+	accts := make(map[basics.Address]basics.AccountData)
+	var holders []basics.Address
+	for i := 0; i < 10; i++ {
+		addr := randomAddress()
+		ad := randomAccountData(0)
+		if i < 4 {
+			ad.Assets = map[basics.AssetIndex]basics.AssetHolding{aidx: {Amount: uint64(i)}, aidx + 1: {}}
+			holders = append(holders, addr)
+		}
+		accts[addr] = ad
+	}
+	_, err = accountsInit(tx, accts, proto)
+	a.NoError(err)
+	a.NoError(accountsAddNormalizedBalance(tx, proto))
+
+	// the counts aren't available until the table is created
+	qs, err := accountsDbInit(tx, tx)
+	a.NoError(err)
+	_, err = assetHolderCount(qs, aidx)
+	a.Error(err)
+	qs.close()
+
+	a.NoError(accountsCreateAssetHolders(tx))
+	// creating the table again is a no-op
+	a.NoError(accountsCreateAssetHolders(tx))
+	qs, err = accountsDbInit(tx, tx)
+	a.NoError(err)
+	defer qs.close()
+
+	checkCount := func(aidx basics.AssetIndex, expected uint64) {
+		count, err := assetHolderCount(qs, aidx)
+		a.NoError(err)
+		a.Equal(expected, count)
+	}
+	checkCount(aidx, 4)
+	checkCount(aidx+1, 4)
+	checkCount(aidx+2, 0)
+
+	newRound := func(rnd basics.Round, updates ledgercore.AccountDeltas) {
+		compactUpdates := makeCompactAccountDeltas([]ledgercore.AccountDeltas{updates}, lruAccounts{})
+		a.NoError(compactUpdates.accountsLoadOld(tx))
+		_, err := accountsNewRound(tx, compactUpdates, nil, proto, rnd)
+		a.NoError(err)
+	}
+
+	// a new account opting in, and an existing one closing out of one of the assets
+	var updates ledgercore.AccountDeltas
+	newHolder := randomAccountData(0)
+	newHolder.Assets = map[basics.AssetIndex]basics.AssetHolding{aidx: {}, aidx + 2: {}}
+	updates.Upsert(randomAddress(), newHolder)
+	closing := accts[holders[0]]
+	closing.Assets = map[basics.AssetIndex]basics.AssetHolding{aidx + 1: {}}
+	updates.Upsert(holders[0], closing)
+	newRound(1, updates)
+	checkCount(aidx, 4)
+	checkCount(aidx+1, 4)
+	checkCount(aidx+2, 1)
+
+	// deleting holders' accounts drops their holdings
+	updates = ledgercore.AccountDeltas{}
+	updates.Upsert(holders[0], basics.AccountData{})
+	updates.Upsert(holders[1], basics.AccountData{})
+	newRound(2, updates)
+	checkCount(aidx, 3)
+	checkCount(aidx+1, 2)
+	checkCount(aidx+2, 1)
+
+	var rows int
+	a.NoError(tx.QueryRow("SELECT count(1) FROM assetholders").Scan(&rows))
+	a.Equal(3, rows)
+}
+
+func TestValidateAccountLocalSchemas(t *testing.T) {
+	a := require.New(t)
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	valid := randomAccountData(0)
+	valid.AppLocalStates = map[basics.AppIndex]basics.AppLocalState{
+		3: {
+			Schema: basics.StateSchema{NumUint: 1, NumByteSlice: 1},
+			KeyValue: basics.TealKeyValue{
+				"int":   {Type: basics.TealUintType, Uint: 1},
+				"bytes": {Type: basics.TealBytesType, Bytes: "bytes"},
+			},
+		},
+	}
+	overSchema := randomAccountData(0)
+	overSchema.AppLocalStates = map[basics.AppIndex]basics.AppLocalState{
+		5: {
+			Schema: basics.StateSchema{NumUint: 2, NumByteSlice: 1},
+			KeyValue: basics.TealKeyValue{
+				"bytes1": {Type: basics.TealBytesType, Bytes: "bytes1"},
+				"bytes2": {Type: basics.TealBytesType, Bytes: "bytes2"},
+			},
+		},
+	}
+	validAddr, overSchemaAddr := randomAddress(), randomAddress()
+	accts := map[basics.Address]basics.AccountData{validAddr: valid, overSchemaAddr: overSchema}
+	_, err = accountsInit(tx, accts, config.Consensus[protocol.ConsensusCurrentVersion])
+	a.NoError(err)
+
+	qs, err := accountsDbInit(tx, tx)
+	a.NoError(err)
+	defer qs.close()
+
+	pad, err := qs.lookup(validAddr)
+	a.NoError(err)
+	a.NoError(validateAccountLocalSchemas(qs, pad.rowid))
+
+	pad, err = qs.lookup(overSchemaAddr)
+	a.NoError(err)
+	err = validateAccountLocalSchemas(qs, pad.rowid)
+	a.Error(err)
+	a.Contains(err.Error(), "app 5 local state holds 2 byte slices")
+
+	// missing accounts have nothing to validate
+	a.NoError(validateAccountLocalSchemas(qs, pad.rowid+100))
+}
+
+func TestAssertHoldingConservation(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	holder := randomAccountData(0)
+	holder.Assets = map[basics.AssetIndex]basics.AssetHolding{1: {Amount: 1}, 2: {Amount: 2}, 3: {Amount: 3}}
+	optingIn := randomAccountData(0)
+	holderAddr, optingInAddr := randomAddress(), randomAddress()
+	accts := map[basics.Address]basics.AccountData{holderAddr: holder, optingInAddr: optingIn}
+	_, err = accountsInit(tx, accts, proto)
+	a.NoError(err)
+	a.NoError(accountsAddNormalizedBalance(tx, proto))
+
+	before, err := accountsTotalHoldings(tx)
+	a.NoError(err)
+	a.Equal(3, before)
+
+	// the holder closes out two of its holdings, while the other account opts into five assets
+	newHolder := holder
+	newHolder.Assets = map[basics.AssetIndex]basics.AssetHolding{3: {Amount: 3}}
+	newOptingIn := optingIn
+	newOptingIn.Assets = make(map[basics.AssetIndex]basics.AssetHolding)
+	for aidx := basics.AssetIndex(10); aidx < 15; aidx++ {
+		newOptingIn.Assets[aidx] = basics.AssetHolding{}
+	}
+	var updates ledgercore.AccountDeltas
+	updates.Upsert(holderAddr, newHolder)
+	updates.Upsert(optingInAddr, newOptingIn)
+
+	var baseAccounts lruAccounts
+	baseAccounts.init(nil, 100, 80)
+	compactUpdates := makeCompactAccountDeltas([]ledgercore.AccountDeltas{updates}, baseAccounts)
+	a.NoError(compactUpdates.accountsLoadOld(tx))
+	_, err = accountsNewRound(tx, compactUpdates, nil, proto, basics.Round(1))
+	a.NoError(err)
+
+	after, err := accountsTotalHoldings(tx)
+	a.NoError(err)
+	a.Equal(before+3, after)
+	a.NoError(assertHoldingConservation(tx, compactUpdates, before, after))
+
+	// a mismatching before state, or a mismatching database state, are both reported
+	a.Error(assertHoldingConservation(tx, compactUpdates, before+1, after))
+	a.Error(assertHoldingConservation(tx, compactUpdates, before+1, after+1))
+}
+
+func TestReconcileCreatables(t *testing.T) {
+	a := require.New(t)
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	creator := randomAddress()
+	creatorData := randomAccountData(0)
+	creatorData.AssetParams = map[basics.AssetIndex]basics.AssetParams{10: {Total: 1}, 11: {Total: 2}}
+	creatorData.AppParams = map[basics.AppIndex]basics.AppParams{20: {}}
+	accts := map[basics.Address]basics.AccountData{creator: creatorData}
+	_, err = accountsInit(tx, accts, config.Consensus[protocol.ConsensusCurrentVersion])
+	a.NoError(err)
+	for _, c := range []struct {
+		cidx  basics.CreatableIndex
+		ctype basics.CreatableType
+	}{{10, basics.AssetCreatable}, {11, basics.AssetCreatable}, {20, basics.AppCreatable}} {
+		_, err = tx.Exec("INSERT INTO assetcreators (asset, creator, ctype) VALUES (?, ?, ?)", c.cidx, creator[:], c.ctype)
+		a.NoError(err)
+	}
+
+	mismatches, err := reconcileCreatables(tx)
+	a.NoError(err)
+	a.Empty(mismatches)
+
+	// delete one of the assets from the creator without updating the assetcreators table, and create another
+	// one without listing it
+	delete(creatorData.AssetParams, 11)
+	creatorData.AssetParams[12] = basics.AssetParams{Total: 3}
+	_, err = tx.Exec("UPDATE accountbase SET data=? WHERE address=?", protocol.Encode(&creatorData), creator[:])
+	a.NoError(err)
+
+	mismatches, err = reconcileCreatables(tx)
+	a.NoError(err)
+	a.Equal([]CreatableMismatch{
+		{Index: 11, Type: basics.AssetCreatable, Creator: creator, MissingParams: true},
+		{Index: 12, Type: basics.AssetCreatable, Creator: creator},
+	}, mismatches)
+
+	// a creatable listed under the wrong creator is reported both ways
+	other := randomAddress()
+	_, err = tx.Exec("UPDATE assetcreators SET creator=? WHERE asset=20 AND ctype=?", other[:], basics.AppCreatable)
+	a.NoError(err)
+	mismatches, err = reconcileCreatables(tx)
+	a.NoError(err)
+	a.Equal([]CreatableMismatch{
+		{Index: 11, Type: basics.AssetCreatable, Creator: creator, MissingParams: true},
+		{Index: 12, Type: basics.AssetCreatable, Creator: creator},
+		{Index: 20, Type: basics.AppCreatable, Creator: other, MissingParams: true},
+		{Index: 20, Type: basics.AppCreatable, Creator: creator},
+	}, mismatches)
+}
+
+func TestLookupAppPrograms(t *testing.T) {
+	a := require.New(t)
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	globalState := make(basics.TealKeyValue)
+	for i := 0; i < 64; i++ {
+		globalState[fmt.Sprintf("key%d", i)] = basics.TealValue{Type: basics.TealBytesType, Bytes: strings.Repeat("v", 100)}
+	}
+	creator := randomAccountData(0)
+	creator.AppParams = map[basics.AppIndex]basics.AppParams{
+		7: {
+			ApprovalProgram:   []byte{0x02, 0x20, 0x01, 0x01, 0x22},
+			ClearStateProgram: []byte{0x02, 0x81, 0x01},
+			GlobalState:       globalState,
+			StateSchemas:      basics.StateSchemas{GlobalStateSchema: basics.StateSchema{NumByteSlice: 64}},
+		},
+		9: {
+			ApprovalProgram:   []byte{0x02, 0x81, 0x00},
+			ClearStateProgram: []byte{0x02, 0x81, 0x02},
+		},
+	}
+	creatorAddr := randomAddress()
+	accts := map[basics.Address]basics.AccountData{creatorAddr: creator}
+	_, err = accountsInit(tx, accts, config.Consensus[protocol.ConsensusCurrentVersion])
+	a.NoError(err)
+
+	qs, err := accountsDbInit(tx, tx)
+	a.NoError(err)
+	defer qs.close()
+
+	pad, err := qs.lookup(creatorAddr)
+	a.NoError(err)
+
+	for aidx, params := range creator.AppParams {
+		approval, clear, exists, err := lookupAppPrograms(qs, pad.rowid, aidx)
+		a.NoError(err)
+		a.True(exists)
+		a.Equal(params.ApprovalProgram, approval)
+		a.Equal(params.ClearStateProgram, clear)
+	}
+
+	// apps that weren't created by the account, and accounts that don't exist, have no programs
+	_, _, exists, err := lookupAppPrograms(qs, pad.rowid, 8)
+	a.NoError(err)
+	a.False(exists)
+	_, _, exists, err = lookupAppPrograms(qs, pad.rowid+100, 7)
+	a.NoError(err)
+	a.False(exists)
+}
+
+func TestAppsWithGlobalKey(t *testing.T) {
+	a := require.New(t)
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	withKey := basics.TealKeyValue{"owner": basics.TealValue{Type: basics.TealBytesType, Bytes: "me"}}
+	withoutKey := basics.TealKeyValue{"other": basics.TealValue{Type: basics.TealUintType, Uint: 1}}
+
+	// two creators, with the matching apps interleaved between them
+	accts := make(map[basics.Address]basics.AccountData)
+	var expected []basics.AppIndex
+	for c := 0; c < 2; c++ {
+		creatorAddr := randomAddress()
+		creator := randomAccountData(0)
+		creator.AppParams = make(map[basics.AppIndex]basics.AppParams)
+		for i := 0; i < 5; i++ {
+			aidx := basics.AppIndex(100 + 10*i + c)
+			params := basics.AppParams{GlobalState: withoutKey}
+			if (i+c)%2 == 0 {
+				params.GlobalState = withKey
+				expected = append(expected, aidx)
+			}
+			creator.AppParams[aidx] = params
+		}
+		accts[creatorAddr] = creator
+	}
+	_, err = accountsInit(tx, accts, config.Consensus[protocol.ConsensusCurrentVersion])
+	a.NoError(err)
+	for addr, ad := range accts {
+		for aidx := range ad.AppParams {
+			_, err = tx.Exec("INSERT INTO assetcreators (asset, creator, ctype) VALUES (?, ?, ?)", aidx, addr[:], basics.AppCreatable)
+			a.NoError(err)
+		}
+	}
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+
+	apps, err := appsWithGlobalKey(tx, "owner", 100)
+	a.NoError(err)
+	a.Equal(expected, apps)
+
+	// the results are capped at the limit
+	apps, err = appsWithGlobalKey(tx, "owner", 2)
+	a.NoError(err)
+	a.Equal(expected[:2], apps)
+
+	apps, err = appsWithGlobalKey(tx, "missing", 100)
+	a.NoError(err)
+	a.Empty(apps)
+}
+
+func TestFirstFreeCreatableIndex(t *testing.T) {
+	a := require.New(t)
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	_, err = accountsInit(tx, nil, config.Consensus[protocol.ConsensusCurrentVersion])
+	a.NoError(err)
+
+	creator := randomAddress()
+	for _, cidx := range []basics.CreatableIndex{3, 4, 5, 7, 10, 11} {
+		ctype := basics.AssetCreatable
+		if cidx%2 == 0 {
+			ctype = basics.AppCreatable
+		}
+		_, err = tx.Exec("INSERT INTO assetcreators (asset, creator, ctype) VALUES (?, ?, ?)", cidx, creator[:], ctype)
+		a.NoError(err)
+	}
+
+	for _, test := range []struct {
+		startFrom basics.CreatableIndex
+		expected  basics.CreatableIndex
+	}{
+		{1, 1},
+		{3, 6},
+		{5, 6},
+		{6, 6},
+		{7, 8},
+		{10, 12},
+		{100, 100},
+	} {
+		cidx, err := firstFreeCreatableIndex(tx, test.startFrom)
+		a.NoError(err)
+		a.Equal(test.expected, cidx, "startFrom %d", test.startFrom)
+	}
+}
+
+// TestAccountsDbQueriesCreateClose tests to see that we can create the accountsDbQueries and close it.
+// it also verify that double-closing it doesn't create an issue.
+func TestAccountsDbQueriesCreateClose(t *testing.T) {
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	err := dbs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) (err error) {
+		_, err = accountsInit(tx, make(map[basics.Address]basics.AccountData), config.Consensus[protocol.ConsensusCurrentVersion])
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	qs, err := accountsDbInit(dbs.Rdb.Handle, dbs.Wdb.Handle)
+	require.NoError(t, err)
+	require.NotNil(t, qs.listCreatablesStmt)
+	qs.close()
+	require.Nil(t, qs.listCreatablesStmt)
+	qs.close()
+	require.Nil(t, qs.listCreatablesStmt)
+}
+
+func benchmarkWriteCatchpointStagingBalancesSub(b *testing.B, ascendingOrder bool) {
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+	genesisInitState, _ := testGenerateInitState(b, protocol.ConsensusCurrentVersion, 100)
+	const inMem = false
+	log := logging.TestingLog(b)
+	cfg := config.GetDefaultLocal()
+	cfg.Archival = false
+	log.SetLevel(logging.Warn)
+	dbBaseFileName := strings.Replace(b.Name(), "/", "_", -1)
+	l, err := OpenLedger(log, dbBaseFileName, inMem, genesisInitState, cfg)
+	require.NoError(b, err, "could not open ledger")
+	defer func() {
+		l.Close()
+		os.Remove(dbBaseFileName + ".block.sqlite")
+		os.Remove(dbBaseFileName + ".tracker.sqlite")
+	}()
+	catchpointAccessor := MakeCatchpointCatchupAccessor(l, log)
+	catchpointAccessor.ResetStagingBalances(context.Background(), true)
+	targetAccountsCount := uint64(b.N)
+	accountsLoaded := uint64(0)
+	var last64KStart time.Time
+	last64KSize := uint64(0)
+	last64KAccountCreationTime := time.Duration(0)
+	accountsWritingStarted := time.Now()
+	accountsGenerationDuration := time.Duration(0)
+	b.ResetTimer()
+	for accountsLoaded < targetAccountsCount {
+		b.StopTimer()
+		balancesLoopStart := time.Now()
+		// generate a chunk;
+		chunkSize := targetAccountsCount - accountsLoaded
+		if chunkSize > BalancesPerCatchpointFileChunk {
+			chunkSize = BalancesPerCatchpointFileChunk
+		}
+		last64KSize += chunkSize
+		if accountsLoaded >= targetAccountsCount-64*1024 && last64KStart.IsZero() {
+			last64KStart = time.Now()
+			last64KSize = chunkSize
+			last64KAccountCreationTime = time.Duration(0)
+		}
+		var balances catchpointFileBalancesChunk
+		balances.Balances = make([]encodedBalanceRecord, chunkSize)
+		for i := uint64(0); i < chunkSize; i++ {
+			var randomAccount encodedBalanceRecord
+			accountData := basics.AccountData{RewardsBase: accountsLoaded + i}
+			accountData.MicroAlgos.Raw = crypto.RandUint63()
+			randomAccount.AccountData = protocol.Encode(&accountData)
+			crypto.RandBytes(randomAccount.Address[:])
+			if ascendingOrder {
+				binary.LittleEndian.PutUint64(randomAccount.Address[:], accountsLoaded+i)
+			}
+			balances.Balances[i] = randomAccount
+		}
+		balanceLoopDuration := time.Now().Sub(balancesLoopStart)
+		last64KAccountCreationTime += balanceLoopDuration
+		accountsGenerationDuration += balanceLoopDuration
+
+		normalizedAccountBalances, err := prepareNormalizedBalances(balances.Balances, proto, nil)
 		b.StartTimer()
 		err = l.trackerDBs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) (err error) {
 			err = writeCatchpointStagingBalances(ctx, tx, normalizedAccountBalances)
@@ -1145,6 +3328,55 @@ func BenchmarkWriteCatchpointStagingBalances(b *testing.B) {
 	}
 }
 
+func TestPrepareNormalizedBalancesLimits(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	accounts := randomAccounts(5, true)
+	bals := make([]encodedBalanceRecord, 0, len(accounts)+1)
+	for addr, ad := range accounts {
+		bals = append(bals, encodedBalanceRecord{Address: addr, AccountData: protocol.Encode(&ad)})
+	}
+	normalized, err := prepareNormalizedBalances(bals, proto, nil)
+	a.NoError(err)
+	a.Len(normalized, len(bals))
+
+	// an account declaring far more holdings than allowed; the record carries only the map header,
+	// so decoding it would fail, or allocate a huge map, had the header not been rejected first.
+	crafted := msgp.AppendMapHeader(nil, 2)
+	crafted = msgp.AppendString(crafted, "algo")
+	crafted = msgp.AppendUint64(crafted, 1000)
+	crafted = msgp.AppendString(crafted, "asset")
+	crafted = msgp.AppendMapHeader(crafted, 1<<30)
+	offender := randomAddress()
+	_, err = prepareNormalizedBalances(append(bals, encodedBalanceRecord{Address: offender, AccountData: crafted}), proto, nil)
+	a.Error(err)
+	limitErr, ok := err.(*accountLimitError)
+	a.True(ok)
+	a.Equal(offender, limitErr.address)
+	a.Equal("asset", limitErr.field)
+	a.Contains(err.Error(), offender.String())
+
+	// a well-formed account opted into one application more than allowed
+	ad := randomAccountData(0)
+	ad.AppLocalStates = make(map[basics.AppIndex]basics.AppLocalState, proto.MaxAppsOptedIn+1)
+	for i := 1; i <= proto.MaxAppsOptedIn+1; i++ {
+		ad.AppLocalStates[basics.AppIndex(i)] = basics.AppLocalState{}
+	}
+	_, err = prepareNormalizedBalances([]encodedBalanceRecord{{Address: offender, AccountData: protocol.Encode(&ad)}}, proto, nil)
+	limitErr, ok = err.(*accountLimitError)
+	a.True(ok)
+	a.Equal("appl", limitErr.field)
+	a.Equal(proto.MaxAppsOptedIn+1, limitErr.count)
+
+	// protocols without a limit leave the enforcement to the decoder bounds
+	delete(ad.AppLocalStates, basics.AppIndex(1))
+	noLimitProto := proto
+	noLimitProto.MaxAppsOptedIn = 0
+	_, err = prepareNormalizedBalances([]encodedBalanceRecord{{Address: offender, AccountData: protocol.Encode(&ad)}}, noLimitProto, nil)
+	a.NoError(err)
+}
+
 func TestCompactAccountDeltas(t *testing.T) {
 	a := require.New(t)
 
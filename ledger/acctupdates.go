@@ -17,11 +17,13 @@
 package ledger
 
 import (
+	"bytes"
 	"container/heap"
 	"context"
 	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
@@ -43,6 +45,7 @@ import (
 	"github.com/algorand/go-algorand/logging"
 	"github.com/algorand/go-algorand/logging/telemetryspec"
 	"github.com/algorand/go-algorand/protocol"
+	"github.com/algorand/go-algorand/util/bloom"
 	"github.com/algorand/go-algorand/util/db"
 	"github.com/algorand/go-algorand/util/metrics"
 )
@@ -99,6 +102,14 @@ const initializingAccountCachesMessageTimeout = 3 * time.Second
 // where we end up batching up to 1000 rounds in a single update.
 const accountsUpdatePerRoundHighWatermark = 1 * time.Second
 
+// accountsFilterFalsePositiveRate is the false positive rate targeted by the accounts bloom filter.
+const accountsFilterFalsePositiveRate = 0.01
+
+// accountsFilterMinElements is the minimal number of accounts the accounts bloom filter is sized for. The filter is
+// sized for twice the number of accounts found on startup, so that accounts created afterward won't degrade the false
+// positive rate right away.
+const accountsFilterMinElements = 10000
+
 // TrieMemoryConfig is the memory configuration setup used for the merkle trie.
 var TrieMemoryConfig = merkletrie.MemoryConfig{
 	NodesCountPerPage:         merkleCommitterNodesPerPage,
@@ -166,6 +177,16 @@ type accountUpdates struct {
 	// address that appears in deltas.
 	accounts map[basics.Address]modifiedAccount
 
+	// accountsFilter is a bloom filter of the addresses of all the accounts stored in the accounts database, which is
+	// maintained only when accountsExistenceFilter is set. Accounts are added as the rounds creating them are committed,
+	// and since deleted accounts are never removed from the filter, it may have false positives, but never false negatives.
+	// Since testing the filter modifies its internal buffers, it's guarded by accountsFilterMu rather than by accountsMu.
+	accountsFilter   *bloom.Filter
+	accountsFilterMu deadlock.Mutex
+
+	// accountsExistenceFilter is a flag for enable/disable maintaining the accountsFilter
+	accountsExistenceFilter bool
+
 	// creatableDeltas stores creatable updates for every round after dbRound.
 	creatableDeltas []map[basics.CreatableIndex]ledgercore.ModifiedCreatable
 
@@ -250,6 +271,37 @@ type accountUpdates struct {
 	// the synchronous mode that would be used while the accounts database is being rebuilt.
 	accountsRebuildSynchronousMode db.SynchronousMode
 
+	// the synchronous mode that would be used for the account database while the node is catching up.
+	catchupSynchronousMode db.SynchronousMode
+
+	// catchingUp is set to a non-zero value while the node is catching up; it's used to select the synchronous mode
+	// that would be used when committing rounds to disk.
+	catchingUp int32
+
+	// commitSynchronousMode is the synchronous mode that was last applied by commitRound.
+	commitSynchronousMode db.SynchronousMode
+
+	// commitLatencyHistogram is a flag for enable/disable the collection of the commitRound latency histograms
+	commitLatencyHistogram bool
+
+	// writeAheadJournal is a flag for enable/disable writing the rounds being committed into the pending journal
+	writeAheadJournal bool
+
+	// strictAccountsValidation is a flag for enable/disable validating the accounts written by commitRound
+	strictAccountsValidation bool
+
+	// assetHolderCounts is a flag for enable/disable maintaining the assetholders table
+	assetHolderCounts bool
+
+	// stateChecksum is a flag for enable/disable maintaining the statechecksum table
+	stateChecksum bool
+
+	// hashFactory creates the hash function used for hashing the accounts into the balances trie; nil stands for crypto.Hash.
+	hashFactory HashFactory
+
+	// verifyNormalizedBalances is a flag for enable/disable verifying the normalized balances read by onlineTop
+	verifyNormalizedBalances bool
+
 	// logAccountUpdatesMetrics is a flag for enable/disable metrics logging
 	logAccountUpdatesMetrics bool
 
@@ -333,6 +385,16 @@ func (au *accountUpdates) initialize(cfg config.Local, dbPathPrefix string, gene
 	au.accountsReadCond = sync.NewCond(au.accountsMu.RLocker())
 	au.synchronousMode = db.SynchronousMode(cfg.LedgerSynchronousMode)
 	au.accountsRebuildSynchronousMode = db.SynchronousMode(cfg.AccountsRebuildSynchronousMode)
+	au.catchupSynchronousMode = db.SynchronousMode(cfg.CatchupLedgerSynchronousMode)
+	au.commitSynchronousMode = au.synchronousMode
+
+	au.commitLatencyHistogram = cfg.EnableAccountsCommitLatencyHistogram
+	au.writeAheadJournal = cfg.EnableAccountsWriteAheadJournal
+	au.strictAccountsValidation = cfg.EnableStrictAccountsValidation
+	au.assetHolderCounts = cfg.EnableAssetHolderCounts
+	au.stateChecksum = cfg.EnableAccountsStateChecksum
+	au.verifyNormalizedBalances = cfg.EnableNormalizedBalanceVerification
+	au.accountsExistenceFilter = cfg.EnableAccountsExistenceFilter
 
 	// log metrics
 	au.logAccountUpdatesMetrics = cfg.EnableAccountUpdatesStats
@@ -396,6 +458,24 @@ func (au *accountUpdates) close() {
 	au.baseAccounts.prune(0)
 }
 
+// setCatchingUp updates the catching up state of the account updates, which determines the synchronous mode used
+// when committing rounds to disk.
+func (au *accountUpdates) setCatchingUp(catchingUp bool) {
+	if catchingUp {
+		atomic.StoreInt32(&au.catchingUp, 1)
+	} else {
+		atomic.StoreInt32(&au.catchingUp, 0)
+	}
+}
+
+// roundSynchronousMode returns the synchronous mode that should be used when committing rounds to disk.
+func (au *accountUpdates) roundSynchronousMode() db.SynchronousMode {
+	if atomic.LoadInt32(&au.catchingUp) != 0 {
+		return au.catchupSynchronousMode
+	}
+	return au.synchronousMode
+}
+
 // IsWritingCatchpointFile returns true when a catchpoint file is being generated. The function is used by the catchup service
 // to avoid memory pressure until the catchpoint file writing is complete.
 func (au *accountUpdates) IsWritingCatchpointFile() bool {
@@ -558,6 +638,16 @@ func (au *accountUpdates) onlineTop(rnd basics.Round, voteRnd basics.Round, n ui
 		//
 		// Keep asking for more accounts until we get the desired number,
 		// or there are no more accounts left.
+		var verifier *normalizedBalanceVerifier
+		if au.verifyNormalizedBalances {
+			verifier = &normalizedBalanceVerifier{
+				proto: au.ledger.GenesisProto(),
+				mismatch: func(err *normalizedBalanceMismatchError) {
+					ledgerNormalizedBalanceMismatchesCount.Inc(nil)
+					au.log.Errorf("onlineTop: %v", err)
+				},
+			}
+		}
 		candidates := make(map[basics.Address]*onlineAccount)
 		batchOffset := uint64(0)
 		batchSize := uint64(1024)
@@ -567,7 +657,7 @@ func (au *accountUpdates) onlineTop(rnd basics.Round, voteRnd basics.Round, n ui
 			start := time.Now()
 			ledgerAccountsonlinetopCount.Inc(nil)
 			err = au.dbs.Rdb.Atomic(func(ctx context.Context, tx *sql.Tx) (err error) {
-				accts, err = accountsOnlineTop(tx, batchOffset, batchSize, proto)
+				accts, err = accountsOnlineTop(tx, batchOffset, batchSize, proto, verifier)
 				if err != nil {
 					return
 				}
@@ -649,6 +739,80 @@ func (au *accountUpdates) GetCreatorForRound(rnd basics.Round, cidx basics.Creat
 	return au.getCreatorForRound(rnd, cidx, ctype, true /* take the lock */)
 }
 
+// DeltaWindow returns the inclusive range of rounds whose deltas are retained in memory by the account updates tracker.
+// The oldest round is the one following the round of the accounts database, and the newest is the latest round. When
+// no deltas are retained, oldest exceeds newest. Lookups for the round preceding oldest are served by the accounts
+// database, lookups for earlier rounds would fail with a RoundOffsetError, and lookups beyond newest would fail as
+// being too far in the future.
+func (au *accountUpdates) DeltaWindow() (oldest, newest basics.Round) {
+	au.accountsMu.RLock()
+	defer au.accountsMu.RUnlock()
+	return au.dbRound + 1, au.latest()
+}
+
+// accountsModifiedInRange returns the accounts modified by the rounds from through to, inclusive, along with the
+// latest round in that range in which each of them was modified. Only the rounds retained in memory can be scanned;
+// a from round that was already committed to the accounts database yields a RoundOffsetError.
+func (au *accountUpdates) accountsModifiedInRange(from, to basics.Round) (map[basics.Address]basics.Round, error) {
+	au.accountsMu.RLock()
+	defer au.accountsMu.RUnlock()
+
+	if from <= au.dbRound {
+		return nil, &RoundOffsetError{
+			round:   from,
+			dbRound: au.dbRound,
+		}
+	}
+	if to > au.latest() {
+		return nil, fmt.Errorf("round %d too high: dbRound %d, deltas %d", to, au.dbRound, len(au.deltas))
+	}
+
+	modified := make(map[basics.Address]basics.Round)
+	for rnd := from; rnd <= to; rnd++ {
+		delta := au.deltas[rnd-au.dbRound-1]
+		for i := 0; i < delta.Len(); i++ {
+			addr, _ := delta.GetByIdx(i)
+			modified[addr] = rnd
+		}
+	}
+	return modified, nil
+}
+
+// accountsChangedSinceCatchpoint returns the accounts modified by the rounds following the given catchpoint round, up
+// to the latest round, sorted by address. These are the accounts whose state diverged from the catchpoint snapshot
+// while replaying the blocks following it. Only the rounds retained in memory are scanned; once rounds past the
+// catchpoint round were committed to the accounts database, a RoundOffsetError is returned.
+func (au *accountUpdates) accountsChangedSinceCatchpoint(catchpointRound basics.Round) ([]basics.Address, error) {
+	au.accountsMu.RLock()
+	defer au.accountsMu.RUnlock()
+
+	if catchpointRound < au.dbRound {
+		return nil, &RoundOffsetError{
+			round:   catchpointRound,
+			dbRound: au.dbRound,
+		}
+	}
+	if catchpointRound > au.latest() {
+		return nil, fmt.Errorf("round %d too high: dbRound %d, deltas %d", catchpointRound, au.dbRound, len(au.deltas))
+	}
+
+	modified := make(map[basics.Address]bool)
+	for _, delta := range au.deltas[catchpointRound-au.dbRound:] {
+		for i := 0; i < delta.Len(); i++ {
+			addr, _ := delta.GetByIdx(i)
+			modified[addr] = true
+		}
+	}
+	changed := make([]basics.Address, 0, len(modified))
+	for addr := range modified {
+		changed = append(changed, addr)
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		return bytes.Compare(changed[i][:], changed[j][:]) < 0
+	})
+	return changed, nil
+}
+
 // committedUpTo enqueues committing the balances for round committedRound-lookback.
 // The deferred committing is done so that we could calculate the historical balances lookback rounds back.
 // Since we don't want to hold off the tracker's mutex for too long, we'll defer the database persistence of this
@@ -1123,6 +1287,19 @@ func (au *accountUpdates) initializeFromDisk(l ledgerForTracker) (lastBalancesRo
 		if err0 != nil {
 			return err0
 		}
+		// Complete a commit that was interrupted after its rounds were journaled
+		roundsReplayed, err0 := ReplayPendingJournal(tx)
+		if err0 != nil {
+			return err0
+		}
+		if roundsReplayed > 0 {
+			au.log.Infof("accountUpdates.initializeFromDisk: replayed %d pending journal rounds on top of round %v", roundsReplayed, au.dbRound)
+			// re-initialize to have the account hashes rebuilt for the replayed rounds
+			au.dbRound, err0 = au.accountsInitialize(ctx, tx)
+			if err0 != nil {
+				return err0
+			}
+		}
 		// Check for blocks DB and tracker DB un-sync
 		if au.dbRound > lastestBlockRound {
 			au.log.Warnf("accountUpdates.initializeFromDisk: resetting accounts DB (on round %v, but blocks DB's latest is %v)", au.dbRound, lastestBlockRound)
@@ -1142,6 +1319,33 @@ func (au *accountUpdates) initializeFromDisk(l ledgerForTracker) (lastBalancesRo
 		}
 
 		au.roundTotals = []ledgercore.AccountTotals{totals}
+
+		if au.accountsExistenceFilter {
+			accountsFilter, err0 := loadAccountsFilter(tx)
+			if err0 != nil {
+				return err0
+			}
+			au.accountsFilterMu.Lock()
+			au.accountsFilter = accountsFilter
+			au.accountsFilterMu.Unlock()
+		}
+
+		if au.assetHolderCounts {
+			err0 = accountsCreateAssetHolders(tx)
+		} else {
+			err0 = accountsDropAssetHolders(tx)
+		}
+		if err0 != nil {
+			return err0
+		}
+		if au.stateChecksum {
+			err0 = accountsCreateStateChecksum(tx)
+		} else {
+			err0 = accountsDropStateChecksum(tx)
+		}
+		if err0 != nil {
+			return err0
+		}
 		return nil
 	})
 
@@ -1189,8 +1393,62 @@ func (au *accountUpdates) initializeFromDisk(l ledgerForTracker) (lastBalancesRo
 	return
 }
 
+// loadAccountsFilter creates a bloom filter containing the addresses of all the accounts in the accountbase table.
+func loadAccountsFilter(tx *sql.Tx) (*bloom.Filter, error) {
+	var count int
+	err := tx.QueryRow("SELECT count(1) FROM accountbase").Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+	elements := 2 * count
+	if elements < accountsFilterMinElements {
+		elements = accountsFilterMinElements
+	}
+	sizeBits, numHashes := bloom.Optimal(elements, accountsFilterFalsePositiveRate)
+	filter := bloom.New(sizeBits, numHashes, 0)
+
+	rows, err := tx.Query("SELECT address FROM accountbase")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var addr []byte
+		err = rows.Scan(&addr)
+		if err != nil {
+			return nil, err
+		}
+		filter.Set(addr)
+	}
+	return filter, rows.Err()
+}
+
+// accountMightExist returns false if the given account is known not to exist in the accounts database, and true if it
+// might exist. It's meant to be used ahead of a database lookup, so that lookups of accounts that don't exist could be
+// avoided; a true result has to be confirmed by such a lookup. It always returns true when the filter isn't maintained.
+func (au *accountUpdates) accountMightExist(addr basics.Address) bool {
+	au.accountsFilterMu.Lock()
+	defer au.accountsFilterMu.Unlock()
+	if au.accountsFilter == nil {
+		return true
+	}
+	return au.accountsFilter.Test(addr[:])
+}
+
+// HashFactory creates the hash function used for calculating the account hashes stored in the catchpoint balances
+// trie. The created hash function must produce crypto.DigestSize long digests. A nil HashFactory stands for crypto.Hash.
+type HashFactory func() hash.Hash
+
 // accountHashBuilder calculates the hash key used for the trie by combining the account address and the account data
 func accountHashBuilder(addr basics.Address, accountData basics.AccountData, encodedAccountData []byte) []byte {
+	hash, _ := accountHashBuilderWithFactory(nil, addr, accountData, encodedAccountData)
+	return hash
+}
+
+// accountHashBuilderWithFactory is similar to accountHashBuilder, using the hash function created by hashFactory
+// for hashing the account address and the account data. A hash function producing digests of any size other than
+// crypto.DigestSize is rejected with an error.
+func accountHashBuilderWithFactory(hashFactory HashFactory, addr basics.Address, accountData basics.AccountData, encodedAccountData []byte) ([]byte, error) {
 	hash := make([]byte, 4+crypto.DigestSize)
 	// write out the lowest 32 bits of the reward base. This should improve the caching of the trie by allowing
 	// recent updated to be in-cache, and "older" nodes will be left alone.
@@ -1198,9 +1456,25 @@ func accountHashBuilder(addr basics.Address, accountData basics.AccountData, enc
 		// the following takes the rewards & 255 -> hash[i]
 		hash[i] = byte(rewards)
 	}
-	entryHash := crypto.Hash(append(addr[:], encodedAccountData[:]...))
-	copy(hash[4:], entryHash[:])
-	return hash[:]
+	if hashFactory == nil {
+		entryHash := crypto.Hash(append(addr[:], encodedAccountData[:]...))
+		copy(hash[4:], entryHash[:])
+		return hash[:], nil
+	}
+	h := hashFactory()
+	h.Write(addr[:])
+	h.Write(encodedAccountData)
+	entryHash := h.Sum(nil)
+	if len(entryHash) != crypto.DigestSize {
+		return nil, fmt.Errorf("account hash function produced a %d bytes digest instead of %d bytes", len(entryHash), crypto.DigestSize)
+	}
+	copy(hash[4:], entryHash)
+	return hash[:], nil
+}
+
+// accountHash calculates the hash key used for the trie of the given account, using the hash function of the tracker.
+func (au *accountUpdates) accountHash(addr basics.Address, accountData basics.AccountData, encodedAccountData []byte) ([]byte, error) {
+	return accountHashBuilderWithFactory(au.hashFactory, addr, accountData, encodedAccountData)
 }
 
 // accountsInitialize initializes the accounts DB if needed and return current account round.
@@ -1258,6 +1532,36 @@ func (au *accountUpdates) accountsInitialize(ctx context.Context, tx *sql.Tx) (b
 					au.log.Warnf("accountsInitialize failed to upgrade accounts database (ledger.tracker.sqlite) from schema 4 : %v", err)
 					return 0, err
 				}
+			case 5:
+				dbVersion, err = au.upgradeDatabaseSchema5(ctx, tx, newDatabase)
+				if err != nil {
+					au.log.Warnf("accountsInitialize failed to upgrade accounts database (ledger.tracker.sqlite) from schema 5 : %v", err)
+					return 0, err
+				}
+			case 6:
+				dbVersion, err = au.upgradeDatabaseSchema6(ctx, tx, newDatabase)
+				if err != nil {
+					au.log.Warnf("accountsInitialize failed to upgrade accounts database (ledger.tracker.sqlite) from schema 6 : %v", err)
+					return 0, err
+				}
+			case 7:
+				dbVersion, err = au.upgradeDatabaseSchema7(ctx, tx, newDatabase)
+				if err != nil {
+					au.log.Warnf("accountsInitialize failed to upgrade accounts database (ledger.tracker.sqlite) from schema 7 : %v", err)
+					return 0, err
+				}
+			case 8:
+				dbVersion, err = au.upgradeDatabaseSchema8(ctx, tx, newDatabase)
+				if err != nil {
+					au.log.Warnf("accountsInitialize failed to upgrade accounts database (ledger.tracker.sqlite) from schema 8 : %v", err)
+					return 0, err
+				}
+			case 9:
+				dbVersion, err = au.upgradeDatabaseSchema9(ctx, tx, newDatabase)
+				if err != nil {
+					au.log.Warnf("accountsInitialize failed to upgrade accounts database (ledger.tracker.sqlite) from schema 9 : %v", err)
+					return 0, err
+				}
 			default:
 				return 0, fmt.Errorf("accountsInitialize unable to upgrade database from schema version %d", dbVersion)
 			}
@@ -1304,7 +1608,7 @@ func (au *accountUpdates) accountsInitialize(ctx context.Context, tx *sql.Tx) (b
 
 	if rootHash.IsZero() {
 		au.log.Infof("accountsInitialize rebuilding merkle trie for round %d", rnd)
-		accountBuilderIt := makeOrderedAccountsIter(tx, trieRebuildAccountChunkSize)
+		accountBuilderIt := makeOrderedAccountsIter(tx, trieRebuildAccountChunkSize, au.hashFactory)
 		defer accountBuilderIt.Close(ctx)
 		startTrieBuildTime := time.Now()
 		accountsCount := 0
@@ -1553,7 +1857,11 @@ func (au *accountUpdates) upgradeDatabaseSchema4(ctx context.Context, tx *sql.Tx
 
 		var totalHashesDeleted int
 		for _, addr := range addresses {
-			hash := accountHashBuilder(addr, basics.AccountData{}, []byte{0x80})
+			hash, err := au.accountHash(addr, basics.AccountData{}, []byte{0x80})
+			if err != nil {
+				au.log.Errorf("upgradeDatabaseSchema4: failed to hash account %v: %v", addr, err)
+				continue
+			}
 			deleted, err := trie.Delete(hash)
 			if err != nil {
 				au.log.Errorf("upgradeDatabaseSchema4: failed to delete hash '%s' from merkle trie for account %v: %v", hex.EncodeToString(hash), addr, err)
@@ -1584,6 +1892,86 @@ done:
 	return 5, nil
 }
 
+// upgradeDatabaseSchema5 upgrades the database schema from version 5 to version 6,
+// adding the status column to the accountbase table.
+func (au *accountUpdates) upgradeDatabaseSchema5(ctx context.Context, tx *sql.Tx, newDatabase bool) (updatedDBVersion int32, err error) {
+	err = accountsAddStatus(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	// update version
+	_, err = db.SetUserVersion(ctx, tx, 6)
+	if err != nil {
+		return 0, fmt.Errorf("accountsInitialize unable to update database schema version from 5 to 6: %v", err)
+	}
+	return 6, nil
+}
+
+// upgradeDatabaseSchema6 upgrades the database schema from version 6 to version 7,
+// adding the indexed microalgos column to the accountbase table.
+func (au *accountUpdates) upgradeDatabaseSchema6(ctx context.Context, tx *sql.Tx, newDatabase bool) (updatedDBVersion int32, err error) {
+	err = accountsAddBalance(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	// update version
+	_, err = db.SetUserVersion(ctx, tx, 7)
+	if err != nil {
+		return 0, fmt.Errorf("accountsInitialize unable to update database schema version from 6 to 7: %v", err)
+	}
+	return 7, nil
+}
+
+// upgradeDatabaseSchema7 upgrades the database schema from version 7 to version 8,
+// adding the accountcount column to the accounttotals table.
+func (au *accountUpdates) upgradeDatabaseSchema7(ctx context.Context, tx *sql.Tx, newDatabase bool) (updatedDBVersion int32, err error) {
+	err = accountsAddAccountCount(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	// update version
+	_, err = db.SetUserVersion(ctx, tx, 8)
+	if err != nil {
+		return 0, fmt.Errorf("accountsInitialize unable to update database schema version from 7 to 8: %v", err)
+	}
+	return 8, nil
+}
+
+// upgradeDatabaseSchema8 upgrades the database schema from version 8 to version 9,
+// adding the appcreatorcounts table.
+func (au *accountUpdates) upgradeDatabaseSchema8(ctx context.Context, tx *sql.Tx, newDatabase bool) (updatedDBVersion int32, err error) {
+	err = accountsAddAppCounts(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	// update version
+	_, err = db.SetUserVersion(ctx, tx, 9)
+	if err != nil {
+		return 0, fmt.Errorf("accountsInitialize unable to update database schema version from 8 to 9: %v", err)
+	}
+	return 9, nil
+}
+
+// upgradeDatabaseSchema9 upgrades the database schema from version 9 to version 10,
+// adding the pendingjournal table.
+func (au *accountUpdates) upgradeDatabaseSchema9(ctx context.Context, tx *sql.Tx, newDatabase bool) (updatedDBVersion int32, err error) {
+	_, err = tx.ExecContext(ctx, createPendingJournalTable)
+	if err != nil {
+		return 0, err
+	}
+
+	// update version
+	_, err = db.SetUserVersion(ctx, tx, 10)
+	if err != nil {
+		return 0, fmt.Errorf("accountsInitialize unable to update database schema version from 9 to 10: %v", err)
+	}
+	return 10, nil
+}
+
 // deleteStoredCatchpoints iterates over the storedcatchpoints table and deletes all the files stored on disk.
 // once all the files have been deleted, it would go ahead and remove the entries from the table.
 func (au *accountUpdates) deleteStoredCatchpoints(ctx context.Context, dbQueries *accountsDbQueries) (err error) {
@@ -1628,7 +2016,11 @@ func (au *accountUpdates) accountsUpdateBalances(accountsDeltas compactAccountDe
 	for i := 0; i < accountsDeltas.len(); i++ {
 		addr, delta := accountsDeltas.getByIdx(i)
 		if !delta.old.accountData.IsZero() {
-			deleteHash := accountHashBuilder(addr, delta.old.accountData, protocol.Encode(&delta.old.accountData))
+			var deleteHash []byte
+			deleteHash, err = au.accountHash(addr, delta.old.accountData, protocol.Encode(&delta.old.accountData))
+			if err != nil {
+				return err
+			}
 			deleted, err = au.balancesTrie.Delete(deleteHash)
 			if err != nil {
 				return fmt.Errorf("failed to delete hash '%s' from merkle trie for account %v: %w", hex.EncodeToString(deleteHash), addr, err)
@@ -1641,7 +2033,11 @@ func (au *accountUpdates) accountsUpdateBalances(accountsDeltas compactAccountDe
 		}
 
 		if !delta.new.IsZero() {
-			addHash := accountHashBuilder(addr, delta.new, protocol.Encode(&delta.new))
+			var addHash []byte
+			addHash, err = au.accountHash(addr, delta.new, protocol.Encode(&delta.new))
+			if err != nil {
+				return err
+			}
 			added, err = au.balancesTrie.Add(addHash)
 			if err != nil {
 				return fmt.Errorf("attempted to add duplicate hash '%s' to merkle trie for account %v: %w", hex.EncodeToString(addHash), addr, err)
@@ -1683,6 +2079,13 @@ func (au *accountUpdates) newBlockImpl(blk bookkeeping.Block, delta ledgercore.S
 	if rnd != au.latest()+1 {
 		au.log.Panicf("accountUpdates: newBlockImpl %d too far in the future, dbRound %d, deltas %d", rnd, au.dbRound, len(au.deltas))
 	}
+	if au.strictAccountsValidation {
+		// the block was already agreed upon, so there is no rejecting it; report the inconsistency instead.
+		if err := validateCreatables(delta); err != nil {
+			ledgerInconsistentCreatablesCount.Inc(nil)
+			au.log.Errorf("accountUpdates: newBlockImpl %d has inconsistent creatables : %v", rnd, err)
+		}
+	}
 	au.deltas = append(au.deltas, delta.Accts)
 	au.versions = append(au.versions, blk.CurrentProtocol)
 	au.creatableDeltas = append(au.creatableDeltas, delta.Creatables)
@@ -1817,6 +2220,11 @@ func (au *accountUpdates) lookupWithRewards(rnd basics.Round, addr basics.Addres
 			return macct.accountData, nil
 		}
 
+		// the account doesn't appear in the deltas, and it's known not to exist in the database.
+		if !au.accountMightExist(addr) {
+			return basics.AccountData{}, nil
+		}
+
 		au.accountsMu.RUnlock()
 		needUnlock = false
 
@@ -1902,6 +2310,11 @@ func (au *accountUpdates) lookupWithoutRewards(rnd basics.Round, addr basics.Add
 			return macct.accountData, rnd, nil
 		}
 
+		// the account doesn't appear in the deltas, and it's known not to exist in the database.
+		if !au.accountMightExist(addr) {
+			return basics.AccountData{}, rnd, nil
+		}
+
 		if synchronized {
 			au.accountsMu.RUnlock()
 			needUnlock = false
@@ -2061,6 +2474,23 @@ func (au *accountUpdates) commitSyncer(deferedCommits chan deferredCommit) {
 	}
 }
 
+// validateDeltasAccounts validates the accounts modified by each of the given rounds against the consensus protocol of
+// that round. The rounds are the ones following dbRound, and versions holds the consensus version of each of them.
+func validateDeltasAccounts(deltas []ledgercore.AccountDeltas, versions []protocol.ConsensusVersion, dbRound basics.Round) error {
+	for i := range deltas {
+		proto := config.Consensus[versions[i]]
+		for j := 0; j < deltas[i].Len(); j++ {
+			addr, data := deltas[i].GetByIdx(j)
+			pad := persistedAccountData{addr: addr, accountData: data}
+			err := pad.validate(proto)
+			if err != nil {
+				return fmt.Errorf("round %d: %v", dbRound+basics.Round(i)+1, err)
+			}
+		}
+	}
+	return nil
+}
+
 // commitRound write to the database a "chunk" of rounds, and update the dbRound accordingly.
 func (au *accountUpdates) commitRound(offset uint64, dbRound basics.Round, lookback basics.Round) {
 	var stats telemetryspec.AccountsUpdateMetrics
@@ -2131,6 +2561,17 @@ func (au *accountUpdates) commitRound(offset uint64, dbRound basics.Round, lookb
 		committedRoundDigest = au.roundDigest[offset+uint64(lookback)-1]
 	}
 
+	var journal []JournalEntry
+	if au.writeAheadJournal {
+		journal = au.makePendingJournal(offset)
+	}
+
+	var versions []protocol.ConsensusVersion
+	if au.strictAccountsValidation {
+		versions = make([]protocol.ConsensusVersion, offset)
+		copy(versions, au.versions[1:offset+1])
+	}
+
 	// compact all the deltas - when we're trying to persist multiple rounds, we might have the same account
 	// being updated multiple times. When that happen, we can safely omit the intermediate updates.
 	compactDeltas := makeCompactAccountDeltas(deltas, au.baseAccounts)
@@ -2156,9 +2597,41 @@ func (au *accountUpdates) commitRound(offset uint64, dbRound basics.Round, lookb
 	start := time.Now()
 	ledgerCommitroundCount.Inc(nil)
 	var updatedPersistedAccounts []persistedAccountData
+	// switch the synchronous mode according to the catching up state before writing the batch.
+	if synchronousMode := au.roundSynchronousMode(); synchronousMode != au.commitSynchronousMode {
+		err := au.dbs.Wdb.SetSynchronousMode(context.Background(), synchronousMode, synchronousMode >= db.SynchronousModeFull)
+		if err != nil {
+			au.log.Warnf("unable to set synchronous mode to %d during committedUpTo: %v", synchronousMode, err)
+		} else {
+			au.commitSynchronousMode = synchronousMode
+		}
+	}
+
+	if au.strictAccountsValidation {
+		// the rounds were already agreed upon, and are committed regardless; holding them back would only accumulate them
+		// in memory, as they would fail the validation again on every attempt.
+		err := validateDeltasAccounts(deltas, versions, dbRound)
+		if err != nil {
+			ledgerStrictValidationFailuresCount.Inc(nil)
+			au.log.Errorf("accounts of rounds %d-%d failed the strict validation: %v", dbRound+1, dbRound+basics.Round(offset), err)
+		}
+	}
+
+	if len(journal) > 0 {
+		err := au.dbs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+			return writePendingJournal(tx, journal)
+		})
+		if err != nil {
+			au.log.Warnf("unable to write the pending journal for rounds %d-%d: %v", dbRound+1, dbRound+basics.Round(offset), err)
+			return
+		}
+	}
+
 	if updateStats {
 		stats.DatabaseCommitDuration = time.Duration(time.Now().UnixNano())
 	}
+	var accountsWritingDuration, roundUpdateDuration time.Duration
+	var transactionDoneTime time.Time
 	err := au.dbs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) (err error) {
 		treeTargetRound := basics.Round(0)
 		if au.catchpointInterval > 0 {
@@ -2216,19 +2689,30 @@ func (au *accountUpdates) commitRound(offset uint64, dbRound basics.Round, lookb
 
 		// the updates of the actual account data is done last since the accountsNewRound would modify the compactDeltas old values
 		// so that we can update the base account back.
+		accountsWritingStart := time.Now()
 		updatedPersistedAccounts, err = accountsNewRound(tx, compactDeltas, compactCreatableDeltas, genesisProto, dbRound+basics.Round(offset))
 		if err != nil {
 			return err
 		}
+		accountsWritingDuration = time.Now().Sub(accountsWritingStart)
 
 		if updateStats {
 			stats.AccountsWritingDuration = time.Duration(time.Now().UnixNano()) - stats.AccountsWritingDuration
 		}
 
+		roundUpdateStart := time.Now()
 		err = updateAccountsRound(tx, dbRound+basics.Round(offset), treeTargetRound)
 		if err != nil {
 			return err
 		}
+		roundUpdateDuration = time.Now().Sub(roundUpdateStart)
+
+		if len(journal) > 0 {
+			err = clearPendingJournal(tx, dbRound+basics.Round(offset))
+			if err != nil {
+				return err
+			}
+		}
 
 		if isCatchpointRound {
 			trieBalancesHash, err = au.balancesTrie.RootHash()
@@ -2236,15 +2720,52 @@ func (au *accountUpdates) commitRound(offset uint64, dbRound basics.Round, lookb
 				return
 			}
 		}
+		transactionDoneTime = time.Now()
 		return nil
 	})
 	ledgerCommitroundMicros.AddMicrosecondsSince(start, nil)
 	if err != nil {
 		au.balancesTrie = nil
 		au.log.Warnf("unable to advance account snapshot (%d-%d): %v", dbRound, dbRound+basics.Round(offset), err)
+		// the transaction was rolled back; make sure that the cached base accounts don't reflect any of its changes
+		addrs := make([]basics.Address, compactDeltas.len())
+		for i := range addrs {
+			addrs[i], _ = compactDeltas.getByIdx(i)
+		}
+		au.accountsMu.Lock()
+		au.baseAccounts.invalidate(addrs)
+		au.accountsMu.Unlock()
+		// the rounds weren't committed; make sure that they won't get replayed from the journal on the next startup
+		if len(journal) > 0 {
+			err = au.dbs.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+				return discardPendingJournal(tx)
+			})
+			if err != nil {
+				au.log.Warnf("unable to discard the pending journal for rounds %d-%d: %v", dbRound+1, dbRound+basics.Round(offset), err)
+			}
+		}
 		return
 	}
 
+	// add the accounts created by the committed rounds to the accounts filter. This has to happen before their deltas are
+	// released below, as lookups consult the filter only for accounts which don't appear in the deltas.
+	au.accountsFilterMu.Lock()
+	if au.accountsFilter != nil {
+		for i := 0; i < compactDeltas.len(); i++ {
+			addr, delta := compactDeltas.getByIdx(i)
+			if !delta.new.IsZero() {
+				au.accountsFilter.Set(addr[:])
+			}
+		}
+	}
+	au.accountsFilterMu.Unlock()
+
+	if au.commitLatencyHistogram {
+		ledgerCommitroundAccountsWritingSeconds.Observe(accountsWritingDuration.Seconds())
+		ledgerCommitroundRoundUpdateSeconds.Observe(roundUpdateDuration.Seconds())
+		ledgerCommitroundTransactionCommitSeconds.Observe(time.Now().Sub(transactionDoneTime).Seconds())
+	}
+
 	if updateStats {
 		stats.DatabaseCommitDuration = time.Duration(time.Now().UnixNano()) - stats.DatabaseCommitDuration - stats.AccountsWritingDuration - stats.MerkleTrieUpdateDuration - stats.OldAccountPreloadDuration
 	}
@@ -2349,6 +2870,44 @@ func (au *accountUpdates) commitRound(offset uint64, dbRound basics.Round, lookb
 
 }
 
+// makePendingJournal returns the journal entries of the next offset rounds to be committed. It expects the caller
+// to hold the accountsMu read lock.
+func (au *accountUpdates) makePendingJournal(offset uint64) []JournalEntry {
+	journal := make([]JournalEntry, offset)
+	for i := range journal {
+		journal[i] = makeJournalEntry(au.dbRound+basics.Round(i+1), au.versions[i+1], au.roundTotals[i+1].RewardsLevel, au.deltas[i], au.creatableDeltas[i])
+	}
+	return journal
+}
+
+// validateCreatables verifies that the creatables of a single round's state delta are consistent with its account
+// deltas : a created creatable must appear in the params of its creator, and a deleted one must be gone from them.
+// Since a round's delta wasn't merged with any other delta yet, none of its creatables can have been counted already.
+func validateCreatables(mods ledgercore.StateDelta) error {
+	for cidx, mc := range mods.Creatables {
+		if mc.Ndeltas != 0 {
+			return fmt.Errorf("creatable %d was already counted %d times", cidx, mc.Ndeltas)
+		}
+		creator, ok := mods.Accts.Get(mc.Creator)
+		if !ok {
+			return fmt.Errorf("creatable %d was modified, but its creator %v wasn't", cidx, mc.Creator)
+		}
+		var exists bool
+		switch mc.Ctype {
+		case basics.AssetCreatable:
+			_, exists = creator.AssetParams[basics.AssetIndex(cidx)]
+		case basics.AppCreatable:
+			_, exists = creator.AppParams[basics.AppIndex(cidx)]
+		default:
+			return fmt.Errorf("creatable %d has an unknown type %d", cidx, mc.Ctype)
+		}
+		if exists != mc.Created {
+			return fmt.Errorf("creatable %d is marked with created=%v, but its creator %v has params=%v", cidx, mc.Created, mc.Creator, exists)
+		}
+	}
+	return nil
+}
+
 // compactCreatableDeltas takes an array of creatables map deltas ( one array entry per round ), and compact the array into a single
 // map that contains all the deltas changes. While doing that, the function eliminate any intermediate changes.
 // It counts the number of changes per round by specifying it in the ndeltas field of the modifiedCreatable.
@@ -2567,7 +3126,7 @@ func (au *accountUpdates) vacuumDatabase(ctx context.Context) (err error) {
 
 	// vaccumming the database would modify the some of the tables rowid, so we need to make sure any stored in-memory
 	// rowid are flushed.
-	au.baseAccounts.prune(0)
+	au.baseAccounts.invalidateAll()
 
 	startTime := time.Now()
 	vacuumExitCh := make(chan struct{}, 1)
@@ -2626,3 +3185,15 @@ var ledgerGeneratecatchpointCount = metrics.NewCounter("ledger_generatecatchpoin
 var ledgerGeneratecatchpointMicros = metrics.NewCounter("ledger_generatecatchpoint_micros", "µs spent")
 var ledgerVacuumCount = metrics.NewCounter("ledger_vacuum_count", "calls")
 var ledgerVacuumMicros = metrics.NewCounter("ledger_vacuum_micros", "µs spent")
+var ledgerInconsistentCreatablesCount = metrics.NewCounter("ledger_inconsistent_creatables_count", "rounds")
+var ledgerNormalizedBalanceMismatchesCount = metrics.NewCounter("ledger_normalized_balance_mismatches_count", "accounts")
+var ledgerStrictValidationFailuresCount = metrics.NewCounter("ledger_strict_validation_failures_count", "failures")
+var ledgerAccountsCacheHitsCount = metrics.NewCounter("ledger_accountscache_hits_count", "hits")
+var ledgerAccountsCacheMissesCount = metrics.NewCounter("ledger_accountscache_misses_count", "misses")
+
+// commitLatencyBuckets are the upper bounds, in seconds, of the buckets used for the commitRound latency histograms.
+var commitLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var ledgerCommitroundAccountsWritingSeconds = metrics.MakeHistogram(metrics.MetricName{Name: "ledger_commitround_accounts_writing_seconds", Description: "time spent writing the accounts on commitRound"}, commitLatencyBuckets)
+var ledgerCommitroundRoundUpdateSeconds = metrics.MakeHistogram(metrics.MetricName{Name: "ledger_commitround_round_update_seconds", Description: "time spent updating the accounts round on commitRound"}, commitLatencyBuckets)
+var ledgerCommitroundTransactionCommitSeconds = metrics.MakeHistogram(metrics.MetricName{Name: "ledger_commitround_transaction_commit_seconds", Description: "time spent committing the database transaction on commitRound"}, commitLatencyBuckets)
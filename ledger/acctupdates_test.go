@@ -19,6 +19,7 @@ package ledger
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -26,6 +27,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -35,12 +37,14 @@ import (
 
 	"github.com/algorand/go-algorand/config"
 	"github.com/algorand/go-algorand/crypto"
+	"github.com/algorand/go-algorand/crypto/merkletrie"
 	"github.com/algorand/go-algorand/data/basics"
 	"github.com/algorand/go-algorand/data/bookkeeping"
 	"github.com/algorand/go-algorand/ledger/ledgercore"
 	"github.com/algorand/go-algorand/logging"
 	"github.com/algorand/go-algorand/protocol"
 	"github.com/algorand/go-algorand/util/db"
+	"github.com/algorand/go-algorand/util/metrics"
 )
 
 type mockLedgerForTracker struct {
@@ -392,6 +396,811 @@ func TestAcctUpdates(t *testing.T) {
 	}
 }
 
+func TestAcctUpdatesDeltaWindow(t *testing.T) {
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	ml := makeMockLedgerForTracker(t, true, 10, protocol.ConsensusCurrentVersion)
+	defer ml.Close()
+
+	accts := randomAccounts(20, true)
+	pooldata := basics.AccountData{}
+	pooldata.MicroAlgos.Raw = 1000 * 1000 * 1000 * 1000
+	pooldata.Status = basics.NotParticipating
+	accts[testPoolAddr] = pooldata
+
+	au := &accountUpdates{}
+	au.initialize(config.GetDefaultLocal(), ".", proto, accts)
+	defer au.close()
+
+	err := au.loadFromDisk(ml)
+	require.NoError(t, err)
+
+	oldest, newest := au.DeltaWindow()
+	require.Equal(t, basics.Round(1), oldest)
+	require.Equal(t, basics.Round(9), newest)
+
+	lastRound := basics.Round(proto.MaxBalLookback + 15)
+	for i := basics.Round(10); i <= lastRound; i++ {
+		blk := bookkeeping.Block{
+			BlockHeader: bookkeeping.BlockHeader{
+				Round: basics.Round(i),
+			},
+		}
+		blk.CurrentProtocol = protocol.ConsensusCurrentVersion
+		au.newBlock(blk, ledgercore.MakeStateDelta(&blk.BlockHeader, 0, 0, 0))
+
+		oldest, newest = au.DeltaWindow()
+		require.Equal(t, basics.Round(1), oldest)
+		require.Equal(t, i, newest)
+	}
+
+	for i := basics.Round(1); i <= 15; i++ {
+		// Clear the timer to ensure a flush
+		au.lastFlushTime = time.Time{}
+
+		au.committedUpTo(basics.Round(proto.MaxBalLookback) + i)
+		au.waitAccountsWriting()
+
+		oldest, newest = au.DeltaWindow()
+		require.Equal(t, i+1, oldest)
+		require.Equal(t, lastRound, newest)
+		require.Equal(t, len(au.deltas), int(newest-oldest)+1)
+
+		// the window bounds are served, as is the round preceding it from the accounts database, while earlier rounds are too old
+		_, err = au.LookupWithRewards(oldest, testPoolAddr)
+		require.NoError(t, err)
+		_, err = au.LookupWithRewards(newest, testPoolAddr)
+		require.NoError(t, err)
+		_, err = au.LookupWithRewards(oldest-1, testPoolAddr)
+		require.NoError(t, err)
+		_, err = au.LookupWithRewards(oldest-2, testPoolAddr)
+		require.Error(t, err)
+		_, ok := err.(*RoundOffsetError)
+		require.True(t, ok)
+		_, err = au.LookupWithRewards(newest+1, testPoolAddr)
+		require.Error(t, err)
+	}
+}
+
+func TestAcctUpdatesAccountsModifiedInRange(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	ml := makeMockLedgerForTracker(t, true, 10, protocol.ConsensusCurrentVersion)
+	defer ml.Close()
+
+	accts := randomAccounts(20, true)
+	pooldata := basics.AccountData{}
+	pooldata.MicroAlgos.Raw = 1000 * 1000 * 1000 * 1000
+	pooldata.Status = basics.NotParticipating
+	accts[testPoolAddr] = pooldata
+
+	au := &accountUpdates{}
+	au.initialize(config.GetDefaultLocal(), ".", proto, accts)
+	defer au.close()
+
+	err := au.loadFromDisk(ml)
+	a.NoError(err)
+
+	var addrs []basics.Address
+	for addr := range accts {
+		if addr != testPoolAddr {
+			addrs = append(addrs, addr)
+		}
+	}
+	addrA, addrB, addrC := addrs[0], addrs[1], addrs[2]
+	modifications := map[basics.Round][]basics.Address{
+		10: {addrA, addrB},
+		11: {addrB, addrC},
+		12: {},
+		13: {addrA},
+	}
+	for rnd := basics.Round(10); rnd <= 13; rnd++ {
+		blk := bookkeeping.Block{
+			BlockHeader: bookkeeping.BlockHeader{
+				Round: rnd,
+			},
+		}
+		blk.CurrentProtocol = protocol.ConsensusCurrentVersion
+		delta := ledgercore.MakeStateDelta(&blk.BlockHeader, 0, 0, 0)
+		for _, addr := range modifications[rnd] {
+			// keep the balances intact, so that the totals are preserved
+			ad := accts[addr]
+			ad.VoteLastValid++
+			accts[addr] = ad
+			delta.Accts.Upsert(addr, ad)
+		}
+		au.newBlock(blk, delta)
+	}
+
+	modified, err := au.accountsModifiedInRange(10, 13)
+	a.NoError(err)
+	a.Equal(map[basics.Address]basics.Round{addrA: 13, addrB: 11, addrC: 11}, modified)
+
+	modified, err = au.accountsModifiedInRange(11, 12)
+	a.NoError(err)
+	a.Equal(map[basics.Address]basics.Round{addrB: 11, addrC: 11}, modified)
+
+	modified, err = au.accountsModifiedInRange(12, 12)
+	a.NoError(err)
+	a.Empty(modified)
+
+	// the rounds of the accounts database are too old, and the future ones are unknown
+	_, err = au.accountsModifiedInRange(0, 13)
+	a.Error(err)
+	_, ok := err.(*RoundOffsetError)
+	a.True(ok)
+	_, err = au.accountsModifiedInRange(10, 14)
+	a.Error(err)
+}
+
+func TestAcctUpdatesAccountsChangedSinceCatchpoint(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	ml := makeMockLedgerForTracker(t, true, 10, protocol.ConsensusCurrentVersion)
+	defer ml.Close()
+
+	accts := randomAccounts(20, true)
+	pooldata := basics.AccountData{}
+	pooldata.MicroAlgos.Raw = 1000 * 1000 * 1000 * 1000
+	pooldata.Status = basics.NotParticipating
+	accts[testPoolAddr] = pooldata
+
+	au := &accountUpdates{}
+	au.initialize(config.GetDefaultLocal(), ".", proto, accts)
+	defer au.close()
+
+	err := au.loadFromDisk(ml)
+	a.NoError(err)
+
+	// the catchpoint blocks are replayed forward from the latest round
+	catchpointRound := au.latest()
+	changed, err := au.accountsChangedSinceCatchpoint(catchpointRound)
+	a.NoError(err)
+	a.Empty(changed)
+
+	var addrs []basics.Address
+	for addr := range accts {
+		if addr != testPoolAddr {
+			addrs = append(addrs, addr)
+		}
+	}
+	addrA, addrB, addrC := addrs[0], addrs[1], addrs[2]
+	modifications := [][]basics.Address{{addrA, addrB}, {addrB}, {addrC}}
+	for i, modified := range modifications {
+		rnd := catchpointRound + basics.Round(i) + 1
+		blk := bookkeeping.Block{
+			BlockHeader: bookkeeping.BlockHeader{
+				Round: rnd,
+			},
+		}
+		blk.CurrentProtocol = protocol.ConsensusCurrentVersion
+		delta := ledgercore.MakeStateDelta(&blk.BlockHeader, 0, 0, 0)
+		for _, addr := range modified {
+			// keep the balances intact, so that the totals are preserved
+			ad := accts[addr]
+			ad.VoteLastValid++
+			accts[addr] = ad
+			delta.Accts.Upsert(addr, ad)
+		}
+		au.newBlock(blk, delta)
+	}
+
+	sorted := func(addrs ...basics.Address) []basics.Address {
+		sort.Slice(addrs, func(i, j int) bool {
+			return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+		})
+		return addrs
+	}
+	changed, err = au.accountsChangedSinceCatchpoint(catchpointRound)
+	a.NoError(err)
+	a.Equal(sorted(addrA, addrB, addrC), changed)
+
+	// a later catchpoint excludes the changes made up to its round
+	changed, err = au.accountsChangedSinceCatchpoint(catchpointRound + 1)
+	a.NoError(err)
+	a.Equal(sorted(addrB, addrC), changed)
+	changed, err = au.accountsChangedSinceCatchpoint(catchpointRound + 3)
+	a.NoError(err)
+	a.Empty(changed)
+
+	// an earlier catchpoint within the in-memory window includes the unmodified rounds preceding it
+	changed, err = au.accountsChangedSinceCatchpoint(catchpointRound - 1)
+	a.NoError(err)
+	a.Equal(sorted(addrA, addrB, addrC), changed)
+
+	// the window doesn't reach back past the accounts database round, and a future catchpoint is unknown
+	_, err = au.accountsChangedSinceCatchpoint(catchpointRound + 4)
+	a.Error(err)
+	// emulate the oldest round in memory being committed
+	au.dbRound, au.deltas = au.dbRound+1, au.deltas[1:]
+	_, err = au.accountsChangedSinceCatchpoint(au.dbRound - 1)
+	a.Error(err)
+	_, ok := err.(*RoundOffsetError)
+	a.True(ok)
+}
+
+func TestAcctUpdatesAccountMightExist(t *testing.T) {
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	ml := makeMockLedgerForTracker(t, true, 10, protocol.ConsensusCurrentVersion)
+	defer ml.Close()
+
+	accts := randomAccounts(50, true)
+	pooldata := basics.AccountData{}
+	pooldata.MicroAlgos.Raw = 1000 * 1000 * 1000 * 1000
+	pooldata.Status = basics.NotParticipating
+	accts[testPoolAddr] = pooldata
+
+	// the filter isn't maintained unless enabled
+	au := &accountUpdates{}
+	au.initialize(config.GetDefaultLocal(), ".", proto, accts)
+	err := au.loadFromDisk(ml)
+	require.NoError(t, err)
+	require.Nil(t, au.accountsFilter)
+	require.True(t, au.accountMightExist(randomAddress()))
+	au.close()
+
+	cfg := config.GetDefaultLocal()
+	cfg.EnableAccountsExistenceFilter = true
+	au = &accountUpdates{}
+	au.initialize(cfg, ".", proto, accts)
+	defer au.close()
+
+	err = au.loadFromDisk(ml)
+	require.NoError(t, err)
+
+	for addr := range accts {
+		require.True(t, au.accountMightExist(addr))
+	}
+
+	// create a batch of accounts, and delete some of the existing ones
+	allAddrs := make([]basics.Address, 0, len(accts))
+	for addr := range accts {
+		allAddrs = append(allAddrs, addr)
+	}
+	genesisAccounts := len(allAddrs)
+	lastRound := basics.Round(proto.MaxBalLookback + 15)
+	for i := basics.Round(10); i <= lastRound; i++ {
+		blk := bookkeeping.Block{
+			BlockHeader: bookkeeping.BlockHeader{
+				Round: basics.Round(i),
+			},
+		}
+		blk.CurrentProtocol = protocol.ConsensusCurrentVersion
+		delta := ledgercore.MakeStateDelta(&blk.BlockHeader, 0, 0, 0)
+		// the created accounts are funded by the pool, and the deleted accounts are closed out to it
+		for j := 0; j < 5; j++ {
+			addr := randomAddress()
+			delta.Accts.Upsert(addr, basics.AccountData{MicroAlgos: basics.MicroAlgos{Raw: 1000000}})
+			pooldata.MicroAlgos.Raw -= 1000000
+			allAddrs = append(allAddrs, addr)
+		}
+		if i%4 == 0 {
+			for addr, data := range accts {
+				if addr != testPoolAddr {
+					delta.Accts.Upsert(addr, basics.AccountData{})
+					pooldata.MicroAlgos.Raw += data.MicroAlgos.Raw
+					delete(accts, addr)
+					break
+				}
+			}
+		}
+		delta.Accts.Upsert(testPoolAddr, pooldata)
+		au.newBlock(blk, delta)
+
+		// the accounts created by the uncommitted rounds are found in the deltas, ahead of consulting the filter
+		for _, addr := range allAddrs[len(allAddrs)-5:] {
+			data, _, err := au.LookupWithoutRewards(i, addr)
+			require.NoError(t, err)
+			require.Equal(t, uint64(1000000), data.MicroAlgos.Raw)
+		}
+	}
+
+	for i := basics.Round(1); i <= 15; i++ {
+		// Clear the timer to ensure a flush
+		au.lastFlushTime = time.Time{}
+		au.committedUpTo(basics.Round(proto.MaxBalLookback) + i)
+		au.waitAccountsWriting()
+	}
+	// the accounts created by the committed rounds are added to the filter, and the deleted ones are kept in it;
+	// the accounts created by the rounds which weren't committed yet are still found in the deltas
+	require.Equal(t, basics.Round(15), au.dbRound)
+	for _, addr := range allAddrs {
+		_, indeltas := au.accounts[addr]
+		require.True(t, indeltas || au.accountMightExist(addr))
+	}
+	// rounds 10 to 15 were committed, creating 5 accounts each
+	for _, addr := range allAddrs[:genesisAccounts+5*6] {
+		require.True(t, au.accountMightExist(addr))
+	}
+
+	// reloading from disk keeps every persisted account in the filter
+	au.close()
+	err = au.loadFromDisk(ml)
+	require.NoError(t, err)
+	for addr := range accts {
+		require.True(t, au.accountMightExist(addr))
+	}
+
+	// the filter does filter out most of the accounts that don't exist
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if au.accountMightExist(randomAddress()) {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, 100)
+
+	// the lookups of accounts which don't exist are answered without failing
+	for i := 0; i < 10; i++ {
+		data, _, err := au.LookupWithoutRewards(au.dbRound, randomAddress())
+		require.NoError(t, err)
+		require.True(t, data.IsZero())
+	}
+}
+
+func TestAcctUpdatesCommitLatencyHistogram(t *testing.T) {
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	ml := makeMockLedgerForTracker(t, true, 10, protocol.ConsensusCurrentVersion)
+	defer ml.Close()
+
+	accts := randomAccounts(20, true)
+	pooldata := basics.AccountData{}
+	pooldata.MicroAlgos.Raw = 1000 * 1000 * 1000 * 1000
+	pooldata.Status = basics.NotParticipating
+	accts[testPoolAddr] = pooldata
+
+	cfg := config.GetDefaultLocal()
+	cfg.EnableAccountsCommitLatencyHistogram = true
+
+	au := &accountUpdates{}
+	au.initialize(cfg, ".", proto, accts)
+	defer au.close()
+
+	err := au.loadFromDisk(ml)
+	require.NoError(t, err)
+
+	lastRound := basics.Round(proto.MaxBalLookback + 15)
+	for i := basics.Round(10); i <= lastRound; i++ {
+		blk := bookkeeping.Block{
+			BlockHeader: bookkeeping.BlockHeader{
+				Round: basics.Round(i),
+			},
+		}
+		blk.CurrentProtocol = protocol.ConsensusCurrentVersion
+		au.newBlock(blk, ledgercore.MakeStateDelta(&blk.BlockHeader, 0, 0, 0))
+	}
+
+	histograms := []*metrics.Histogram{ledgerCommitroundAccountsWritingSeconds, ledgerCommitroundRoundUpdateSeconds, ledgerCommitroundTransactionCommitSeconds}
+	observed := func(h *metrics.Histogram) (total uint64) {
+		for _, count := range h.BucketCounts() {
+			total += count
+		}
+		return
+	}
+	before := make([]uint64, len(histograms))
+	for i, h := range histograms {
+		before[i] = observed(h)
+	}
+
+	const rounds = 5
+	for i := basics.Round(1); i <= rounds; i++ {
+		// Clear the timer to ensure a flush
+		au.lastFlushTime = time.Time{}
+		au.committedUpTo(basics.Round(proto.MaxBalLookback) + i)
+		au.waitAccountsWriting()
+	}
+
+	for i, h := range histograms {
+		require.Equal(t, before[i]+rounds, observed(h))
+	}
+}
+
+func TestAcctUpdatesCatchupSynchronousMode(t *testing.T) {
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	ml := makeMockLedgerForTracker(t, true, 10, protocol.ConsensusCurrentVersion)
+	defer ml.Close()
+
+	accts := randomAccounts(20, true)
+	pooldata := basics.AccountData{}
+	pooldata.MicroAlgos.Raw = 1000 * 1000 * 1000 * 1000
+	pooldata.Status = basics.NotParticipating
+	accts[testPoolAddr] = pooldata
+
+	cfg := config.GetDefaultLocal()
+	cfg.LedgerSynchronousMode = int(db.SynchronousModeFull)
+	cfg.CatchupLedgerSynchronousMode = int(db.SynchronousModeOff)
+
+	au := &accountUpdates{}
+	au.initialize(cfg, ".", proto, accts)
+	defer au.close()
+
+	err := au.loadFromDisk(ml)
+	require.NoError(t, err)
+	require.Equal(t, db.SynchronousModeFull, au.roundSynchronousMode())
+
+	lastRound := basics.Round(proto.MaxBalLookback + 15)
+	for i := basics.Round(10); i <= lastRound; i++ {
+		blk := bookkeeping.Block{
+			BlockHeader: bookkeeping.BlockHeader{
+				Round: basics.Round(i),
+			},
+		}
+		blk.CurrentProtocol = protocol.ConsensusCurrentVersion
+		au.newBlock(blk, ledgercore.MakeStateDelta(&blk.BlockHeader, 0, 0, 0))
+	}
+
+	commit := func(rnd basics.Round) {
+		// Clear the timer to ensure a flush
+		au.lastFlushTime = time.Time{}
+		au.committedUpTo(rnd)
+		au.waitAccountsWriting()
+	}
+
+	// entering catchup switches the mode on the next committed batch
+	au.setCatchingUp(true)
+	require.Equal(t, db.SynchronousModeOff, au.roundSynchronousMode())
+	commit(basics.Round(proto.MaxBalLookback) + 1)
+	require.Equal(t, db.SynchronousModeOff, au.commitSynchronousMode)
+	commit(basics.Round(proto.MaxBalLookback) + 2)
+	require.Equal(t, db.SynchronousModeOff, au.commitSynchronousMode)
+
+	// leaving catchup restores the steady-state mode
+	au.setCatchingUp(false)
+	require.Equal(t, db.SynchronousModeFull, au.roundSynchronousMode())
+	commit(basics.Round(proto.MaxBalLookback) + 3)
+	require.Equal(t, db.SynchronousModeFull, au.commitSynchronousMode)
+}
+
+// TestAcctUpdatesPendingJournalReplay tests that rounds journaled by commitRound, but not yet committed to the
+// accounts tables, are replayed on the next startup.
+func TestAcctUpdatesPendingJournalReplay(t *testing.T) {
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	ml := makeMockLedgerForTracker(t, true, 1, protocol.ConsensusCurrentVersion)
+	defer ml.Close()
+
+	accts := []map[basics.Address]basics.AccountData{randomAccounts(20, true)}
+	pooldata := basics.AccountData{}
+	pooldata.MicroAlgos.Raw = 1000 * 1000 * 1000 * 1000
+	pooldata.Status = basics.NotParticipating
+	accts[0][testPoolAddr] = pooldata
+
+	cfg := config.GetDefaultLocal()
+	cfg.EnableAccountsWriteAheadJournal = true
+
+	au := &accountUpdates{}
+	au.initialize(cfg, ".", proto, accts[0])
+	err := au.loadFromDisk(ml)
+	require.NoError(t, err)
+
+	const lastRound = basics.Round(10)
+	for i := basics.Round(1); i <= lastRound; i++ {
+		updates, totals := randomDeltasBalanced(2, accts[i-1], 0)
+		blk := bookkeeping.Block{
+			BlockHeader: bookkeeping.BlockHeader{
+				Round: i,
+			},
+		}
+		blk.CurrentProtocol = protocol.ConsensusCurrentVersion
+		delta := ledgercore.MakeStateDelta(&blk.BlockHeader, 0, updates.Len(), 0)
+		delta.Accts.MergeAccounts(updates)
+		ml.addMockBlock(blockEntry{block: blk}, delta)
+		au.newBlock(blk, delta)
+		accts = append(accts, totals)
+	}
+
+	// journal the first rounds the way commitRound does, and "crash" before committing them
+	const offset = 3
+	au.accountsMu.RLock()
+	journal := au.makePendingJournal(offset)
+	au.accountsMu.RUnlock()
+	trackerDB := ml.trackerDB()
+	err = trackerDB.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+		return writePendingJournal(tx, journal)
+	})
+	require.NoError(t, err)
+	au.close()
+
+	au = &accountUpdates{}
+	au.initialize(cfg, ".", proto, accts[0])
+	err = au.loadFromDisk(ml)
+	require.NoError(t, err)
+	defer au.close()
+
+	require.Equal(t, basics.Round(offset), au.dbRound)
+	for _, rnd := range []basics.Round{offset, lastRound} {
+		for addr, ad := range accts[rnd] {
+			data, _, err := au.LookupWithoutRewards(rnd, addr)
+			require.NoError(t, err)
+			require.Equal(t, ad, data)
+		}
+	}
+	var count int
+	require.NoError(t, ml.trackerDB().Rdb.Handle.QueryRow("SELECT COUNT(*) FROM pendingjournal").Scan(&count))
+	require.Zero(t, count)
+}
+
+// TestAcctUpdatesPendingJournalRejectedCommit tests that the journal of rounds whose commit failed is discarded, so that
+// these rounds don't get replayed on the next startup.
+func TestAcctUpdatesPendingJournalRejectedCommit(t *testing.T) {
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	ml := makeMockLedgerForTracker(t, true, 1, protocol.ConsensusCurrentVersion)
+	defer ml.Close()
+
+	accts := randomAccounts(20, true)
+	pooldata := basics.AccountData{}
+	pooldata.MicroAlgos.Raw = 1000 * 1000 * 1000 * 1000
+	pooldata.Status = basics.NotParticipating
+	accts[testPoolAddr] = pooldata
+
+	cfg := config.GetDefaultLocal()
+	cfg.EnableAccountsWriteAheadJournal = true
+
+	au := &accountUpdates{}
+	au.initialize(cfg, ".", proto, accts)
+	err := au.loadFromDisk(ml)
+	require.NoError(t, err)
+
+	// opt an account into an application
+	var addr basics.Address
+	for addr = range accts {
+		if addr != testPoolAddr {
+			break
+		}
+	}
+	opted := accts[addr]
+	opted.AppLocalStates = map[basics.AppIndex]basics.AppLocalState{
+		1: {Schema: basics.StateSchema{NumUint: 1}, KeyValue: basics.TealKeyValue{"key": {Type: basics.TealUintType, Uint: 1}}},
+	}
+
+	lastRound := basics.Round(proto.MaxBalLookback + 5)
+	for i := basics.Round(1); i <= lastRound; i++ {
+		blk := bookkeeping.Block{
+			BlockHeader: bookkeeping.BlockHeader{
+				Round: i,
+			},
+		}
+		blk.CurrentProtocol = protocol.ConsensusCurrentVersion
+		delta := ledgercore.MakeStateDelta(&blk.BlockHeader, 0, 1, 0)
+		if i == 1 {
+			delta.Accts.Upsert(addr, opted)
+		}
+		ml.addMockBlock(blockEntry{block: blk}, delta)
+		au.newBlock(blk, delta)
+	}
+
+	// fail the commit once the journal was written, by failing the update of the accounts round
+	trackerDB := ml.trackerDB()
+	err = trackerDB.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.Exec("CREATE TRIGGER failcommit BEFORE UPDATE ON acctrounds BEGIN SELECT RAISE(ABORT, 'commit failure'); END")
+		return err
+	})
+	require.NoError(t, err)
+
+	au.committedUpTo(lastRound)
+	au.waitAccountsWriting()
+	require.Equal(t, basics.Round(0), au.dbRound)
+	var count int
+	require.NoError(t, trackerDB.Rdb.Handle.QueryRow("SELECT COUNT(*) FROM pendingjournal").Scan(&count))
+	require.Zero(t, count)
+	au.close()
+
+	err = trackerDB.Wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.Exec("DROP TRIGGER failcommit")
+		return err
+	})
+	require.NoError(t, err)
+
+	// the rejected rounds aren't replayed from the journal on startup, but from the blocks
+	au = &accountUpdates{}
+	au.initialize(cfg, ".", proto, accts)
+	err = au.loadFromDisk(ml)
+	require.NoError(t, err)
+	defer au.close()
+	data, _, err := au.LookupWithoutRewards(lastRound, addr)
+	require.NoError(t, err)
+	require.Equal(t, opted, data)
+}
+
+// TestAcctUpdatesStrictValidationFailure tests that the strict accounts validation validates the accounts of every round,
+// rather than only their final state, and that the rounds failing it are committed regardless, so that the rounds held in
+// memory stay bounded.
+func TestAcctUpdatesStrictValidationFailure(t *testing.T) {
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	ml := makeMockLedgerForTracker(t, true, 1, protocol.ConsensusCurrentVersion)
+	defer ml.Close()
+
+	accts := randomAccounts(20, true)
+	pooldata := basics.AccountData{}
+	pooldata.MicroAlgos.Raw = 1000 * 1000 * 1000 * 1000
+	pooldata.Status = basics.NotParticipating
+	accts[testPoolAddr] = pooldata
+
+	cfg := config.GetDefaultLocal()
+	cfg.EnableStrictAccountsValidation = true
+
+	au := &accountUpdates{}
+	au.initialize(cfg, ".", proto, accts)
+	err := au.loadFromDisk(ml)
+	require.NoError(t, err)
+	defer au.close()
+
+	// the local state of an account exceeds its schema in round 1, and is fixed in round 2
+	var addr basics.Address
+	for addr = range accts {
+		if addr != testPoolAddr {
+			break
+		}
+	}
+	invalid := accts[addr]
+	invalid.AppLocalStates = map[basics.AppIndex]basics.AppLocalState{
+		1: {KeyValue: basics.TealKeyValue{"key": {Type: basics.TealUintType, Uint: 1}}},
+	}
+
+	addBlocks := func(first, last basics.Round) {
+		for i := first; i <= last; i++ {
+			blk := bookkeeping.Block{
+				BlockHeader: bookkeeping.BlockHeader{
+					Round: i,
+				},
+			}
+			blk.CurrentProtocol = protocol.ConsensusCurrentVersion
+			delta := ledgercore.MakeStateDelta(&blk.BlockHeader, 0, 1, 0)
+			switch i {
+			case 1:
+				delta.Accts.Upsert(addr, invalid)
+			case 2:
+				delta.Accts.Upsert(addr, accts[addr])
+			}
+			ml.addMockBlock(blockEntry{block: blk}, delta)
+			au.newBlock(blk, delta)
+		}
+	}
+
+	// count the failures through the log, as the rounds are committed regardless
+	logBuffer := bytes.NewBuffer(nil)
+	au.log.SetOutput(logBuffer)
+	defer au.log.SetOutput(os.Stderr)
+
+	lastRound := basics.Round(proto.MaxBalLookback + 5)
+	addBlocks(1, lastRound)
+	au.committedUpTo(lastRound)
+	au.waitAccountsWriting()
+	require.Equal(t, basics.Round(5), au.dbRound)
+	require.Equal(t, 1, strings.Count(logBuffer.String(), "failed the strict validation"))
+	require.Contains(t, logBuffer.String(), "round 1")
+
+	// the later rounds keep being committed, and the rounds held in memory stay bounded
+	for rnd := lastRound + 1; rnd <= lastRound+50; rnd++ {
+		addBlocks(rnd, rnd)
+		// Clear the timer to ensure a flush
+		au.lastFlushTime = time.Time{}
+		au.committedUpTo(rnd)
+		au.waitAccountsWriting()
+		require.LessOrEqual(t, len(au.deltas), int(proto.MaxBalLookback))
+	}
+	require.Equal(t, lastRound+50-basics.Round(proto.MaxBalLookback), au.dbRound)
+	require.Equal(t, 1, strings.Count(logBuffer.String(), "failed the strict validation"))
+	data, _, err := au.LookupWithoutRewards(au.dbRound, addr)
+	require.NoError(t, err)
+	require.Equal(t, accts[addr], data)
+}
+
+// TestAcctUpdatesOptionalTables tests that the optional tables are created when enabled, and dropped once disabled, so
+// that commitRound stops maintaining them.
+func TestAcctUpdatesOptionalTables(t *testing.T) {
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	ml := makeMockLedgerForTracker(t, true, 1, protocol.ConsensusCurrentVersion)
+	defer ml.Close()
+
+	accts := randomAccounts(20, true)
+	tableExistsInTrackerDB := func(name string) bool {
+		exists, err := tableExists(ml.trackerDB().Rdb.Handle, name)
+		require.NoError(t, err)
+		return exists
+	}
+
+	for _, enabled := range []bool{true, false} {
+		cfg := config.GetDefaultLocal()
+		cfg.EnableAccountsStateChecksum = enabled
+		cfg.EnableAssetHolderCounts = enabled
+
+		au := &accountUpdates{}
+		au.initialize(cfg, ".", proto, accts)
+		err := au.loadFromDisk(ml)
+		require.NoError(t, err)
+		au.close()
+
+		require.Equal(t, enabled, tableExistsInTrackerDB("statechecksum"))
+		require.Equal(t, enabled, tableExistsInTrackerDB("assetholders"))
+	}
+}
+
+// TestAcctUpdatesHashFactory tests that the balances trie maintained by the tracker, both when rebuilt on startup and
+// when updated by commitRound, hashes the accounts using the tracker's hash factory.
+func TestAcctUpdatesHashFactory(t *testing.T) {
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	ml := makeMockLedgerForTracker(t, true, 1, protocol.ConsensusCurrentVersion)
+	defer ml.Close()
+
+	accts := []map[basics.Address]basics.AccountData{randomAccounts(20, true)}
+	pooldata := basics.AccountData{}
+	pooldata.MicroAlgos.Raw = 1000 * 1000 * 1000 * 1000
+	pooldata.Status = basics.NotParticipating
+	accts[0][testPoolAddr] = pooldata
+
+	cfg := config.GetDefaultLocal()
+	cfg.CatchpointTracking = 1
+	cfg.CatchpointInterval = 1000
+
+	au := &accountUpdates{}
+	au.initialize(cfg, ".", proto, accts[0])
+	au.hashFactory = sha256.New
+	err := au.loadFromDisk(ml)
+	require.NoError(t, err)
+	defer au.close()
+
+	lastRound := basics.Round(proto.MaxBalLookback + 5)
+	for i := basics.Round(1); i <= lastRound; i++ {
+		blk := bookkeeping.Block{
+			BlockHeader: bookkeeping.BlockHeader{
+				Round: i,
+			},
+		}
+		blk.CurrentProtocol = protocol.ConsensusCurrentVersion
+		// only the first rounds, which get committed, modify the accounts
+		updates, totals := ledgercore.AccountDeltas{}, accts[i-1]
+		if i <= 5 {
+			updates, totals = randomDeltasBalanced(2, accts[i-1], 0)
+		}
+		delta := ledgercore.MakeStateDelta(&blk.BlockHeader, 0, updates.Len(), 0)
+		delta.Accts.MergeAccounts(updates)
+		ml.addMockBlock(blockEntry{block: blk}, delta)
+		au.newBlock(blk, delta)
+		accts = append(accts, totals)
+	}
+	au.committedUpTo(lastRound)
+	au.waitAccountsWriting()
+	require.Equal(t, basics.Round(5), au.dbRound)
+
+	expectedTrie, err := merkletrie.MakeTrie(&merkletrie.InMemoryCommitter{}, TrieMemoryConfig)
+	require.NoError(t, err)
+	for addr, ad := range accts[au.dbRound] {
+		hash, err := accountHashBuilderWithFactory(sha256.New, addr, ad, protocol.Encode(&ad))
+		require.NoError(t, err)
+		_, err = expectedTrie.Add(hash)
+		require.NoError(t, err)
+	}
+	expectedHash, err := expectedTrie.RootHash()
+	require.NoError(t, err)
+
+	var trieHash crypto.Digest
+	trackerDB := ml.trackerDB()
+	err = trackerDB.Rdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+		committer, err := MakeMerkleCommitter(tx, false)
+		if err != nil {
+			return err
+		}
+		trie, err := merkletrie.MakeTrie(committer, TrieMemoryConfig)
+		if err != nil {
+			return err
+		}
+		trieHash, err = trie.RootHash()
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, expectedHash, trieHash)
+}
+
 func TestAcctUpdatesFastUpdates(t *testing.T) {
 	if runtime.GOARCH == "arm" || runtime.GOARCH == "arm64" {
 		t.Skip("This test is too slow on ARM and causes travis builds to time out")
@@ -1425,6 +2234,78 @@ func TestCompactDeltas(t *testing.T) {
 
 }
 
+func TestValidateCreatables(t *testing.T) {
+	a := require.New(t)
+
+	creator := randomAddress()
+	withAsset := basics.AccountData{
+		MicroAlgos:  basics.MicroAlgos{Raw: 1000000},
+		AssetParams: map[basics.AssetIndex]basics.AssetParams{100: {Total: 10}},
+	}
+
+	var mods ledgercore.StateDelta
+	mods.Creatables = map[basics.CreatableIndex]ledgercore.ModifiedCreatable{
+		100: {Ctype: basics.AssetCreatable, Creator: creator, Created: true},
+	}
+	// the creator must be modified along with the creatable
+	a.Error(validateCreatables(mods))
+
+	mods.Accts.Upsert(creator, withAsset)
+	a.NoError(validateCreatables(mods))
+
+	// a creatable marked as deleted while its creator still has its params
+	mods.Creatables[100] = ledgercore.ModifiedCreatable{Ctype: basics.AssetCreatable, Creator: creator, Created: false}
+	a.Error(validateCreatables(mods))
+
+	// a creatable marked as created while its creator has no params for it
+	mods.Accts.Upsert(creator, basics.AccountData{MicroAlgos: basics.MicroAlgos{Raw: 1000000}})
+	a.NoError(validateCreatables(mods))
+	mods.Creatables[100] = ledgercore.ModifiedCreatable{Ctype: basics.AssetCreatable, Creator: creator, Created: true}
+	a.Error(validateCreatables(mods))
+
+	// the params of an asset don't account for an app with the same index
+	mods.Accts.Upsert(creator, withAsset)
+	mods.Creatables[100] = ledgercore.ModifiedCreatable{Ctype: basics.AppCreatable, Creator: creator, Created: true}
+	a.Error(validateCreatables(mods))
+
+	// a creatable that was already counted by a merge
+	mods.Creatables[100] = ledgercore.ModifiedCreatable{Ctype: basics.AssetCreatable, Creator: creator, Created: true, Ndeltas: 2}
+	a.Error(validateCreatables(mods))
+}
+
+// TestAcctUpdatesInconsistentCreatables tests that a new block with inconsistent creatables is reported, but still added.
+func TestAcctUpdatesInconsistentCreatables(t *testing.T) {
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	ml := makeMockLedgerForTracker(t, true, 1, protocol.ConsensusCurrentVersion)
+	defer ml.Close()
+
+	cfg := config.GetDefaultLocal()
+	cfg.EnableStrictAccountsValidation = true
+
+	au := &accountUpdates{}
+	au.initialize(cfg, ".", proto, randomAccounts(20, true))
+	defer au.close()
+	err := au.loadFromDisk(ml)
+	require.NoError(t, err)
+
+	blk := bookkeeping.Block{
+		BlockHeader: bookkeeping.BlockHeader{
+			Round: basics.Round(1),
+		},
+	}
+	blk.CurrentProtocol = protocol.ConsensusCurrentVersion
+	delta := ledgercore.MakeStateDelta(&blk.BlockHeader, 0, 0, 0)
+	// an asset created without its creator being modified
+	delta.Creatables = map[basics.CreatableIndex]ledgercore.ModifiedCreatable{
+		100: {Ctype: basics.AssetCreatable, Creator: randomAddress(), Created: true},
+	}
+	require.Error(t, validateCreatables(delta))
+
+	require.NotPanics(t, func() { au.newBlock(blk, delta) })
+	require.Equal(t, basics.Round(1), au.latest())
+}
+
 func TestReproducibleCatchpointLabels(t *testing.T) {
 	if runtime.GOARCH == "arm" || runtime.GOARCH == "arm64" {
 		t.Skip("This test is too slow on ARM and causes travis builds to time out")
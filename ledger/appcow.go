@@ -17,7 +17,10 @@
 package ledger
 
 import (
+	"encoding/binary"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/algorand/go-algorand/config"
 	"github.com/algorand/go-algorand/data/basics"
@@ -146,6 +149,28 @@ func (cb *roundCowState) ensureStorageDelta(addr basics.Address, aidx basics.App
 	return lsd, nil
 }
 
+// SetCompatibilityKeyIndex seeds the account index recorded for the {addr, aidx, global} storage in compatibility mode,
+// as if a previous getKey call had cached it. This allows replaying the application calls of blocks that relied on
+// the compatibility mode account indices from a known state.
+func (cb *roundCowState) SetCompatibilityKeyIndex(addr basics.Address, aidx basics.AppIndex, global bool, idx uint64) {
+	if cb.compatibilityGetKeyCache == nil {
+		cb.compatibilityGetKeyCache = make(map[basics.Address]map[storagePtr]uint64)
+	}
+	s, ok := cb.compatibilityGetKeyCache[addr]
+	if !ok {
+		s = make(map[storagePtr]uint64)
+		cb.compatibilityGetKeyCache[addr] = s
+	}
+	s[storagePtr{aidx, global}] = idx
+}
+
+// CompatibilityKeyIndex returns the account index recorded for the {addr, aidx, global} storage in compatibility mode,
+// if any.
+func (cb *roundCowState) CompatibilityKeyIndex(addr basics.Address, aidx basics.AppIndex, global bool) (idx uint64, ok bool) {
+	idx, ok = cb.compatibilityGetKeyCache[addr][storagePtr{aidx, global}]
+	return
+}
+
 // getStorageCounts returns current storage usage for a given {addr, aidx, global} as basics.StateSchema
 func (cb *roundCowState) getStorageCounts(addr basics.Address, aidx basics.AppIndex, global bool) (basics.StateSchema, error) {
 	// If we haven't allocated storage, then our used storage count is zero
@@ -233,6 +258,10 @@ func (cb *roundCowState) Allocate(addr basics.Address, aidx basics.AppIndex, glo
 		return err
 	}
 
+	if cb.maxAllocations > 0 && cb.allocations >= cb.maxAllocations {
+		return ledgercore.TooManyAllocationsError{Allocations: cb.allocations + 1, Max: cb.maxAllocations}
+	}
+
 	lsd, err := cb.ensureStorageDelta(addr, aidx, global, allocAction, 0)
 	if err != nil {
 		return err
@@ -240,6 +269,7 @@ func (cb *roundCowState) Allocate(addr basics.Address, aidx basics.AppIndex, glo
 
 	lsd.action = allocAction
 	lsd.maxCounts = &space
+	cb.allocations++
 
 	return nil
 }
@@ -325,6 +355,14 @@ func (cb *roundCowState) getKey(addr basics.Address, aidx basics.AppIndex, globa
 
 // SetKey creates a new key-value in {addr, aidx, global} storage
 func (cb *roundCowState) SetKey(addr basics.Address, aidx basics.AppIndex, global bool, key string, value basics.TealValue, accountIdx uint64) error {
+	if cb.proto.ReservedLargeAppKeys && isLargeKeyEntry(key) {
+		return fmt.Errorf("cannot set key 0x%x: the key is reserved for large values", key)
+	}
+	return cb.setKey(addr, aidx, global, key, value, accountIdx)
+}
+
+// setKey is similar to SetKey, but allows setting the keys reserved for large values
+func (cb *roundCowState) setKey(addr basics.Address, aidx basics.AppIndex, global bool, key string, value basics.TealValue, accountIdx uint64) error {
 	// Enforce maximum key length
 	if len(key) > cb.proto.MaxAppKeyLen {
 		return fmt.Errorf("key too long: length was %d, maximum is %d", len(key), cb.proto.MaxAppKeyLen)
@@ -382,8 +420,39 @@ func (cb *roundCowState) SetKey(addr basics.Address, aidx basics.AppIndex, globa
 	return lsd.checkCounts()
 }
 
+// SetKeyMinBalanceImpact returns the change in the minimum balance of the given account that setting the given key to
+// the given value would cause, without applying it. The SetKey is performed in a child cow, so that the same errors
+// SetKey would return, such as exceeding the storage schema, are returned as well. Note that the minimum balance is
+// charged for the storage schema when it's allocated, rather than for the keys actually used, so a successful SetKey
+// doesn't change it.
+func (cb *roundCowState) SetKeyMinBalanceImpact(addr basics.Address, aidx basics.AppIndex, global bool, key string, value basics.TealValue) (deltaMicroAlgos int64, err error) {
+	child := cb.child(1)
+	err = child.SetKey(addr, aidx, global, key, value, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	before, err := cb.lookup(addr)
+	if err != nil {
+		return 0, err
+	}
+	after, err := applyStorageDelta(before, storagePtr{aidx, global}, child.sdeltas[addr][storagePtr{aidx, global}])
+	if err != nil {
+		return 0, err
+	}
+	return int64(after.MinBalance(&cb.proto).Raw) - int64(before.MinBalance(&cb.proto).Raw), nil
+}
+
 // DelKey removes a key from {addr, aidx, global} storage
 func (cb *roundCowState) DelKey(addr basics.Address, aidx basics.AppIndex, global bool, key string, accountIdx uint64) error {
+	if cb.proto.ReservedLargeAppKeys && isLargeKeyEntry(key) {
+		return fmt.Errorf("cannot del key 0x%x: the key is reserved for large values", key)
+	}
+	return cb.delKey(addr, aidx, global, key, accountIdx)
+}
+
+// delKey is similar to DelKey, but allows deleting the keys reserved for large values
+func (cb *roundCowState) delKey(addr basics.Address, aidx basics.AppIndex, global bool, key string, accountIdx uint64) error {
 	// Check that account has allocated storage
 	allocated, err := cb.allocated(addr, aidx, global)
 	if err != nil {
@@ -425,13 +494,239 @@ func (cb *roundCowState) DelKey(addr basics.Address, aidx basics.AppIndex, globa
 	return nil // note: deletion cannot cause us to violate maxCount
 }
 
+// DelKeys removes multiple keys from {addr, aidx, global} storage, updating the storage delta and its counts in a single pass.
+// Deleting a key which doesn't exist is a no-op, same as with DelKey.
+// The keys are recorded with account index 0 for the purpose of building the eval delta.
+func (cb *roundCowState) DelKeys(addr basics.Address, aidx basics.AppIndex, global bool, keys []string) error {
+	// Check that account has allocated storage
+	allocated, err := cb.allocated(addr, aidx, global)
+	if err != nil {
+		return err
+	}
+	if !allocated {
+		err = fmt.Errorf("cannot del keys, %v", errNoStorage(addr, aidx, global))
+		return err
+	}
+
+	if cb.proto.ReservedLargeAppKeys {
+		for _, key := range keys {
+			if isLargeKeyEntry(key) {
+				return fmt.Errorf("cannot del key 0x%x: the key is reserved for large values", key)
+			}
+		}
+	}
+
+	lsd, err := cb.ensureStorageDelta(addr, aidx, global, remainAllocAction, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		// Fetch the old value + presence so we know how to update counts
+		oldValue, oldOk, err := cb.GetKey(addr, aidx, global, key, 0)
+		if err != nil {
+			return err
+		}
+
+		vdelta, ok := lsd.kvCow[key]
+		if !ok {
+			vdelta = valueDelta{old: oldValue, oldExists: oldOk}
+		}
+		vdelta.new = basics.TealValue{}
+		vdelta.newExists = false
+		lsd.kvCow[key] = vdelta
+
+		// Update counts
+		err = updateCounts(lsd, oldValue, oldOk, vdelta.new, vdelta.newExists)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil // note: deletion cannot cause us to violate maxCount
+}
+
+// LocalStorageDeletedKeys returns, sorted, the keys deleted from the local storage of the given account for the given
+// application by this cow. Only the changes made in this cow are reported. Since a deallocated local storage doesn't
+// track the individual keys it lost, an error is returned when the local storage was deallocated by this cow.
+func (cb *roundCowState) LocalStorageDeletedKeys(addr basics.Address, aidx basics.AppIndex) ([]string, error) {
+	lsd, ok := cb.sdeltas[addr][storagePtr{aidx, false}]
+	if !ok {
+		return nil, nil
+	}
+	if lsd.action == deallocAction {
+		return nil, fmt.Errorf("cannot enumerate deleted keys, local storage of %v for app %d was deallocated", addr, aidx)
+	}
+	var keys []string
+	for key, vdelta := range lsd.kvCow {
+		if !vdelta.newExists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// largeKeyPrefix prefixes the keys of all the entries making up the large values. Keys with this prefix are reserved by
+// protocols enabling ReservedLargeAppKeys: SetKey and DelKey reject them, so that these entries never collide with
+// ordinary keys. Earlier protocols leave these keys to the applications, and don't support large values.
+const largeKeyPrefix = "\xffLV"
+
+// the tags following largeKeyPrefix, telling the header entry of a large value from its chunks
+const (
+	largeKeyHeaderTag = 'h'
+	largeKeyChunkTag  = 'c'
+)
+
+// largeKeyChunkSuffixLen is the number of bytes added to a large value key to form its chunks keys
+const largeKeyChunkSuffixLen = len(largeKeyPrefix) + 3
+
+// largeValueHeaderType is the leading byte of the header of a large value, followed by its big endian number of chunks
+const largeValueHeaderType = 0x01
+
+// maxLargeKeyChunks is the maximal number of chunks a large value could be split into
+const maxLargeKeyChunks = 1 << 16
+
+// isLargeKeyEntry returns true if key is reserved for the entries making up the large values
+func isLargeKeyEntry(key string) bool {
+	return strings.HasPrefix(key, largeKeyPrefix)
+}
+
+// largeKeyHeaderKey returns the storage key holding the header of the large value stored under key
+func largeKeyHeaderKey(key string) string {
+	return largeKeyPrefix + string(largeKeyHeaderTag) + key
+}
+
+// largeKeyChunkKey returns the storage key holding the i-th chunk of the large value stored under key
+func largeKeyChunkKey(key string, i int) string {
+	return largeKeyPrefix + string([]byte{largeKeyChunkTag, byte(i >> 8), byte(i)}) + key
+}
+
+// largeKeyChunkLen returns the size of the chunks a large value stored under key is split into
+func (cb *roundCowState) largeKeyChunkLen(key string) int {
+	chunkLen := cb.proto.MaxAppBytesValueLen
+	if sumLen := cb.proto.MaxAppSumKeyValueLens - len(key) - largeKeyChunkSuffixLen; sumLen < chunkLen {
+		chunkLen = sumLen
+	}
+	return chunkLen
+}
+
+// SetLargeKey stores a value that may exceed MaxAppBytesValueLen in {addr, aidx, global} storage.
+// The value is split into byte slice chunks, and a byte slice header holds the number of chunks. These are
+// stored under keys derived from key in the namespace reserved by largeKeyPrefix, and each of these entries
+// counts against the storage schema. An ordinary value stored under key is replaced by the large one.
+// The entries are recorded with account index 0 for the purpose of building the eval delta. Large values are only
+// supported by protocols enabling ReservedLargeAppKeys.
+func (cb *roundCowState) SetLargeKey(addr basics.Address, aidx basics.AppIndex, global bool, key string, value []byte) error {
+	if len(key)+largeKeyChunkSuffixLen > cb.proto.MaxAppKeyLen {
+		return fmt.Errorf("key too long: length was %d, maximum is %d", len(key), cb.proto.MaxAppKeyLen-largeKeyChunkSuffixLen)
+	}
+	if !cb.proto.ReservedLargeAppKeys {
+		return fmt.Errorf("cannot set large value for key 0x%x: large values are not supported by the protocol", key)
+	}
+	if isLargeKeyEntry(key) {
+		return fmt.Errorf("cannot set large value for key 0x%x: the key is reserved for large values", key)
+	}
+	chunkLen := cb.largeKeyChunkLen(key)
+	if chunkLen <= 0 {
+		return fmt.Errorf("cannot set large value for key 0x%x: byte values are not supported", key)
+	}
+	numChunks := (len(value) + chunkLen - 1) / chunkLen
+	if numChunks > maxLargeKeyChunks {
+		return fmt.Errorf("value too long for key 0x%x: length was %d", key, len(value))
+	}
+
+	oldChunks, _, err := cb.getLargeKeyChunks(addr, aidx, global, key)
+	if err != nil {
+		return err
+	}
+
+	// release the ordinary value first, so that it doesn't count against the schema along with the large one
+	_, plainOk, err := cb.getKey(addr, aidx, global, key, 0)
+	if err != nil {
+		return err
+	}
+	if plainOk {
+		err = cb.delKey(addr, aidx, global, key, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	header := make([]byte, 5)
+	header[0] = largeValueHeaderType
+	binary.BigEndian.PutUint32(header[1:], uint32(numChunks))
+	err = cb.setKey(addr, aidx, global, largeKeyHeaderKey(key), basics.TealValue{Type: basics.TealBytesType, Bytes: string(header)}, 0)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < numChunks; i++ {
+		end := (i + 1) * chunkLen
+		if end > len(value) {
+			end = len(value)
+		}
+		chunk := basics.TealValue{Type: basics.TealBytesType, Bytes: string(value[i*chunkLen : end])}
+		err = cb.setKey(addr, aidx, global, largeKeyChunkKey(key, i), chunk, 0)
+		if err != nil {
+			return err
+		}
+	}
+	// remove the chunks of the previous value that are no longer in use
+	for i := numChunks; i < oldChunks; i++ {
+		err = cb.delKey(addr, aidx, global, largeKeyChunkKey(key, i), 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetLargeKey looks for a value stored by SetLargeKey in {addr, aidx, global} storage and reassembles it.
+// Ordinary values stored under key are not reported.
+func (cb *roundCowState) GetLargeKey(addr basics.Address, aidx basics.AppIndex, global bool, key string) ([]byte, bool, error) {
+	numChunks, ok, err := cb.getLargeKeyChunks(addr, aidx, global, key)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+
+	value := make([]byte, 0, numChunks*cb.largeKeyChunkLen(key))
+	for i := 0; i < numChunks; i++ {
+		chunk, ok, err := cb.getKey(addr, aidx, global, largeKeyChunkKey(key, i), 0)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok || chunk.Type != basics.TealBytesType {
+			return nil, false, fmt.Errorf("large value for key 0x%x is missing chunk %d", key, i)
+		}
+		value = append(value, chunk.Bytes...)
+	}
+	return value, true, nil
+}
+
+// getLargeKeyChunks returns the number of chunks of the large value stored under key
+func (cb *roundCowState) getLargeKeyChunks(addr basics.Address, aidx basics.AppIndex, global bool, key string) (int, bool, error) {
+	header, ok, err := cb.getKey(addr, aidx, global, largeKeyHeaderKey(key), 0)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	if header.Type != basics.TealBytesType || len(header.Bytes) != 5 || header.Bytes[0] != largeValueHeaderType {
+		return 0, false, fmt.Errorf("large value for key 0x%x has a malformed header", key)
+	}
+	numChunks := int(binary.BigEndian.Uint32([]byte(header.Bytes[1:])))
+	if numChunks > maxLargeKeyChunks {
+		return 0, false, fmt.Errorf("large value for key 0x%x has a malformed header", key)
+	}
+	return numChunks, true, nil
+}
+
 // MakeDebugBalances creates a ledger suitable for dryrun and debugger
 func MakeDebugBalances(l ledgerForCowBase, round basics.Round, proto protocol.ConsensusVersion, prevTimestamp int64) apply.Balances {
 	base := &roundCowBase{
 		l:        l,
 		rnd:      round - 1,
 		proto:    config.Consensus[proto],
-		accounts: make(map[basics.Address]basics.AccountData),
+		accounts: makeBaseAccountsCache(),
+		creators: make(map[creatableCacheKey]foundAddress),
 	}
 
 	hdr := bookkeeping.BlockHeader{
@@ -465,7 +760,10 @@ func (cb *roundCowState) StatefulEval(params logic.EvalParams, aidx basics.AppIn
 		if err != nil {
 			return false, basics.EvalDelta{}, err
 		}
-		calf.commitToParent()
+		err = calf.commitToParent()
+		if err != nil {
+			return false, basics.EvalDelta{}, err
+		}
 	}
 
 	return pass, evalDelta, nil
@@ -473,7 +771,6 @@ func (cb *roundCowState) StatefulEval(params logic.EvalParams, aidx basics.AppIn
 
 // BuildEvalDelta converts internal sdeltas into basics.EvalDelta
 func (cb *roundCowState) BuildEvalDelta(aidx basics.AppIndex, txn *transactions.Transaction) (evalDelta basics.EvalDelta, err error) {
-	foundGlobal := false
 	for addr, smod := range cb.sdeltas {
 		for aapp, sdelta := range smod {
 			// Check that all of these deltas are for the correct app
@@ -481,47 +778,92 @@ func (cb *roundCowState) BuildEvalDelta(aidx basics.AppIndex, txn *transactions.
 				err = fmt.Errorf("found storage delta for different app during StatefulEval/BuildDelta: %d != %d", aapp.aidx, aidx)
 				return basics.EvalDelta{}, err
 			}
-			if aapp.global {
-				// Check that there is at most one global delta
-				if foundGlobal {
-					err = fmt.Errorf("found more than one global delta during StatefulEval/BuildDelta: %d", aapp.aidx)
-					return basics.EvalDelta{}, err
-				}
-				evalDelta.GlobalDelta = sdelta.kvCow.serialize()
-				foundGlobal = true
-			} else {
-				if evalDelta.LocalDeltas == nil {
-					evalDelta.LocalDeltas = make(map[uint64]basics.StateDelta)
-				}
-
-				// It is impossible for there to be more than one local delta for
-				// a particular (address, app ID) in sdeltas, because the appAddr
-				// type consists only of (address, appID, global=false). So if
-				// IndexByAddress is deterministic (and it is), there is no need
-				// to check for duplicates here.
-				var addrOffset uint64
-				if cb.compatibilityMode {
-					addrOffset = sdelta.accountIdx
-				} else {
-					addrOffset, err = txn.IndexByAddress(addr, txn.Sender)
-					if err != nil {
-						return basics.EvalDelta{}, err
-					}
-				}
-
-				d := sdelta.kvCow.serialize()
-				// noEmptyDeltas restricts producing empty local deltas in general
-				// but allows it for a period of time when a buggy version was live
-				noEmptyDeltas := cb.proto.NoEmptyLocalDeltas || (cb.mods.Hdr.CurrentProtocol == protocol.ConsensusV24) && (cb.mods.Hdr.NextProtocol != protocol.ConsensusV26)
-				if !noEmptyDeltas || len(d) != 0 {
-					evalDelta.LocalDeltas[addrOffset] = d
-				}
+			err = cb.addStorageDelta(&evalDelta, addr, aapp, sdelta, txn)
+			if err != nil {
+				return basics.EvalDelta{}, err
 			}
 		}
 	}
 	return
 }
 
+// BuildAllDeltas converts internal sdeltas into an eval delta per application. Unlike BuildEvalDelta, the storage deltas
+// could belong to any number of applications, as is the case for a transaction group touching multiple applications.
+func (cb *roundCowState) BuildAllDeltas(txn *transactions.Transaction) (map[basics.AppIndex]basics.EvalDelta, error) {
+	evalDeltas := make(map[basics.AppIndex]basics.EvalDelta)
+	for addr, smod := range cb.sdeltas {
+		for aapp, sdelta := range smod {
+			evalDelta := evalDeltas[aapp.aidx]
+			err := cb.addStorageDelta(&evalDelta, addr, aapp, sdelta, txn)
+			if err != nil {
+				return nil, err
+			}
+			evalDeltas[aapp.aidx] = evalDelta
+		}
+	}
+	return evalDeltas, nil
+}
+
+// AppGlobalStateDelta returns the serialized changes made by this cow to the global state of the given application, as
+// BuildEvalDelta would report them, regardless of whether a transaction built them yet. A nil delta is returned if the
+// global state of the application wasn't modified.
+func (cb *roundCowState) AppGlobalStateDelta(aidx basics.AppIndex) (delta basics.StateDelta, err error) {
+	found := false
+	for addr, smod := range cb.sdeltas {
+		sdelta, ok := smod[storagePtr{aidx, true}]
+		if !ok {
+			continue
+		}
+		if found {
+			return nil, fmt.Errorf("found more than one global delta for app %d: %v", aidx, addr)
+		}
+		found = true
+		delta = sdelta.kvCow.serialize()
+	}
+	return delta, nil
+}
+
+// addStorageDelta serializes the storage delta of {addr, aapp} into the given eval delta
+func (cb *roundCowState) addStorageDelta(evalDelta *basics.EvalDelta, addr basics.Address, aapp storagePtr, sdelta *storageDelta, txn *transactions.Transaction) (err error) {
+	if aapp.global {
+		// Check that there is at most one global delta
+		if evalDelta.GlobalDelta != nil {
+			err = fmt.Errorf("found more than one global delta during StatefulEval/BuildDelta: %d", aapp.aidx)
+			return err
+		}
+		evalDelta.GlobalDelta = sdelta.kvCow.serialize()
+		return nil
+	}
+
+	if evalDelta.LocalDeltas == nil {
+		evalDelta.LocalDeltas = make(map[uint64]basics.StateDelta)
+	}
+
+	// It is impossible for there to be more than one local delta for
+	// a particular (address, app ID) in sdeltas, because the appAddr
+	// type consists only of (address, appID, global=false). So if
+	// IndexByAddress is deterministic (and it is), there is no need
+	// to check for duplicates here.
+	var addrOffset uint64
+	if cb.compatibilityMode {
+		addrOffset = sdelta.accountIdx
+	} else {
+		addrOffset, err = txn.IndexByAddress(addr, txn.Sender)
+		if err != nil {
+			return err
+		}
+	}
+
+	d := sdelta.kvCow.serialize()
+	// noEmptyDeltas restricts producing empty local deltas in general
+	// but allows it for a period of time when a buggy version was live
+	noEmptyDeltas := cb.proto.NoEmptyLocalDeltas || (cb.mods.Hdr.CurrentProtocol == protocol.ConsensusV24) && (cb.mods.Hdr.NextProtocol != protocol.ConsensusV26)
+	if !noEmptyDeltas || len(d) != 0 {
+		evalDelta.LocalDeltas[addrOffset] = d
+	}
+	return nil
+}
+
 // updateCounts updates usage counters
 func updateCounts(lsd *storageDelta, bv basics.TealValue, bok bool, av basics.TealValue, aok bool) error {
 	// If the value existed before, decrement the count of the old type.
@@ -562,8 +904,73 @@ func (lsd *storageDelta) checkCounts() error {
 	return nil
 }
 
+func (a storageAction) String() string {
+	switch a {
+	case remainAllocAction:
+		return "remain-alloc"
+	case allocAction:
+		return "alloc"
+	case deallocAction:
+		return "dealloc"
+	}
+	return fmt.Sprintf("storageAction(%d)", uint64(a))
+}
+
+// storageDeltaMergeError is returned when a child storageDelta cannot be merged into its parent
+// because the combination of their actions is not possible.
+type storageDeltaMergeError struct {
+	parentAction storageAction
+	childAction  storageAction
+	reason       string
+}
+
+func (e *storageDeltaMergeError) Error() string {
+	return fmt.Sprintf("cannot apply %v child state delta onto %v parent state delta: %s", e.childAction, e.parentAction, e.reason)
+}
+
+// checkChild verifies that child storageDelta could be merged into this storageDelta
+func (lsd *storageDelta) checkChild(child *storageDelta) error {
+	switch child.action {
+	case allocAction:
+		// freshly allocated storage could only contain the values written by the child
+		var counts basics.StateSchema
+		for _, vdelta := range child.kvCow {
+			if !vdelta.newExists {
+				continue
+			}
+			if vdelta.new.Type == basics.TealBytesType {
+				counts.NumByteSlice++
+			} else {
+				counts.NumUint++
+			}
+		}
+		if child.counts != nil && *child.counts != counts {
+			return &storageDeltaMergeError{parentAction: lsd.action, childAction: child.action, reason: fmt.Sprintf("preexisting counts %v", *child.counts)}
+		}
+	case deallocAction:
+		if len(child.kvCow) > 0 {
+			return &storageDeltaMergeError{parentAction: lsd.action, childAction: child.action, reason: "nonzero kv change"}
+		}
+	case remainAllocAction:
+		if lsd.action == deallocAction {
+			return &storageDeltaMergeError{parentAction: lsd.action, childAction: child.action, reason: "storage is not allocated"}
+		}
+	}
+	return nil
+}
+
 // applyChild merges child storageDelta into this storageDelta
-func (lsd *storageDelta) applyChild(child *storageDelta) {
+func (lsd *storageDelta) applyChild(child *storageDelta) error {
+	if err := lsd.checkChild(child); err != nil {
+		return err
+	}
+	lsd.mergeChild(child)
+	return nil
+}
+
+// mergeChild merges child storageDelta into this storageDelta without verifying it could be merged, for callers
+// that already did so with checkChild
+func (lsd *storageDelta) mergeChild(child *storageDelta) {
 	if child.action != remainAllocAction {
 		// If child state allocated or deallocated, then its deltas
 		// completely overwrite those of the parent.
@@ -590,13 +997,52 @@ func (lsd *storageDelta) applyChild(child *storageDelta) {
 		// see ensureStorageDelta: child.counts is initialized from parent cow
 		lsd.counts = child.counts
 	}
+}
 
-	// sanity checks
-	if lsd.action == deallocAction {
-		if len(lsd.kvCow) > 0 {
-			panic("dealloc state delta, but nonzero kv change")
+// StorageDeltaDiff describes the differences between two storage deltas of the same storage.
+type StorageDeltaDiff struct {
+	// ActionA and ActionB are the actions of the two deltas, reported only when they differ.
+	ActionA, ActionB storageAction
+	// OnlyInA and OnlyInB list the keys modified by only one of the deltas.
+	OnlyInA, OnlyInB []string
+	// Differing lists the keys modified by both deltas, but differently.
+	Differing []string
+}
+
+// Empty returns true if the two storage deltas had no differences.
+func (d StorageDeltaDiff) Empty() bool {
+	return d.ActionA == d.ActionB && len(d.OnlyInA) == 0 && len(d.OnlyInB) == 0 && len(d.Differing) == 0
+}
+
+// diffStorageDeltas compares two storage deltas of the same storage, such as the ones produced by two evaluations of
+// the same application call. A nil delta is treated as one modifying nothing. The keys are reported sorted.
+func diffStorageDeltas(a, b *storageDelta) (diff StorageDeltaDiff) {
+	if a == nil {
+		a = &storageDelta{}
+	}
+	if b == nil {
+		b = &storageDelta{}
+	}
+	if a.action != b.action {
+		diff.ActionA, diff.ActionB = a.action, b.action
+	}
+	for key, avd := range a.kvCow {
+		bvd, ok := b.kvCow[key]
+		if !ok {
+			diff.OnlyInA = append(diff.OnlyInA, key)
+		} else if avd != bvd {
+			diff.Differing = append(diff.Differing, key)
+		}
+	}
+	for key := range b.kvCow {
+		if _, ok := a.kvCow[key]; !ok {
+			diff.OnlyInB = append(diff.OnlyInB, key)
 		}
 	}
+	sort.Strings(diff.OnlyInA)
+	sort.Strings(diff.OnlyInB)
+	sort.Strings(diff.Differing)
+	return diff
 }
 
 // applyStorageDelta saves in-mem storageDelta into AccountData
@@ -17,6 +17,7 @@
 package ledger
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"strings"
@@ -297,7 +298,7 @@ func TestCowStorage(t *testing.T) {
 
 		// Collapse a child
 		if childDepth > 0 && rand.Float32() < 0.1 {
-			cow.commitToParent()
+			require.NoError(t, cow.commitToParent())
 			cow = lastParent
 			childDepth--
 		}
@@ -596,6 +597,79 @@ func TestCowBuildDelta(t *testing.T) {
 	)
 }
 
+func TestCowBuildAllDeltas(t *testing.T) {
+	a := require.New(t)
+
+	creator := randomAddress()
+	sender := randomAddress()
+	app1 := basics.AppIndex(2)
+	app2 := basics.AppIndex(5)
+
+	cow := roundCowState{}
+	cow.proto = config.Consensus[protocol.ConsensusCurrentVersion]
+	cow.sdeltas = make(map[basics.Address]map[storagePtr]*storageDelta)
+	txn := transactions.Transaction{}
+	txn.Sender = sender
+	txn.Accounts = []basics.Address{creator}
+
+	eds, err := cow.BuildAllDeltas(&txn)
+	a.NoError(err)
+	a.Empty(eds)
+
+	updated := func(key string, v1, v2 uint64) stateDelta {
+		return stateDelta{
+			key: valueDelta{
+				old:       basics.TealValue{Type: basics.TealUintType, Uint: v1},
+				new:       basics.TealValue{Type: basics.TealUintType, Uint: v2},
+				oldExists: true,
+				newExists: true,
+			},
+		}
+	}
+
+	// the first app modifies its global state and the sender local state, while the second app
+	// modifies the local state of both the sender and the creator
+	cow.sdeltas[creator] = map[storagePtr]*storageDelta{
+		{app1, true}:  {action: remainAllocAction, kvCow: updated("g1", 1, 2)},
+		{app2, false}: {action: remainAllocAction, kvCow: updated("l2", 3, 4)},
+	}
+	cow.sdeltas[sender] = map[storagePtr]*storageDelta{
+		{app1, false}: {action: remainAllocAction, kvCow: updated("l1", 5, 6)},
+		{app2, false}: {action: remainAllocAction, kvCow: updated("l3", 7, 8)},
+	}
+
+	eds, err = cow.BuildAllDeltas(&txn)
+	a.NoError(err)
+	a.Equal(map[basics.AppIndex]basics.EvalDelta{
+		app1: {
+			GlobalDelta: basics.StateDelta{"g1": basics.ValueDelta{Action: basics.SetUintAction, Uint: 2}},
+			LocalDeltas: map[uint64]basics.StateDelta{
+				0: {"l1": basics.ValueDelta{Action: basics.SetUintAction, Uint: 6}},
+			},
+		},
+		app2: {
+			LocalDeltas: map[uint64]basics.StateDelta{
+				0: {"l3": basics.ValueDelta{Action: basics.SetUintAction, Uint: 8}},
+				1: {"l2": basics.ValueDelta{Action: basics.SetUintAction, Uint: 4}},
+			},
+		},
+	}, eds)
+
+	// each app delta matches the one built for that app alone
+	delete(cow.sdeltas[creator], storagePtr{app2, false})
+	delete(cow.sdeltas[sender], storagePtr{app2, false})
+	ed, err := cow.BuildEvalDelta(app1, &txn)
+	a.NoError(err)
+	a.Equal(eds[app1], ed)
+
+	// errors of the per-app logic are reported
+	cow.sdeltas[sender][storagePtr{app1, true}] = &storageDelta{}
+	eds, err = cow.BuildAllDeltas(&txn)
+	a.Error(err)
+	a.Contains(err.Error(), "found more than one global delta")
+	a.Nil(eds)
+}
+
 func TestCowDeltaSerialize(t *testing.T) {
 	a := require.New(t)
 
@@ -687,24 +761,29 @@ func TestApplyChild(t *testing.T) {
 		a.Equal(0, len(delta.kvCow))
 	}
 
-	parent.applyChild(&child)
+	a.NoError(parent.applyChild(&child))
 	chkEmpty(&parent)
 	chkEmpty(&child)
 
 	child.action = deallocAction
 	child.kvCow["key1"] = valueDelta{}
-	a.Panics(func() { parent.applyChild(&child) })
+	err := parent.applyChild(&child)
+	a.Error(err)
+	_, ok := err.(*storageDeltaMergeError)
+	a.True(ok)
+	a.Empty(parent.action)
 
 	// check child overwrites values
 	child.action = allocAction
-	s1 := getSchema(1, 2)
+	child.kvCow["key1"] = valueDelta{new: basics.TealValue{Type: basics.TealUintType, Uint: 1}, newExists: true}
+	s1 := getSchema(1, 0)
 	s2 := getSchema(3, 4)
 	child.counts = &s1
 	child.maxCounts = &s2
-	parent.applyChild(&child)
+	a.NoError(parent.applyChild(&child))
 	a.Equal(allocAction, parent.action)
 	a.Equal(1, len(parent.kvCow))
-	a.Equal(getSchema(1, 2), *parent.counts)
+	a.Equal(getSchema(1, 0), *parent.counts)
 	a.Equal(getSchema(3, 4), *parent.maxCounts)
 
 	// check child is correctly merged into parent
@@ -785,13 +864,156 @@ func TestApplyChild(t *testing.T) {
 			child.counts = &cs
 			child.kvCow = test.ckv
 
-			parent.applyChild(&child)
+			a.NoError(parent.applyChild(&child))
 			a.Equal(test.result, parent.kvCow)
 			a.Equal(cs, *parent.counts)
 		})
 	}
 }
 
+func TestApplyChildUnexpectedActions(t *testing.T) {
+	a := require.New(t)
+
+	var tests = []struct {
+		parent    storageAction
+		child     storageAction
+		kv        bool
+		badCounts bool
+		valid     bool
+	}{
+		{parent: remainAllocAction, child: remainAllocAction, kv: true, valid: true},
+		{parent: remainAllocAction, child: allocAction, kv: true, valid: true},
+		{parent: remainAllocAction, child: allocAction, badCounts: true, valid: false},
+		{parent: remainAllocAction, child: deallocAction, valid: true},
+		{parent: remainAllocAction, child: deallocAction, kv: true, valid: false},
+		{parent: allocAction, child: remainAllocAction, kv: true, valid: true},
+		{parent: allocAction, child: allocAction, kv: true, valid: true},
+		{parent: allocAction, child: allocAction, kv: true, badCounts: true, valid: false},
+		{parent: allocAction, child: deallocAction, valid: true},
+		{parent: allocAction, child: deallocAction, kv: true, valid: false},
+		{parent: deallocAction, child: remainAllocAction, valid: false},
+		{parent: deallocAction, child: remainAllocAction, kv: true, valid: false},
+		{parent: deallocAction, child: allocAction, valid: true},
+		{parent: deallocAction, child: allocAction, badCounts: true, valid: false},
+		{parent: deallocAction, child: deallocAction, valid: true},
+		{parent: deallocAction, child: deallocAction, kv: true, valid: false},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v-%v-kv=%v-badcounts=%v", test.parent, test.child, test.kv, test.badCounts), func(t *testing.T) {
+			parent := storageDelta{
+				action:    test.parent,
+				kvCow:     make(stateDelta),
+				counts:    &basics.StateSchema{},
+				maxCounts: &basics.StateSchema{},
+			}
+			child := storageDelta{
+				action:    test.child,
+				kvCow:     make(stateDelta),
+				counts:    &basics.StateSchema{},
+				maxCounts: &basics.StateSchema{NumUint: 2},
+			}
+			if test.kv {
+				child.kvCow["key"] = valueDelta{new: basics.TealValue{Type: basics.TealUintType, Uint: 1}, newExists: true}
+				child.counts.NumUint++
+			}
+			if test.badCounts {
+				child.counts.NumUint++
+			}
+
+			err := parent.applyChild(&child)
+			if test.valid {
+				a.NoError(err)
+				return
+			}
+			a.Error(err)
+			mergeErr, ok := err.(*storageDeltaMergeError)
+			a.True(ok)
+			a.Equal(test.parent, mergeErr.parentAction)
+			a.Equal(test.child, mergeErr.childAction)
+
+			// the parent is left untouched
+			a.Equal(test.parent, parent.action)
+			a.Equal(basics.StateSchema{}, *parent.counts)
+			a.Empty(parent.kvCow)
+		})
+	}
+
+	// commitToParent reports the error without modifying the parent
+	addr := randomAddress()
+	ml := mockLedger{balanceMap: map[basics.Address]basics.AccountData{addr: {}}}
+	parent := makeRoundCowState(&ml, bookkeeping.BlockHeader{}, 0, 0)
+	aapp := storagePtr{aidx: 1, global: false}
+	parent.sdeltas[addr] = map[storagePtr]*storageDelta{aapp: {
+		action:    deallocAction,
+		kvCow:     make(stateDelta),
+		counts:    &basics.StateSchema{},
+		maxCounts: &basics.StateSchema{},
+	}}
+	child := parent.child(1)
+	child.sdeltas[addr] = map[storagePtr]*storageDelta{aapp: {
+		action:    remainAllocAction,
+		kvCow:     stateDelta{"key": valueDelta{newExists: true}},
+		counts:    &basics.StateSchema{NumUint: 1},
+		maxCounts: &basics.StateSchema{NumUint: 1},
+	}}
+	child.put(addr, basics.AccountData{MicroAlgos: basics.MicroAlgos{Raw: 1}}, nil, nil)
+
+	err := child.commitToParent()
+	a.Error(err)
+	var mergeErr *storageDeltaMergeError
+	a.True(errors.As(err, &mergeErr))
+	a.Equal(deallocAction, parent.sdeltas[addr][aapp].action)
+	a.Equal(0, parent.mods.Accts.Len())
+}
+
+func TestDiffStorageDeltas(t *testing.T) {
+	a := require.New(t)
+
+	one := basics.TealValue{Type: basics.TealUintType, Uint: 1}
+	two := basics.TealValue{Type: basics.TealUintType, Uint: 2}
+	sd1 := &storageDelta{
+		action: remainAllocAction,
+		kvCow: stateDelta{
+			"same":    valueDelta{new: one, newExists: true},
+			"value":   valueDelta{new: one, newExists: true},
+			"deleted": valueDelta{old: one, oldExists: true},
+			"onlyA":   valueDelta{new: two, newExists: true},
+		},
+	}
+	sd2 := &storageDelta{
+		action: remainAllocAction,
+		kvCow: stateDelta{
+			"same":    valueDelta{new: one, newExists: true},
+			"value":   valueDelta{new: two, newExists: true},
+			"deleted": valueDelta{old: one, oldExists: true, new: one, newExists: true},
+		},
+	}
+
+	diff := diffStorageDeltas(sd1, sd2)
+	a.False(diff.Empty())
+	a.Equal(StorageDeltaDiff{OnlyInA: []string{"onlyA"}, Differing: []string{"deleted", "value"}}, diff)
+
+	// the diff is symmetric
+	diff = diffStorageDeltas(sd2, sd1)
+	a.Equal(StorageDeltaDiff{OnlyInB: []string{"onlyA"}, Differing: []string{"deleted", "value"}}, diff)
+
+	a.True(diffStorageDeltas(sd1, sd1).Empty())
+	a.True(diffStorageDeltas(nil, nil).Empty())
+
+	// action differences are reported
+	sd3 := &storageDelta{action: deallocAction, kvCow: stateDelta{}}
+	diff = diffStorageDeltas(sd2, sd3)
+	a.Equal(remainAllocAction, diff.ActionA)
+	a.Equal(deallocAction, diff.ActionB)
+	a.Equal([]string{"deleted", "same", "value"}, diff.OnlyInA)
+
+	diff = diffStorageDeltas(nil, sd1)
+	a.Equal(storageAction(0), diff.ActionA)
+	a.Equal(remainAllocAction, diff.ActionB)
+	a.Equal([]string{"deleted", "onlyA", "same", "value"}, diff.OnlyInB)
+}
+
 func TestApplyStorageDelta(t *testing.T) {
 	a := require.New(t)
 
@@ -947,6 +1169,38 @@ func TestCowAllocated(t *testing.T) {
 	a.Panics(func() { c.allocated(getRandomAddress(a), aidx, true) })
 }
 
+func TestCowMaxAllocations(t *testing.T) {
+	a := require.New(t)
+
+	ml := emptyLedger{}
+	var bh bookkeeping.BlockHeader
+	bh.CurrentProtocol = protocol.ConsensusCurrentVersion
+	cow := makeRoundCowState(&ml, bh, 0, 0)
+	cow.maxAllocations = 3
+
+	addr := getRandomAddress(a)
+	calf := cow.child(1)
+	for i := 1; i <= cow.maxAllocations; i++ {
+		a.NoError(calf.Allocate(addr, basics.AppIndex(i), false, basics.StateSchema{}))
+	}
+	err := calf.Allocate(addr, basics.AppIndex(cow.maxAllocations+1), false, basics.StateSchema{})
+	a.Error(err)
+	tmae, ok := err.(ledgercore.TooManyAllocationsError)
+	a.True(ok)
+	a.Equal(cow.maxAllocations+1, tmae.Allocations)
+	a.Equal(cow.maxAllocations, tmae.Max)
+
+	// the next transaction starts with a fresh count
+	calf.setGroupIdx(1)
+	a.NoError(calf.Allocate(addr, basics.AppIndex(cow.maxAllocations+1), false, basics.StateSchema{}))
+
+	// and so does a new child
+	calf = cow.child(1)
+	for i := 1; i <= cow.maxAllocations; i++ {
+		a.NoError(calf.Allocate(addr, basics.AppIndex(i), true, basics.StateSchema{}))
+	}
+}
+
 func TestCowGetCreator(t *testing.T) {
 	a := require.New(t)
 
@@ -1171,6 +1425,54 @@ func TestCowSetKey(t *testing.T) {
 	a.Panics(func() { c.SetKey(addr, aidx+1, false, key, tv, 0) })
 }
 
+func TestCowSetKeyMinBalanceImpact(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	creator := getRandomAddress(a)
+	aidx := basics.AppIndex(1)
+	schema := basics.StateSchema{NumByteSlice: 1}
+	// the account as left by the app creation, which charges the minimum balance for the whole schema
+	creatorData := basics.AccountData{
+		MicroAlgos:     basics.MicroAlgos{Raw: 10000000},
+		AppParams:      map[basics.AppIndex]basics.AppParams{aidx: {StateSchemas: basics.StateSchemas{GlobalStateSchema: schema}}},
+		TotalAppSchema: schema,
+	}
+	a.Greater(creatorData.MinBalance(&proto).Raw, basics.AccountData{}.MinBalance(&proto).Raw)
+
+	ml := mockLedger{balanceMap: map[basics.Address]basics.AccountData{creator: creatorData}}
+	var bh bookkeeping.BlockHeader
+	bh.CurrentProtocol = protocol.ConsensusCurrentVersion
+	cow := makeRoundCowState(&ml, bh, 0, 0)
+	counts := basics.StateSchema{}
+	maxCounts := schema
+	cow.sdeltas = map[basics.Address]map[storagePtr]*storageDelta{
+		creator: {storagePtr{aidx, true}: &storageDelta{action: allocAction, kvCow: make(stateDelta), counts: &counts, maxCounts: &maxCounts}},
+	}
+
+	value := basics.TealValue{Type: basics.TealBytesType, Bytes: "value"}
+	impact, err := cow.SetKeyMinBalanceImpact(creator, aidx, true, "key", value)
+	a.NoError(err)
+	// the estimate doesn't modify the cow
+	_, ok, err := cow.GetKey(creator, aidx, true, "key", 0)
+	a.NoError(err)
+	a.False(ok)
+
+	// and matches the minimum balance change of actually setting the key
+	before := creatorData.MinBalance(&proto).Raw
+	a.NoError(cow.SetKey(creator, aidx, true, "key", value, 0))
+	delta := cow.deltas()
+	after, ok := delta.Accts.Get(creator)
+	a.True(ok)
+	a.Equal(int64(after.MinBalance(&proto).Raw)-int64(before), impact)
+	a.Zero(impact)
+
+	// a key exceeding the schema fails just like SetKey would
+	_, err = cow.SetKeyMinBalanceImpact(creator, aidx, true, "other", value)
+	a.Error(err)
+	a.Error(cow.SetKey(creator, aidx, true, "other", value, 0))
+}
+
 func TestCowSetKeyVFuture(t *testing.T) {
 	a := require.New(t)
 
@@ -1299,3 +1601,375 @@ func TestCowDelKey(t *testing.T) {
 	a.Panics(func() { c.DelKey(getRandomAddress(a), aidx, false, key, 0) })
 	a.Panics(func() { c.DelKey(addr, aidx+1, false, key, 0) })
 }
+
+func TestCowLocalStorageDeletedKeys(t *testing.T) {
+	a := require.New(t)
+
+	ml := emptyLedger{}
+	var bh bookkeeping.BlockHeader
+	bh.CurrentProtocol = protocol.ConsensusCurrentVersion
+	cow := makeRoundCowState(&ml, bh, 0, 0)
+
+	addr := getRandomAddress(a)
+	aidx := basics.AppIndex(1)
+	keys, err := cow.LocalStorageDeletedKeys(addr, aidx)
+	a.NoError(err)
+	a.Empty(keys)
+
+	a.NoError(cow.Allocate(addr, aidx, false, basics.StateSchema{NumUint: 3}))
+	for _, key := range []string{"c", "a", "b"} {
+		a.NoError(cow.SetKey(addr, aidx, false, key, basics.TealValue{Type: basics.TealUintType, Uint: 1}, 0))
+	}
+	keys, err = cow.LocalStorageDeletedKeys(addr, aidx)
+	a.NoError(err)
+	a.Empty(keys)
+
+	a.NoError(cow.DelKey(addr, aidx, false, "c", 0))
+	a.NoError(cow.DelKey(addr, aidx, false, "a", 0))
+	keys, err = cow.LocalStorageDeletedKeys(addr, aidx)
+	a.NoError(err)
+	a.Equal([]string{"a", "c"}, keys)
+
+	// setting a deleted key again makes it no longer deleted
+	a.NoError(cow.SetKey(addr, aidx, false, "a", basics.TealValue{Type: basics.TealUintType, Uint: 2}, 0))
+	keys, err = cow.LocalStorageDeletedKeys(addr, aidx)
+	a.NoError(err)
+	a.Equal([]string{"c"}, keys)
+
+	// global storage deletions aren't reported
+	a.NoError(cow.Allocate(addr, aidx, true, basics.StateSchema{NumUint: 1}))
+	a.NoError(cow.SetKey(addr, aidx, true, "g", basics.TealValue{Type: basics.TealUintType, Uint: 1}, 0))
+	a.NoError(cow.DelKey(addr, aidx, true, "g", 0))
+	keys, err = cow.LocalStorageDeletedKeys(addr, aidx)
+	a.NoError(err)
+	a.Equal([]string{"c"}, keys)
+
+	// a deallocated local storage can't be enumerated
+	a.NoError(cow.Deallocate(addr, aidx, false))
+	_, err = cow.LocalStorageDeletedKeys(addr, aidx)
+	a.Error(err)
+}
+
+func TestCowDelKeys(t *testing.T) {
+	a := require.New(t)
+
+	addr := getRandomAddress(a)
+	aidx := basics.AppIndex(1)
+	c := getCow([]modsData{
+		{addr, basics.CreatableIndex(aidx), basics.AppCreatable},
+	})
+
+	c.sdeltas = map[basics.Address]map[storagePtr]*storageDelta{
+		addr: {storagePtr{aidx, true}: &storageDelta{action: deallocAction}},
+	}
+	err := c.DelKeys(addr, aidx, true, []string{"key"})
+	a.Error(err)
+	a.Contains(err.Error(), "cannot del keys")
+
+	counts := basics.StateSchema{}
+	maxCounts := basics.StateSchema{NumUint: 5, NumByteSlice: 5}
+	c.sdeltas = map[basics.Address]map[storagePtr]*storageDelta{
+		addr: {
+			storagePtr{aidx, true}: &storageDelta{
+				action:    allocAction,
+				kvCow:     make(stateDelta),
+				counts:    &counts,
+				maxCounts: &maxCounts,
+			},
+		},
+	}
+	for i := 0; i < 4; i++ {
+		a.NoError(c.SetKey(addr, aidx, true, fmt.Sprintf("uint%d", i), basics.TealValue{Type: basics.TealUintType, Uint: uint64(i)}, 0))
+		a.NoError(c.SetKey(addr, aidx, true, fmt.Sprintf("bytes%d", i), basics.TealValue{Type: basics.TealBytesType, Bytes: "val"}, 0))
+	}
+
+	// a mix of existing and missing keys, including a key repeated twice
+	keys := []string{"uint0", "missing1", "bytes1", "uint2", "bytes1", "missing2", "bytes3"}
+
+	batched := c.child(0)
+	a.NoError(batched.DelKeys(addr, aidx, true, keys))
+
+	looped := c.child(0)
+	for _, key := range keys {
+		a.NoError(looped.DelKey(addr, aidx, true, key, 0))
+	}
+
+	a.Equal(looped.sdeltas, batched.sdeltas)
+	a.Equal(basics.StateSchema{NumUint: 2, NumByteSlice: 2}, *batched.sdeltas[addr][storagePtr{aidx, true}].counts)
+
+	// deleting only missing keys leaves the counts intact
+	a.NoError(batched.DelKeys(addr, aidx, true, []string{"missing3"}))
+	a.Equal(basics.StateSchema{NumUint: 2, NumByteSlice: 2}, *batched.sdeltas[addr][storagePtr{aidx, true}].counts)
+}
+
+func TestCowLargeKey(t *testing.T) {
+	a := require.New(t)
+
+	addr := getRandomAddress(a)
+	aidx := basics.AppIndex(1)
+	c := getCow([]modsData{
+		{addr, basics.CreatableIndex(aidx), basics.AppCreatable},
+	})
+	c.proto = config.Consensus[protocol.ConsensusFuture]
+
+	key := "large"
+	chunkLen := c.largeKeyChunkLen(key)
+	a.Greater(chunkLen, 0)
+
+	counts := basics.StateSchema{}
+	maxCounts := basics.StateSchema{NumUint: 1, NumByteSlice: 7}
+	c.sdeltas = map[basics.Address]map[storagePtr]*storageDelta{
+		addr: {
+			storagePtr{aidx, true}: &storageDelta{
+				action:    allocAction,
+				kvCow:     make(stateDelta),
+				counts:    &counts,
+				maxCounts: &maxCounts,
+			},
+		},
+	}
+
+	_, ok, err := c.GetLargeKey(addr, aidx, true, key)
+	a.NoError(err)
+	a.False(ok)
+
+	value := make([]byte, 4*c.proto.MaxAppBytesValueLen+1)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	err = c.SetLargeKey(addr, aidx, true, key, value)
+	a.NoError(err)
+
+	// the chunks and the header are all byte slices
+	numChunks := (len(value) + chunkLen - 1) / chunkLen
+	a.Equal(basics.StateSchema{NumByteSlice: uint64(numChunks) + 1}, counts)
+
+	stored, ok, err := c.GetLargeKey(addr, aidx, true, key)
+	a.NoError(err)
+	a.True(ok)
+	a.Equal(value, stored)
+
+	// the large value doesn't show up as an ordinary value
+	_, ok, err = c.GetKey(addr, aidx, true, key, 0)
+	a.NoError(err)
+	a.False(ok)
+
+	// a shorter value releases the unused chunks
+	err = c.SetLargeKey(addr, aidx, true, key, value[:chunkLen+1])
+	a.NoError(err)
+	a.Equal(basics.StateSchema{NumByteSlice: 3}, counts)
+	stored, ok, err = c.GetLargeKey(addr, aidx, true, key)
+	a.NoError(err)
+	a.True(ok)
+	a.Equal(value[:chunkLen+1], stored)
+
+	// plain values cannot be read as large ones
+	err = c.SetKey(addr, aidx, true, "plain", basics.TealValue{Type: basics.TealBytesType, Bytes: "val"}, 0)
+	a.NoError(err)
+	_, ok, err = c.GetLargeKey(addr, aidx, true, "plain")
+	a.NoError(err)
+	a.False(ok)
+
+	// chunks count against the schema
+	err = c.SetLargeKey(addr, aidx, true, key, make([]byte, 7*chunkLen))
+	a.Error(err)
+	a.Contains(err.Error(), "exceeds schema bytes")
+
+	err = c.SetLargeKey(addr, aidx, true, strings.Repeat("k", c.proto.MaxAppKeyLen), value)
+	a.Error(err)
+	a.Contains(err.Error(), "key too long")
+}
+
+func TestCowLargeKeyCollisions(t *testing.T) {
+	a := require.New(t)
+
+	addr := getRandomAddress(a)
+	aidx := basics.AppIndex(1)
+	c := getCow([]modsData{
+		{addr, basics.CreatableIndex(aidx), basics.AppCreatable},
+	})
+	c.proto = config.Consensus[protocol.ConsensusFuture]
+
+	counts := basics.StateSchema{}
+	maxCounts := basics.StateSchema{NumUint: 4, NumByteSlice: 8}
+	c.sdeltas = map[basics.Address]map[storagePtr]*storageDelta{
+		addr: {
+			storagePtr{aidx, true}: &storageDelta{
+				action:    allocAction,
+				kvCow:     make(stateDelta),
+				counts:    &counts,
+				maxCounts: &maxCounts,
+			},
+		},
+	}
+
+	key := "large"
+	value := make([]byte, c.largeKeyChunkLen(key)+1)
+	for i := range value {
+		value[i] = byte(i)
+	}
+
+	// an ordinary key named like a chunk key of the old layout doesn't interfere with the large value
+	chunkLike := key + string([]byte{0, 0, 0})
+	err := c.SetKey(addr, aidx, true, chunkLike, basics.TealValue{Type: basics.TealBytesType, Bytes: "user"}, 0)
+	a.NoError(err)
+	err = c.SetLargeKey(addr, aidx, true, key, value)
+	a.NoError(err)
+	stored, ok, err := c.GetLargeKey(addr, aidx, true, key)
+	a.NoError(err)
+	a.True(ok)
+	a.Equal(value, stored)
+	userValue, ok, err := c.GetKey(addr, aidx, true, chunkLike, 0)
+	a.NoError(err)
+	a.True(ok)
+	a.Equal("user", userValue.Bytes)
+
+	// the keys holding the large values can't be set or deleted as ordinary keys
+	err = c.SetKey(addr, aidx, true, largeKeyChunkKey(key, 0), basics.TealValue{Type: basics.TealBytesType, Bytes: "user"}, 0)
+	a.Error(err)
+	a.Contains(err.Error(), "reserved")
+	err = c.DelKey(addr, aidx, true, largeKeyHeaderKey(key), 0)
+	a.Error(err)
+	a.Contains(err.Error(), "reserved")
+	err = c.DelKeys(addr, aidx, true, []string{largeKeyChunkKey(key, 1)})
+	a.Error(err)
+	a.Contains(err.Error(), "reserved")
+	stored, ok, err = c.GetLargeKey(addr, aidx, true, key)
+	a.NoError(err)
+	a.True(ok)
+	a.Equal(value, stored)
+
+	// a small uint isn't mistaken for the header of a large value
+	err = c.SetKey(addr, aidx, true, "counter", basics.TealValue{Type: basics.TealUintType, Uint: 2}, 0)
+	a.NoError(err)
+	_, ok, err = c.GetLargeKey(addr, aidx, true, "counter")
+	a.NoError(err)
+	a.False(ok)
+
+	// a large value replaces an ordinary bytes value stored under the same key
+	err = c.SetKey(addr, aidx, true, "plain", basics.TealValue{Type: basics.TealBytesType, Bytes: "val"}, 0)
+	a.NoError(err)
+	err = c.SetLargeKey(addr, aidx, true, "plain", value)
+	a.NoError(err)
+	stored, ok, err = c.GetLargeKey(addr, aidx, true, "plain")
+	a.NoError(err)
+	a.True(ok)
+	a.Equal(value, stored)
+	_, ok, err = c.GetKey(addr, aidx, true, "plain", 0)
+	a.NoError(err)
+	a.False(ok)
+
+	// protocols which don't reserve the keys leave them to the applications, and don't support large values
+	c.proto = config.Consensus[protocol.ConsensusCurrentVersion]
+	a.False(c.proto.ReservedLargeAppKeys)
+	reserved := largeKeyChunkKey("other", 0)
+	err = c.SetKey(addr, aidx, true, reserved, basics.TealValue{Type: basics.TealBytesType, Bytes: "user"}, 0)
+	a.NoError(err)
+	a.NoError(c.DelKeys(addr, aidx, true, []string{reserved}))
+	err = c.SetKey(addr, aidx, true, reserved, basics.TealValue{Type: basics.TealBytesType, Bytes: "user"}, 0)
+	a.NoError(err)
+	a.NoError(c.DelKey(addr, aidx, true, reserved, 0))
+	err = c.SetLargeKey(addr, aidx, true, "other", value)
+	a.Error(err)
+	a.Contains(err.Error(), "not supported")
+}
+
+func TestCowCompatibilityKeyIndex(t *testing.T) {
+	a := require.New(t)
+
+	addr := getRandomAddress(a)
+	aidx := basics.AppIndex(1)
+	ml := mockLedger{balanceMap: map[basics.Address]basics.AccountData{}}
+	var bh bookkeeping.BlockHeader
+	bh.CurrentProtocol = protocol.ConsensusCurrentVersion
+	cow := makeRoundCowState(&ml, bh, 0, 0)
+	cow.compatibilityMode = true
+	cow.compatibilityGetKeyCache = make(map[basics.Address]map[storagePtr]uint64)
+
+	_, ok := cow.CompatibilityKeyIndex(addr, aidx, false)
+	a.False(ok)
+	cow.SetCompatibilityKeyIndex(addr, aidx, false, 3)
+	idx, ok := cow.CompatibilityKeyIndex(addr, aidx, false)
+	a.True(ok)
+	a.Equal(uint64(3), idx)
+
+	// reading a key keeps the seeded index rather than recording its own
+	_, _, err := cow.GetKey(addr, aidx, false, "key", 1)
+	a.NoError(err)
+	idx, ok = cow.CompatibilityKeyIndex(addr, aidx, false)
+	a.True(ok)
+	a.Equal(uint64(3), idx)
+
+	// and the storage delta created by a write uses it
+	a.NoError(cow.DelKey(addr, aidx, false, "key", 2))
+	a.Equal(uint64(3), cow.sdeltas[addr][storagePtr{aidx, false}].accountIdx)
+
+	// without a seeded index, the first read records the index
+	other := getRandomAddress(a)
+	_, _, err = cow.GetKey(other, aidx, false, "key", 1)
+	a.NoError(err)
+	idx, ok = cow.CompatibilityKeyIndex(other, aidx, false)
+	a.True(ok)
+	a.Equal(uint64(1), idx)
+}
+
+func TestCowAppGlobalStateDelta(t *testing.T) {
+	a := require.New(t)
+
+	creator := getRandomAddress(a)
+	aidx := basics.AppIndex(1)
+	ml := mockLedger{balanceMap: map[basics.Address]basics.AccountData{}}
+	var bh bookkeeping.BlockHeader
+	bh.CurrentProtocol = protocol.ConsensusCurrentVersion
+	c0 := makeRoundCowState(&ml, bh, 0, 0)
+
+	delta, err := c0.AppGlobalStateDelta(aidx)
+	a.NoError(err)
+	a.Nil(delta)
+
+	counts := basics.StateSchema{}
+	maxCounts := basics.StateSchema{NumUint: 2, NumByteSlice: 2}
+	c0.sdeltas = map[basics.Address]map[storagePtr]*storageDelta{
+		creator: {storagePtr{aidx, true}: &storageDelta{action: allocAction, kvCow: make(stateDelta), counts: &counts, maxCounts: &maxCounts}},
+	}
+	a.NoError(c0.SetKey(creator, aidx, true, "counter", basics.TealValue{Type: basics.TealUintType, Uint: 7}, 0))
+	a.NoError(c0.SetKey(creator, aidx, true, "owner", basics.TealValue{Type: basics.TealBytesType, Bytes: "me"}, 0))
+	delta, err = c0.AppGlobalStateDelta(aidx)
+	a.NoError(err)
+	a.Equal(basics.StateDelta{
+		"counter": {Action: basics.SetUintAction, Uint: 7},
+		"owner":   {Action: basics.SetBytesAction, Bytes: "me"},
+	}, delta)
+
+	// the delta of a child is relative to its parent
+	c1 := c0.child(1)
+	a.NoError(c1.SetKey(creator, aidx, true, "counter", basics.TealValue{Type: basics.TealUintType, Uint: 8}, 0))
+	a.NoError(c1.SetKey(creator, aidx, true, "name", basics.TealValue{Type: basics.TealBytesType, Bytes: "app"}, 0))
+	a.NoError(c1.DelKey(creator, aidx, true, "owner", 0))
+	// setting and deleting a new key leaves no trace
+	a.NoError(c1.SetKey(creator, aidx, true, "temp", basics.TealValue{Type: basics.TealUintType, Uint: 1}, 0))
+	a.NoError(c1.DelKey(creator, aidx, true, "temp", 0))
+	// local state changes of the app aren't included
+	other := getRandomAddress(a)
+	a.NoError(c1.DelKey(other, aidx, false, "local", 0))
+
+	delta, err = c1.AppGlobalStateDelta(aidx)
+	a.NoError(err)
+	a.Equal(basics.StateDelta{
+		"counter": {Action: basics.SetUintAction, Uint: 8},
+		"name":    {Action: basics.SetBytesAction, Bytes: "app"},
+		"owner":   {Action: basics.DeleteAction},
+	}, delta)
+
+	// and it's the same global delta a transaction would build
+	txn := transactions.Transaction{}
+	txn.Sender = creator
+	txn.Accounts = []basics.Address{other}
+	ed, err := c1.BuildEvalDelta(aidx, &txn)
+	a.NoError(err)
+	a.Equal(ed.GlobalDelta, delta)
+
+	delta, err = c1.AppGlobalStateDelta(aidx + 1)
+	a.NoError(err)
+	a.Nil(delta)
+}
@@ -17,6 +17,7 @@
 package ledger
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/hex"
@@ -25,11 +26,15 @@ import (
 	"sync"
 	"time"
 
+	"github.com/algorand/msgp/msgp"
+
 	"github.com/algorand/go-algorand/config"
 	"github.com/algorand/go-algorand/crypto"
 	"github.com/algorand/go-algorand/crypto/merkletrie"
 	"github.com/algorand/go-algorand/data/basics"
 	"github.com/algorand/go-algorand/data/bookkeeping"
+	"github.com/algorand/go-algorand/data/transactions"
+	"github.com/algorand/go-algorand/ledger/apply"
 	"github.com/algorand/go-algorand/ledger/ledgercore"
 	"github.com/algorand/go-algorand/logging"
 	"github.com/algorand/go-algorand/protocol"
@@ -96,6 +101,10 @@ type CatchpointCatchupAccessorImpl struct {
 
 	// Prepared SQL statements for fast accounts DB lookups.
 	accountsq *accountsDbQueries
+
+	// hashFactory creates the hash function used for hashing the staged balances; nil stands for crypto.Hash. It has to match
+	// the hash function of the ledger's account updates tracker, which maintains the balances trie once the catchup completes.
+	hashFactory HashFactory
 }
 
 // CatchpointCatchupState is the state of the current catchpoint catchup process
@@ -127,9 +136,10 @@ func MakeCatchpointCatchupAccessor(ledger *Ledger, log logging.Logger) Catchpoin
 		return nil
 	}
 	return &CatchpointCatchupAccessorImpl{
-		ledger:    ledger,
-		log:       log,
-		accountsq: accountsq,
+		ledger:      ledger,
+		log:         log,
+		accountsq:   accountsq,
+		hashFactory: ledger.accts.hashFactory,
 	}
 }
 
@@ -293,12 +303,103 @@ func (c *CatchpointCatchupAccessorImpl) processStagingContent(ctx context.Contex
 	return err
 }
 
+// validateCatchpointChunk checks an encoded catchpoint balances chunk received from a peer before it gets decoded and
+// staged : every record must have an address of exactly crypto.DigestSize bytes and account data that decodes, and when
+// expectSorted is set the addresses must be strictly increasing. The chunk is walked in its encoded form since decoding
+// it would silently pad a short address. The first violation found is returned.
+func validateCatchpointChunk(chunk []byte, expectSorted bool) error {
+	fields, _, buf, err := msgp.ReadMapHeaderBytes(chunk)
+	if err != nil {
+		return fmt.Errorf("validateCatchpointChunk: %w", err)
+	}
+	for ; fields > 0; fields-- {
+		var field []byte
+		field, buf, err = msgp.ReadMapKeyZC(buf)
+		if err != nil {
+			return fmt.Errorf("validateCatchpointChunk: %w", err)
+		}
+		if string(field) != "bl" {
+			buf, err = msgp.Skip(buf)
+			if err != nil {
+				return fmt.Errorf("validateCatchpointChunk: %w", err)
+			}
+			continue
+		}
+		var records int
+		records, _, buf, err = msgp.ReadArrayHeaderBytes(buf)
+		if err != nil {
+			return fmt.Errorf("validateCatchpointChunk: %w", err)
+		}
+		var prevAddr []byte
+		for i := 0; i < records; i++ {
+			var addr []byte
+			addr, buf, err = validateCatchpointChunkRecord(buf)
+			if err != nil {
+				return fmt.Errorf("validateCatchpointChunk: record %d: %w", i, err)
+			}
+			if expectSorted && i > 0 && bytes.Compare(prevAddr, addr) >= 0 {
+				return fmt.Errorf("validateCatchpointChunk: record %d: address %x doesn't follow the address %x of the previous record", i, addr, prevAddr)
+			}
+			prevAddr = addr
+		}
+	}
+	return nil
+}
+
+// validateCatchpointChunkRecord checks a single encoded balance record of a catchpoint chunk, returning its address
+// along with the remainder of the buffer.
+func validateCatchpointChunkRecord(buf []byte) (addr []byte, o []byte, err error) {
+	fields, _, buf, err := msgp.ReadMapHeaderBytes(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	for ; fields > 0; fields-- {
+		var field []byte
+		field, buf, err = msgp.ReadMapKeyZC(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch string(field) {
+		case "pk":
+			addr, buf, err = msgp.ReadBytesZC(buf)
+			if err == nil && len(addr) != crypto.DigestSize {
+				err = fmt.Errorf("address %x is %d bytes long rather than %d", addr, len(addr), crypto.DigestSize)
+			}
+		case "ad":
+			var raw msgp.Raw
+			buf, err = raw.UnmarshalMsg(buf)
+			if err == nil {
+				var ad basics.AccountData
+				err = protocol.Decode(raw, &ad)
+				if err != nil {
+					err = fmt.Errorf("unable to decode account data: %w", err)
+				}
+			}
+		default:
+			buf, err = msgp.Skip(buf)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(addr) == 0 {
+		return nil, nil, fmt.Errorf("record has no address")
+	}
+	return addr, buf, nil
+}
+
 // processStagingBalances deserialize the given bytes as a temporary staging balances
 func (c *CatchpointCatchupAccessorImpl) processStagingBalances(ctx context.Context, bytes []byte, progress *CatchpointCatchupAccessorProgress) (err error) {
 	if !progress.SeenHeader {
 		return fmt.Errorf("CatchpointCatchupAccessorImpl::processStagingBalances: content chunk was missing")
 	}
 
+	// the catchpoint writer emits the accounts in their database order, which isn't sorted by address
+	err = validateCatchpointChunk(bytes, false)
+	if err != nil {
+		return err
+	}
+
 	var balances catchpointFileBalancesChunk
 	err = protocol.Decode(bytes, &balances)
 	if err != nil {
@@ -313,7 +414,7 @@ func (c *CatchpointCatchupAccessorImpl) processStagingBalances(ctx context.Conte
 	start := time.Now()
 	ledgerProcessstagingbalancesCount.Inc(nil)
 
-	normalizedAccountBalances, err := prepareNormalizedBalances(balances.Balances, c.ledger.GenesisProto())
+	normalizedAccountBalances, err := prepareNormalizedBalances(balances.Balances, c.ledger.GenesisProto(), c.hashFactory)
 
 	wg := sync.WaitGroup{}
 	errChan := make(chan error, 3)
@@ -760,11 +861,14 @@ func (c *CatchpointCatchupAccessorImpl) CompleteCatchup(ctx context.Context) (er
 	return c.ledger.reloadLedger()
 }
 
-// finishBalances concludes the catchup of the balances(tracker) database.
+// finishBalances concludes the catchup of the balances(tracker) database. All the changes are made within a single
+// transaction; canceling the given context before the staged tables are switched onto the actual ones aborts it,
+// leaving the actual tables untouched and the staged ones intact for a later attempt.
 func (c *CatchpointCatchupAccessorImpl) finishBalances(ctx context.Context) (err error) {
 	wdb := c.ledger.trackerDB().Wdb
 	start := time.Now()
 	ledgerCatchpointFinishBalsCount.Inc(nil)
+	promotionCtx := ctx
 	err = wdb.Atomic(func(ctx context.Context, tx *sql.Tx) (err error) {
 		var balancesRound uint64
 		var totals ledgercore.AccountTotals
@@ -785,7 +889,7 @@ func (c *CatchpointCatchupAccessorImpl) finishBalances(ctx context.Context) (err
 			return err
 		}
 
-		err = applyCatchpointStagingBalances(ctx, tx, basics.Round(balancesRound))
+		err = applyCatchpointStagingBalances(promotionCtx, tx, basics.Round(balancesRound))
 		if err != nil {
 			return err
 		}
@@ -826,6 +930,67 @@ func (c *CatchpointCatchupAccessorImpl) finishBalances(ctx context.Context) (err
 	return err
 }
 
+// catchpointLedgerForCowBase implements ledgerForCowBase on top of the accounts tables of a promoted catchpoint. It
+// serves the account data and the creatables as of the catchpoint balances round only, and has no block history.
+type catchpointLedgerForCowBase struct {
+	accountsq *accountsDbQueries
+	round     basics.Round
+}
+
+// MakeCatchpointBackedBalances creates an apply.Balances backed by the accounts tables of a promoted catchpoint, serving
+// the account data as of the given catchpoint balances round. Changes made through the returned balances are kept in
+// memory and never written back to the database. Since no block history is available, block headers
+// can't be retrieved and transactions aren't checked for duplicates; it's intended for forensic reads of the snapshot rather
+// than for validating blocks. Reads fail once the accounts tables advance beyond the given round.
+func MakeCatchpointBackedBalances(accessor CatchpointCatchupAccessor, round basics.Round, proto protocol.ConsensusVersion) (apply.Balances, error) {
+	impl, ok := accessor.(*CatchpointCatchupAccessorImpl)
+	if !ok {
+		return nil, fmt.Errorf("MakeCatchpointBackedBalances: unsupported catchpoint catchup accessor %T", accessor)
+	}
+	if _, ok := config.Consensus[proto]; !ok {
+		return nil, protocol.Error(proto)
+	}
+	l := &catchpointLedgerForCowBase{accountsq: impl.accountsq, round: round}
+	// the balances are evaluated as of the round following the catchpoint round, so that the lookups are made against it.
+	return MakeDebugBalances(l, round+1, proto, 0), nil
+}
+
+func (l *catchpointLedgerForCowBase) BlockHdr(rnd basics.Round) (bookkeeping.BlockHeader, error) {
+	return bookkeeping.BlockHeader{}, fmt.Errorf("catchpoint backed balances have no block header for round %d", rnd)
+}
+
+func (l *catchpointLedgerForCowBase) CheckDup(config.ConsensusParams, basics.Round, basics.Round, basics.Round, transactions.Txid, TxLease) error {
+	return nil
+}
+
+func (l *catchpointLedgerForCowBase) LookupWithoutRewards(rnd basics.Round, addr basics.Address) (basics.AccountData, basics.Round, error) {
+	if rnd != l.round {
+		return basics.AccountData{}, 0, fmt.Errorf("catchpoint backed balances serve round %d only, round %d was requested", l.round, rnd)
+	}
+	pad, err := l.accountsq.lookup(addr)
+	if err != nil {
+		return basics.AccountData{}, 0, err
+	}
+	if pad.round != l.round {
+		return basics.AccountData{}, 0, &MismatchingDatabaseRoundError{databaseRound: pad.round, memoryRound: l.round}
+	}
+	return pad.accountData, l.round, nil
+}
+
+func (l *catchpointLedgerForCowBase) GetCreatorForRound(rnd basics.Round, cidx basics.CreatableIndex, ctype basics.CreatableType) (basics.Address, bool, error) {
+	if rnd != l.round {
+		return basics.Address{}, false, fmt.Errorf("catchpoint backed balances serve round %d only, round %d was requested", l.round, rnd)
+	}
+	creator, ok, dbRound, err := l.accountsq.lookupCreator(cidx, ctype)
+	if err != nil {
+		return basics.Address{}, false, err
+	}
+	if dbRound != l.round {
+		return basics.Address{}, false, &MismatchingDatabaseRoundError{databaseRound: dbRound, memoryRound: l.round}
+	}
+	return creator, ok, nil
+}
+
 var ledgerResetstagingbalancesCount = metrics.NewCounter("ledger_catchup_resetstagingbalances_count", "calls")
 var ledgerResetstagingbalancesMicros = metrics.NewCounter("ledger_catchup_resetstagingbalances_micros", "µs spent")
 var ledgerProcessstagingcontentCount = metrics.NewCounter("ledger_catchup_processstagingcontent_count", "calls")
@@ -18,8 +18,12 @@ package ledger
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
 	"encoding/binary"
 	"fmt"
+	"hash"
 	"os"
 	"strings"
 	"testing"
@@ -29,6 +33,7 @@ import (
 
 	"github.com/algorand/go-algorand/config"
 	"github.com/algorand/go-algorand/crypto"
+	"github.com/algorand/go-algorand/crypto/merkletrie"
 	"github.com/algorand/go-algorand/data/basics"
 	"github.com/algorand/go-algorand/data/bookkeeping"
 	"github.com/algorand/go-algorand/ledger/ledgercore"
@@ -281,6 +286,402 @@ func TestBuildMerkleTrie(t *testing.T) {
 	require.Equal(t, basics.Round(0), blockRound)
 }
 
+func TestVerifyStagingAgainstManifest(t *testing.T) {
+	// setup boilerplate
+	log := logging.TestingLog(t)
+	dbBaseFileName := t.Name()
+	const inMem = true
+	genesisInitState, _ := testGenerateInitState(t, protocol.ConsensusCurrentVersion, 100)
+	cfg := config.GetDefaultLocal()
+	l, err := OpenLedger(log, dbBaseFileName, inMem, genesisInitState, cfg)
+	require.NoError(t, err, "could not open ledger")
+	defer func() {
+		l.Close()
+	}()
+	catchpointAccessor := MakeCatchpointCatchupAccessor(l, log)
+	ctx := context.Background()
+
+	err = catchpointAccessor.ResetStagingBalances(ctx, true)
+	require.NoError(t, err, "ResetStagingBalances")
+
+	accountsCount := uint64(1000)
+	fileHeader := CatchpointFileHeader{
+		Version:       catchpointFileVersion,
+		TotalAccounts: accountsCount,
+		TotalChunks:   (accountsCount + BalancesPerCatchpointFileChunk - 1) / BalancesPerCatchpointFileChunk,
+	}
+	var progress CatchpointCatchupAccessorProgress
+	err = catchpointAccessor.ProgressStagingBalances(ctx, "content.msgpack", protocol.Encode(&fileHeader), &progress)
+	require.NoError(t, err)
+
+	// stage the accounts, and independently compute the expected balances hash
+	expectedTrie, err := merkletrie.MakeTrie(&merkletrie.InMemoryCommitter{}, TrieMemoryConfig)
+	require.NoError(t, err)
+	encodedAccountChunks, _ := createTestingEncodedChunks(accountsCount)
+	for _, encodedAccounts := range encodedAccountChunks {
+		err = catchpointAccessor.ProgressStagingBalances(ctx, "balances.XX.msgpack", encodedAccounts, &progress)
+		require.NoError(t, err)
+
+		var balances catchpointFileBalancesChunk
+		require.NoError(t, protocol.Decode(encodedAccounts, &balances))
+		for _, balance := range balances.Balances {
+			var accountData basics.AccountData
+			require.NoError(t, protocol.Decode(balance.AccountData, &accountData))
+			added, err := expectedTrie.Add(accountHashBuilder(balance.Address, accountData, balance.AccountData))
+			require.NoError(t, err)
+			require.True(t, added)
+		}
+	}
+	err = catchpointAccessor.BuildMerkleTrie(ctx, func(uint64) {})
+	require.NoError(t, err)
+
+	expectedHash, err := expectedTrie.RootHash()
+	require.NoError(t, err)
+
+	verify := func(expectedAccounts uint64, expectedHash crypto.Digest) error {
+		rdb := l.trackerDB().Rdb
+		return rdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+			return verifyStagingAgainstManifest(tx, expectedAccounts, expectedHash)
+		})
+	}
+
+	require.NoError(t, verify(accountsCount, expectedHash))
+
+	err = verify(accountsCount+1, expectedHash)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "accounts count")
+
+	err = verify(accountsCount, crypto.Hash([]byte("wrong")))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "balances hash")
+
+	err = verify(accountsCount-1, crypto.Digest{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "accounts count")
+	require.Contains(t, err.Error(), "balances hash")
+}
+
+type countingHashFactory struct {
+	invocations int
+}
+
+func (chf *countingHashFactory) newHash() hash.Hash {
+	chf.invocations++
+	return sha256.New()
+}
+
+func TestValidateCatchpointChunk(t *testing.T) {
+	a := require.New(t)
+
+	var chunk catchpointFileBalancesChunk
+	for i := 0; i < 5; i++ {
+		ad := randomAccountData(0)
+		var addr basics.Address
+		addr[0] = byte(i + 1)
+		chunk.Balances = append(chunk.Balances, encodedBalanceRecord{Address: addr, AccountData: protocol.Encode(&ad)})
+	}
+	a.NoError(validateCatchpointChunk(protocol.Encode(&chunk), true))
+
+	// an out of order address is caught only when the chunk is expected to be sorted
+	chunk.Balances[2].Address, chunk.Balances[3].Address = chunk.Balances[3].Address, chunk.Balances[2].Address
+	a.NoError(validateCatchpointChunk(protocol.Encode(&chunk), false))
+	err := validateCatchpointChunk(protocol.Encode(&chunk), true)
+	a.Error(err)
+	a.Contains(err.Error(), "record 3")
+
+	// account data which doesn't decode is caught either way
+	chunk.Balances[2].Address, chunk.Balances[3].Address = chunk.Balances[3].Address, chunk.Balances[2].Address
+	chunk.Balances[1].AccountData = []byte{0x81, 0xa1, 'a', 0xc1}
+	err = validateCatchpointChunk(protocol.Encode(&chunk), false)
+	a.Error(err)
+	a.Contains(err.Error(), "record 1")
+
+	// a too short address would be padded by the decoder, but is caught here
+	type shortRecord struct {
+		Address []byte `codec:"pk"`
+	}
+	encoded := protocol.EncodeReflect(struct {
+		Balances []shortRecord `codec:"bl"`
+	}{Balances: []shortRecord{{Address: make([]byte, crypto.DigestSize-1)}}})
+	err = validateCatchpointChunk(encoded, false)
+	a.Error(err)
+	a.Contains(err.Error(), "record 0")
+
+	// as is a truncated chunk
+	a.Error(validateCatchpointChunk(protocol.Encode(&chunk)[:20], false))
+}
+
+func TestCatchupAccessorHashFactory(t *testing.T) {
+	// setup boilerplate
+	log := logging.TestingLog(t)
+	dbBaseFileName := t.Name()
+	const inMem = true
+	genesisInitState, _ := testGenerateInitState(t, protocol.ConsensusCurrentVersion, 100)
+	cfg := config.GetDefaultLocal()
+	l, err := OpenLedger(log, dbBaseFileName, inMem, genesisInitState, cfg)
+	require.NoError(t, err, "could not open ledger")
+	defer func() {
+		l.Close()
+	}()
+	// the catchpoint accessor uses the hash factory of the ledger's account updates tracker
+	stubHashFactory := &countingHashFactory{}
+	l.accts.hashFactory = stubHashFactory.newHash
+	catchpointAccessor := MakeCatchpointCatchupAccessor(l, log)
+	ctx := context.Background()
+
+	err = catchpointAccessor.ResetStagingBalances(ctx, true)
+	require.NoError(t, err, "ResetStagingBalances")
+
+	accountsCount := uint64(100)
+	fileHeader := CatchpointFileHeader{
+		Version:       catchpointFileVersion,
+		TotalAccounts: accountsCount,
+		TotalChunks:   (accountsCount + BalancesPerCatchpointFileChunk - 1) / BalancesPerCatchpointFileChunk,
+	}
+	var progress CatchpointCatchupAccessorProgress
+	err = catchpointAccessor.ProgressStagingBalances(ctx, "content.msgpack", protocol.Encode(&fileHeader), &progress)
+	require.NoError(t, err)
+
+	// compute the expected balances hash using the stub hash, as well as the one using the default hash
+	expectedTrie, err := merkletrie.MakeTrie(&merkletrie.InMemoryCommitter{}, TrieMemoryConfig)
+	require.NoError(t, err)
+	defaultTrie, err := merkletrie.MakeTrie(&merkletrie.InMemoryCommitter{}, TrieMemoryConfig)
+	require.NoError(t, err)
+	encodedAccountChunks, _ := createTestingEncodedChunks(accountsCount)
+	for _, encodedAccounts := range encodedAccountChunks {
+		err = catchpointAccessor.ProgressStagingBalances(ctx, "balances.XX.msgpack", encodedAccounts, &progress)
+		require.NoError(t, err)
+
+		var balances catchpointFileBalancesChunk
+		require.NoError(t, protocol.Decode(encodedAccounts, &balances))
+		for _, balance := range balances.Balances {
+			var accountData basics.AccountData
+			require.NoError(t, protocol.Decode(balance.AccountData, &accountData))
+			expectedAccountHash, err := accountHashBuilderWithFactory(sha256.New, balance.Address, accountData, balance.AccountData)
+			require.NoError(t, err)
+			_, err = expectedTrie.Add(expectedAccountHash)
+			require.NoError(t, err)
+			_, err = defaultTrie.Add(accountHashBuilder(balance.Address, accountData, balance.AccountData))
+			require.NoError(t, err)
+		}
+	}
+	require.Equal(t, int(accountsCount), stubHashFactory.invocations)
+
+	err = catchpointAccessor.BuildMerkleTrie(ctx, func(uint64) {})
+	require.NoError(t, err)
+
+	expectedHash, err := expectedTrie.RootHash()
+	require.NoError(t, err)
+	defaultHash, err := defaultTrie.RootHash()
+	require.NoError(t, err)
+	require.NotEqual(t, expectedHash, defaultHash)
+
+	rdb := l.trackerDB().Rdb
+	err = rdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+		return verifyStagingAgainstManifest(tx, accountsCount, expectedHash)
+	})
+	require.NoError(t, err)
+
+	// the default hash factory matches crypto.Hash
+	addr := randomAddress()
+	accountData := randomAccountData(0)
+	encodedAccountData := protocol.Encode(&accountData)
+	accountHash, err := accountHashBuilderWithFactory(sha512.New512_256, addr, accountData, encodedAccountData)
+	require.NoError(t, err)
+	require.Equal(t, accountHashBuilder(addr, accountData, encodedAccountData), accountHash)
+
+	// hash functions producing digests of other sizes are rejected rather than truncated or padded
+	_, err = accountHashBuilderWithFactory(sha256.New224, addr, accountData, encodedAccountData)
+	require.Error(t, err)
+	_, err = accountHashBuilderWithFactory(sha512.New, addr, accountData, encodedAccountData)
+	require.Error(t, err)
+
+	balances := []encodedBalanceRecord{{Address: addr, AccountData: encodedAccountData}}
+	_, err = prepareNormalizedBalances(balances, config.Consensus[protocol.ConsensusCurrentVersion], sha512.New)
+	require.Error(t, err)
+}
+
+func TestCatchpointBackedBalances(t *testing.T) {
+	// setup boilerplate
+	log := logging.TestingLog(t)
+	dbBaseFileName := t.Name()
+	const inMem = true
+	genesisInitState, _ := testGenerateInitState(t, protocol.ConsensusCurrentVersion, 100)
+	cfg := config.GetDefaultLocal()
+	l, err := OpenLedger(log, dbBaseFileName, inMem, genesisInitState, cfg)
+	require.NoError(t, err, "could not open ledger")
+	defer func() {
+		l.Close()
+	}()
+	catchpointAccessor := MakeCatchpointCatchupAccessor(l, log)
+	ctx := context.Background()
+
+	err = catchpointAccessor.ResetStagingBalances(ctx, true)
+	require.NoError(t, err, "ResetStagingBalances")
+
+	// a catchpoint holding a few accounts, one of which created an asset
+	accts := randomAccounts(10, true)
+	creator := randomAddress()
+	creatorData := randomAccountData(0)
+	creatorData.AssetParams = map[basics.AssetIndex]basics.AssetParams{77: {Total: 100, UnitName: "unit"}}
+	accts[creator] = creatorData
+
+	var balances catchpointFileBalancesChunk
+	for addr, ad := range accts {
+		balances.Balances = append(balances.Balances, encodedBalanceRecord{Address: addr, AccountData: protocol.Encode(&ad)})
+	}
+	fileHeader := CatchpointFileHeader{
+		Version:       catchpointFileVersion,
+		TotalAccounts: uint64(len(accts)),
+		TotalChunks:   1,
+	}
+	var progress CatchpointCatchupAccessorProgress
+	err = catchpointAccessor.ProgressStagingBalances(ctx, "content.msgpack", protocol.Encode(&fileHeader), &progress)
+	require.NoError(t, err)
+	err = catchpointAccessor.ProgressStagingBalances(ctx, "balances.00.msgpack", protocol.Encode(&balances), &progress)
+	require.NoError(t, err)
+	err = catchpointAccessor.BuildMerkleTrie(ctx, func(uint64) {})
+	require.NoError(t, err)
+
+	// promote the catchpoint
+	const balancesRound = basics.Round(1000)
+	wdb := l.trackerDB().Wdb
+	err = wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+		return applyCatchpointStagingBalances(ctx, tx, balancesRound)
+	})
+	require.NoError(t, err)
+
+	bals, err := MakeCatchpointBackedBalances(catchpointAccessor, balancesRound, protocol.ConsensusCurrentVersion)
+	require.NoError(t, err)
+
+	for addr, ad := range accts {
+		data, err := bals.Get(addr, false)
+		require.NoError(t, err)
+		require.Equal(t, ad, data)
+	}
+	data, err := bals.Get(randomAddress(), false)
+	require.NoError(t, err)
+	require.True(t, data.IsZero())
+
+	addr, ok, err := bals.GetCreator(77, basics.AssetCreatable)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, creator, addr)
+	_, ok, err = bals.GetCreator(78, basics.AssetCreatable)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// balances backed by a round other than the catchpoint one can't be read
+	bals, err = MakeCatchpointBackedBalances(catchpointAccessor, balancesRound+1, protocol.ConsensusCurrentVersion)
+	require.NoError(t, err)
+	_, err = bals.Get(creator, false)
+	require.Error(t, err)
+	_, ok = err.(*MismatchingDatabaseRoundError)
+	require.True(t, ok)
+
+	_, err = MakeCatchpointBackedBalances(catchpointAccessor, balancesRound, protocol.ConsensusVersion("unknown"))
+	require.Error(t, err)
+}
+
+// cancelAfterContext is a context which gets canceled once its Err method was called a given number of times.
+type cancelAfterContext struct {
+	context.Context
+	remaining int
+}
+
+func (c *cancelAfterContext) Err() error {
+	if c.remaining <= 0 {
+		return context.Canceled
+	}
+	c.remaining--
+	return nil
+}
+
+func TestCatchpointPromotionCancel(t *testing.T) {
+	// setup boilerplate
+	log := logging.TestingLog(t)
+	dbBaseFileName := t.Name()
+	const inMem = true
+	genesisInitState, _ := testGenerateInitState(t, protocol.ConsensusCurrentVersion, 100)
+	cfg := config.GetDefaultLocal()
+	l, err := OpenLedger(log, dbBaseFileName, inMem, genesisInitState, cfg)
+	require.NoError(t, err, "could not open ledger")
+	defer func() {
+		l.Close()
+	}()
+	catchpointAccessor := MakeCatchpointCatchupAccessor(l, log)
+	ctx := context.Background()
+
+	err = catchpointAccessor.ResetStagingBalances(ctx, true)
+	require.NoError(t, err, "ResetStagingBalances")
+
+	accts := randomAccounts(10, true)
+	var balances catchpointFileBalancesChunk
+	for addr, ad := range accts {
+		balances.Balances = append(balances.Balances, encodedBalanceRecord{Address: addr, AccountData: protocol.Encode(&ad)})
+	}
+	fileHeader := CatchpointFileHeader{
+		Version:       catchpointFileVersion,
+		TotalAccounts: uint64(len(accts)),
+		TotalChunks:   1,
+	}
+	var progress CatchpointCatchupAccessorProgress
+	err = catchpointAccessor.ProgressStagingBalances(ctx, "content.msgpack", protocol.Encode(&fileHeader), &progress)
+	require.NoError(t, err)
+	err = catchpointAccessor.ProgressStagingBalances(ctx, "balances.00.msgpack", protocol.Encode(&balances), &progress)
+	require.NoError(t, err)
+	err = catchpointAccessor.BuildMerkleTrie(ctx, func(uint64) {})
+	require.NoError(t, err)
+
+	rdb := l.trackerDB().Rdb
+	countRows := func(table string) (count int) {
+		err := rdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+			return tx.QueryRow(fmt.Sprintf("SELECT count(1) FROM %s", table)).Scan(&count)
+		})
+		require.NoError(t, err)
+		return
+	}
+	liveAccounts := countRows("accountbase")
+	require.Equal(t, len(genesisInitState.Accounts), liveAccounts)
+	dbRound := func() (rnd basics.Round) {
+		err := rdb.Atomic(func(ctx context.Context, tx *sql.Tx) (err error) {
+			rnd, _, err = accountsRound(tx)
+			return
+		})
+		require.NoError(t, err)
+		return
+	}
+	liveRound := dbRound()
+
+	// cancel the promotion before each of its steps, and make sure nothing changed
+	const balancesRound = basics.Round(1000)
+	wdb := l.trackerDB().Wdb
+	for steps, applied := 0, false; !applied; steps++ {
+		cancelCtx := &cancelAfterContext{Context: ctx, remaining: steps}
+		err = wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+			err := applyCatchpointStagingBalances(cancelCtx, tx, balancesRound)
+			if err != nil {
+				return err
+			}
+			// the promotion went through all of its steps; drop the transaction so that it could be retried below
+			applied = true
+			return context.Canceled
+		})
+		require.Equal(t, context.Canceled, err)
+		require.Equal(t, liveAccounts, countRows("accountbase"))
+		require.Equal(t, len(accts), countRows("catchpointbalances"))
+		require.Equal(t, liveRound, dbRound())
+	}
+
+	// the staged tables remained intact, so the promotion could be retried
+	err = wdb.Atomic(func(ctx context.Context, tx *sql.Tx) error {
+		return applyCatchpointStagingBalances(ctx, tx, balancesRound)
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(accts), countRows("accountbase"))
+	require.Equal(t, balancesRound, dbRound())
+}
+
 // blockdb.go code
 // TODO: blockStartCatchupStaging called from StoreFirstBlock()
 // TODO: blockCompleteCatchup called from FinishBlocks()
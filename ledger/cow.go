@@ -17,7 +17,10 @@
 package ledger
 
 import (
+	"bytes"
 	"fmt"
+	"math"
+	"sort"
 
 	"github.com/algorand/go-algorand/config"
 	"github.com/algorand/go-algorand/data/basics"
@@ -73,6 +76,11 @@ type roundCowState struct {
 	groupIdx int
 	// track creatables created during each transaction in the round
 	trackedCreatables map[int]basics.CreatableIndex
+
+	// number of Allocate calls made by the current transaction, and the
+	// maximum permitted; a zero maximum disables the check
+	allocations    int
+	maxAllocations int
 }
 
 func makeRoundCowState(b roundCowParent, hdr bookkeeping.BlockHeader, prevTimestamp int64, hint int) *roundCowState {
@@ -135,6 +143,23 @@ func (cb *roundCowState) round() basics.Round {
 	return cb.mods.Hdr.Round
 }
 
+// BaseRound returns the committed round the evaluation started from. It walks the cow chain up to its root
+// and reports the round of the backing roundCowBase; roots not backed by a roundCowBase report the round
+// preceding the one being evaluated.
+func (cb *roundCowState) BaseRound() basics.Round {
+	root := cb
+	for root.commitParent != nil {
+		root = root.commitParent
+	}
+	if base, ok := root.lookupParent.(*roundCowBase); ok {
+		return base.rnd
+	}
+	if root.round() == 0 {
+		return 0
+	}
+	return root.round() - 1
+}
+
 func (cb *roundCowState) prevTimestamp() int64 {
 	return cb.mods.PrevTimestamp
 }
@@ -163,6 +188,175 @@ func (cb *roundCowState) lookup(addr basics.Address) (data basics.AccountData, e
 	return cb.lookupParent.lookup(addr)
 }
 
+// HoldingCount returns the number of assets held by the given account, reflecting the holdings created or
+// removed within this cow and its parents. The account data is kept decoded throughout the cow chain and
+// the backing store cache, so the count is taken from the holdings map without any further decoding.
+func (cb *roundCowState) HoldingCount(addr basics.Address) (int, error) {
+	data, err := cb.lookup(addr)
+	if err != nil {
+		return 0, err
+	}
+	return len(data.Assets), nil
+}
+
+// LookupHolding returns the holding of the given asset by the given account, along with a flag indicating whether the
+// account holds that asset. Holdings created or removed earlier within this cow and its parents are reflected even though
+// they weren't committed yet; otherwise, the holding is read from the backing store.
+func (cb *roundCowState) LookupHolding(addr basics.Address, aidx basics.AssetIndex) (basics.AssetHolding, bool, error) {
+	data, err := cb.lookup(addr)
+	if err != nil {
+		return basics.AssetHolding{}, false, err
+	}
+	holding, ok := data.Assets[aidx]
+	return holding, ok, nil
+}
+
+// OnlineStakeDelta returns the change in the total normalized online balance caused by the accounts modified within
+// this cow, relative to its parent. Accounts going offline contribute their entire previous online balance negatively,
+// and accounts coming online contribute their entire new balance.
+func (cb *roundCowState) OnlineStakeDelta(proto config.ConsensusParams) (int64, error) {
+	var delta int64
+	for i := 0; i < cb.mods.Accts.Len(); i++ {
+		addr, newData := cb.mods.Accts.GetByIdx(i)
+		oldData, err := cb.lookupParent.lookup(addr)
+		if err != nil {
+			return 0, err
+		}
+		oldBalance := oldData.NormalizedOnlineBalance(proto)
+		newBalance := newData.NormalizedOnlineBalance(proto)
+		if oldBalance > math.MaxInt64 || newBalance > math.MaxInt64 {
+			return 0, fmt.Errorf("online stake delta: normalized online balance of %v overflows", addr)
+		}
+		delta += int64(newBalance) - int64(oldBalance)
+	}
+	return delta, nil
+}
+
+// ReadOnlyAccessedAccounts returns, sorted by address, the accounts that were read from the base accounts cache
+// but weren't modified by this cow or any of its parents. Accounts evicted from a bounded cache aren't reported.
+func (cb *roundCowState) ReadOnlyAccessedAccounts() []basics.Address {
+	cows, base := cb.ancestors()
+	if base == nil || base.accounts == nil {
+		return nil
+	}
+
+	var addrs []basics.Address
+	for _, addr := range base.accounts.addresses() {
+		if !modifiedByAny(cows, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
+	return addrs
+}
+
+// TrimPadCache evicts accounts from the base accounts cache in order to free memory during a long evaluation. When
+// keepModified is set, the accounts modified by this cow or any of its parents are retained, and only the accounts
+// that were merely read are evicted. Pinned accounts are never evicted. Evicted accounts are looked up again from the
+// ledger on their next access, so trimming the cache doesn't affect the evaluation outcome.
+func (cb *roundCowState) TrimPadCache(keepModified bool) {
+	cows, base := cb.ancestors()
+	if base == nil || base.accounts == nil {
+		return
+	}
+	base.accounts.evict(func(addr basics.Address) bool {
+		return keepModified && modifiedByAny(cows, addr)
+	})
+}
+
+const (
+	// storageDeltaEntrySize is the estimated size of a storageDelta, including its counts and its map
+	storageDeltaEntrySize = 200
+	// valueDeltaEntrySize is the estimated size of a valueDelta entry, excluding its key and byte slices
+	valueDeltaEntrySize = 100
+	// baseAccountsCacheEntrySize is the estimated size of a baseAccountsCache entry, excluding the account data maps
+	baseAccountsCacheEntrySize = 300
+)
+
+// ApproxMemoryFootprint estimates the number of bytes used by this cow : its state delta, its application storage
+// deltas, and the base accounts cache it reads through. The estimate is meant for sizing the hint passed to
+// MakeStateDelta, and for detecting runaway memory usage; it isn't an accurate accounting of the allocations.
+func (cb *roundCowState) ApproxMemoryFootprint() int {
+	size := cb.mods.ApproxMemoryFootprint()
+	for _, smod := range cb.sdeltas {
+		for _, sd := range smod {
+			size += storageDeltaEntrySize
+			for key, vd := range sd.kvCow {
+				size += valueDeltaEntrySize + len(key) + len(vd.old.Bytes) + len(vd.new.Bytes)
+			}
+		}
+	}
+	if _, base := cb.ancestors(); base != nil && base.accounts != nil {
+		for _, data := range base.accounts.pinned {
+			size += baseAccountsCacheEntrySize
+			if data != nil {
+				size += data.Msgsize()
+			}
+		}
+		for _, el := range base.accounts.accounts {
+			entry := el.Value.(baseAccountsCacheEntry)
+			size += baseAccountsCacheEntrySize + entry.data.Msgsize()
+		}
+	}
+	return size
+}
+
+// ancestors returns this cow along with all of its parent cows, and the roundCowBase they are layered over, if any.
+func (cb *roundCowState) ancestors() (cows []*roundCowState, base *roundCowBase) {
+	for parent := roundCowParent(cb); parent != nil; {
+		switch p := parent.(type) {
+		case *roundCowState:
+			cows = append(cows, p)
+			parent = p.lookupParent
+		case *roundCowBase:
+			base = p
+			parent = nil
+		default:
+			parent = nil
+		}
+	}
+	return
+}
+
+// modifiedByAny returns true if any of the given cows modified the account or its application storage.
+func modifiedByAny(cows []*roundCowState, addr basics.Address) bool {
+	for _, c := range cows {
+		if _, ok := c.mods.Accts.Get(addr); ok {
+			return true
+		}
+		if _, ok := c.sdeltas[addr]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusTransition is a change in the status of an account, as reported by StatusTransitions.
+type StatusTransition struct {
+	Addr basics.Address
+	Old  basics.Status
+	New  basics.Status
+}
+
+// StatusTransitions returns the accounts modified by this cow whose status differs from the one seen by its parent,
+// sorted by address.
+func (cb *roundCowState) StatusTransitions() ([]StatusTransition, error) {
+	var transitions []StatusTransition
+	for _, addr := range cb.modifiedAccountsSorted() {
+		newData, _ := cb.mods.Accts.Get(addr)
+		oldData, err := cb.lookupParent.lookup(addr)
+		if err != nil {
+			return nil, err
+		}
+		if oldData.Status != newData.Status {
+			transitions = append(transitions, StatusTransition{Addr: addr, Old: oldData.Status, New: newData.Status})
+		}
+	}
+	return transitions, nil
+}
+
 func (cb *roundCowState) checkDup(firstValid, lastValid basics.Round, txid transactions.Txid, txl ledgercore.Txlease) error {
 	_, present := cb.mods.Txids[txid]
 	if present {
@@ -223,6 +417,74 @@ func (cb *roundCowState) addTx(txn transactions.Transaction, txid transactions.T
 	cb.mods.Txleases[ledgercore.Txlease{Sender: txn.Sender, Lease: txn.Lease}] = txn.LastValid
 }
 
+// accountsExpiredLeases returns the leases recorded in the cow whose expiration round is at or before asOf.
+// Only the leases held by the cow itself are examined; leases committed to the parent are not included.
+func accountsExpiredLeases(cb *roundCowState, asOf basics.Round) []ledgercore.Txlease {
+	var expired []ledgercore.Txlease
+	for txl, expires := range cb.mods.Txleases {
+		if expires <= asOf {
+			expired = append(expired, txl)
+		}
+	}
+	return expired
+}
+
+// creatableChanges lists the creatables created and deleted by a single creator.
+type creatableChanges struct {
+	Created []basics.CreatableIndex
+	Deleted []basics.CreatableIndex
+}
+
+// creatableChangesByCreator groups the creatables created or deleted in the cow by their creator. The creatable
+// indices are sorted, so that the result doesn't depend on the map iteration order.
+func (cb *roundCowState) creatableChangesByCreator() map[basics.Address]creatableChanges {
+	changes := make(map[basics.Address]creatableChanges)
+	for cidx, mc := range cb.mods.Creatables {
+		cc := changes[mc.Creator]
+		if mc.Created {
+			cc.Created = append(cc.Created, cidx)
+		} else {
+			cc.Deleted = append(cc.Deleted, cidx)
+		}
+		changes[mc.Creator] = cc
+	}
+	for _, cc := range changes {
+		sort.Slice(cc.Created, func(i, j int) bool { return cc.Created[i] < cc.Created[j] })
+		sort.Slice(cc.Deleted, func(i, j int) bool { return cc.Deleted[i] < cc.Deleted[j] })
+	}
+	return changes
+}
+
+// CreatedAssets returns, sorted by index, the assets created by the given account in this cow.
+func (cb *roundCowState) CreatedAssets(creator basics.Address) []basics.AssetIndex {
+	var assets []basics.AssetIndex
+	for _, cidx := range cb.createdBy(creator, basics.AssetCreatable) {
+		assets = append(assets, basics.AssetIndex(cidx))
+	}
+	return assets
+}
+
+// CreatedApps returns, sorted by index, the applications created by the given account in this cow.
+func (cb *roundCowState) CreatedApps(creator basics.Address) []basics.AppIndex {
+	var apps []basics.AppIndex
+	for _, cidx := range cb.createdBy(creator, basics.AppCreatable) {
+		apps = append(apps, basics.AppIndex(cidx))
+	}
+	return apps
+}
+
+// createdBy returns, sorted by index, the creatables of the given type created by the given account in this cow.
+func (cb *roundCowState) createdBy(creator basics.Address, ctype basics.CreatableType) []basics.CreatableIndex {
+	var created []basics.CreatableIndex
+	for cidx, mc := range cb.mods.Creatables {
+		if mc.Created && mc.Ctype == ctype && mc.Creator == creator {
+			created = append(created, cidx)
+		}
+	}
+	sort.Slice(created, func(i, j int) bool { return created[i] < created[j] })
+	return created
+}
+
 func (cb *roundCowState) setCompactCertNext(rnd basics.Round) {
 	cb.mods.CompactCertNext = rnd
 }
@@ -234,6 +496,8 @@ func (cb *roundCowState) child(hint int) *roundCowState {
 		proto:        cb.proto,
 		mods:         ledgercore.MakeStateDelta(cb.mods.Hdr, cb.mods.PrevTimestamp, hint, cb.mods.CompactCertNext),
 		sdeltas:      make(map[basics.Address]map[storagePtr]*storageDelta),
+
+		maxAllocations: cb.maxAllocations,
 	}
 
 	// clone tracked creatables
@@ -252,9 +516,24 @@ func (cb *roundCowState) child(hint int) *roundCowState {
 // setGroupIdx sets this transaction's index within its group
 func (cb *roundCowState) setGroupIdx(txnIdx int) {
 	cb.groupIdx = txnIdx
+	cb.allocations = 0
 }
 
-func (cb *roundCowState) commitToParent() {
+// commitToParent merges the changes accumulated in this cow into its parent. The storage deltas are validated
+// before anything is merged, so that the parent is left untouched if any of them cannot be applied.
+func (cb *roundCowState) commitToParent() error {
+	for addr, smod := range cb.sdeltas {
+		for aapp, nsd := range smod {
+			lsd, ok := cb.commitParent.sdeltas[addr][aapp]
+			if !ok {
+				lsd = &storageDelta{}
+			}
+			if err := lsd.checkChild(nsd); err != nil {
+				return fmt.Errorf("address %v app %d global %v: %w", addr, aapp.aidx, aapp.global, err)
+			}
+		}
+	}
+
 	cb.commitParent.mods.Accts.MergeAccounts(cb.mods.Accts)
 
 	for txid, lv := range cb.mods.Txids {
@@ -270,7 +549,8 @@ func (cb *roundCowState) commitToParent() {
 		for aapp, nsd := range smod {
 			lsd, ok := cb.commitParent.sdeltas[addr][aapp]
 			if ok {
-				lsd.applyChild(nsd)
+				// already verified by checkChild above
+				lsd.mergeChild(nsd)
 			} else {
 				_, ok = cb.commitParent.sdeltas[addr]
 				if !ok {
@@ -281,8 +561,19 @@ func (cb *roundCowState) commitToParent() {
 		}
 	}
 	cb.commitParent.mods.CompactCertNext = cb.mods.CompactCertNext
+	return nil
 }
 
 func (cb *roundCowState) modifiedAccounts() []basics.Address {
 	return cb.mods.Accts.ModifiedAccounts()
 }
+
+// modifiedAccountsSorted returns the modified accounts sorted by address, so that the order doesn't depend on the
+// order in which the accounts were modified.
+func (cb *roundCowState) modifiedAccountsSorted() []basics.Address {
+	addrs := cb.modifiedAccounts()
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
+	return addrs
+}
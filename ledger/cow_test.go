@@ -17,14 +17,19 @@
 package ledger
 
 import (
+	"bytes"
+	"fmt"
+	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/algorand/go-algorand/config"
 	"github.com/algorand/go-algorand/data/basics"
 	"github.com/algorand/go-algorand/data/bookkeeping"
 	"github.com/algorand/go-algorand/data/transactions"
 	"github.com/algorand/go-algorand/ledger/ledgercore"
+	"github.com/algorand/go-algorand/protocol"
 )
 
 type mockLedger struct {
@@ -132,10 +137,386 @@ func TestCowBalance(t *testing.T) {
 	checkCow(t, c1, accts1)
 	checkCow(t, c2, accts2)
 
-	c2.commitToParent()
+	require.NoError(t, c2.commitToParent())
 	checkCow(t, c0, accts0)
 	checkCow(t, c1, accts2)
 
-	c1.commitToParent()
+	require.NoError(t, c1.commitToParent())
 	checkCow(t, c0, accts2)
 }
+
+func TestCowExpiredLeases(t *testing.T) {
+	a := require.New(t)
+
+	ml := mockLedger{balanceMap: make(map[basics.Address]basics.AccountData)}
+	c0 := makeRoundCowState(&ml, bookkeeping.BlockHeader{}, 0, 0)
+	a.Empty(accountsExpiredLeases(c0, 100))
+
+	sender := randomAddress()
+	var expected []ledgercore.Txlease
+	for i := 1; i <= 10; i++ {
+		txn := transactions.Transaction{
+			Header: transactions.Header{
+				Sender:    sender,
+				LastValid: basics.Round(i * 10),
+				Lease:     [32]byte{byte(i)},
+			},
+		}
+		c0.addTx(txn, transactions.Txid{byte(i)})
+		if txn.LastValid <= 50 {
+			expected = append(expected, ledgercore.Txlease{Sender: sender, Lease: txn.Lease})
+		}
+	}
+
+	a.ElementsMatch(expected, accountsExpiredLeases(c0, 50))
+	a.ElementsMatch(expected, accountsExpiredLeases(c0, 59))
+	a.Empty(accountsExpiredLeases(c0, 9))
+	a.Len(accountsExpiredLeases(c0, 100), 10)
+}
+
+func TestCowBaseRound(t *testing.T) {
+	a := require.New(t)
+
+	base := &roundCowBase{rnd: basics.Round(42)}
+	c0 := makeRoundCowState(base, bookkeeping.BlockHeader{Round: 43}, 0, 0)
+	a.Equal(basics.Round(42), c0.BaseRound())
+
+	c1 := c0.child(0)
+	c2 := c1.child(0)
+	a.Equal(basics.Round(42), c1.BaseRound())
+	a.Equal(basics.Round(42), c2.BaseRound())
+
+	// without a roundCowBase, the base round is the one preceding the evaluated round
+	ml := mockLedger{balanceMap: make(map[basics.Address]basics.AccountData)}
+	c3 := makeRoundCowState(&ml, bookkeeping.BlockHeader{Round: 10}, 0, 0)
+	a.Equal(basics.Round(9), c3.child(0).BaseRound())
+}
+
+func TestCowHoldingCount(t *testing.T) {
+	a := require.New(t)
+
+	addr := randomAddress()
+	base := randomAccountData(0)
+	base.Assets = map[basics.AssetIndex]basics.AssetHolding{1: {Amount: 1}, 2: {Amount: 2}, 3: {Amount: 3}}
+	ml := mockLedger{balanceMap: map[basics.Address]basics.AccountData{addr: base}}
+
+	c0 := makeRoundCowState(&ml, bookkeeping.BlockHeader{}, 0, 0)
+	count, err := c0.HoldingCount(addr)
+	a.NoError(err)
+	a.Equal(3, count)
+
+	// opt into two assets and close out of one within a child cow
+	c1 := c0.child(0)
+	updated := base
+	updated.Assets = map[basics.AssetIndex]basics.AssetHolding{1: {Amount: 1}, 3: {Amount: 3}, 4: {}, 5: {}}
+	c1.put(addr, updated, nil, nil)
+	count, err = c1.HoldingCount(addr)
+	a.NoError(err)
+	a.Equal(4, count)
+
+	// the parent isn't affected until the child is committed
+	count, err = c0.HoldingCount(addr)
+	a.NoError(err)
+	a.Equal(3, count)
+
+	require.NoError(t, c1.commitToParent())
+	count, err = c0.HoldingCount(addr)
+	a.NoError(err)
+	a.Equal(4, count)
+
+	count, err = c0.HoldingCount(randomAddress())
+	a.NoError(err)
+	a.Equal(0, count)
+}
+
+func TestCowLookupHolding(t *testing.T) {
+	a := require.New(t)
+
+	addr := randomAddress()
+	base := randomAccountData(0)
+	base.Assets = map[basics.AssetIndex]basics.AssetHolding{1: {Amount: 1}, 2: {Amount: 2, Frozen: true}}
+	ml := mockLedger{balanceMap: map[basics.Address]basics.AccountData{addr: base}}
+
+	c0 := makeRoundCowState(&ml, bookkeeping.BlockHeader{}, 0, 0)
+	holding, ok, err := c0.LookupHolding(addr, 2)
+	a.NoError(err)
+	a.True(ok)
+	a.Equal(basics.AssetHolding{Amount: 2, Frozen: true}, holding)
+
+	// create a holding and close out of another one in a child cow, and read them back before committing
+	c1 := c0.child(0)
+	updated := base
+	updated.Assets = map[basics.AssetIndex]basics.AssetHolding{2: {Amount: 2, Frozen: true}, 3: {Amount: 30}}
+	c1.put(addr, updated, nil, nil)
+
+	c2 := c1.child(0)
+	for _, c := range []*roundCowState{c1, c2} {
+		holding, ok, err = c.LookupHolding(addr, 3)
+		a.NoError(err)
+		a.True(ok)
+		a.Equal(basics.AssetHolding{Amount: 30}, holding)
+
+		_, ok, err = c.LookupHolding(addr, 1)
+		a.NoError(err)
+		a.False(ok)
+	}
+
+	// the parent isn't affected until the child is committed
+	_, ok, err = c0.LookupHolding(addr, 3)
+	a.NoError(err)
+	a.False(ok)
+
+	a.NoError(c1.commitToParent())
+	holding, ok, err = c0.LookupHolding(addr, 3)
+	a.NoError(err)
+	a.True(ok)
+	a.Equal(basics.AssetHolding{Amount: 30}, holding)
+
+	_, ok, err = c0.LookupHolding(randomAddress(), 1)
+	a.NoError(err)
+	a.False(ok)
+}
+
+func TestCowOnlineStakeDelta(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	online := randomAddress()
+	onlineData := basics.AccountData{Status: basics.Online, MicroAlgos: basics.MicroAlgos{Raw: 5000000}}
+	offline := randomAddress()
+	offlineData := basics.AccountData{Status: basics.Offline, MicroAlgos: basics.MicroAlgos{Raw: 2000000}}
+	ml := mockLedger{balanceMap: map[basics.Address]basics.AccountData{online: onlineData, offline: offlineData}}
+
+	c0 := makeRoundCowState(&ml, bookkeeping.BlockHeader{}, 0, 0)
+	delta, err := c0.OnlineStakeDelta(proto)
+	a.NoError(err)
+	a.Zero(delta)
+
+	// take the online account offline
+	c1 := c0.child(0)
+	updated := onlineData
+	updated.Status = basics.Offline
+	c1.put(online, updated, nil, nil)
+	delta, err = c1.OnlineStakeDelta(proto)
+	a.NoError(err)
+	a.Equal(-int64(onlineData.NormalizedOnlineBalance(proto)), delta)
+	a.Less(delta, int64(0))
+
+	// bring the offline account online
+	updated = offlineData
+	updated.Status = basics.Online
+	c1.put(offline, updated, nil, nil)
+	delta, err = c1.OnlineStakeDelta(proto)
+	a.NoError(err)
+	a.Equal(int64(updated.NormalizedOnlineBalance(proto))-int64(onlineData.NormalizedOnlineBalance(proto)), delta)
+
+	// a balance change of an account remaining online
+	c2 := c0.child(0)
+	updated = onlineData
+	updated.MicroAlgos.Raw += 1000000
+	c2.put(online, updated, nil, nil)
+	delta, err = c2.OnlineStakeDelta(proto)
+	a.NoError(err)
+	a.Equal(int64(updated.NormalizedOnlineBalance(proto)-onlineData.NormalizedOnlineBalance(proto)), delta)
+}
+
+func TestCowCreatableChangesByCreator(t *testing.T) {
+	a := require.New(t)
+
+	addr1 := randomAddress()
+	addr2 := randomAddress()
+	ml := mockLedger{balanceMap: map[basics.Address]basics.AccountData{}}
+	c0 := makeRoundCowState(&ml, bookkeeping.BlockHeader{}, 0, 0)
+	a.Empty(c0.creatableChangesByCreator())
+
+	create := func(cb *roundCowState, creator basics.Address, cidx basics.CreatableIndex, ctype basics.CreatableType) {
+		cb.put(creator, basics.AccountData{}, &basics.CreatableLocator{Type: ctype, Creator: creator, Index: cidx}, nil)
+	}
+	remove := func(cb *roundCowState, creator basics.Address, cidx basics.CreatableIndex, ctype basics.CreatableType) {
+		cb.put(creator, basics.AccountData{}, nil, &basics.CreatableLocator{Type: ctype, Creator: creator, Index: cidx})
+	}
+
+	create(c0, addr1, 7, basics.AssetCreatable)
+	create(c0, addr1, 3, basics.AppCreatable)
+	remove(c0, addr1, 1, basics.AssetCreatable)
+	create(c0, addr2, 5, basics.AssetCreatable)
+
+	c1 := c0.child(0)
+	remove(c1, addr2, 2, basics.AppCreatable)
+	remove(c1, addr2, 4, basics.AssetCreatable)
+	create(c1, addr1, 6, basics.AssetCreatable)
+	require.NoError(t, c1.commitToParent())
+
+	a.Equal(map[basics.Address]creatableChanges{
+		addr1: {Created: []basics.CreatableIndex{3, 6, 7}, Deleted: []basics.CreatableIndex{1}},
+		addr2: {Created: []basics.CreatableIndex{5}, Deleted: []basics.CreatableIndex{2, 4}},
+	}, c0.creatableChangesByCreator())
+}
+
+func TestCowCreatedAssetsAndApps(t *testing.T) {
+	a := require.New(t)
+
+	addr1 := randomAddress()
+	addr2 := randomAddress()
+	ml := mockLedger{balanceMap: map[basics.Address]basics.AccountData{}}
+	c0 := makeRoundCowState(&ml, bookkeeping.BlockHeader{}, 0, 0)
+	a.Empty(c0.CreatedAssets(addr1))
+	a.Empty(c0.CreatedApps(addr1))
+
+	create := func(cb *roundCowState, creator basics.Address, cidx basics.CreatableIndex, ctype basics.CreatableType) {
+		cb.put(creator, basics.AccountData{}, &basics.CreatableLocator{Type: ctype, Creator: creator, Index: cidx}, nil)
+	}
+	remove := func(cb *roundCowState, creator basics.Address, cidx basics.CreatableIndex, ctype basics.CreatableType) {
+		cb.put(creator, basics.AccountData{}, nil, &basics.CreatableLocator{Type: ctype, Creator: creator, Index: cidx})
+	}
+
+	create(c0, addr1, 9, basics.AssetCreatable)
+	create(c0, addr1, 3, basics.AssetCreatable)
+	create(c0, addr1, 4, basics.AppCreatable)
+	remove(c0, addr1, 1, basics.AssetCreatable)
+	remove(c0, addr1, 2, basics.AppCreatable)
+	create(c0, addr2, 5, basics.AssetCreatable)
+	create(c0, addr2, 6, basics.AppCreatable)
+
+	c1 := c0.child(0)
+	create(c1, addr1, 7, basics.AppCreatable)
+	a.Empty(c1.CreatedAssets(addr1))
+	a.Equal([]basics.AppIndex{7}, c1.CreatedApps(addr1))
+	a.NoError(c1.commitToParent())
+
+	a.Equal([]basics.AssetIndex{3, 9}, c0.CreatedAssets(addr1))
+	a.Equal([]basics.AppIndex{4, 7}, c0.CreatedApps(addr1))
+	a.Equal([]basics.AssetIndex{5}, c0.CreatedAssets(addr2))
+	a.Equal([]basics.AppIndex{6}, c0.CreatedApps(addr2))
+	a.Empty(c0.CreatedAssets(randomAddress()))
+}
+
+func TestCowApproxMemoryFootprint(t *testing.T) {
+	a := require.New(t)
+
+	accts := randomAccounts(400, true)
+	addrs := make([]basics.Address, 0, len(accts))
+	for addr := range accts {
+		addrs = append(addrs, addr)
+	}
+	ccl := &countingLedgerForCowBase{balances: accts}
+	base := &roundCowBase{l: ccl, rnd: basics.Round(10), accounts: makeBaseAccountsCache()}
+	cb := makeRoundCowState(base, bookkeeping.BlockHeader{Round: 11}, 0, 0)
+	empty := cb.ApproxMemoryFootprint()
+
+	// modify a growing number of accounts, and check the footprint grows along
+	modify := func(addrs []basics.Address) {
+		for _, addr := range addrs {
+			ad, err := cb.lookup(addr)
+			a.NoError(err)
+			ad.MicroAlgos.Raw++
+			cb.put(addr, ad, nil, nil)
+		}
+	}
+	modify(addrs[:100])
+	first := cb.ApproxMemoryFootprint() - empty
+	a.Greater(first, 0)
+	modify(addrs[100:])
+	all := cb.ApproxMemoryFootprint() - empty
+	ratio := float64(all) / float64(first)
+	a.True(ratio > 3 && ratio < 5, "footprint ratio %f", ratio)
+
+	// storage deltas are accounted for as well
+	before := cb.ApproxMemoryFootprint()
+	counts := basics.StateSchema{}
+	kv := make(stateDelta)
+	for i := 0; i < 10; i++ {
+		kv[fmt.Sprintf("key%d", i)] = valueDelta{new: basics.TealValue{Type: basics.TealBytesType, Bytes: "value"}, newExists: true}
+	}
+	cb.sdeltas[addrs[0]] = map[storagePtr]*storageDelta{{aidx: 1, global: true}: {action: allocAction, kvCow: kv, counts: &counts, maxCounts: &counts}}
+	a.Greater(cb.ApproxMemoryFootprint(), before)
+}
+
+func TestCowModifiedAccountsSorted(t *testing.T) {
+	a := require.New(t)
+
+	accts := randomAccounts(20, true)
+	addrs := make([]basics.Address, 0, len(accts))
+	for addr := range accts {
+		addrs = append(addrs, addr)
+	}
+	ml := mockLedger{balanceMap: accts}
+
+	var expected []basics.Address
+	for run := 0; run < 5; run++ {
+		// modify the accounts in a different order on every run
+		c0 := makeRoundCowState(&ml, bookkeeping.BlockHeader{}, 0, 0)
+		for _, i := range rand.Perm(len(addrs)) {
+			c0.put(addrs[i], accts[addrs[i]], nil, nil)
+		}
+		sorted := c0.modifiedAccountsSorted()
+		a.Len(sorted, len(addrs))
+		a.ElementsMatch(addrs, sorted)
+		for i := 1; i < len(sorted); i++ {
+			a.True(bytes.Compare(sorted[i-1][:], sorted[i][:]) < 0)
+		}
+		if expected == nil {
+			expected = sorted
+		}
+		a.Equal(expected, sorted)
+	}
+}
+
+func TestCowStatusTransitions(t *testing.T) {
+	a := require.New(t)
+
+	accts := randomAccounts(10, true)
+	var online, offline, unchanged basics.Address
+	for addr, ad := range accts {
+		switch {
+		case online.IsZero():
+			online = addr
+			ad.Status = basics.Online
+		case offline.IsZero():
+			offline = addr
+			ad.Status = basics.Offline
+		case unchanged.IsZero():
+			unchanged = addr
+			ad.Status = basics.Online
+		}
+		accts[addr] = ad
+	}
+	ml := mockLedger{balanceMap: accts}
+	c0 := makeRoundCowState(&ml, bookkeeping.BlockHeader{}, 0, 0)
+
+	transitions, err := c0.StatusTransitions()
+	a.NoError(err)
+	a.Empty(transitions)
+
+	goingOffline := accts[online]
+	goingOffline.Status = basics.Offline
+	c0.put(online, goingOffline, nil, nil)
+	goingOnline := accts[offline]
+	goingOnline.Status = basics.Online
+	c0.put(offline, goingOnline, nil, nil)
+	// modifying an account without changing its status isn't a transition
+	modified := accts[unchanged]
+	modified.MicroAlgos.Raw++
+	c0.put(unchanged, modified, nil, nil)
+
+	expected := []StatusTransition{
+		{Addr: online, Old: basics.Online, New: basics.Offline},
+		{Addr: offline, Old: basics.Offline, New: basics.Online},
+	}
+	if bytes.Compare(offline[:], online[:]) < 0 {
+		expected[0], expected[1] = expected[1], expected[0]
+	}
+	transitions, err = c0.StatusTransitions()
+	a.NoError(err)
+	a.Equal(expected, transitions)
+
+	// a child reports the transitions relative to its parent
+	c1 := c0.child(0)
+	transitions, err = c1.StatusTransitions()
+	a.NoError(err)
+	a.Empty(transitions)
+	c1.put(online, accts[online], nil, nil)
+	transitions, err = c1.StatusTransitions()
+	a.NoError(err)
+	a.Equal([]StatusTransition{{Addr: online, Old: basics.Offline, New: basics.Online}}, transitions)
+}
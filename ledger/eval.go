@@ -17,6 +17,7 @@
 package ledger
 
 import (
+	"container/list"
 	"context"
 	"errors"
 	"fmt"
@@ -75,28 +76,179 @@ type roundCowBase struct {
 	// The underlying (accountupdates) infrastucture may provide additional cross-round caching which
 	// are beyond the scope of this cache.
 	// The account data store here is always the account data without the rewards.
-	accounts map[basics.Address]basics.AccountData
+	accounts *baseAccountsCache
+
+	// The creators of the creatables that were already looked up during this round evaluation. Similarly
+	// to the accounts cache above, the creator lookups are historical ones and therefore won't be changing;
+	// the creatables created or deleted during the evaluation are tracked by the roundCowState and
+	// are consulted before reaching this cache.
+	creators map[creatableCacheKey]foundAddress
+}
+
+// creatableCacheKey is the key of the roundCowBase creators cache
+type creatableCacheKey struct {
+	cidx  basics.CreatableIndex
+	ctype basics.CreatableType
+}
+
+// foundAddress is the value of the roundCowBase creators cache
+type foundAddress struct {
+	address basics.Address
+	exists  bool
 }
 
+// getCreator returns the creator of the given creatable as of the base round. It uses the internal per-round cache
+// first, and if it cannot find it there, it would defer to the underlaying implementation. As with lookup, errors
+// are not cached.
 func (x *roundCowBase) getCreator(cidx basics.CreatableIndex, ctype basics.CreatableType) (basics.Address, bool, error) {
-	return x.l.GetCreatorForRound(x.rnd, cidx, ctype)
+	key := creatableCacheKey{cidx: cidx, ctype: ctype}
+	if found, ok := x.creators[key]; ok {
+		return found.address, found.exists, nil
+	}
+
+	creator, exists, err := x.l.GetCreatorForRound(x.rnd, cidx, ctype)
+	if err == nil {
+		x.creators[key] = foundAddress{address: creator, exists: exists}
+	}
+	return creator, exists, err
 }
 
 // lookup returns the non-rewarded account data for the provided account address. It uses the internal per-round cache
 // first, and if it cannot find it there, it would defer to the underlaying implementation.
 // note that errors in accounts data retrivals are not cached as these typically cause the transaction evaluation to fail.
 func (x *roundCowBase) lookup(addr basics.Address) (basics.AccountData, error) {
-	if accountData, found := x.accounts[addr]; found {
+	if accountData, found := x.accounts.read(addr); found {
 		return accountData, nil
 	}
 
 	accountData, _, err := x.l.LookupWithoutRewards(x.rnd, addr)
 	if err == nil {
-		x.accounts[addr] = accountData
+		x.accounts.write(addr, accountData)
 	}
 	return accountData, err
 }
 
+// baseAccountsCache is the roundCowBase accounts cache. It's unbounded by default; once a size is set, the least
+// recently used accounts are evicted whenever the cache grows beyond that size. Pinned accounts are never evicted,
+// but are counted towards the cache size, and no more than size accounts are pinned. Evicted accounts are simply
+// looked up again on their next access.
+type baseAccountsCache struct {
+	// size is the maximal number of accounts retained by the cache, including the pinned ones; zero means unbounded.
+	size int
+	// accountsList contains the unpinned accounts, where the front ones are the most recently used.
+	accountsList *list.List
+	// accounts provides fast access to the elements of accountsList by account address.
+	accounts map[basics.Address]*list.Element
+	// pinned contains the pinned addresses, along with their account data once it was written.
+	pinned map[basics.Address]*basics.AccountData
+}
+
+// baseAccountsCacheEntry is the element stored in the baseAccountsCache accountsList.
+type baseAccountsCacheEntry struct {
+	addr basics.Address
+	data basics.AccountData
+}
+
+func makeBaseAccountsCache() *baseAccountsCache {
+	return &baseAccountsCache{
+		accountsList: list.New(),
+		accounts:     make(map[basics.Address]*list.Element),
+		pinned:       make(map[basics.Address]*basics.AccountData),
+	}
+}
+
+// read returns the account data cached for the given address, marking it as the most recently used one.
+func (c *baseAccountsCache) read(addr basics.Address) (basics.AccountData, bool) {
+	if data, pinned := c.pinned[addr]; pinned {
+		if data == nil {
+			return basics.AccountData{}, false
+		}
+		return *data, true
+	}
+	if el := c.accounts[addr]; el != nil {
+		c.accountsList.MoveToFront(el)
+		return el.Value.(baseAccountsCacheEntry).data, true
+	}
+	return basics.AccountData{}, false
+}
+
+// write adds or replaces the account data of the given address, evicting the least recently used accounts as needed.
+func (c *baseAccountsCache) write(addr basics.Address, data basics.AccountData) {
+	if _, pinned := c.pinned[addr]; pinned {
+		c.pinned[addr] = &data
+		return
+	}
+	if el := c.accounts[addr]; el != nil {
+		el.Value = baseAccountsCacheEntry{addr: addr, data: data}
+		c.accountsList.MoveToFront(el)
+	} else {
+		c.accounts[addr] = c.accountsList.PushFront(baseAccountsCacheEntry{addr: addr, data: data})
+	}
+	c.prune()
+}
+
+// addresses returns the addresses of all the accounts currently held by the cache.
+func (c *baseAccountsCache) addresses() []basics.Address {
+	addrs := make([]basics.Address, 0, len(c.pinned)+len(c.accounts))
+	for addr, data := range c.pinned {
+		if data != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	for addr := range c.accounts {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// pin marks the given address as one that is never evicted from the cache. Once the pinned accounts fill the cache
+// size, the address is left unpinned, and gets evicted like any other account.
+func (c *baseAccountsCache) pin(addr basics.Address) {
+	if _, pinned := c.pinned[addr]; pinned {
+		return
+	}
+	if c.size > 0 && len(c.pinned) >= c.size {
+		return
+	}
+	if el := c.accounts[addr]; el != nil {
+		data := el.Value.(baseAccountsCacheEntry).data
+		c.pinned[addr] = &data
+		delete(c.accounts, addr)
+		c.accountsList.Remove(el)
+		return
+	}
+	c.pinned[addr] = nil
+	c.prune()
+}
+
+// evict drops the unpinned accounts for which keep returns false.
+func (c *baseAccountsCache) evict(keep func(addr basics.Address) bool) {
+	for addr, el := range c.accounts {
+		if !keep(addr) {
+			delete(c.accounts, addr)
+			c.accountsList.Remove(el)
+		}
+	}
+}
+
+// setSize bounds the number of accounts retained by the cache; a zero size makes the cache unbounded.
+func (c *baseAccountsCache) setSize(size int) {
+	c.size = size
+	c.prune()
+}
+
+// prune drops the least recently used accounts until the cache fits its size.
+func (c *baseAccountsCache) prune() {
+	if c.size <= 0 {
+		return
+	}
+	for len(c.accounts) > 0 && len(c.accounts)+len(c.pinned) > c.size {
+		back := c.accountsList.Back()
+		delete(c.accounts, back.Value.(baseAccountsCacheEntry).addr)
+		c.accountsList.Remove(back)
+	}
+}
+
 func (x *roundCowBase) checkDup(firstValid, lastValid basics.Round, txid transactions.Txid, txl ledgercore.Txlease) error {
 	return x.l.CheckDup(x.proto, x.rnd+1, firstValid, lastValid, txid, TxLease{txl})
 }
@@ -378,6 +530,12 @@ type ledgerForCowBase interface {
 	GetCreatorForRound(basics.Round, basics.CreatableIndex, basics.CreatableType) (basics.Address, bool, error)
 }
 
+// evalConfigLedger is implemented by ledgers that configure the evaluators started on top of them.
+type evalConfigLedger interface {
+	// evalAccountsCacheSize returns the size of the evaluator's accounts cache; see BlockEvaluator.SetAccountsCacheSize.
+	evalAccountsCacheSize() int
+}
+
 // StartEvaluator creates a BlockEvaluator, given a ledger and a block header
 // of the block that the caller is planning to evaluate. If the length of the
 // payset being evaluated is known in advance, a paysetHint >= 0 can be
@@ -400,8 +558,15 @@ func startEvaluator(l ledgerForEvaluator, hdr bookkeeping.BlockHeader, paysetHin
 		// an agreement.Certificate attesting that hdr is valid.
 		rnd:      hdr.Round - 1,
 		proto:    proto,
-		accounts: make(map[basics.Address]basics.AccountData),
+		accounts: makeBaseAccountsCache(),
+		creators: make(map[creatableCacheKey]foundAddress),
 	}
+	if ecl, ok := l.(evalConfigLedger); ok {
+		base.accounts.setSize(ecl.evalAccountsCacheSize())
+	}
+	// the fee sink and the rewards pool are accessed throughout the block evaluation; keep them cached.
+	base.accounts.pin(hdr.FeeSink)
+	base.accounts.pin(hdr.RewardsPool)
 
 	eval := &BlockEvaluator{
 		validate:    validate,
@@ -568,6 +733,27 @@ func (eval *BlockEvaluator) Round() basics.Round {
 	return eval.block.Round()
 }
 
+// SetAccountsCacheSize bounds the number of accounts retained by the evaluator's accounts cache. The fee sink,
+// the rewards pool and the application call senders are retained for as long as they fit the size. A zero size
+// leaves the cache unbounded. Evaluators started by the Ledger are bounded by the EvalAccountsCacheSize config.
+func (eval *BlockEvaluator) SetAccountsCacheSize(size int) {
+	if base, ok := eval.state.lookupParent.(*roundCowBase); ok {
+		base.accounts.setSize(size)
+	}
+}
+
+// SetMaxAllocationsPerTransaction bounds the number of application storage allocations, i.e. app creations
+// and opt-ins, that a single transaction may perform. Exceeding it fails the transaction with a
+// ledgercore.TooManyAllocationsError. A zero maximum, which is the default, leaves allocations unbounded.
+// The bound is a node-local policy, and so it only applies to evaluators assembling a block; an evaluator
+// validating a block must accept whatever the consensus rules accept, and ignores it.
+func (eval *BlockEvaluator) SetMaxAllocationsPerTransaction(max int) {
+	if !eval.generate {
+		return
+	}
+	eval.state.maxAllocations = max
+}
+
 // ResetTxnBytes resets the number of bytes tracked by the BlockEvaluator to
 // zero.  This is a specialized operation used by the transaction pool to
 // simulate the effect of putting pending transactions in multiple blocks.
@@ -730,6 +916,15 @@ func (eval *BlockEvaluator) transactionGroup(txgroup []transactions.SignedTxnWit
 	// Prepare eval params for any ApplicationCall transactions in the group
 	evalParams := eval.prepareEvalParams(txgroup)
 
+	// application call senders are likely to be accessed repeatedly; keep them cached.
+	if base, ok := eval.state.lookupParent.(*roundCowBase); ok {
+		for _, txad := range txgroup {
+			if txad.SignedTxn.Txn.Type == protocol.ApplicationCallTx {
+				base.accounts.pin(txad.SignedTxn.Txn.Sender)
+			}
+		}
+	}
+
 	// Evaluate each transaction in the group
 	txibs = make([]transactions.SignedTxnInBlock, 0, len(txgroup))
 	for gi, txad := range txgroup {
@@ -774,9 +969,14 @@ func (eval *BlockEvaluator) transactionGroup(txgroup []transactions.SignedTxnWit
 		}
 	}
 
+	err := cow.commitToParent()
+	if err != nil {
+		logging.Base().Warnf("transactionGroup: unexpected state delta in round %d: %v", eval.block.Round(), err)
+		return err
+	}
+
 	eval.block.Payset = append(eval.block.Payset, txibs...)
 	eval.blockTxBytes += groupTxBytes
-	cow.commitToParent()
 
 	return nil
 }
@@ -1224,7 +1424,7 @@ transactionGroupLoop:
 			}
 
 			for _, br := range txgroup.balances {
-				base.accounts[br.Addr] = br.AccountData
+				base.accounts.write(br.Addr, br.AccountData)
 			}
 			err = eval.TransactionGroup(txgroup.group)
 			if err != nil {
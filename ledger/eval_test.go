@@ -529,7 +529,7 @@ ok:
 
 // TestEvalAppStateCountsWithTxnGroup ensures txns in a group can't violate app state schema limits
 // the test ensures that
-// commitToParent -> applyChild copies child's cow state usage counts into parent
+// commitToParent -> mergeChild copies child's cow state usage counts into parent
 // and the usage counts correctly propagated from parent cow to child cow and back
 func TestEvalAppStateCountsWithTxnGroup(t *testing.T) {
 	_, _, err := testEvalAppGroup(t, basics.StateSchema{NumByteSlice: 1})
@@ -850,3 +850,286 @@ func testnetFixupExecution(t *testing.T, headerRound basics.Round, poolBonus uin
 	require.Equal(t, nextPoolBalance, poolOld.MicroAlgos.Raw)
 	require.NoError(t, err)
 }
+
+type countingLedgerForCowBase struct {
+	creators       map[basics.CreatableIndex]basics.Address
+	lookups        int
+	balances       map[basics.Address]basics.AccountData
+	accountLookups int
+}
+
+func (ccl *countingLedgerForCowBase) BlockHdr(basics.Round) (bookkeeping.BlockHeader, error) {
+	return bookkeeping.BlockHeader{}, nil
+}
+
+func (ccl *countingLedgerForCowBase) CheckDup(config.ConsensusParams, basics.Round, basics.Round, basics.Round, transactions.Txid, TxLease) error {
+	return nil
+}
+
+func (ccl *countingLedgerForCowBase) LookupWithoutRewards(rnd basics.Round, addr basics.Address) (basics.AccountData, basics.Round, error) {
+	ccl.accountLookups++
+	return ccl.balances[addr], rnd, nil
+}
+
+func (ccl *countingLedgerForCowBase) GetCreatorForRound(rnd basics.Round, cidx basics.CreatableIndex, ctype basics.CreatableType) (basics.Address, bool, error) {
+	ccl.lookups++
+	if ctype != basics.AssetCreatable {
+		return basics.Address{}, false, nil
+	}
+	creator, ok := ccl.creators[cidx]
+	return creator, ok, nil
+}
+
+func TestCowBaseCreatorCache(t *testing.T) {
+	a := require.New(t)
+
+	creator := randomAddress()
+	ccl := &countingLedgerForCowBase{creators: map[basics.CreatableIndex]basics.Address{1: creator}}
+	cb := MakeDebugBalances(ccl, basics.Round(10), protocol.ConsensusCurrentVersion, 0).(*roundCowState)
+
+	for i := 0; i < 3; i++ {
+		addr, ok, err := cb.getCreator(1, basics.AssetCreatable)
+		a.NoError(err)
+		a.True(ok)
+		a.Equal(creator, addr)
+	}
+	a.Equal(1, ccl.lookups)
+
+	// missing creatables are cached as well, and the creatable type is part of the key
+	for i := 0; i < 3; i++ {
+		_, ok, err := cb.getCreator(1, basics.AppCreatable)
+		a.NoError(err)
+		a.False(ok)
+	}
+	a.Equal(2, ccl.lookups)
+
+	// creatables deleted or created in the cow take precedence over the cache
+	child := cb.child(1)
+	child.put(creator, basics.AccountData{}, nil, &basics.CreatableLocator{Type: basics.AssetCreatable, Creator: creator, Index: 1})
+	_, ok, err := child.getCreator(1, basics.AssetCreatable)
+	a.NoError(err)
+	a.False(ok)
+
+	newCreator := randomAddress()
+	child.put(newCreator, basics.AccountData{}, &basics.CreatableLocator{Type: basics.AppCreatable, Creator: newCreator, Index: 1}, nil)
+	addr, ok, err := child.getCreator(1, basics.AppCreatable)
+	a.NoError(err)
+	a.True(ok)
+	a.Equal(newCreator, addr)
+
+	// the parent still sees the cached, historical creator
+	addr, ok, err = cb.getCreator(1, basics.AssetCreatable)
+	a.NoError(err)
+	a.True(ok)
+	a.Equal(creator, addr)
+	a.Equal(2, ccl.lookups)
+}
+
+func TestLedgerEvalAccountsCacheSize(t *testing.T) {
+	genesisInitState, _, _ := genesis(10)
+
+	dbName := fmt.Sprintf("%s.%d", t.Name(), crypto.RandUint64())
+	cfg := config.GetDefaultLocal()
+	cfg.EvalAccountsCacheSize = 7
+	l, err := OpenLedger(logging.Base(), dbName, true, genesisInitState, cfg)
+	require.NoError(t, err)
+	defer l.Close()
+
+	newBlock := bookkeeping.MakeBlock(genesisInitState.Block.BlockHeader)
+	eval, err := l.StartEvaluator(newBlock.BlockHeader, 0)
+	require.NoError(t, err)
+	base, ok := eval.state.lookupParent.(*roundCowBase)
+	require.True(t, ok)
+	require.Equal(t, cfg.EvalAccountsCacheSize, base.accounts.size)
+}
+
+func TestEvalMaxAllocationsPerTransaction(t *testing.T) {
+	genesisInitState, _, _ := genesis(10)
+
+	dbName := fmt.Sprintf("%s.%d", t.Name(), crypto.RandUint64())
+	l, err := OpenLedger(logging.Base(), dbName, true, genesisInitState, config.GetDefaultLocal())
+	require.NoError(t, err)
+	defer l.Close()
+
+	// the bound applies when assembling a block
+	newBlock := bookkeeping.MakeBlock(genesisInitState.Block.BlockHeader)
+	eval, err := l.StartEvaluator(newBlock.BlockHeader, 0)
+	require.NoError(t, err)
+	eval.SetMaxAllocationsPerTransaction(3)
+	require.Equal(t, 3, eval.state.maxAllocations)
+
+	// but not when validating one
+	eval, err = startEvaluator(l, newBlock.BlockHeader, 0, false, false)
+	require.NoError(t, err)
+	eval.SetMaxAllocationsPerTransaction(3)
+	require.Zero(t, eval.state.maxAllocations)
+}
+
+func TestCowBaseAccountsCache(t *testing.T) {
+	a := require.New(t)
+
+	accts := randomAccounts(20, true)
+	addrs := make([]basics.Address, 0, len(accts))
+	for addr := range accts {
+		addrs = append(addrs, addr)
+	}
+	ccl := &countingLedgerForCowBase{balances: accts}
+	base := &roundCowBase{l: ccl, rnd: basics.Round(10), accounts: makeBaseAccountsCache()}
+
+	pinned := addrs[:2]
+	for _, addr := range pinned {
+		base.accounts.pin(addr)
+	}
+	const cacheSize = 5
+	base.accounts.setSize(cacheSize)
+
+	lookupAll := func() {
+		for _, addr := range addrs {
+			data, err := base.lookup(addr)
+			a.NoError(err)
+			a.Equal(accts[addr], data)
+		}
+	}
+
+	// fill the cache; the pinned addresses are counted towards its size
+	lookupAll()
+	a.Equal(len(addrs), ccl.accountLookups)
+	a.Len(base.accounts.accounts, cacheSize-len(pinned))
+
+	// pinned addresses remain, as well as the most recently used ones
+	for _, addr := range pinned {
+		_, found := base.accounts.read(addr)
+		a.True(found)
+	}
+	for i, addr := range addrs[len(pinned):] {
+		_, found := base.accounts.read(addr)
+		a.Equal(i >= len(addrs)-cacheSize, found)
+	}
+
+	// evicted accounts are looked up again, while the pinned ones are always served from the cache
+	ccl.accountLookups = 0
+	lookupAll()
+	a.Equal(len(addrs)-len(pinned), ccl.accountLookups)
+
+	// pinning a cached address moves it out of the evictable part of the cache
+	recent := addrs[len(addrs)-1]
+	base.accounts.pin(recent)
+	a.Len(base.accounts.pinned, len(pinned)+1)
+	a.Len(base.accounts.accounts, cacheSize-len(pinned)-1)
+	data, found := base.accounts.read(recent)
+	a.True(found)
+	a.Equal(accts[recent], data)
+
+	// no more accounts than the cache size get pinned
+	for _, addr := range addrs {
+		base.accounts.pin(addr)
+	}
+	a.Len(base.accounts.pinned, cacheSize)
+	a.Empty(base.accounts.accounts)
+	lookupAll()
+	ccl.accountLookups = 0
+	lookupAll()
+	a.Equal(len(addrs)-cacheSize, ccl.accountLookups)
+	a.Empty(base.accounts.accounts)
+
+	// an unbounded cache retains all the accounts
+	base.accounts.setSize(0)
+	lookupAll()
+	ccl.accountLookups = 0
+	lookupAll()
+	a.Zero(ccl.accountLookups)
+}
+
+func TestCowReadOnlyAccessedAccounts(t *testing.T) {
+	a := require.New(t)
+
+	accts := randomAccounts(3, true)
+	addrs := make([]basics.Address, 0, len(accts))
+	for addr := range accts {
+		addrs = append(addrs, addr)
+	}
+	ccl := &countingLedgerForCowBase{balances: accts}
+	base := &roundCowBase{l: ccl, rnd: basics.Round(10), accounts: makeBaseAccountsCache()}
+	cb := makeRoundCowState(base, bookkeeping.BlockHeader{Round: 11}, 0, 0)
+	a.Empty(cb.ReadOnlyAccessedAccounts())
+
+	// read two accounts, and modify one of them in a child cow
+	readOnly, modified := addrs[0], addrs[1]
+	child := cb.child(1)
+	for _, addr := range []basics.Address{readOnly, modified} {
+		_, err := child.lookup(addr)
+		a.NoError(err)
+	}
+	updated := accts[modified]
+	updated.MicroAlgos.Raw++
+	child.put(modified, updated, nil, nil)
+	a.Equal([]basics.Address{readOnly}, child.ReadOnlyAccessedAccounts())
+
+	// the parent doesn't see the modification until the child is committed
+	a.ElementsMatch([]basics.Address{readOnly, modified}, cb.ReadOnlyAccessedAccounts())
+	a.NoError(child.commitToParent())
+	a.Equal([]basics.Address{readOnly}, cb.ReadOnlyAccessedAccounts())
+
+	// accounts with storage deltas count as modified as well
+	child = cb.child(1)
+	_, err := child.lookup(addrs[2])
+	a.NoError(err)
+	child.sdeltas[addrs[2]] = map[storagePtr]*storageDelta{{aidx: 1, global: false}: {action: allocAction}}
+	a.Equal([]basics.Address{readOnly}, child.ReadOnlyAccessedAccounts())
+}
+
+func TestCowTrimPadCache(t *testing.T) {
+	a := require.New(t)
+
+	accts := randomAccounts(10, true)
+	addrs := make([]basics.Address, 0, len(accts))
+	for addr := range accts {
+		addrs = append(addrs, addr)
+	}
+	ccl := &countingLedgerForCowBase{balances: accts}
+	base := &roundCowBase{l: ccl, rnd: basics.Round(10), accounts: makeBaseAccountsCache()}
+	pinned := addrs[0]
+	base.accounts.pin(pinned)
+	cb := makeRoundCowState(base, bookkeeping.BlockHeader{Round: 11}, 0, 0)
+
+	// fill the cache, and modify a couple of the accounts
+	for _, addr := range addrs {
+		_, err := cb.lookup(addr)
+		a.NoError(err)
+	}
+	a.Len(base.accounts.addresses(), len(addrs))
+	modified := addrs[1]
+	updated := accts[modified]
+	updated.MicroAlgos.Raw++
+	cb.put(modified, updated, nil, nil)
+	withStorage := addrs[2]
+	cb.sdeltas[withStorage] = map[storagePtr]*storageDelta{{aidx: 1, global: false}: {action: allocAction}}
+
+	// trimming evicts the accounts that were only read
+	child := cb.child(1)
+	child.TrimPadCache(true)
+	a.ElementsMatch([]basics.Address{pinned, modified, withStorage}, base.accounts.addresses())
+
+	// evicted accounts are looked up again, and read correctly
+	lookups := ccl.accountLookups
+	for _, addr := range addrs[3:] {
+		ad, err := child.lookup(addr)
+		a.NoError(err)
+		a.Equal(accts[addr], ad)
+	}
+	a.Equal(lookups+len(addrs)-3, ccl.accountLookups)
+	ad, err := child.lookup(modified)
+	a.NoError(err)
+	a.Equal(updated, ad)
+	a.Equal(lookups+len(addrs)-3, ccl.accountLookups)
+
+	// without keeping the modified accounts, only the pinned ones remain
+	child.TrimPadCache(false)
+	a.Equal([]basics.Address{pinned}, base.accounts.addresses())
+	ad, err = child.lookup(modified)
+	a.NoError(err)
+	a.Equal(updated, ad)
+	ad, err = base.lookup(modified)
+	a.NoError(err)
+	a.Equal(accts[modified], ad)
+}
@@ -0,0 +1,230 @@
+// Copyright (C) 2019-2021 Algorand, Inc.
+// This file is part of go-algorand
+//
+// go-algorand is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// go-algorand is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with go-algorand.  If not, see <https://www.gnu.org/licenses/>.
+
+package ledger
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/algorand/go-algorand/config"
+	"github.com/algorand/go-algorand/data/basics"
+	"github.com/algorand/go-algorand/ledger/ledgercore"
+	"github.com/algorand/go-algorand/protocol"
+)
+
+// JournalEntry captures the changes a single round made to the accounts and creatables, in a form that
+// can be replayed onto an accounts database using ReplayJournal. The accounts are sorted by address and
+// the creatables by index, so that capturing the same round always yields the same entry.
+type JournalEntry struct {
+	Round        basics.Round
+	Protocol     protocol.ConsensusVersion
+	RewardsLevel uint64
+
+	// Accounts holds the new account data of every account modified in the round, including
+	// the application storage changes.
+	Accounts []basics.BalanceRecord
+
+	// Creatables holds the creatables created or deleted in the round.
+	Creatables []JournalCreatable
+}
+
+// JournalCreatable describes the creation or deletion of a single creatable.
+type JournalCreatable struct {
+	Index   basics.CreatableIndex
+	Type    basics.CreatableType
+	Creator basics.Address
+	Created bool
+}
+
+// DeltaJournalEntry returns the journal entry for the changes made in this cow. The storage deltas are folded into
+// the account data the same way deltas() does, so it is meant to be called once the round evaluation is complete.
+func (cb *roundCowState) DeltaJournalEntry() JournalEntry {
+	delta := cb.deltas()
+	return makeJournalEntry(cb.round(), cb.mods.Hdr.CurrentProtocol, cb.rewardsLevel(), delta.Accts, delta.Creatables)
+}
+
+// makeJournalEntry builds the journal entry of a single round out of its account and creatable deltas.
+func makeJournalEntry(rnd basics.Round, proto protocol.ConsensusVersion, rewardsLevel uint64, accts ledgercore.AccountDeltas, creatables map[basics.CreatableIndex]ledgercore.ModifiedCreatable) JournalEntry {
+	entry := JournalEntry{
+		Round:        rnd,
+		Protocol:     proto,
+		RewardsLevel: rewardsLevel,
+		Accounts:     make([]basics.BalanceRecord, 0, accts.Len()),
+		Creatables:   make([]JournalCreatable, 0, len(creatables)),
+	}
+	for i := 0; i < accts.Len(); i++ {
+		addr, data := accts.GetByIdx(i)
+		entry.Accounts = append(entry.Accounts, basics.BalanceRecord{Addr: addr, AccountData: data})
+	}
+	sort.Slice(entry.Accounts, func(i, j int) bool {
+		return bytes.Compare(entry.Accounts[i].Addr[:], entry.Accounts[j].Addr[:]) < 0
+	})
+	for cidx, mc := range creatables {
+		entry.Creatables = append(entry.Creatables, JournalCreatable{Index: cidx, Type: mc.Ctype, Creator: mc.Creator, Created: mc.Created})
+	}
+	sort.Slice(entry.Creatables, func(i, j int) bool {
+		return entry.Creatables[i].Index < entry.Creatables[j].Index
+	})
+	return entry
+}
+
+// NonContiguousRoundsError is returned when a round being committed to the accounts database doesn't immediately
+// follow the round of the database.
+type NonContiguousRoundsError struct {
+	round    basics.Round
+	expected basics.Round
+}
+
+func (e *NonContiguousRoundsError) Error() string {
+	return fmt.Sprintf("round %d doesn't follow the accounts database round; expected round %d", e.round, e.expected)
+}
+
+// ReplayJournal applies the given journal entries, in order, to the accounts database, updating the accounts,
+// creatables, totals and the accounts round. The merkle trie isn't updated; as the hash round is left behind,
+// the account hashes would get rebuilt the next time the database is loaded by the account updates tracker.
+// Every entry has to be for the round following the one of the database; a gap or a regression stops the
+// replay with a NonContiguousRoundsError.
+func ReplayJournal(tx *sql.Tx, entries []JournalEntry) error {
+	for _, entry := range entries {
+		proto, ok := config.Consensus[entry.Protocol]
+		if !ok {
+			return fmt.Errorf("ReplayJournal: round %d has unsupported protocol %s", entry.Round, entry.Protocol)
+		}
+
+		dbRound, hashRound, err := accountsRound(tx)
+		if err != nil {
+			return err
+		}
+		if entry.Round != dbRound+1 {
+			return &NonContiguousRoundsError{round: entry.Round, expected: dbRound + 1}
+		}
+
+		var updates ledgercore.AccountDeltas
+		for _, br := range entry.Accounts {
+			updates.Upsert(br.Addr, br.AccountData)
+		}
+		creatables := make(map[basics.CreatableIndex]ledgercore.ModifiedCreatable, len(entry.Creatables))
+		for _, c := range entry.Creatables {
+			creatables[c.Index] = ledgercore.ModifiedCreatable{Ctype: c.Type, Creator: c.Creator, Created: c.Created, Ndeltas: 1}
+		}
+
+		compactUpdates := makeCompactAccountDeltas([]ledgercore.AccountDeltas{updates}, lruAccounts{})
+		err = compactUpdates.accountsLoadOld(tx)
+		if err != nil {
+			return err
+		}
+		err = totalsNewRounds(tx, []ledgercore.AccountDeltas{updates}, compactUpdates, []ledgercore.AccountTotals{{RewardsLevel: entry.RewardsLevel}}, proto)
+		if err != nil {
+			return err
+		}
+		_, err = accountsNewRound(tx, compactUpdates, creatables, proto, entry.Round)
+		if err != nil {
+			return err
+		}
+		err = updateAccountsRound(tx, entry.Round, hashRound)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePendingJournal appends the given entries to the pending journal table. The entries are written ahead of
+// committing the corresponding rounds to the accounts tables, so that ReplayPendingJournal could complete the
+// commit if it gets interrupted.
+func writePendingJournal(tx *sql.Tx, entries []JournalEntry) error {
+	insertStmt, err := tx.Prepare("INSERT OR REPLACE INTO pendingjournal (rnd, entry) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insertStmt.Close()
+	for _, entry := range entries {
+		_, err = insertStmt.Exec(entry.Round, protocol.EncodeReflect(&entry))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearPendingJournal removes the pending journal entries up to and including the given round, once these
+// were committed to the accounts tables.
+func clearPendingJournal(tx *sql.Tx, rnd basics.Round) error {
+	_, err := tx.Exec("DELETE FROM pendingjournal WHERE rnd <= ?", rnd)
+	return err
+}
+
+// discardPendingJournal removes all the pending journal entries, once the commit of the corresponding rounds failed.
+// Leaving them behind would have ReplayPendingJournal apply these rounds on the next startup.
+func discardPendingJournal(tx *sql.Tx) error {
+	_, err := tx.Exec("DELETE FROM pendingjournal")
+	return err
+}
+
+// ReplayPendingJournal completes an interrupted commit by replaying the pending journal entries that are ahead of
+// the accounts round onto the accounts database, and then clears the pending journal. Entries at or behind the
+// accounts round were already committed, and are dropped. The number of replayed rounds is returned.
+func ReplayPendingJournal(tx *sql.Tx) (roundsReplayed int, err error) {
+	dbRound, _, err := accountsRound(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query("SELECT rnd, entry FROM pendingjournal WHERE rnd > ? ORDER BY rnd", dbRound)
+	if err != nil {
+		return 0, err
+	}
+	var entries []JournalEntry
+	for rows.Next() {
+		var rnd basics.Round
+		var buf []byte
+		err = rows.Scan(&rnd, &buf)
+		if err != nil {
+			break
+		}
+		var entry JournalEntry
+		err = protocol.DecodeReflect(buf, &entry)
+		if err != nil {
+			err = fmt.Errorf("ReplayPendingJournal: unable to decode the entry of round %d: %w", rnd, err)
+			break
+		}
+		if entry.Round != dbRound+basics.Round(len(entries))+1 {
+			err = fmt.Errorf("ReplayPendingJournal: expected an entry for round %d, found round %d", dbRound+basics.Round(len(entries))+1, entry.Round)
+			break
+		}
+		entries = append(entries, entry)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	err = ReplayJournal(tx, entries)
+	if err != nil {
+		return 0, err
+	}
+	err = discardPendingJournal(tx)
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
@@ -0,0 +1,209 @@
+// Copyright (C) 2019-2021 Algorand, Inc.
+// This file is part of go-algorand
+//
+// go-algorand is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// go-algorand is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with go-algorand.  If not, see <https://www.gnu.org/licenses/>.
+
+package ledger
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/algorand/go-algorand/config"
+	"github.com/algorand/go-algorand/data/basics"
+	"github.com/algorand/go-algorand/data/bookkeeping"
+	"github.com/algorand/go-algorand/ledger/ledgercore"
+	"github.com/algorand/go-algorand/protocol"
+)
+
+func TestJournalReplay(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	accts := randomAccounts(20, true)
+	ml := mockLedger{balanceMap: accts}
+
+	// capture two synthetic rounds
+	var entries []JournalEntry
+	expected := accts
+	for rnd := basics.Round(1); rnd <= 2; rnd++ {
+		hdr := bookkeeping.BlockHeader{Round: rnd}
+		hdr.CurrentProtocol = protocol.ConsensusCurrentVersion
+		cow := makeRoundCowState(&ml, hdr, 0, 0)
+
+		updates, newAccts, _ := randomDeltas(10, expected, 0)
+		applyUpdates(cow, updates)
+		expected = newAccts
+
+		creator := randomAddress()
+		creatorData := randomAccountData(0)
+		expected[creator] = creatorData
+		cow.put(creator, creatorData, &basics.CreatableLocator{Type: basics.AssetCreatable, Creator: creator, Index: basics.CreatableIndex(rnd)}, nil)
+
+		entry := cow.DeltaJournalEntry()
+		a.Equal(rnd, entry.Round)
+		a.Equal(protocol.ConsensusCurrentVersion, entry.Protocol)
+		a.Len(entry.Creatables, 1)
+		for i := 1; i < len(entry.Accounts); i++ {
+			a.True(bytes.Compare(entry.Accounts[i-1].Addr[:], entry.Accounts[i].Addr[:]) < 0)
+		}
+		entries = append(entries, entry)
+
+		ml.balanceMap = expected
+	}
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	_, err = accountsInit(tx, accts, proto)
+	a.NoError(err)
+	a.NoError(accountsAddNormalizedBalance(tx, proto))
+
+	a.NoError(ReplayJournal(tx, entries))
+
+	for addr, ad := range expected {
+		if ad.IsZero() {
+			delete(expected, addr)
+		}
+	}
+	checkAccounts(t, tx, basics.Round(2), expected)
+
+	qs, err := accountsDbInit(tx, tx)
+	a.NoError(err)
+	defer qs.close()
+	for _, entry := range entries {
+		creator, ok, _, err := qs.lookupCreator(entry.Creatables[0].Index, basics.AssetCreatable)
+		a.NoError(err)
+		a.True(ok)
+		a.Equal(entry.Creatables[0].Creator, creator)
+	}
+}
+
+func TestReplayPendingJournal(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	accts := randomAccounts(20, true)
+	_, err = accountsInit(tx, accts, proto)
+	a.NoError(err)
+	a.NoError(accountsAddNormalizedBalance(tx, proto))
+
+	// nothing to replay before anything was ever journaled
+	replayed, err := ReplayPendingJournal(tx)
+	a.NoError(err)
+	a.Zero(replayed)
+
+	// journal two rounds, and "crash" before committing them to the accounts tables
+	var entries []JournalEntry
+	expected := accts
+	for rnd := basics.Round(1); rnd <= 2; rnd++ {
+		updates, newAccts, _ := randomDeltas(10, expected, 0)
+		creatables := map[basics.CreatableIndex]ledgercore.ModifiedCreatable{
+			basics.CreatableIndex(rnd): {Ctype: basics.AssetCreatable, Creator: randomAddress(), Created: true},
+		}
+		entries = append(entries, makeJournalEntry(rnd, protocol.ConsensusCurrentVersion, 0, updates, creatables))
+		expected = newAccts
+	}
+	a.NoError(writePendingJournal(tx, entries))
+
+	dbRound, _, err := accountsRound(tx)
+	a.NoError(err)
+	a.Equal(basics.Round(0), dbRound)
+
+	replayed, err = ReplayPendingJournal(tx)
+	a.NoError(err)
+	a.Equal(2, replayed)
+
+	for addr, ad := range expected {
+		if ad.IsZero() {
+			delete(expected, addr)
+		}
+	}
+	checkAccounts(t, tx, basics.Round(2), expected)
+
+	// the journal was cleared, so a second restart has nothing to replay
+	replayed, err = ReplayPendingJournal(tx)
+	a.NoError(err)
+	a.Zero(replayed)
+
+	// entries of rounds that were already committed are dropped
+	a.NoError(writePendingJournal(tx, entries))
+	replayed, err = ReplayPendingJournal(tx)
+	a.NoError(err)
+	a.Zero(replayed)
+	a.NoError(clearPendingJournal(tx, basics.Round(2)))
+	var count int
+	a.NoError(tx.QueryRow("SELECT COUNT(*) FROM pendingjournal").Scan(&count))
+	a.Zero(count)
+}
+
+func TestReplayJournalNonContiguousRounds(t *testing.T) {
+	a := require.New(t)
+	proto := config.Consensus[protocol.ConsensusCurrentVersion]
+
+	dbs, _ := dbOpenTest(t, true)
+	setDbLogging(t, dbs)
+	defer dbs.Close()
+
+	tx, err := dbs.Wdb.Handle.Begin()
+	a.NoError(err)
+	defer tx.Rollback()
+
+	accts := randomAccounts(20, true)
+	_, err = accountsInit(tx, accts, proto)
+	a.NoError(err)
+	a.NoError(accountsAddNormalizedBalance(tx, proto))
+
+	var entries []JournalEntry
+	expected := accts
+	for _, rnd := range []basics.Round{1, 2, 4} {
+		updates, newAccts, _ := randomDeltas(10, expected, 0)
+		expected = newAccts
+		entries = append(entries, makeJournalEntry(rnd, protocol.ConsensusCurrentVersion, 0, updates, nil))
+	}
+
+	// the rounds preceding the gap are applied, and the gap is caught before round 4 is
+	err = ReplayJournal(tx, entries)
+	a.Error(err)
+	gapErr, ok := err.(*NonContiguousRoundsError)
+	a.True(ok)
+	a.Equal(basics.Round(4), gapErr.round)
+	a.Equal(basics.Round(3), gapErr.expected)
+	dbRound, _, err := accountsRound(tx)
+	a.NoError(err)
+	a.Equal(basics.Round(2), dbRound)
+
+	// so is a regression
+	err = ReplayJournal(tx, entries[1:2])
+	a.Error(err)
+	gapErr, ok = err.(*NonContiguousRoundsError)
+	a.True(ok)
+	a.Equal(basics.Round(2), gapErr.round)
+	a.Equal(basics.Round(3), gapErr.expected)
+}
@@ -84,6 +84,9 @@ type Ledger struct {
 
 	// verifiedTxnCache holds all the verified transactions state
 	verifiedTxnCache verify.VerifiedTransactionCache
+
+	// accountsCacheSize is the size of the accounts cache of the evaluators started by the ledger
+	accountsCacheSize int
 }
 
 // InitState structure defines blockchain init params
@@ -116,6 +119,7 @@ func OpenLedger(
 		synchronousMode:                db.SynchronousMode(cfg.LedgerSynchronousMode),
 		accountsRebuildSynchronousMode: db.SynchronousMode(cfg.AccountsRebuildSynchronousMode),
 		verifiedTxnCache:               verify.MakeVerifiedTransactionCache(verifiedCacheSize),
+		accountsCacheSize:              cfg.EvalAccountsCacheSize,
 	}
 
 	l.headerCache.maxEntries = 10
@@ -633,6 +637,11 @@ func (l *Ledger) trackerLog() logging.Logger {
 	return l.log
 }
 
+// evalAccountsCacheSize implements evalConfigLedger, bounding the accounts cache of the evaluators started by the ledger.
+func (l *Ledger) evalAccountsCacheSize() int {
+	return l.accountsCacheSize
+}
+
 // trackerEvalVerified is used by the accountUpdates to reconstruct the ledgercore.StateDelta from a given block during it's loadFromDisk execution.
 // when this function is called, the trackers mutex is expected already to be taken. The provided accUpdatesLedger would allow the
 // evaluator to shortcut the "main" ledger ( i.e. this struct ) and avoid taking the trackers lock a second time.
@@ -649,6 +658,14 @@ func (l *Ledger) IsWritingCatchpointFile() bool {
 	return l.accts.IsWritingCatchpointFile()
 }
 
+// SetCatchingUp notifies the ledger whether the node is currently catching up. The ledger uses this to select the
+// synchronous mode used when flushing rounds to the accounts database.
+func (l *Ledger) SetCatchingUp(catchingUp bool) {
+	l.trackerMu.RLock()
+	defer l.trackerMu.RUnlock()
+	l.accts.setCatchingUp(catchingUp)
+}
+
 // VerifiedTransactionCache returns the verify.VerifiedTransactionCache
 func (l *Ledger) VerifiedTransactionCache() verify.VerifiedTransactionCache {
 	return l.verifiedTxnCache
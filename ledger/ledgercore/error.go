@@ -86,3 +86,15 @@ type LogicEvalError struct {
 func (err LogicEvalError) Error() string {
 	return fmt.Sprintf("logic eval error: %v", err.Err)
 }
+
+// TooManyAllocationsError is returned when a single transaction attempts to allocate more application storage
+// than the evaluator permits
+type TooManyAllocationsError struct {
+	Allocations int
+	Max         int
+}
+
+// Error satisfies builtin interface `error`
+func (err TooManyAllocationsError) Error() string {
+	return fmt.Sprintf("too many storage allocations in transaction: %d > %d", err.Allocations, err.Max)
+}
@@ -17,6 +17,8 @@
 package ledgercore
 
 import (
+	"sort"
+
 	"github.com/algorand/go-algorand/config"
 	"github.com/algorand/go-algorand/data/basics"
 	"github.com/algorand/go-algorand/data/bookkeeping"
@@ -28,6 +30,7 @@ const (
 	accountMapCacheEntrySize              = uint64(64)  // Measured by BenchmarkAcctCache
 	txleasesEntrySize                     = uint64(112) // Measured by BenchmarkTxLeases
 	creatablesEntrySize                   = uint64(100) // Measured by BenchmarkCreatables
+	txidsEntrySize                        = uint64(64)  // Estimated from the Txid and Round sizes, plus the map overhead
 	stateDeltaTargetOptimizationThreshold = uint64(50000000)
 )
 
@@ -135,6 +138,32 @@ func (ad *AccountDeltas) MergeAccounts(other AccountDeltas) {
 	}
 }
 
+// Merge returns the union of this and the other AccountDeltas, leaving both unchanged. Accounts present in only one
+// of them are copied into the result, while accounts present in both are left out of it and reported as conflicts,
+// since the two account data can't be reconciled without knowing how they were derived. The result retains the
+// order of the accounts in this AccountDeltas, followed by the ones of the other AccountDeltas, and the conflicts
+// are reported in the order in which they appear in this AccountDeltas.
+func (ad *AccountDeltas) Merge(other AccountDeltas) (merged AccountDeltas, conflicts []basics.Address) {
+	merged = AccountDeltas{
+		accts:      make([]basics.BalanceRecord, 0, len(ad.accts)+len(other.accts)),
+		acctsCache: make(map[basics.Address]int, len(ad.accts)+len(other.accts)),
+	}
+	for _, br := range ad.accts {
+		if _, conflict := other.acctsCache[br.Addr]; conflict {
+			conflicts = append(conflicts, br.Addr)
+			continue
+		}
+		merged.upsert(br)
+	}
+	for _, br := range other.accts {
+		if _, conflict := ad.acctsCache[br.Addr]; conflict {
+			continue
+		}
+		merged.upsert(br)
+	}
+	return merged, conflicts
+}
+
 // Len returns number of stored accounts
 func (ad *AccountDeltas) Len() int {
 	return len(ad.accts)
@@ -207,3 +236,55 @@ func (sd *StateDelta) OptimizeAllocatedMemory(proto config.ConsensusParams) {
 		sd.Creatables = creatableDeltas
 	}
 }
+
+// ApproxMemoryFootprint estimates the number of bytes used by the state delta. The modified accounts are accounted for
+// by their fixed size along with the encoded size of their maps, such as the asset holdings and the application states.
+func (sd *StateDelta) ApproxMemoryFootprint() int {
+	size := uint64(cap(sd.Accts.accts)) * accountArrayEntrySize
+	size += uint64(len(sd.Accts.acctsCache)) * accountMapCacheEntrySize
+	for i := range sd.Accts.accts {
+		size += uint64(sd.Accts.accts[i].AccountData.Msgsize())
+	}
+	size += uint64(len(sd.Txids)) * txidsEntrySize
+	size += uint64(len(sd.Txleases)) * txleasesEntrySize
+	size += uint64(len(sd.Creatables)) * creatablesEntrySize
+	return int(size)
+}
+
+// DiffHoldings compares the asset holdings of two snapshots of the same account. It returns the assets
+// that were opted into, the assets that were closed out, and the assets whose holding was modified,
+// each sorted by asset index.
+func DiffHoldings(old, new basics.AccountData) (created, deleted []basics.AssetIndex, changed []basics.AssetIndex) {
+	for aidx, holding := range new.Assets {
+		oldHolding, ok := old.Assets[aidx]
+		if !ok {
+			created = append(created, aidx)
+		} else if oldHolding != holding {
+			changed = append(changed, aidx)
+		}
+	}
+	for aidx := range old.Assets {
+		if _, ok := new.Assets[aidx]; !ok {
+			deleted = append(deleted, aidx)
+		}
+	}
+
+	sortAssetIndices(created)
+	sortAssetIndices(deleted)
+	sortAssetIndices(changed)
+	return
+}
+
+// DiffTotalAppSchema returns the change of the TotalAppSchema of an account between two snapshots of it. The grown schema
+// holds the number of uint and byte slice entries the new snapshot reserves beyond the old one, and the shrunk schema
+// holds the number of entries the old snapshot reserved beyond the new one. Since each field is diffed independently,
+// both may be non-empty, such as when uints are traded for byte slices.
+func DiffTotalAppSchema(old, new basics.AccountData) (grown, shrunk basics.StateSchema) {
+	grown = new.TotalAppSchema.SubSchema(old.TotalAppSchema)
+	shrunk = old.TotalAppSchema.SubSchema(new.TotalAppSchema)
+	return
+}
+
+func sortAssetIndices(indices []basics.AssetIndex) {
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+}
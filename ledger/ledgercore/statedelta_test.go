@@ -93,6 +93,54 @@ func TestAccountDeltas(t *testing.T) {
 	a.Equal(sample1, data)
 }
 
+func TestAccountDeltasMerge(t *testing.T) {
+	a := require.New(t)
+
+	addr1, addr2, addr3, addr4 := randomAddress(), randomAddress(), randomAddress(), randomAddress()
+	sample1 := basics.AccountData{MicroAlgos: basics.MicroAlgos{Raw: 1}}
+	sample2 := basics.AccountData{MicroAlgos: basics.MicroAlgos{Raw: 2}}
+	sample3 := basics.AccountData{MicroAlgos: basics.MicroAlgos{Raw: 3}}
+	sample4 := basics.AccountData{MicroAlgos: basics.MicroAlgos{Raw: 4}}
+
+	// disjoint deltas
+	ad1 := AccountDeltas{}
+	ad1.Upsert(addr1, sample1)
+	ad1.Upsert(addr2, sample2)
+	ad2 := AccountDeltas{}
+	ad2.Upsert(addr3, sample3)
+
+	merged, conflicts := ad1.Merge(ad2)
+	a.Empty(conflicts)
+	a.Equal([]basics.Address{addr1, addr2, addr3}, merged.ModifiedAccounts())
+	for addr, expected := range map[basics.Address]basics.AccountData{addr1: sample1, addr2: sample2, addr3: sample3} {
+		data, ok := merged.Get(addr)
+		a.True(ok)
+		a.Equal(expected, data)
+	}
+
+	// the result doesn't share its storage with the merged deltas
+	merged.Upsert(addr4, sample4)
+	a.Equal(2, ad1.Len())
+	a.Equal(1, ad2.Len())
+
+	// overlapping deltas
+	ad2.Upsert(addr2, sample4)
+	ad2.Upsert(addr1, sample4)
+	merged, conflicts = ad1.Merge(ad2)
+	a.Equal([]basics.Address{addr1, addr2}, conflicts)
+	a.Equal([]basics.Address{addr3}, merged.ModifiedAccounts())
+	_, ok := merged.Get(addr1)
+	a.False(ok)
+
+	// merging with empty deltas
+	merged, conflicts = ad1.Merge(AccountDeltas{})
+	a.Empty(conflicts)
+	a.Equal(ad1.ModifiedAccounts(), merged.ModifiedAccounts())
+	merged, conflicts = (&AccountDeltas{}).Merge(ad1)
+	a.Empty(conflicts)
+	a.Equal(ad1.ModifiedAccounts(), merged.ModifiedAccounts())
+}
+
 func BenchmarkMakeStateDelta(b *testing.B) {
 	hint := 23000
 	b.ReportAllocs()
@@ -149,3 +197,87 @@ func BenchmarkTxLeases(b *testing.B) {
 		}
 	}
 }
+
+func TestDiffHoldings(t *testing.T) {
+	a := require.New(t)
+
+	old := basics.AccountData{
+		Assets: map[basics.AssetIndex]basics.AssetHolding{
+			1: {Amount: 10},
+			2: {Amount: 20},
+			3: {Amount: 30, Frozen: false},
+			4: {Amount: 40},
+			7: {Amount: 70},
+		},
+	}
+	new := basics.AccountData{
+		Assets: map[basics.AssetIndex]basics.AssetHolding{
+			1: {Amount: 10},
+			2: {Amount: 21},
+			3: {Amount: 30, Frozen: true},
+			5: {Amount: 50},
+			6: {},
+		},
+	}
+
+	created, deleted, changed := DiffHoldings(old, new)
+	a.Equal([]basics.AssetIndex{5, 6}, created)
+	a.Equal([]basics.AssetIndex{4, 7}, deleted)
+	a.Equal([]basics.AssetIndex{2, 3}, changed)
+
+	// the diff is symmetric
+	created, deleted, changed = DiffHoldings(new, old)
+	a.Equal([]basics.AssetIndex{4, 7}, created)
+	a.Equal([]basics.AssetIndex{5, 6}, deleted)
+	a.Equal([]basics.AssetIndex{2, 3}, changed)
+
+	// identical and empty snapshots have no differences
+	created, deleted, changed = DiffHoldings(old, old)
+	a.Empty(created)
+	a.Empty(deleted)
+	a.Empty(changed)
+
+	created, deleted, changed = DiffHoldings(basics.AccountData{}, basics.AccountData{})
+	a.Empty(created)
+	a.Empty(deleted)
+	a.Empty(changed)
+}
+
+func TestDiffTotalAppSchema(t *testing.T) {
+	a := require.New(t)
+
+	old := basics.AccountData{
+		TotalAppSchema: basics.StateSchema{NumUint: 2, NumByteSlice: 3},
+	}
+
+	// opting into an app adds its local schema to the total
+	localSchema := basics.StateSchema{NumUint: 4, NumByteSlice: 1}
+	new := old
+	new.AppLocalStates = map[basics.AppIndex]basics.AppLocalState{
+		10: {Schema: localSchema},
+	}
+	new.TotalAppSchema = old.TotalAppSchema.AddSchema(localSchema)
+
+	grown, shrunk := DiffTotalAppSchema(old, new)
+	a.Equal(localSchema, grown)
+	a.Equal(basics.StateSchema{}, shrunk)
+
+	// closing out shrinks the schema
+	grown, shrunk = DiffTotalAppSchema(new, old)
+	a.Equal(basics.StateSchema{}, grown)
+	a.Equal(localSchema, shrunk)
+
+	// each field is diffed independently
+	mixed := old
+	mixed.TotalAppSchema = basics.StateSchema{NumUint: 5, NumByteSlice: 1}
+	grown, shrunk = DiffTotalAppSchema(old, mixed)
+	a.Equal(basics.StateSchema{NumUint: 3}, grown)
+	a.Equal(basics.StateSchema{NumByteSlice: 2}, shrunk)
+	grown, shrunk = DiffTotalAppSchema(mixed, old)
+	a.Equal(basics.StateSchema{NumByteSlice: 2}, grown)
+	a.Equal(basics.StateSchema{NumUint: 3}, shrunk)
+
+	grown, shrunk = DiffTotalAppSchema(old, old)
+	a.Equal(basics.StateSchema{}, grown)
+	a.Equal(basics.StateSchema{}, shrunk)
+}
@@ -18,6 +18,7 @@ package ledger
 
 import (
 	"container/list"
+	"sync/atomic"
 
 	"github.com/algorand/go-algorand/data/basics"
 	"github.com/algorand/go-algorand/logging"
@@ -27,6 +28,10 @@ import (
 // It doesn't have any synchronization primitive on it's own and require to be
 // syncronized by the caller.
 type lruAccounts struct {
+	// hits and misses count the number of read calls that were found / not found in the cache. These are updated
+	// atomically since reads happen under a read lock, and are kept at the top of the struct to keep them 64 bit aligned.
+	hits   uint64
+	misses uint64
 	// accountsList contain the list of persistedAccountData, where the front ones are the most "fresh"
 	// and the ones on the back are the oldest.
 	accountsList *list.List
@@ -55,11 +60,21 @@ func (m *lruAccounts) init(log logging.Logger, pendingWrites int, pendingWritesW
 // thread locking semantics : read lock
 func (m *lruAccounts) read(addr basics.Address) (data persistedAccountData, has bool) {
 	if el := m.accounts[addr]; el != nil {
+		atomic.AddUint64(&m.hits, 1)
+		ledgerAccountsCacheHitsCount.Inc(nil)
 		return el.Value.(persistedAccountData), true
 	}
+	atomic.AddUint64(&m.misses, 1)
+	ledgerAccountsCacheMissesCount.Inc(nil)
 	return persistedAccountData{}, false
 }
 
+// stats returns the number of read calls that were served from the cache and the number of read calls that weren't.
+// thread locking semantics : no lock is required.
+func (m *lruAccounts) stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&m.hits), atomic.LoadUint64(&m.misses)
+}
+
 // flushPendingWrites flushes the pending writes to the main lruAccounts cache.
 // thread locking semantics : write lock
 func (m *lruAccounts) flushPendingWrites() {
@@ -123,3 +138,29 @@ func (m *lruAccounts) prune(newSize int) (removed int) {
 	}
 	return
 }
+
+// invalidate drops the entries of the given addresses from the lruAccounts cache, so that the next reads of these
+// accounts would reload them from the database. Pending writes are flushed beforehand, so that a stale pending entry
+// couldn't make it back into the cache.
+// thread locking semantics : write lock
+func (m *lruAccounts) invalidate(addrs []basics.Address) {
+	m.flushPendingWrites()
+	for _, addr := range addrs {
+		if el := m.accounts[addr]; el != nil {
+			delete(m.accounts, addr)
+			m.accountsList.Remove(el)
+		}
+	}
+}
+
+// invalidateAll drops all the entries of the lruAccounts cache, along with any pending writes.
+// thread locking semantics : write lock
+func (m *lruAccounts) invalidateAll() {
+	for len(m.pendingAccounts) > 0 {
+		select {
+		case <-m.pendingAccounts:
+		default:
+		}
+	}
+	m.prune(0)
+}
@@ -197,6 +197,40 @@ func TestLRUAccountsOmittedPendingWrites(t *testing.T) {
 	}
 }
 
+func TestLRUAccountsStats(t *testing.T) {
+	var baseAcct lruAccounts
+	baseAcct.init(logging.TestingLog(t), 10, 5)
+
+	hits, misses := baseAcct.stats()
+	require.Zero(t, hits)
+	require.Zero(t, misses)
+
+	accounts := generatePersistedAccountData(0, 20)
+	for _, acct := range accounts[:10] {
+		baseAcct.write(acct)
+	}
+
+	// read all the accounts twice; the first half are hits, the second half are misses.
+	for j := 0; j < 2; j++ {
+		for i, acct := range accounts {
+			_, has := baseAcct.read(acct.addr)
+			require.Equal(t, i < 10, has)
+		}
+	}
+	hits, misses = baseAcct.stats()
+	require.Equal(t, uint64(20), hits)
+	require.Equal(t, uint64(20), misses)
+
+	// pruned entries become misses.
+	baseAcct.prune(5)
+	for _, acct := range accounts[:10] {
+		baseAcct.read(acct.addr)
+	}
+	hits, misses = baseAcct.stats()
+	require.Equal(t, uint64(25), hits)
+	require.Equal(t, uint64(25), misses)
+}
+
 func BenchmarkLRUAccountsWrite(b *testing.B) {
 	numTestAccounts := 5000
 	// there are 2500 accounts that overlap
@@ -240,3 +274,62 @@ func generatePersistedAccountData(startRound, endRound int) []persistedAccountDa
 	}
 	return accounts
 }
+
+func TestLRUAccountsInvalidate(t *testing.T) {
+	var baseAcct lruAccounts
+	baseAcct.init(logging.TestingLog(t), 10, 5)
+
+	accountsNum := 20
+	addrs := make([]basics.Address, accountsNum)
+	for i := 0; i < accountsNum; i++ {
+		addrs[i] = basics.Address(crypto.Hash([]byte{byte(i)}))
+		baseAcct.write(persistedAccountData{
+			addr:        addrs[i],
+			round:       basics.Round(i),
+			rowid:       int64(i),
+			accountData: basics.AccountData{MicroAlgos: basics.MicroAlgos{Raw: uint64(i)}},
+		})
+	}
+	// a pending write of an invalidated account doesn't make it back into the cache
+	baseAcct.writePending(persistedAccountData{addr: addrs[1], round: basics.Round(100), rowid: 1})
+
+	invalidated := make(map[basics.Address]bool)
+	for i := 0; i < accountsNum; i += 3 {
+		invalidated[addrs[i]] = true
+	}
+	invalidated[addrs[1]] = true
+	var toInvalidate []basics.Address
+	for addr := range invalidated {
+		toInvalidate = append(toInvalidate, addr)
+	}
+	// invalidating an address that isn't cached is a no-op
+	toInvalidate = append(toInvalidate, basics.Address(crypto.Hash([]byte{byte(accountsNum)})))
+	baseAcct.invalidate(toInvalidate)
+	require.Equal(t, accountsNum-len(invalidated), baseAcct.accountsList.Len())
+	require.Zero(t, len(baseAcct.pendingAccounts))
+
+	for i, addr := range addrs {
+		acct, has := baseAcct.read(addr)
+		require.Equal(t, !invalidated[addr], has)
+		if has {
+			require.Equal(t, basics.Round(i), acct.round)
+			continue
+		}
+
+		// reloading the account from the database repopulates the cache
+		baseAcct.write(persistedAccountData{addr: addr, round: basics.Round(i + 1000), rowid: int64(i)})
+		acct, has = baseAcct.read(addr)
+		require.True(t, has)
+		require.Equal(t, basics.Round(i+1000), acct.round)
+	}
+
+	baseAcct.writePending(persistedAccountData{addr: addrs[0], round: basics.Round(2000)})
+	baseAcct.invalidateAll()
+	require.Zero(t, len(baseAcct.accounts))
+	require.Zero(t, baseAcct.accountsList.Len())
+	baseAcct.flushPendingWrites()
+	for _, addr := range addrs {
+		_, has := baseAcct.read(addr)
+		require.False(t, has)
+	}
+}
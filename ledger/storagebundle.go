@@ -0,0 +1,138 @@
+// Copyright (C) 2019-2021 Algorand, Inc.
+// This file is part of go-algorand
+//
+// go-algorand is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// go-algorand is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with go-algorand.  If not, see <https://www.gnu.org/licenses/>.
+
+package ledger
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/algorand/go-algorand/data/basics"
+	"github.com/algorand/go-algorand/protocol"
+)
+
+// storageDeltaBundle is the serialized form of the storage deltas of a cow, allowing application state changes
+// evaluated in one cow to be shipped to and merged into another one. The deltas are sorted by address, application
+// and storage type, so that serializing the same deltas always yields the same bundle.
+type storageDeltaBundle struct {
+	Deltas []bundledStorageDelta
+}
+
+// bundledStorageDelta is the serialized form of a single storageDelta.
+type bundledStorageDelta struct {
+	Addr       basics.Address
+	App        basics.AppIndex
+	Global     bool
+	Action     storageAction
+	KV         map[string]bundledValueDelta
+	Counts     *basics.StateSchema
+	MaxCounts  *basics.StateSchema
+	AccountIdx uint64
+}
+
+// bundledValueDelta is the serialized form of a single valueDelta.
+type bundledValueDelta struct {
+	Old       basics.TealValue
+	New       basics.TealValue
+	OldExists bool
+	NewExists bool
+}
+
+// SerializeStorageDeltas returns the storage deltas of this cow as a bundle that could be merged into another cow
+// using ApplySerializedStorageDeltas.
+func (cb *roundCowState) SerializeStorageDeltas() []byte {
+	var bundle storageDeltaBundle
+	for addr, smod := range cb.sdeltas {
+		for aapp, sd := range smod {
+			bsd := bundledStorageDelta{
+				Addr:       addr,
+				App:        aapp.aidx,
+				Global:     aapp.global,
+				Action:     sd.action,
+				KV:         make(map[string]bundledValueDelta, len(sd.kvCow)),
+				Counts:     sd.counts,
+				MaxCounts:  sd.maxCounts,
+				AccountIdx: sd.accountIdx,
+			}
+			for key, vd := range sd.kvCow {
+				bsd.KV[key] = bundledValueDelta{Old: vd.old, New: vd.new, OldExists: vd.oldExists, NewExists: vd.newExists}
+			}
+			bundle.Deltas = append(bundle.Deltas, bsd)
+		}
+	}
+	sort.Slice(bundle.Deltas, func(i, j int) bool {
+		di, dj := &bundle.Deltas[i], &bundle.Deltas[j]
+		if c := bytes.Compare(di.Addr[:], dj.Addr[:]); c != 0 {
+			return c < 0
+		}
+		if di.App != dj.App {
+			return di.App < dj.App
+		}
+		return !di.Global && dj.Global
+	})
+	return protocol.EncodeReflect(&bundle)
+}
+
+// ApplySerializedStorageDeltas merges the storage deltas serialized by SerializeStorageDeltas into this cow. The bundle
+// is expected to have been evaluated against the same state as this cow, and therefore may not touch any storage this
+// cow already modified; such a conflict fails the merge. The cow is left unmodified when an error is returned.
+func (cb *roundCowState) ApplySerializedStorageDeltas(data []byte) error {
+	var bundle storageDeltaBundle
+	err := protocol.DecodeReflect(data, &bundle)
+	if err != nil {
+		return err
+	}
+
+	deltas := make([]*storageDelta, len(bundle.Deltas))
+	seen := make(map[basics.Address]map[storagePtr]bool)
+	for i, bsd := range bundle.Deltas {
+		aapp := storagePtr{bsd.App, bsd.Global}
+		if _, ok := cb.sdeltas[bsd.Addr][aapp]; ok {
+			return fmt.Errorf("address %v app %d global %v: storage delta conflicts with an existing one", bsd.Addr, bsd.App, bsd.Global)
+		}
+		if seen[bsd.Addr][aapp] {
+			return fmt.Errorf("address %v app %d global %v: duplicate storage delta in bundle", bsd.Addr, bsd.App, bsd.Global)
+		}
+		if seen[bsd.Addr] == nil {
+			seen[bsd.Addr] = make(map[storagePtr]bool)
+		}
+		seen[bsd.Addr][aapp] = true
+
+		sd := &storageDelta{
+			action:     bsd.Action,
+			kvCow:      make(stateDelta, len(bsd.KV)),
+			counts:     bsd.Counts,
+			maxCounts:  bsd.MaxCounts,
+			accountIdx: bsd.AccountIdx,
+		}
+		for key, bvd := range bsd.KV {
+			sd.kvCow[key] = valueDelta{old: bvd.Old, new: bvd.New, oldExists: bvd.OldExists, newExists: bvd.NewExists}
+		}
+		if err := (&storageDelta{}).checkChild(sd); err != nil {
+			return fmt.Errorf("address %v app %d global %v: %w", bsd.Addr, bsd.App, bsd.Global, err)
+		}
+		deltas[i] = sd
+	}
+
+	for i, bsd := range bundle.Deltas {
+		if _, ok := cb.sdeltas[bsd.Addr]; !ok {
+			cb.sdeltas[bsd.Addr] = make(map[storagePtr]*storageDelta)
+		}
+		cb.sdeltas[bsd.Addr][storagePtr{bsd.App, bsd.Global}] = deltas[i]
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2019-2021 Algorand, Inc.
+// This file is part of go-algorand
+//
+// go-algorand is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// go-algorand is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with go-algorand.  If not, see <https://www.gnu.org/licenses/>.
+
+package ledger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/algorand/go-algorand/data/basics"
+	"github.com/algorand/go-algorand/data/bookkeeping"
+	"github.com/algorand/go-algorand/protocol"
+)
+
+func TestStorageDeltasBundle(t *testing.T) {
+	a := require.New(t)
+
+	ml := emptyLedger{}
+	var bh bookkeeping.BlockHeader
+	bh.CurrentProtocol = protocol.ConsensusCurrentVersion
+
+	// evaluate some application state changes in one cow
+	src := makeRoundCowState(&ml, bh, 0, 0)
+	addr1 := getRandomAddress(a)
+	addr2 := getRandomAddress(a)
+	schema := basics.StateSchema{NumUint: 2, NumByteSlice: 2}
+	a.NoError(src.Allocate(addr1, 1, true, schema))
+	a.NoError(src.SetKey(addr1, 1, true, "counter", basics.TealValue{Type: basics.TealUintType, Uint: 7}, 0))
+	a.NoError(src.SetKey(addr1, 1, true, "name", basics.TealValue{Type: basics.TealBytesType, Bytes: "app"}, 0))
+	a.NoError(src.DelKey(addr1, 1, true, "name", 0))
+	a.NoError(src.Allocate(addr2, 1, false, schema))
+	a.NoError(src.SetKey(addr2, 1, false, "balance", basics.TealValue{Type: basics.TealUintType, Uint: 3}, 0))
+
+	data := src.SerializeStorageDeltas()
+	// serializing is deterministic
+	a.Equal(data, src.SerializeStorageDeltas())
+
+	// and merge them into another one, evaluated against the same state
+	dst := makeRoundCowState(&ml, bh, 0, 0)
+	a.NoError(dst.ApplySerializedStorageDeltas(data))
+	a.Equal(src.sdeltas, dst.sdeltas)
+
+	for _, cow := range []*roundCowState{src, dst} {
+		value, ok, err := cow.GetKey(addr1, 1, true, "counter", 0)
+		a.NoError(err)
+		a.True(ok)
+		a.Equal(uint64(7), value.Uint)
+		_, ok, err = cow.GetKey(addr1, 1, true, "name", 0)
+		a.NoError(err)
+		a.False(ok)
+		value, ok, err = cow.GetKey(addr2, 1, false, "balance", 0)
+		a.NoError(err)
+		a.True(ok)
+		a.Equal(uint64(3), value.Uint)
+	}
+
+	// merging deltas touching storage the cow already modified is a conflict, and leaves the cow as it was
+	other := makeRoundCowState(&ml, bh, 0, 0)
+	addr3 := getRandomAddress(a)
+	a.NoError(other.Allocate(addr3, 2, true, schema))
+	a.NoError(other.Allocate(addr1, 1, true, schema))
+	before := len(dst.sdeltas)
+	a.Error(dst.ApplySerializedStorageDeltas(other.SerializeStorageDeltas()))
+	a.Len(dst.sdeltas, before)
+	_, ok := dst.sdeltas[addr3]
+	a.False(ok)
+
+	// corrupted bundles are rejected
+	a.Error(dst.ApplySerializedStorageDeltas(data[:len(data)/2]))
+}
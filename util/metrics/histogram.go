@@ -0,0 +1,153 @@
+// Copyright (C) 2019-2021 Algorand, Inc.
+// This file is part of go-algorand
+//
+// go-algorand is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// go-algorand is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with go-algorand.  If not, see <https://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/algorand/go-deadlock"
+)
+
+// Histogram represent a single histogram variable, counting observed values into a fixed set of buckets.
+type Histogram struct {
+	deadlock.Mutex
+	name        string
+	description string
+	// buckets holds the upper bounds of the buckets, in ascending order.
+	buckets []float64
+	// counts holds the number of observed values falling into each of the buckets; the last entry counts
+	// the values exceeding the upper bound of the last bucket.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// MakeHistogram create a new histogram with the provided name, description and buckets upper bounds.
+func MakeHistogram(metric MetricName, buckets []float64) *Histogram {
+	h := &Histogram{
+		description: metric.Description,
+		name:        metric.Name,
+		buckets:     append([]float64{}, buckets...),
+		counts:      make([]uint64, len(buckets)+1),
+	}
+	sort.Float64s(h.buckets)
+	h.Register(nil)
+	return h
+}
+
+// Register registers the histogram with the default/specific registry
+func (h *Histogram) Register(reg *Registry) {
+	if reg == nil {
+		DefaultRegistry().Register(h)
+	} else {
+		reg.Register(h)
+	}
+}
+
+// Deregister deregisters the histogram with the default/specific registry
+func (h *Histogram) Deregister(reg *Registry) {
+	if reg == nil {
+		DefaultRegistry().Deregister(h)
+	} else {
+		reg.Deregister(h)
+	}
+}
+
+// Observe adds x to the histogram
+func (h *Histogram) Observe(x float64) {
+	h.Lock()
+	defer h.Unlock()
+	i := sort.SearchFloat64s(h.buckets, x)
+	h.counts[i]++
+	h.sum += x
+	h.count++
+}
+
+// BucketCounts returns the number of observed values falling into each of the buckets. The returned slice has one more
+// entry than the number of buckets, counting the values exceeding the upper bound of the last bucket.
+func (h *Histogram) BucketCounts() []uint64 {
+	h.Lock()
+	defer h.Unlock()
+	return append([]uint64{}, h.counts...)
+}
+
+// WriteMetric writes the metric into the output stream
+func (h *Histogram) WriteMetric(buf *strings.Builder, parentLabels string) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.count == 0 {
+		return
+	}
+	buf.WriteString("# HELP ")
+	buf.WriteString(h.name)
+	buf.WriteString(" ")
+	buf.WriteString(h.description)
+	buf.WriteString("\n# TYPE ")
+	buf.WriteString(h.name)
+	buf.WriteString(" histogram\n")
+
+	labels := ""
+	if len(parentLabels) > 0 {
+		labels = parentLabels + ","
+	}
+	cumulative := uint64(0)
+	for i, count := range h.counts {
+		cumulative += count
+		upperBound := "+Inf"
+		if i < len(h.buckets) {
+			upperBound = strconv.FormatFloat(h.buckets[i], 'f', -1, 64)
+		}
+		buf.WriteString(h.name)
+		buf.WriteString("_bucket{")
+		buf.WriteString(labels)
+		buf.WriteString("le=\"")
+		buf.WriteString(upperBound)
+		buf.WriteString("\"} ")
+		buf.WriteString(strconv.FormatUint(cumulative, 10))
+		buf.WriteString("\n")
+	}
+	h.writeValue(buf, "_sum", parentLabels, strconv.FormatFloat(h.sum, 'f', -1, 64))
+	h.writeValue(buf, "_count", parentLabels, strconv.FormatUint(h.count, 10))
+}
+
+func (h *Histogram) writeValue(buf *strings.Builder, suffix string, parentLabels string, value string) {
+	buf.WriteString(h.name)
+	buf.WriteString(suffix)
+	if len(parentLabels) > 0 {
+		buf.WriteString("{")
+		buf.WriteString(parentLabels)
+		buf.WriteString("}")
+	}
+	buf.WriteString(" ")
+	buf.WriteString(value)
+	buf.WriteString("\n")
+}
+
+// AddMetric adds the metric into the map
+func (h *Histogram) AddMetric(values map[string]string) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.count == 0 {
+		return
+	}
+	values[h.name+"_sum"] = strconv.FormatFloat(h.sum, 'f', -1, 64)
+	values[h.name+"_count"] = strconv.FormatUint(h.count, 10)
+}
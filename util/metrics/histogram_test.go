@@ -0,0 +1,54 @@
+// Copyright (C) 2019-2021 Algorand, Inc.
+// This file is part of go-algorand
+//
+// go-algorand is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// go-algorand is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with go-algorand.  If not, see <https://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogram(t *testing.T) {
+	h := MakeHistogram(MetricName{Name: "metric_test_histogram", Description: "this is the metric test for histogram object"}, []float64{1, 0.1, 10})
+	defer h.Deregister(nil)
+
+	// nothing is written before values are observed
+	var buf strings.Builder
+	h.WriteMetric(&buf, "")
+	require.Empty(t, buf.String())
+
+	for _, x := range []float64{0.05, 0.1, 0.5, 2, 5, 100} {
+		h.Observe(x)
+	}
+	require.Equal(t, []uint64{2, 1, 2, 1}, h.BucketCounts())
+
+	h.WriteMetric(&buf, "host=\"h1\"")
+	require.Equal(t, `# HELP metric_test_histogram this is the metric test for histogram object
+# TYPE metric_test_histogram histogram
+metric_test_histogram_bucket{host="h1",le="0.1"} 2
+metric_test_histogram_bucket{host="h1",le="1"} 3
+metric_test_histogram_bucket{host="h1",le="10"} 5
+metric_test_histogram_bucket{host="h1",le="+Inf"} 6
+metric_test_histogram_sum{host="h1"} 107.65
+metric_test_histogram_count{host="h1"} 6
+`, buf.String())
+
+	values := make(map[string]string)
+	h.AddMetric(values)
+	require.Equal(t, map[string]string{"metric_test_histogram_sum": "107.65", "metric_test_histogram_count": "6"}, values)
+}